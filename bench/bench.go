@@ -0,0 +1,183 @@
+// Package bench is the load generator of socks proxy, it opens concurrent sessions through a proxy to a sink
+// server, and measures handshake latency, connection rate and throughput per session.
+package bench
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"sync"
+	"time"
+	"xproxy/socks5"
+)
+
+var (
+	ErrNoSession = errors.New("bench: no session completed")
+)
+
+const (
+	DefaultSessions = 10
+	DefaultDuration = 10 * time.Second
+)
+
+// Config of one benchmark run, Proxy is used to connect the proxy under test.
+type Config struct {
+	Proxy    *socks5.ClientConfig
+	Target   string        // sink address reachable by proxy, empty means bundled sink on loopback
+	Sessions int           // concurrent sessions
+	Duration time.Duration // every worker opens sessions one by one until duration passed
+	Upload   int64         // bytes sent by every session
+	Download int64         // bytes received by every session
+}
+
+// Result of benchmark, latencies are in milliseconds, throughput is in bytes per second.
+type Result struct {
+	Sessions int64   `json:"sessions"` // completed sessions
+	Errors   int64   `json:"errors"`
+	Duration float64 `json:"duration"`  // seconds
+	ConnRate float64 `json:"conn_rate"` // completed sessions per second
+
+	HandshakeP50 float64 `json:"handshake_p50"`
+	HandshakeP90 float64 `json:"handshake_p90"`
+	HandshakeP99 float64 `json:"handshake_p99"`
+	HandshakeMax float64 `json:"handshake_max"`
+
+	// throughput of one session, P10 is the slow tail.
+	ThroughputMean float64 `json:"throughput_mean"`
+	ThroughputP50  float64 `json:"throughput_p50"`
+	ThroughputP10  float64 `json:"throughput_p10"`
+	BytesTotal     int64   `json:"bytes_total"`
+}
+
+// Run start the benchmark and block until duration passed and running sessions finished.
+func Run(cfg Config) (*Result, error) {
+	if cfg.Sessions <= 0 {
+		cfg.Sessions = DefaultSessions
+	}
+	if cfg.Duration <= 0 {
+		cfg.Duration = DefaultDuration
+	}
+	if cfg.Target == "" {
+		sink, err := NewSink("127.0.0.1:0")
+		if nil != err {
+			return nil, err
+		}
+		defer sink.Close()
+		if cfg.Download > sink.MaxDownload {
+			sink.MaxDownload = cfg.Download
+		}
+		go sink.Serve()
+		cfg.Target = sink.Addr()
+	}
+
+	var mu sync.Mutex
+	var samples []sample
+	var errs int64
+
+	start := time.Now()
+	deadline := start.Add(cfg.Duration)
+	var wg sync.WaitGroup
+	wg.Add(cfg.Sessions)
+	for i := 0; i < cfg.Sessions; i++ {
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				s, err := runSession(cfg)
+				mu.Lock()
+				if nil != err {
+					if errs == 0 {
+						log.Printf("bench: session error: %v", err)
+					}
+					errs++
+				} else {
+					samples = append(samples, s)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(samples) == 0 {
+		return &Result{Errors: errs}, ErrNoSession
+	}
+	return summarize(samples, errs, time.Since(start)), nil
+}
+
+// help func ===========================================================================================================
+
+type sample struct {
+	handshake  time.Duration
+	throughput float64 // bytes per second
+	bytes      int64
+}
+
+// runSession open one session, handshake includes connecting proxy, negotiation and CONNECT reply.
+// with optimistic client, replies are verified by first read, so handshake only covers sending the requests.
+func runSession(cfg Config) (sample, error) {
+	start := time.Now()
+	conn, err := cfg.Proxy.Connect(cfg.Target)
+	if nil != err {
+		return sample{}, err
+	}
+	defer conn.Close()
+	handshake := time.Since(start)
+
+	start = time.Now()
+	if _, err := conn.Write(sinkHeader(cfg.Upload, cfg.Download)); nil != err {
+		return sample{}, err
+	}
+	if _, err := io.CopyN(conn, zeroReader{}, cfg.Upload); nil != err {
+		return sample{}, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, conn, cfg.Download); nil != err {
+		return sample{}, err
+	}
+	elapsed := time.Since(start)
+
+	s := sample{handshake: handshake, bytes: cfg.Upload + cfg.Download}
+	if elapsed > 0 {
+		s.throughput = float64(s.bytes) / elapsed.Seconds()
+	}
+	return s, nil
+}
+
+func summarize(samples []sample, errs int64, elapsed time.Duration) *Result {
+	result := &Result{
+		Sessions: int64(len(samples)),
+		Errors:   errs,
+		Duration: elapsed.Seconds(),
+		ConnRate: float64(len(samples)) / elapsed.Seconds(),
+	}
+
+	handshakes := make([]float64, len(samples))
+	throughputs := make([]float64, len(samples))
+	for i, s := range samples {
+		handshakes[i] = float64(s.handshake) / float64(time.Millisecond)
+		throughputs[i] = s.throughput
+		result.ThroughputMean += s.throughput
+		result.BytesTotal += s.bytes
+	}
+	result.ThroughputMean /= float64(len(samples))
+
+	sort.Float64s(handshakes)
+	sort.Float64s(throughputs)
+	result.HandshakeP50 = percentile(handshakes, 50)
+	result.HandshakeP90 = percentile(handshakes, 90)
+	result.HandshakeP99 = percentile(handshakes, 99)
+	result.HandshakeMax = handshakes[len(handshakes)-1]
+	result.ThroughputP50 = percentile(throughputs, 50)
+	result.ThroughputP10 = percentile(throughputs, 10)
+	return result
+}
+
+// percentile of sorted values, nearest-rank method.
+func percentile(sorted []float64, p int) float64 {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
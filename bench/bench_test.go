@@ -0,0 +1,143 @@
+package bench
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+	"xproxy/socks5/socks5test"
+)
+
+func TestRun(t *testing.T) {
+	server := socks5test.NewServer(t, "admin", "admin", nil)
+
+	for _, optimistic := range []bool{false, true} {
+		proxy := server.ClientConfig("admin", "admin")
+		proxy.Optimistic = optimistic
+		result, err := Run(Config{
+			Proxy:    proxy,
+			Sessions: 4,
+			Duration: 200 * time.Millisecond,
+			Upload:   4096,
+			Download: 64 * 1024,
+		})
+		if nil != err {
+			t.Fatalf("optimistic %v: %v", optimistic, err)
+		}
+		if result.Sessions == 0 || result.Errors != 0 {
+			t.Fatalf("optimistic %v: sessions %d, errors %d", optimistic, result.Sessions, result.Errors)
+		}
+		if result.BytesTotal != result.Sessions*(4096+64*1024) {
+			t.Fatalf("optimistic %v: bytes %d of %d sessions", optimistic, result.BytesTotal, result.Sessions)
+		}
+		if result.HandshakeP50 > result.HandshakeP99 || result.HandshakeP99 > result.HandshakeMax {
+			t.Fatalf("optimistic %v: handshake percentiles out of order: %+v", optimistic, result)
+		}
+	}
+}
+
+func TestRunNoSession(t *testing.T) {
+	result, err := Run(Config{
+		Proxy:    socks5test.NewServer(t, "admin", "admin", nil).ClientConfig("admin", "wrong"),
+		Sessions: 1,
+		Duration: 50 * time.Millisecond,
+	})
+	if err != ErrNoSession {
+		t.Fatalf("got %v, want %v", err, ErrNoSession)
+	}
+	if result.Errors == 0 {
+		t.Fatal("errors not counted")
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for _, c := range []struct {
+		p    int
+		want float64
+	}{{10, 1}, {50, 5}, {90, 9}, {99, 10}, {100, 10}} {
+		if got := percentile(sorted, c.p); got != c.want {
+			t.Errorf("p%d: got %v, want %v", c.p, got, c.want)
+		}
+	}
+}
+
+func TestWrite(t *testing.T) {
+	result := summarize([]sample{
+		{handshake: time.Millisecond, throughput: 1000, bytes: 10},
+		{handshake: 3 * time.Millisecond, throughput: 3000, bytes: 10},
+	}, 1, time.Second)
+
+	var buf bytes.Buffer
+	if err := result.Write(&buf, FormatCSV, "v1", true); nil != err {
+		t.Fatal(err)
+	}
+	if err := result.Write(&buf, FormatCSV, "v2", false); nil != err {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&buf).ReadAll()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[1][0] != "v1" || records[2][0] != "v2" || records[1][1] != "2" {
+		t.Fatalf("bad csv: %q", records)
+	}
+
+	buf.Reset()
+	if err := result.Write(&buf, FormatJSON, "v1", true); nil != err {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &decoded); nil != err {
+		t.Fatal(err)
+	}
+	// every csv column must be a json field.
+	for _, column := range csvHeader {
+		if _, ok := decoded[column]; !ok {
+			t.Errorf("json missing %q", column)
+		}
+	}
+
+	if err := result.Write(&buf, "xml", "", true); err != ErrFormat {
+		t.Fatalf("got %v, want %v", err, ErrFormat)
+	}
+}
+
+func TestSinkMaxDownload(t *testing.T) {
+	sink, err := NewSink("127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	sink.MaxDownload = 1024
+	go sink.Serve()
+
+	session := func(upload string, download int64) net.Conn {
+		conn, err := net.Dial("tcp", sink.Addr())
+		if nil != err {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write(append(sinkHeader(int64(len(upload)), download), upload...))
+		return conn
+	}
+
+	conn := session("abc", 1024)
+	if n, err := io.CopyN(ioutil.Discard, conn, 1024); nil != err {
+		t.Errorf("download within limit: received %d bytes, %v", n, err)
+	}
+	conn.Close()
+
+	// sessions over limit are closed without reply.
+	for _, download := range []int64{1025, -1} {
+		conn := session("", download)
+		if b, err := ioutil.ReadAll(conn); len(b) != 0 || nil != err {
+			t.Errorf("download %d: received %d bytes, %v", download, len(b), err)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,99 @@
+package bench
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+var (
+	ErrFormat = errors.New("bench: unknown output format")
+)
+
+const (
+	FormatText = "text"
+	FormatCSV  = "csv"
+	FormatJSON = "json"
+)
+
+// csvHeader is the column order of csv output, it matches json field names, so both can be compared across releases.
+var csvHeader = []string{
+	"label", "sessions", "errors", "duration", "conn_rate",
+	"handshake_p50", "handshake_p90", "handshake_p99", "handshake_max",
+	"throughput_mean", "throughput_p50", "throughput_p10", "bytes_total",
+}
+
+// Write result in format, label identifies the run, such as release version.
+// header is only written by csv, so several runs can be appended to one file.
+func (r *Result) Write(w io.Writer, format, label string, header bool) error {
+	switch format {
+	case FormatText, "":
+		return r.writeText(w, label)
+	case FormatCSV:
+		return r.writeCSV(w, label, header)
+	case FormatJSON:
+		return json.NewEncoder(w).Encode(struct {
+			Label string `json:"label,omitempty"`
+			*Result
+		}{label, r})
+	}
+	return ErrFormat
+}
+
+// help func ===========================================================================================================
+
+func (r *Result) writeCSV(w io.Writer, label string, header bool) error {
+	writer := csv.NewWriter(w)
+	if header {
+		writer.Write(csvHeader)
+	}
+	writer.Write([]string{
+		label,
+		strconv.FormatInt(r.Sessions, 10),
+		strconv.FormatInt(r.Errors, 10),
+		formatFloat(r.Duration),
+		formatFloat(r.ConnRate),
+		formatFloat(r.HandshakeP50),
+		formatFloat(r.HandshakeP90),
+		formatFloat(r.HandshakeP99),
+		formatFloat(r.HandshakeMax),
+		formatFloat(r.ThroughputMean),
+		formatFloat(r.ThroughputP50),
+		formatFloat(r.ThroughputP10),
+		strconv.FormatInt(r.BytesTotal, 10),
+	})
+	writer.Flush()
+	return writer.Error()
+}
+
+func (r *Result) writeText(w io.Writer, label string) error {
+	if label != "" {
+		fmt.Fprintf(w, "%s\n", label)
+	}
+	_, err := fmt.Fprintf(w, "sessions:   %d completed, %d errors in %.2fs\n"+
+		"conn rate:  %.1f sessions/s\n"+
+		"handshake:  p50 %.3fms  p90 %.3fms  p99 %.3fms  max %.3fms\n"+
+		"throughput: mean %s/s  p50 %s/s  p10 %s/s per session\n",
+		r.Sessions, r.Errors, r.Duration,
+		r.ConnRate,
+		r.HandshakeP50, r.HandshakeP90, r.HandshakeP99, r.HandshakeMax,
+		formatBytes(r.ThroughputMean), formatBytes(r.ThroughputP50), formatBytes(r.ThroughputP10))
+	return err
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 3, 64)
+}
+
+func formatBytes(b float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB"}
+	i := 0
+	for b >= 1024 && i < len(units)-1 {
+		b /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%s", b, units[i])
+}
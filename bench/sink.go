@@ -0,0 +1,105 @@
+package bench
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+)
+
+// sink protocol, client sends a header, then upload bytes, sink replies download bytes after upload received:
+//
+//	+--------------+----------------+--------+
+//	| UPLOAD SIZE  | DOWNLOAD SIZE  | UPLOAD |
+//	+--------------+----------------+--------+
+//	| 8, big-endian| 8, big-endian  |  ...   |
+//	+--------------+----------------+--------+
+
+const (
+	sinkHeaderSize = 16
+
+	// DefaultSinkMaxDownload bound the reply of one session, so an exposed sink is not a bandwidth amplifier.
+	DefaultSinkMaxDownload = 16 * 1024 * 1024
+)
+
+// Sink is the destination server of benchmark, it's bundled so proxy capacity is measured without a real service.
+// it answers anyone who connects, so listen on loopback or a private address only.
+type Sink struct {
+	MaxDownload int64 // sessions asking for more bytes are closed, default is DefaultSinkMaxDownload
+
+	listener net.Listener
+}
+
+// NewSink listen on addr, such as "127.0.0.1:0".
+func NewSink(addr string) (*Sink, error) {
+	listener, err := net.Listen("tcp", addr)
+	if nil != err {
+		return nil, err
+	}
+	return &Sink{MaxDownload: DefaultSinkMaxDownload, listener: listener}, nil
+}
+
+func (s *Sink) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Serve accept connections until sink closed.
+func (s *Sink) Serve() error {
+	for {
+		conn, err := s.listener.Accept()
+		if nil != err {
+			return err
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Sink) Close() error {
+	return s.listener.Close()
+}
+
+// help func ===========================================================================================================
+
+func (s *Sink) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	header := make([]byte, sinkHeaderSize)
+	if _, err := io.ReadFull(conn, header); nil != err {
+		return
+	}
+	upload := int64(binary.BigEndian.Uint64(header))
+	download := int64(binary.BigEndian.Uint64(header[8:]))
+	if download < 0 || download > s.MaxDownload {
+		log.Printf("bench sink: %s download %d bytes over limit %d", conn.RemoteAddr(), download, s.MaxDownload)
+		return
+	}
+
+	if n, err := io.CopyN(ioutil.Discard, conn, upload); nil != err {
+		log.Printf("bench sink: %s upload %d of %d bytes: %v", conn.RemoteAddr(), n, upload, err)
+		return
+	}
+	if _, err := io.CopyN(conn, zeroReader{}, download); nil != err {
+		return
+	}
+	// wait for client to close, so the last bytes are not reset.
+	io.Copy(ioutil.Discard, conn)
+}
+
+// zeroReader is an endless stream of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+// sinkHeader encode the header of one session.
+func sinkHeader(upload, download int64) []byte {
+	header := make([]byte, sinkHeaderSize)
+	binary.BigEndian.PutUint64(header, uint64(upload))
+	binary.BigEndian.PutUint64(header[8:], uint64(download))
+	return header
+}
@@ -1,9 +1,24 @@
 module xproxy
 
-go 1.12
+go 1.18
 
 require (
+	github.com/gorilla/websocket v1.4.2
+	github.com/jcmturner/gofork v1.0.0
+	github.com/jcmturner/gokrb5/v8 v8.4.2
+	github.com/oschwald/maxminddb-golang v1.8.0
 	github.com/patrickmn/go-cache v2.1.0+incompatible
+	golang.org/x/crypto v0.0.0-20201112155050-0c6587e931a9
+	golang.org/x/sys v0.0.0-20191224085550-c709ea063b76
+)
+
+require (
+	github.com/hashicorp/go-uuid v1.0.2 // indirect
+	github.com/jcmturner/aescts/v2 v2.0.0 // indirect
+	github.com/jcmturner/dnsutils/v2 v2.0.0 // indirect
+	github.com/jcmturner/goidentity/v6 v6.0.1 // indirect
+	github.com/jcmturner/rpc/v2 v2.0.3 // indirect
 	github.com/txthinking/socks5 v0.0.0-20190404052647-254e122c4eaf // indirect
 	github.com/txthinking/x v0.0.0-20190708114625-99b19c1440b6 // indirect
+	golang.org/x/net v0.0.0-20200114155413-6afb5195e5aa // indirect
 )
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"time"
+	"xproxy/bench"
+	"xproxy/socks5"
+)
+
+// bench open concurrent sessions through a socks proxy to a sink server, such as:
+//
+//	go run main/bench.go -proxy 127.0.0.1:8090 -user admin -pass admin -c 100 -d 30s -format csv -label v1.2.0 >> bench.csv
+//
+// without -target, a sink server is bundled on loopback, so proxy must run on the same host.
+// for remote proxy, run the sink on the proxy host with -sink 127.0.0.1:9000, then pass -target 127.0.0.1:9000 to
+// the benchmark. sink answers anyone who connects, never listen on a public address.
+func main() {
+	proxyAddr := flag.String("proxy", "127.0.0.1:8090", "socks proxy address")
+	username := flag.String("user", "", "username of proxy")
+	password := flag.String("pass", "", "password of proxy")
+	optimistic := flag.Bool("optimistic", false, "send handshake in one flight")
+	muxConns := flag.Int("mux", 0, "multiplex sessions over n connections, proxy must be xproxy")
+	target := flag.String("target", "", "sink address reachable by proxy, empty means bundled sink")
+	sessions := flag.Int("c", bench.DefaultSessions, "concurrent sessions")
+	duration := flag.Duration("d", bench.DefaultDuration, "benchmark duration")
+	upload := flag.Int64("up", 0, "bytes sent by every session")
+	download := flag.Int64("down", 64*1024, "bytes received by every session")
+	format := flag.String("format", bench.FormatText, "output format: text, csv or json")
+	label := flag.String("label", "", "label of run, such as release version")
+	header := flag.Bool("header", true, "write csv header")
+	sinkAddr := flag.String("sink", "", "only run sink server on address, such as 127.0.0.1:9000")
+	sinkMaxDownload := flag.Int64("sink-max-down", bench.DefaultSinkMaxDownload, "max bytes received by one session of sink")
+	flag.Parse()
+
+	if *sinkAddr != "" {
+		sink, err := bench.NewSink(*sinkAddr)
+		if nil != err {
+			log.Fatal(err)
+		}
+		sink.MaxDownload = *sinkMaxDownload
+		log.Printf("sink listen on %s", sink.Addr())
+		log.Fatal(sink.Serve())
+	}
+
+	result, err := bench.Run(bench.Config{
+		Proxy: &socks5.ClientConfig{
+			Username:    *username,
+			Password:    *password,
+			ProxyAddr:   *proxyAddr,
+			TCPDeadline: int((*duration + time.Minute) / time.Second),
+			Mux:         *muxConns,
+			Optimistic:  *optimistic,
+		},
+		Target:   *target,
+		Sessions: *sessions,
+		Duration: *duration,
+		Upload:   *upload,
+		Download: *download,
+	})
+	if nil != err {
+		log.Fatal(err)
+	}
+	if err := result.Write(os.Stdout, *format, *label, *header); nil != err {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"xproxy/socks5"
+)
+
+func main() {
+	socks5.Debug = true
+	forwarder := socks5.NewForwarder("admin", "admin", "127.0.0.1:8090", []socks5.Forward{
+		{Network: "tcp", Local: "127.0.0.1:5432", Remote: "db.internal:5432"},
+		{Network: "udp", Local: "127.0.0.1:5353", Remote: "8.8.8.8:53"},
+	})
+	if err := forwarder.Run(); nil != err {
+		panic(err)
+	}
+}
@@ -0,0 +1,13 @@
+package main
+
+import (
+	"xproxy/socks5"
+)
+
+func main() {
+	socks5.Debug = true
+	bridge := socks5.NewHTTPBridge("127.0.0.1:8118", "admin", "admin", "127.0.0.1:8090")
+	if err := bridge.Run(); nil != err {
+		panic(err)
+	}
+}
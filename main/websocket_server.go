@@ -0,0 +1,16 @@
+package main
+
+import (
+	"xproxy/socks5"
+)
+
+func main() {
+	socks5.Debug = true
+	server, err := socks5.NewServer("127.0.0.1:8090", "", "admin", "admin", 120, 120, 120, 120)
+	if nil != err {
+		panic(err)
+	}
+	// plain tcp and websocket listeners share the same server, put behind l7 gateway or set cert/key for wss.
+	go server.RunWebSocketServer("127.0.0.1:8443", socks5.DefaultWebSocketPath, "", "")
+	server.Run()
+}
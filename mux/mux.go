@@ -0,0 +1,373 @@
+// Package mux implement stream multiplexing over a single reliable connection, like yamux/smux.
+//
+// Frame format, all integers are big-endian:
+//
+//	+-----+-----+--------+-----------+---------+
+//	| VER | CMD | LENGTH | STREAM ID | PAYLOAD |
+//	+-----+-----+--------+-----------+---------+
+//	|  1  |  1  |   2    |     4     | LENGTH  |
+//	+-----+-----+--------+-----------+---------+
+//
+// every stream has its own receive window, sender stops when the window used up, receiver returns the window by
+// WINDOW frame after data consumed, so a slow stream never blocks the others.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrSessionClosed   = errors.New("mux session closed")
+	ErrStreamClosed    = errors.New("mux stream closed")
+	ErrStreamReset     = errors.New("mux stream reset by peer")
+	ErrBadVersion      = errors.New("mux bad protocol version")
+	ErrBadFrame        = errors.New("mux bad frame")
+	ErrTimeout         = &timeoutError{}
+	ErrAcceptBacklog   = errors.New("mux accept backlog full")
+	ErrKeepAliveFailed = errors.New("mux keepalive timeout")
+)
+
+const (
+	Version byte = 0x01
+
+	cmdSYN    byte = 0x01 // open stream
+	cmdData   byte = 0x02 // stream data
+	cmdWindow byte = 0x03 // stream window update, payload is 4 bytes increment
+	cmdFIN    byte = 0x04 // stream half close, no more data from sender
+	cmdRST    byte = 0x05 // stream reset, both directions closed
+	cmdPing   byte = 0x06 // session keepalive
+	cmdPong   byte = 0x07
+
+	headerSize   = 8
+	MaxFrameSize = 32 * 1024
+
+	DefaultWindow            = 256 * 1024
+	DefaultKeepAliveInterval = 30 * time.Second
+	acceptBacklog            = 1024
+	controlBacklog           = 64 // RST replies queued for the control writer, the rest are dropped
+)
+
+// Config is the session settings, zero value means default.
+type Config struct {
+	Window            uint32        // per stream receive window
+	KeepAliveInterval time.Duration // negative disables keepalive
+}
+
+// Session is one side of multiplexed connection, client opens odd stream id, server opens even stream id.
+type Session struct {
+	conn   net.Conn
+	config Config
+
+	nextID uint32
+
+	mu       sync.Mutex
+	streams  map[uint32]*Stream
+	acceptCh chan *Stream
+
+	writeMu sync.Mutex
+
+	// replies of received frames, written by one goroutine so a peer that doesn't read can't pile up writers.
+	rstCh  chan uint32
+	pongCh chan struct{}
+
+	lastRecv  int64 // unix nano, accessed by atomic operations
+	die       chan struct{}
+	dieOnce   sync.Once
+	dieReason error
+}
+
+// Client create client side session, conn must be already established.
+func Client(conn net.Conn, config *Config) *Session {
+	return newSession(conn, config, 1)
+}
+
+// Server create server side session.
+func Server(conn net.Conn, config *Config) *Session {
+	return newSession(conn, config, 2)
+}
+
+func newSession(conn net.Conn, config *Config, firstID uint32) *Session {
+	s := &Session{
+		conn:     conn,
+		nextID:   firstID,
+		streams:  make(map[uint32]*Stream),
+		acceptCh: make(chan *Stream, acceptBacklog),
+		rstCh:    make(chan uint32, controlBacklog),
+		pongCh:   make(chan struct{}, 1),
+		lastRecv: time.Now().UnixNano(),
+		die:      make(chan struct{}),
+	}
+	if nil != config {
+		s.config = *config
+	}
+	if s.config.Window == 0 {
+		s.config.Window = DefaultWindow
+	}
+	if s.config.KeepAliveInterval == 0 {
+		s.config.KeepAliveInterval = DefaultKeepAliveInterval
+	}
+
+	go s.recvLoop()
+	go s.controlLoop()
+	if s.config.KeepAliveInterval > 0 {
+		go s.keepalive()
+	}
+	return s
+}
+
+// OpenStream open a new stream, it doesn't wait for peer.
+func (s *Session) OpenStream() (*Stream, error) {
+	if s.IsClosed() {
+		return nil, ErrSessionClosed
+	}
+
+	s.mu.Lock()
+	id := s.nextID
+	s.nextID += 2
+	stream := newStream(id, s)
+	s.streams[id] = stream
+	s.mu.Unlock()
+
+	if err := s.writeFrame(cmdSYN, id, nil); nil != err {
+		s.removeStream(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// AcceptStream wait for stream opened by peer.
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		return stream, nil
+	case <-s.die:
+		return nil, s.closeReason()
+	}
+}
+
+// Close close session and all streams.
+func (s *Session) Close() error {
+	return s.closeWithReason(ErrSessionClosed)
+}
+
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// CloseChan is closed when session closed.
+func (s *Session) CloseChan() <-chan struct{} {
+	return s.die
+}
+
+// NumStreams return count of running streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// help func ===========================================================================================================
+
+func (s *Session) closeWithReason(reason error) error {
+	var err error
+	s.dieOnce.Do(func() {
+		s.mu.Lock()
+		s.dieReason = reason
+		s.mu.Unlock()
+		close(s.die)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+func (s *Session) closeReason() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if nil == s.dieReason {
+		return ErrSessionClosed
+	}
+	return s.dieReason
+}
+
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+}
+
+func (s *Session) getStream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// writeFrame serialize frame into one buffer, so concurrent streams never interleave.
+func (s *Session) writeFrame(cmd byte, id uint32, payload []byte) error {
+	frame := make([]byte, headerSize+len(payload))
+	frame[0] = Version
+	frame[1] = cmd
+	binary.BigEndian.PutUint16(frame[2:4], uint16(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:8], id)
+	copy(frame[headerSize:], payload)
+
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+	if _, err := s.conn.Write(frame); nil != err {
+		s.closeWithReason(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) recvLoop() {
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(s.conn, header); nil != err {
+			s.closeWithReason(err)
+			return
+		}
+		atomic.StoreInt64(&s.lastRecv, time.Now().UnixNano())
+
+		if header[0] != Version {
+			s.closeWithReason(ErrBadVersion)
+			return
+		}
+		cmd := header[1]
+		length := int(binary.BigEndian.Uint16(header[2:4]))
+		id := binary.BigEndian.Uint32(header[4:8])
+
+		var payload []byte
+		if length > 0 {
+			payload = make([]byte, length)
+			if _, err := io.ReadFull(s.conn, payload); nil != err {
+				s.closeWithReason(err)
+				return
+			}
+		}
+
+		if err := s.handleFrame(cmd, id, payload); nil != err {
+			s.closeWithReason(err)
+			return
+		}
+	}
+}
+
+func (s *Session) handleFrame(cmd byte, id uint32, payload []byte) error {
+	switch cmd {
+	case cmdSYN:
+		s.mu.Lock()
+		if _, ok := s.streams[id]; ok {
+			s.mu.Unlock()
+			return ErrBadFrame
+		}
+		stream := newStream(id, s)
+		s.streams[id] = stream
+		s.mu.Unlock()
+
+		select {
+		case s.acceptCh <- stream:
+		default:
+			s.removeStream(id)
+			s.sendRST(id)
+		}
+	case cmdData:
+		if stream := s.getStream(id); nil != stream {
+			stream.pushData(payload)
+		} else {
+			s.sendRST(id)
+		}
+	case cmdWindow:
+		if len(payload) != 4 {
+			return ErrBadFrame
+		}
+		if stream := s.getStream(id); nil != stream {
+			stream.addWindow(binary.BigEndian.Uint32(payload))
+		}
+	case cmdFIN:
+		if stream := s.getStream(id); nil != stream {
+			stream.remoteFIN()
+		}
+	case cmdRST:
+		if stream := s.getStream(id); nil != stream {
+			stream.remoteRST()
+		}
+	case cmdPing:
+		// pings not answered yet are coalesced into one pong.
+		select {
+		case s.pongCh <- struct{}{}:
+		default:
+		}
+	case cmdPong:
+	default:
+		return ErrBadFrame
+	}
+	return nil
+}
+
+// sendRST queue RST reply, it's dropped if the queue is full, the peer learns the stream is gone by later frames.
+func (s *Session) sendRST(id uint32) {
+	select {
+	case s.rstCh <- id:
+	default:
+	}
+}
+
+// controlLoop write replies queued by recvLoop, recvLoop never blocks on writing.
+func (s *Session) controlLoop() {
+	for {
+		select {
+		case id := <-s.rstCh:
+			s.writeFrame(cmdRST, id, nil)
+		case <-s.pongCh:
+			s.writeFrame(cmdPong, 0, nil)
+		case <-s.die:
+			return
+		}
+	}
+}
+
+func (s *Session) keepalive() {
+	ticker := time.NewTicker(s.config.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			idle := time.Since(time.Unix(0, atomic.LoadInt64(&s.lastRecv)))
+			if idle > 3*s.config.KeepAliveInterval {
+				s.closeWithReason(ErrKeepAliveFailed)
+				return
+			}
+			s.writeFrame(cmdPing, 0, nil)
+		case <-s.die:
+			return
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "mux i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
@@ -0,0 +1,219 @@
+package mux
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func newTestSessions(t *testing.T, config *Config) (client, server *Session) {
+	c, s := net.Pipe()
+	client, server = Client(c, config), Server(s, config)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// openPair open stream on client and accept it on server.
+func openPair(t *testing.T, client, server *Session) (*Stream, *Stream) {
+	local, err := client.OpenStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	remote, err := server.AcceptStream()
+	if nil != err {
+		t.Fatal(err)
+	}
+	if local.ID() != remote.ID() || local.ID()%2 != 1 {
+		t.Fatalf("stream id %d, accepted %d", local.ID(), remote.ID())
+	}
+	return local, remote
+}
+
+func waitClosed(t *testing.T, session *Session) {
+	select {
+	case <-session.CloseChan():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session not closed")
+	}
+}
+
+func TestStream(t *testing.T) {
+	client, server := newTestSessions(t, nil)
+	local, remote := openPair(t, client, server)
+
+	go local.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(remote, b); nil != err || string(b) != "hello" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+
+	// half close: peer reads EOF, but it can still reply.
+	if err := local.CloseWrite(); nil != err {
+		t.Fatal(err)
+	}
+	if n, err := remote.Read(b); n != 0 || err != io.EOF {
+		t.Fatalf("read after FIN: %d, %v", n, err)
+	}
+	if _, err := local.Write([]byte("more")); err != ErrStreamClosed {
+		t.Errorf("write after half close: got %v, want %v", err, ErrStreamClosed)
+	}
+	go remote.Write([]byte("reply"))
+	if _, err := io.ReadFull(local, b); nil != err || string(b) != "reply" {
+		t.Fatalf("reply after half close: %q, %v", b, err)
+	}
+
+	// stream is removed when both directions closed.
+	remote.Close()
+	if n, err := local.Read(b); n != 0 || err != io.EOF {
+		t.Fatalf("read after close: %d, %v", n, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for client.NumStreams() != 0 || server.NumStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d client streams, %d server streams", client.NumStreams(), server.NumStreams())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := remote.Read(b); err != io.EOF && err != ErrStreamClosed {
+		t.Errorf("read closed stream: %v", err)
+	}
+}
+
+func TestStreamReadDeadline(t *testing.T) {
+	client, server := newTestSessions(t, nil)
+	local, _ := openPair(t, client, server)
+
+	local.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := local.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("got %v, want timeout", err)
+	}
+}
+
+func TestStreamWindow(t *testing.T) {
+	const window = 1024
+	client, server := newTestSessions(t, &Config{Window: window})
+	local, remote := openPair(t, client, server)
+	data := bytes.Repeat([]byte("0123456789abcdef"), window/4)
+
+	// sender stops when receive window of peer used up.
+	local.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := local.Write(data)
+	if err != ErrTimeout || n != window {
+		t.Fatalf("write over window: %d, %v", n, err)
+	}
+
+	// window is returned after data consumed.
+	local.SetWriteDeadline(time.Time{})
+	written := make(chan error, 1)
+	go func() {
+		_, err := local.Write(data[n:])
+		written <- err
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(remote, got); nil != err || !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes: %v", len(got), err)
+	}
+	if err := <-written; nil != err {
+		t.Fatal(err)
+	}
+
+	// a stream waiting for window never blocks the others.
+	local.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	local.Write(data)
+	other, otherRemote := openPair(t, client, server)
+	go other.Write([]byte("other"))
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(otherRemote, b); nil != err || string(b) != "other" {
+		t.Fatalf("other stream: %q, %v", b, err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	const interval = 20 * time.Millisecond
+
+	// peer answers pings.
+	client, _ := newTestSessions(t, &Config{KeepAliveInterval: interval})
+	time.Sleep(6 * interval)
+	if client.IsClosed() {
+		t.Fatal("session with live peer closed")
+	}
+
+	// peer never answers.
+	c, s := net.Pipe()
+	defer s.Close()
+	go io.Copy(ioutil.Discard, s)
+	silent := Client(c, &Config{KeepAliveInterval: interval})
+	waitClosed(t, silent)
+	if _, err := silent.AcceptStream(); err != ErrKeepAliveFailed {
+		t.Errorf("got %v, want %v", err, ErrKeepAliveFailed)
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := newTestSessions(t, nil)
+	local, remote := openPair(t, client, server)
+
+	reading := make(chan error, 1)
+	go func() {
+		_, err := remote.Read(make([]byte, 1))
+		reading <- err
+	}()
+	client.Close()
+
+	// blocked read of peer is woken up, streams of both sides fail.
+	waitClosed(t, server)
+	if err := <-reading; nil == err {
+		t.Error("read of closed session succeeded")
+	}
+	if _, err := local.Write([]byte("x")); nil == err {
+		t.Error("write of closed session succeeded")
+	}
+	if _, err := client.OpenStream(); err != ErrSessionClosed {
+		t.Errorf("open stream: got %v, want %v", err, ErrSessionClosed)
+	}
+	if _, err := client.AcceptStream(); err != ErrSessionClosed {
+		t.Errorf("accept stream: got %v, want %v", err, ErrSessionClosed)
+	}
+}
+
+func TestBadFrame(t *testing.T) {
+	c, s := net.Pipe()
+	server := Server(s, nil)
+	defer c.Close()
+	go io.Copy(ioutil.Discard, c)
+
+	c.Write([]byte{0x02, cmdSYN, 0, 0, 0, 0, 0, 1})
+	waitClosed(t, server)
+	if _, err := server.AcceptStream(); err != ErrBadVersion {
+		t.Errorf("got %v, want %v", err, ErrBadVersion)
+	}
+}
+
+func TestControlFlood(t *testing.T) {
+	// peer floods frames which need replies, but never reads.
+	c, s := net.Pipe()
+	defer c.Close()
+	server := Server(s, &Config{KeepAliveInterval: -1})
+	defer server.Close()
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 5000; i++ {
+		c.Write([]byte{Version, cmdPing, 0, 0, 0, 0, 0, 0})
+		c.Write([]byte{Version, cmdData, 0, 1, 0, 0, 0, byte(2*i + 1), 'x'})
+	}
+	if n := runtime.NumGoroutine(); n > before+2 {
+		t.Fatalf("%d goroutines after flood, %d before", n, before)
+	}
+	if server.IsClosed() {
+		t.Fatal("session closed by control frames")
+	}
+}
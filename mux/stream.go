@@ -0,0 +1,278 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream is a logical connection in session, it implements net.Conn.
+type Stream struct {
+	id   uint32
+	sess *Session
+
+	mu         sync.Mutex
+	recvBuf    bytes.Buffer
+	consumed   uint32 // bytes read since last window update
+	sendWindow uint32
+	finRecv    bool // peer closed write
+	finSent    bool
+	reset      bool
+	closed     bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	readCh  chan struct{} // notify data, fin or reset arrived
+	writeCh chan struct{} // notify window increased
+	die     chan struct{} // closed when stream closed locally
+}
+
+func newStream(id uint32, sess *Session) *Stream {
+	return &Stream{
+		id:         id,
+		sess:       sess,
+		sendWindow: sess.config.Window,
+		readCh:     make(chan struct{}, 1),
+		writeCh:    make(chan struct{}, 1),
+		die:        make(chan struct{}),
+	}
+}
+
+// ID return stream id.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.recvBuf.Len() > 0 {
+			n, _ := st.recvBuf.Read(b)
+			st.consumed += uint32(n)
+			// return window when half of it consumed, avoid too many small frames.
+			var increment uint32
+			if st.consumed >= st.sess.config.Window/2 {
+				increment = st.consumed
+				st.consumed = 0
+			}
+			st.mu.Unlock()
+
+			if increment > 0 {
+				payload := make([]byte, 4)
+				binary.BigEndian.PutUint32(payload, increment)
+				st.sess.writeFrame(cmdWindow, st.id, payload)
+			}
+			return n, nil
+		}
+		if st.reset {
+			st.mu.Unlock()
+			return 0, ErrStreamReset
+		}
+		if st.finRecv {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		if st.closed {
+			st.mu.Unlock()
+			return 0, ErrStreamClosed
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+
+		if err := st.wait(st.readCh, deadline); nil != err {
+			return 0, err
+		}
+	}
+}
+
+func (st *Stream) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		st.mu.Lock()
+		if st.reset {
+			st.mu.Unlock()
+			return written, ErrStreamReset
+		}
+		if st.closed || st.finSent {
+			st.mu.Unlock()
+			return written, ErrStreamClosed
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := st.wait(st.writeCh, deadline); nil != err {
+				return written, err
+			}
+			continue
+		}
+
+		n := len(b) - written
+		if n > MaxFrameSize {
+			n = MaxFrameSize
+		}
+		if uint32(n) > st.sendWindow {
+			n = int(st.sendWindow)
+		}
+		st.sendWindow -= uint32(n)
+		st.mu.Unlock()
+
+		if err := st.sess.writeFrame(cmdData, st.id, b[written:written+n]); nil != err {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+// CloseWrite send FIN, peer reads EOF, but stream can still read.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.finSent || st.closed || st.reset {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	done := st.finRecv
+	st.mu.Unlock()
+
+	err := st.sess.writeFrame(cmdFIN, st.id, nil)
+	if done {
+		st.sess.removeStream(st.id)
+	}
+	return err
+}
+
+// Close close both directions, data from peer after closed will be answered with RST.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	sendFIN := !st.finSent && !st.reset
+	st.finSent = true
+	close(st.die)
+	st.mu.Unlock()
+
+	st.sess.removeStream(st.id)
+	if sendFIN {
+		return st.sess.writeFrame(cmdFIN, st.id, nil)
+	}
+	return nil
+}
+
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.LocalAddr()
+}
+
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.RemoteAddr()
+}
+
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readCh)
+	return nil
+}
+
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writeCh)
+	return nil
+}
+
+// help func ===========================================================================================================
+
+// wait block until notified, deadline exceeded, stream or session closed.
+func (st *Stream) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return ErrTimeout
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-ch:
+		return nil
+	case <-timeout:
+		return ErrTimeout
+	case <-st.die:
+		return ErrStreamClosed
+	case <-st.sess.die:
+		return st.sess.closeReason()
+	}
+}
+
+func (st *Stream) pushData(data []byte) {
+	st.mu.Lock()
+	// peer doesn't respect window, drop the stream.
+	overflow := uint32(st.recvBuf.Len()+len(data)) > st.sess.config.Window
+	if !overflow && !st.closed {
+		st.recvBuf.Write(data)
+	}
+	st.mu.Unlock()
+
+	if overflow {
+		st.remoteRST()
+		st.sess.removeStream(st.id)
+		go st.sess.writeFrame(cmdRST, st.id, nil)
+		return
+	}
+	notify(st.readCh)
+}
+
+func (st *Stream) addWindow(increment uint32) {
+	st.mu.Lock()
+	st.sendWindow += increment
+	st.mu.Unlock()
+	notify(st.writeCh)
+}
+
+func (st *Stream) remoteFIN() {
+	st.mu.Lock()
+	st.finRecv = true
+	done := st.finSent
+	st.mu.Unlock()
+
+	if done {
+		st.sess.removeStream(st.id)
+	}
+	notify(st.readCh)
+}
+
+func (st *Stream) remoteRST() {
+	st.mu.Lock()
+	st.reset = true
+	st.mu.Unlock()
+
+	st.sess.removeStream(st.id)
+	notify(st.readCh)
+	notify(st.writeCh)
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,280 @@
+// Package pcapng write captured streams to pcapng file, tcp connections are synthesized from stream payload,
+// so the file opens in wireshark with stream reassembly and protocol dissectors.
+// See: https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-02.html
+package pcapng
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAddressFamily = errors.New("pcapng: stream endpoints have different address family")
+)
+
+const (
+	// block types.
+	blockSectionHeader    uint32 = 0x0A0D0D0A
+	blockInterface        uint32 = 0x00000001
+	blockEnhancedPacket   uint32 = 0x00000006
+	byteOrderMagic        uint32 = 0x1A2B3C4D
+	linkTypeRaw           uint16 = 101 // raw ip, version is in the first nibble
+	optionEnd             uint16 = 0
+	optionComment         uint16 = 1
+	optionUserApplication uint16 = 4
+
+	// tcp flags.
+	flagFIN byte = 0x01
+	flagSYN byte = 0x02
+	flagPSH byte = 0x08
+	flagACK byte = 0x10
+
+	// MaxSegmentSize split stream payload to segments like ethernet tcp.
+	MaxSegmentSize = 1460
+)
+
+var order = binary.LittleEndian
+
+// Writer write one section with one raw ip interface, it's safe for concurrent use.
+type Writer struct {
+	mu   sync.Mutex
+	w    io.Writer
+	size int64
+	buff []byte
+}
+
+// NewWriter write section header with comment, such as description of captured session.
+func NewWriter(w io.Writer, application, comment string) (*Writer, error) {
+	writer := &Writer{w: w}
+
+	var options []byte
+	options = appendOption(options, optionComment, comment)
+	options = appendOption(options, optionUserApplication, application)
+	options = appendOption(options, optionEnd, "")
+	body := make([]byte, 16, 16+len(options))
+	order.PutUint32(body, byteOrderMagic)
+	order.PutUint16(body[4:], 1) // major version
+	order.PutUint16(body[6:], 0) // minor version
+	order.PutUint64(body[8:], 0xFFFFFFFFFFFFFFFF)
+	body = append(body, options...)
+	if err := writer.writeBlock(blockSectionHeader, body); nil != err {
+		return nil, err
+	}
+
+	// interface 0, timestamps are in microseconds by default.
+	body = make([]byte, 8)
+	order.PutUint16(body, linkTypeRaw)
+	if err := writer.writeBlock(blockInterface, body); nil != err {
+		return nil, err
+	}
+	return writer, nil
+}
+
+// Size return written bytes.
+func (w *Writer) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.size
+}
+
+// Stream is a synthesized tcp connection, client is the side which sent SYN.
+type Stream struct {
+	w      *Writer
+	ends   [2]*net.TCPAddr // client, server
+	seq    [2]uint32       // next sequence number of client, server
+	ipID   uint16
+	closed bool
+}
+
+// NewStream write tcp handshake of client and server.
+func (w *Writer) NewStream(client, server *net.TCPAddr, ts time.Time) (*Stream, error) {
+	clientIP, serverIP := client.IP.To4(), server.IP.To4()
+	if (nil == clientIP) != (nil == serverIP) {
+		return nil, ErrAddressFamily
+	}
+	if nil == clientIP {
+		clientIP, serverIP = client.IP.To16(), server.IP.To16()
+	}
+	s := &Stream{
+		w:    w,
+		ends: [2]*net.TCPAddr{{IP: clientIP, Port: client.Port}, {IP: serverIP, Port: server.Port}},
+		seq:  [2]uint32{0x10000000, 0x20000000},
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := s.writeSegment(0, flagSYN, nil, ts); nil != err {
+		return nil, err
+	}
+	s.seq[0]++
+	if err := s.writeSegment(1, flagSYN|flagACK, nil, ts); nil != err {
+		return nil, err
+	}
+	s.seq[1]++
+	return s, s.writeSegment(0, flagACK, nil, ts)
+}
+
+// Write write payload sent by client or server, it's split to segments of MaxSegmentSize.
+func (s *Stream) Write(fromClient bool, data []byte, ts time.Time) error {
+	side := 1
+	if fromClient {
+		side = 0
+	}
+
+	s.w.mu.Lock()
+	defer s.w.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	for len(data) > 0 {
+		n := len(data)
+		if n > MaxSegmentSize {
+			n = MaxSegmentSize
+		}
+		if err := s.writeSegment(side, flagPSH|flagACK, data[:n], ts); nil != err {
+			return err
+		}
+		s.seq[side] += uint32(n)
+		data = data[n:]
+	}
+	return nil
+}
+
+// Close write FIN of both sides, stream writes nothing after closed.
+func (s *Stream) Close(ts time.Time) error {
+	s.w.mu.Lock()
+	defer s.w.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if err := s.writeSegment(0, flagFIN|flagACK, nil, ts); nil != err {
+		return err
+	}
+	s.seq[0]++
+	if err := s.writeSegment(1, flagFIN|flagACK, nil, ts); nil != err {
+		return err
+	}
+	s.seq[1]++
+	return s.writeSegment(0, flagACK, nil, ts)
+}
+
+// help func ===========================================================================================================
+
+// writeSegment must be called with writer lock held.
+func (s *Stream) writeSegment(side int, flags byte, payload []byte, ts time.Time) error {
+	src, dst := s.ends[side], s.ends[1-side]
+	s.ipID++
+
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp, uint16(src.Port))
+	binary.BigEndian.PutUint16(tcp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(tcp[4:], s.seq[side])
+	if flags&flagACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], s.seq[1-side])
+	}
+	tcp[12] = 5 << 4 // data offset, no options
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 0xFFFF) // window
+	tcp = append(tcp, payload...)
+
+	var packet []byte
+	if len(src.IP) == net.IPv4len {
+		packet = make([]byte, 20, 20+len(tcp))
+		packet[0] = 0x45 // version 4, header length 5 words
+		binary.BigEndian.PutUint16(packet[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(packet[4:], s.ipID)
+		binary.BigEndian.PutUint16(packet[6:], 0x4000) // don't fragment
+		packet[8] = 64                                 // ttl
+		packet[9] = 6                                  // tcp
+		copy(packet[12:], src.IP)
+		copy(packet[16:], dst.IP)
+		binary.BigEndian.PutUint16(packet[10:], ^checksum(0, packet))
+	} else {
+		packet = make([]byte, 40, 40+len(tcp))
+		packet[0] = 0x60 // version 6
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+		packet[6] = 6  // next header tcp
+		packet[7] = 64 // hop limit
+		copy(packet[8:], src.IP)
+		copy(packet[24:], dst.IP)
+	}
+
+	// tcp checksum covers pseudo header of addresses, protocol and tcp length.
+	pseudo := uint32(checksum(0, src.IP))
+	pseudo = uint32(checksum(pseudo, dst.IP)) + 6 + uint32(len(tcp))
+	binary.BigEndian.PutUint16(tcp[16:], ^checksum(pseudo, tcp))
+
+	packet = append(packet, tcp...)
+	return s.w.writePacket(packet, ts)
+}
+
+// writePacket must be called with writer lock held.
+func (w *Writer) writePacket(packet []byte, ts time.Time) error {
+	micros := uint64(ts.UnixNano() / int64(time.Microsecond))
+	var header [20]byte
+	order.PutUint32(header[0:], 0) // interface id
+	order.PutUint32(header[4:], uint32(micros>>32))
+	order.PutUint32(header[8:], uint32(micros))
+	order.PutUint32(header[12:], uint32(len(packet)))
+	order.PutUint32(header[16:], uint32(len(packet)))
+	return w.writeBlock(blockEnhancedPacket, header[:], packet)
+}
+
+// writeBlock write block type, total length, body and total length again in one write, body is padded to 4 bytes.
+func (w *Writer) writeBlock(blockType uint32, body ...[]byte) error {
+	block := append(w.buff[:0], 0, 0, 0, 0, 0, 0, 0, 0)
+	for _, b := range body {
+		block = append(block, b...)
+	}
+	block = pad(block)
+	total := uint32(len(block) + 4)
+	order.PutUint32(block, blockType)
+	order.PutUint32(block[4:], total)
+	block = append(block, 0, 0, 0, 0)
+	order.PutUint32(block[total-4:], total)
+	w.buff = block
+
+	n, err := w.w.Write(block)
+	w.size += int64(n)
+	return err
+}
+
+// appendOption append option padded to 4 bytes, empty option is skipped except end of options.
+func appendOption(options []byte, code uint16, value string) []byte {
+	if value == "" && code != optionEnd {
+		return options
+	}
+	var header [4]byte
+	order.PutUint16(header[:], code)
+	order.PutUint16(header[2:], uint16(len(value)))
+	options = append(options, header[:]...)
+	options = append(options, value...)
+	return pad(options)
+}
+
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// checksum add data to one's complement sum, the result is folded to 16 bits.
+func checksum(sum uint32, data []byte) uint16 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return uint16(sum)
+}
@@ -0,0 +1,118 @@
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+type block struct {
+	blockType uint32
+	body      []byte
+}
+
+// readBlocks split file to blocks and check leading and trailing total lengths.
+func readBlocks(t *testing.T, data []byte) []block {
+	var blocks []block
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("truncated block: % x", data)
+		}
+		total := int(order.Uint32(data[4:]))
+		if total%4 != 0 || total > len(data) || int(order.Uint32(data[total-4:])) != total {
+			t.Fatalf("bad block length %d", total)
+		}
+		blocks = append(blocks, block{order.Uint32(data), data[8 : total-4]})
+		data = data[total:]
+	}
+	return blocks
+}
+
+func TestStream(t *testing.T) {
+	for _, test := range []struct {
+		client, server string
+	}{
+		{"192.0.2.1:50000", "198.51.100.1:443"},
+		{"[2001:db8::1]:50000", "[2001:db8::2]:443"},
+		{"[::ffff:192.0.2.1]:50000", "198.51.100.1:443"},
+	} {
+		client, _ := net.ResolveTCPAddr("tcp", test.client)
+		server, _ := net.ResolveTCPAddr("tcp", test.server)
+		var buff bytes.Buffer
+		w, err := NewWriter(&buff, "xproxy", "session 1")
+		if nil != err {
+			t.Fatal(err)
+		}
+		stream, err := w.NewStream(client, server, time.Now())
+		if nil != err {
+			t.Fatal(err)
+		}
+		upload := bytes.Repeat([]byte("u"), 2*MaxSegmentSize+1)
+		stream.Write(true, upload, time.Now())
+		stream.Write(false, []byte("download"), time.Now())
+		stream.Close(time.Now())
+		stream.Write(true, []byte("after close"), time.Now())
+		if w.Size() != int64(buff.Len()) {
+			t.Fatalf("size %d, written %d", w.Size(), buff.Len())
+		}
+
+		blocks := readBlocks(t, buff.Bytes())
+		if blocks[0].blockType != blockSectionHeader || order.Uint32(blocks[0].body) != byteOrderMagic {
+			t.Fatalf("bad section header: %+v", blocks[0])
+		}
+		if blocks[1].blockType != blockInterface || order.Uint16(blocks[1].body) != linkTypeRaw {
+			t.Fatalf("bad interface: %+v", blocks[1])
+		}
+
+		// syn, syn-ack, ack, 3 upload segments, 1 download segment, fin, fin-ack, ack.
+		packets := blocks[2:]
+		if len(packets) != 10 {
+			t.Fatalf("%d packets, want 10", len(packets))
+		}
+		var payload [2][]byte
+		for i, p := range packets {
+			if p.blockType != blockEnhancedPacket {
+				t.Fatalf("packet %d: block type %#x", i, p.blockType)
+			}
+			packet := p.body[20 : 20+order.Uint32(p.body[12:])]
+			var tcp, pseudo []byte
+			switch packet[0] >> 4 {
+			case 4:
+				if checksum(0, packet[:20]) != 0xFFFF {
+					t.Fatalf("packet %d: bad ip checksum", i)
+				}
+				if int(binary.BigEndian.Uint16(packet[2:])) != len(packet) {
+					t.Fatalf("packet %d: bad ip length", i)
+				}
+				tcp, pseudo = packet[20:], packet[12:20]
+			case 6:
+				tcp, pseudo = packet[40:], packet[8:40]
+			default:
+				t.Fatalf("packet %d: ip version %d", i, packet[0]>>4)
+			}
+			sum := uint32(checksum(0, pseudo)) + 6 + uint32(len(tcp))
+			if checksum(sum, tcp) != 0xFFFF {
+				t.Fatalf("packet %d: bad tcp checksum", i)
+			}
+			side := 0
+			if binary.BigEndian.Uint16(tcp) == uint16(server.Port) {
+				side = 1
+			}
+			payload[side] = append(payload[side], tcp[20:]...)
+		}
+		if !bytes.Equal(payload[0], upload) || string(payload[1]) != "download" {
+			t.Fatalf("payload %d bytes up, %q down", len(payload[0]), payload[1])
+		}
+	}
+}
+
+func TestStreamAddressFamily(t *testing.T) {
+	w, _ := NewWriter(&bytes.Buffer{}, "", "")
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}
+	server := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 2}
+	if _, err := w.NewStream(client, server, time.Now()); err != ErrAddressFamily {
+		t.Fatalf("got %v, want %v", err, ErrAddressFamily)
+	}
+}
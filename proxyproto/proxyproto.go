@@ -0,0 +1,256 @@
+// Package proxyproto read and write HAProxy PROXY protocol v1 and v2 headers, which carry the original client
+// address of a tcp connection through load balancers and proxies.
+// See: https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNoHeader      = errors.New("proxyproto: no PROXY protocol header")
+	ErrInvalidHeader = errors.New("proxyproto: invalid PROXY protocol header")
+	ErrVersion       = errors.New("proxyproto: unknown PROXY protocol version")
+)
+
+const (
+	Version1 = 1 // human readable
+	Version2 = 2 // binary
+
+	// v1 header is a single line, not longer than 107 bytes with CRLF.
+	v1Prefix    = "PROXY "
+	v1MaxLength = 107
+
+	// v2 header is 16 bytes and addresses.
+	v2HeaderLength = 16
+	v2CommandLocal = 0x0
+	v2CommandProxy = 0x1
+	v2FamilyUnspec = 0x0
+	v2FamilyInet   = 0x1
+	v2FamilyInet6  = 0x2
+	v2FamilyUnix   = 0x3
+	v2AddrLength4  = 12 // source and destination ip and port
+	v2AddrLength6  = 36
+)
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Header is the PROXY protocol header in front of connection stream.
+type Header struct {
+	Version int
+	// Local connection is made by the proxy itself, e.g. health check, addresses are nil.
+	// it's v2 LOCAL command, v1 UNKNOWN protocol, or unix socket and unspecified families which carry no ip.
+	Local       bool
+	Source      *net.TCPAddr // original client address
+	Destination *net.TCPAddr // address the client connected to
+}
+
+// Read read header from r, ErrNoHeader is returned without consuming any byte if stream doesn't start with header.
+func Read(r *bufio.Reader) (*Header, error) {
+	first, err := r.Peek(1)
+	if nil != err {
+		return nil, err
+	}
+	switch first[0] {
+	case v1Prefix[0]:
+		return readV1(r)
+	case v2Signature[0]:
+		return readV2(r)
+	}
+	return nil, ErrNoHeader
+}
+
+// Bytes encode header, Version1 is used if version is not set.
+func (h *Header) Bytes() ([]byte, error) {
+	switch h.Version {
+	case 0, Version1:
+		return h.bytesV1()
+	case Version2:
+		return h.bytesV2()
+	}
+	return nil, ErrVersion
+}
+
+// WriteTo write encoded header to w by one write.
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.Bytes()
+	if nil != err {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
+
+// help func ===========================================================================================================
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	prefix, err := r.Peek(len(v1Prefix))
+	if nil != err {
+		return nil, err
+	}
+	if string(prefix) != v1Prefix {
+		return nil, ErrNoHeader
+	}
+
+	var line []byte
+	for len(line) < v1MaxLength {
+		b, err := r.ReadByte()
+		if nil != err {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: Version1}
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		h.Local = true
+		return h, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+	if h.Source, err = parseV1Addr(fields[2], fields[4], fields[1] == "TCP4"); nil != err {
+		return nil, err
+	}
+	if h.Destination, err = parseV1Addr(fields[3], fields[5], fields[1] == "TCP4"); nil != err {
+		return nil, err
+	}
+	return h, nil
+}
+
+func parseV1Addr(host, port string, ipv4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if nil == ip || strings.Contains(host, ":") == ipv4 {
+		return nil, ErrInvalidHeader
+	}
+	// leading zeros are not allowed.
+	p, err := strconv.ParseUint(port, 10, 16)
+	if nil != err || (len(port) > 1 && port[0] == '0') {
+		return nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	head, err := r.Peek(v2HeaderLength)
+	n := len(head)
+	if n > len(v2Signature) {
+		n = len(v2Signature)
+	}
+	if !bytes.Equal(head[:n], v2Signature[:n]) {
+		return nil, ErrNoHeader
+	}
+	if nil != err {
+		return nil, err
+	}
+
+	verCmd, family := head[12], head[13]
+	length := int(binary.BigEndian.Uint16(head[14:]))
+	if verCmd>>4 != Version2 {
+		return nil, ErrVersion
+	}
+	command := verCmd & 0x0F
+	if command != v2CommandLocal && command != v2CommandProxy {
+		return nil, ErrInvalidHeader
+	}
+	if _, err := r.Discard(v2HeaderLength); nil != err {
+		return nil, err
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); nil != err {
+		return nil, err
+	}
+
+	h := &Header{Version: Version2}
+	if command == v2CommandLocal {
+		h.Local = true
+		return h, nil
+	}
+	// transport (stream or datagram) is ignored, tlvs after addresses are skipped.
+	switch family >> 4 {
+	case v2FamilyInet:
+		if length < v2AddrLength4 {
+			return nil, ErrInvalidHeader
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:]))}
+	case v2FamilyInet6:
+		if length < v2AddrLength6 {
+			return nil, ErrInvalidHeader
+		}
+		h.Source = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}
+		h.Destination = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:]))}
+	case v2FamilyUnspec, v2FamilyUnix:
+		h.Local = true
+	default:
+		return nil, ErrInvalidHeader
+	}
+	return h, nil
+}
+
+func (h *Header) bytesV1() ([]byte, error) {
+	if h.Local || nil == h.Source || nil == h.Destination {
+		return []byte("PROXY UNKNOWN\r\n"), nil
+	}
+	ipv4 := h.ipv4()
+	protocol, src, dst := "TCP6", v1IPv6(h.Source.IP), v1IPv6(h.Destination.IP)
+	if ipv4 {
+		protocol, src, dst = "TCP4", h.Source.IP.To4().String(), h.Destination.IP.To4().String()
+	}
+	line := v1Prefix + protocol + " " + src + " " + dst + " " +
+		strconv.Itoa(h.Source.Port) + " " + strconv.Itoa(h.Destination.Port) + "\r\n"
+	return []byte(line), nil
+}
+
+// v1IPv6 format ip as ipv6 address, go formats ipv4-mapped address as ipv4.
+func v1IPv6(ip net.IP) string {
+	if ipv4 := ip.To4(); nil != ipv4 {
+		return "::ffff:" + ipv4.String()
+	}
+	return ip.String()
+}
+
+func (h *Header) bytesV2() ([]byte, error) {
+	b := make([]byte, v2HeaderLength, v2HeaderLength+v2AddrLength6)
+	copy(b, v2Signature)
+	if h.Local || nil == h.Source || nil == h.Destination {
+		b[12] = Version2<<4 | v2CommandLocal
+		return b, nil
+	}
+	ipv4 := h.ipv4()
+	b[12] = Version2<<4 | v2CommandProxy
+	if ipv4 {
+		b[13] = v2FamilyInet<<4 | 0x1 // stream
+		b = append(b, h.Source.IP.To4()...)
+		b = append(b, h.Destination.IP.To4()...)
+	} else {
+		b[13] = v2FamilyInet6<<4 | 0x1
+		b = append(b, h.Source.IP.To16()...)
+		b = append(b, h.Destination.IP.To16()...)
+	}
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[:], uint16(h.Source.Port))
+	binary.BigEndian.PutUint16(ports[2:], uint16(h.Destination.Port))
+	b = append(b, ports[:]...)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(b)-v2HeaderLength))
+	return b, nil
+}
+
+// ipv4 return true if both addresses are ipv4, otherwise ipv4 address is sent as ipv4-mapped ipv6 address.
+func (h *Header) ipv4() bool {
+	return nil != h.Source.IP.To4() && nil != h.Destination.IP.To4()
+}
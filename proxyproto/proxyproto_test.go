@@ -0,0 +1,133 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	addrs := [][2]*net.TCPAddr{
+		{{IP: net.ParseIP("192.0.2.1"), Port: 56324}, {IP: net.ParseIP("198.51.100.2"), Port: 443}},
+		{{IP: net.ParseIP("2001:db8::1"), Port: 1}, {IP: net.ParseIP("2001:db8::2"), Port: 65535}},
+	}
+	for _, version := range []int{Version1, Version2} {
+		for _, addr := range addrs {
+			h := &Header{Version: version, Source: addr[0], Destination: addr[1]}
+			var buff bytes.Buffer
+			if _, err := h.WriteTo(&buff); nil != err {
+				t.Fatal(err)
+			}
+			buff.WriteString("payload")
+
+			r := bufio.NewReader(&buff)
+			got, err := Read(r)
+			if nil != err {
+				t.Fatalf("v%d %v: %v", version, addr, err)
+			}
+			if got.Version != version || got.Local || got.Source.String() != addr[0].String() || got.Destination.String() != addr[1].String() {
+				t.Fatalf("v%d: got %+v, want %v", version, got, addr)
+			}
+			if rest, _ := ioutil.ReadAll(r); string(rest) != "payload" {
+				t.Fatalf("v%d: stream after header %q", version, rest)
+			}
+		}
+
+		local, err := (&Header{Version: version, Local: true}).Bytes()
+		if nil != err {
+			t.Fatal(err)
+		}
+		if got, err := Read(bufio.NewReader(bytes.NewReader(local))); nil != err || !got.Local || nil != got.Source {
+			t.Fatalf("v%d local: got %+v, %v", version, got, err)
+		}
+	}
+
+	// mixed families are sent as ipv6.
+	mixed, _ := (&Header{Source: addrs[0][0], Destination: addrs[1][1]}).Bytes()
+	if string(mixed) != "PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 65535\r\n" {
+		t.Fatalf("mixed families: %q", mixed)
+	}
+}
+
+func TestReadV1(t *testing.T) {
+	tests := []struct {
+		line string
+		src  string
+		err  error
+	}{
+		{"PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n", "192.0.2.1:56324", nil},
+		{"PROXY TCP6 ::ffff:192.0.2.1 2001:db8::2 56324 443\r\n", "192.0.2.1:56324", nil},
+		{"PROXY UNKNOWN ffff:f...f:ffff ffff:f...f:ffff 65535 65535\r\n", "", nil},
+		{"PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\n", "", ErrInvalidHeader},
+		{"PROXY TCP4 2001:db8::1 198.51.100.2 56324 443\r\n", "", ErrInvalidHeader},
+		{"PROXY TCP4 192.0.2.1 198.51.100.2 056324 443\r\n", "", ErrInvalidHeader},
+		{"PROXY TCP4 192.0.2.1 198.51.100.2 65536 443\r\n", "", ErrInvalidHeader},
+		{"PROXY UDP4 192.0.2.1 198.51.100.2 56324 443\r\n", "", ErrInvalidHeader},
+		{"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n", "", ErrInvalidHeader},
+		{"PROXY TCP4 192.0.2.1", "", io.EOF},
+	}
+	for _, test := range tests {
+		h, err := Read(bufio.NewReader(strings.NewReader(test.line)))
+		if err != test.err {
+			t.Errorf("%q: got %v, want %v", test.line, err, test.err)
+			continue
+		}
+		if nil == err && test.src == "" && !h.Local {
+			t.Errorf("%q: not local", test.line)
+		}
+		if nil == err && test.src != "" && h.Source.String() != test.src {
+			t.Errorf("%q: source %v, want %s", test.line, h.Source, test.src)
+		}
+	}
+}
+
+func TestReadV2(t *testing.T) {
+	// ipv4 with a tlv (alpn "h2") after addresses.
+	header := append([]byte("\r\n\r\n\x00\r\nQUIT\n"), 0x21, 0x11, 0x00, 0x11,
+		192, 0, 2, 1, 198, 51, 100, 2, 0xdc, 0x04, 0x01, 0xbb,
+		0x01, 0x00, 0x02, 'h', '2')
+	r := bufio.NewReader(bytes.NewReader(append(header, "payload"...)))
+	h, err := Read(r)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if h.Source.String() != "192.0.2.1:56324" || h.Destination.String() != "198.51.100.2:443" {
+		t.Fatalf("got %v -> %v", h.Source, h.Destination)
+	}
+	if rest, _ := ioutil.ReadAll(r); string(rest) != "payload" {
+		t.Fatalf("stream after header %q", rest)
+	}
+
+	invalid := func(b ...byte) []byte { return append([]byte("\r\n\r\n\x00\r\nQUIT\n"), b...) }
+	tests := []struct {
+		data []byte
+		err  error
+	}{
+		{invalid(0x11, 0x11, 0x00, 0x0c), ErrVersion},
+		{invalid(0x22, 0x11, 0x00, 0x0c), ErrInvalidHeader},
+		{invalid(0x21, 0x11, 0x00, 0x04, 1, 2, 3, 4), ErrInvalidHeader},
+		{invalid(0x21, 0x11, 0x00, 0x0c, 1, 2), io.ErrUnexpectedEOF},
+		{invalid(0x21, 0x31, 0x00, 0x00), nil}, // unix socket addresses are ignored
+	}
+	for i, test := range tests {
+		if _, err := Read(bufio.NewReader(bytes.NewReader(test.data))); err != test.err {
+			t.Errorf("%d: got %v, want %v", i, err, test.err)
+		}
+	}
+}
+
+func TestNoHeader(t *testing.T) {
+	for _, data := range []string{"\x05\x01\x00", "GET / HTTP/1.1\r\n", "POST / HTTP/1.1\r\n", "\r\n\r\nabc"} {
+		r := bufio.NewReader(strings.NewReader(data))
+		if _, err := Read(r); err != ErrNoHeader {
+			t.Errorf("%q: got %v, want %v", data, err, ErrNoHeader)
+		}
+		if rest, _ := ioutil.ReadAll(r); string(rest) != data {
+			t.Errorf("%q: consumed, rest %q", data, rest)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package socks5
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// default admin listener settings, bound to localhost so it's not exposed by default.
+const (
+	DefaultAdminAddr = "127.0.0.1:8091"
+	DefaultPACPath   = "/proxy.pac"
+)
+
+// AdminServer is the http listener for management, it serves PAC file generated from server routing rules,
+// and the REST API for live sessions if Token is set.
+type AdminServer struct {
+	Addr     string
+	PACPath  string // empty means PAC file disabled
+	PACProxy string // proxy address written in PAC file, default is server tcp address, its host is the requested one when listening on all interfaces
+
+	Token  string       // bearer token of admin api, it's not the socks password, empty means api disabled
+	Reload func() error // called by reload api, default reloads server routing rules
+
+	server *Server
+	mux    *http.ServeMux
+	mu     sync.Mutex
+	http   *http.Server
+}
+
+func NewAdminServer(s *Server, addr string) *AdminServer {
+	if addr == "" {
+		addr = DefaultAdminAddr
+	}
+	a := &AdminServer{
+		Addr:    addr,
+		PACPath: DefaultPACPath,
+		server:  s,
+		mux:     http.NewServeMux(),
+	}
+	// handlers are registered once, they check PACPath and Token of every request, so Run can be called again.
+	a.mux.HandleFunc("/", a.servePAC)
+	a.mux.Handle(AdminAPIPrefix, a.authorize(http.HandlerFunc(a.serveAPI)))
+	return a
+}
+
+// Run start admin http listener, it blocks until listener closed.
+func (a *AdminServer) Run() error {
+	a.mu.Lock()
+	a.http = &http.Server{Addr: a.Addr, Handler: a.mux}
+	server := a.http
+	a.mu.Unlock()
+
+	log.Printf("admin server listen %s", a.Addr)
+	return server.ListenAndServe()
+}
+
+func (a *AdminServer) Stop() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if nil == a.http {
+		return nil
+	}
+	return a.http.Close()
+}
+
+// servePAC generate PAC file every request, so it always matches reloaded rules.
+func (a *AdminServer) servePAC(w http.ResponseWriter, r *http.Request) {
+	if a.PACPath == "" || r.URL.Path != a.PACPath {
+		http.NotFound(w, r)
+		return
+	}
+
+	proxyAddr := a.pacProxyAddr(r)
+	if proxyAddr == "" {
+		http.Error(w, "proxy address unknown, PACProxy is required", http.StatusInternalServerError)
+		return
+	}
+
+	var rules *RuleSet
+	if nil != a.server.Router {
+		rules = a.server.Router.Rules()
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Write([]byte(GeneratePAC(rules, proxyAddr)))
+}
+
+// pacProxyAddr return proxy address written in PAC file, server listening on all interfaces has no address for clients,
+// so host of the PAC request is used, it's the address client reaches this machine by.
+func (a *AdminServer) pacProxyAddr(r *http.Request) string {
+	if a.PACProxy != "" {
+		return a.PACProxy
+	}
+
+	addr, _ := a.server.Addrs()
+	if nil != addr.IP && !addr.IP.IsUnspecified() {
+		return addr.String()
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); nil == err {
+		host = h
+	}
+	if host == "" {
+		return ""
+	}
+	return net.JoinHostPort(host, strconv.Itoa(addr.Port))
+}
@@ -0,0 +1,226 @@
+package socks5
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNothingToReload = errors.New("nothing to reload")
+)
+
+// Admin REST API, all requests need header "Authorization: Bearer <token>".
+//
+//	GET    /api/sessions                 list running sessions, "?user=name" filters by username
+//	GET    /api/sessions/{id}            session detail
+//	DELETE /api/sessions/{id}            kill session
+//	DELETE /api/users/{name}/sessions    kill all sessions of user
+//	POST   /api/sessions/{id}/capture    start packet capture of relaying session
+//	DELETE /api/sessions/{id}/capture    stop packet capture of session
+//	GET    /api/capture                  capture filters
+//	PUT    /api/capture                  replace capture filters, matched by sessions starting relay later
+//	POST   /api/reload                   reload config
+//	GET    /api/stats                    server counters and upstream group health
+const AdminAPIPrefix = "/api/"
+
+// authorize compare bearer token in constant time, so it can't be guessed by response time.
+func (a *AdminServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// api is disabled without token.
+		if a.Token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		authorization := r.Header.Get("Authorization")
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if token == authorization || subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			log.Printf("admin api: unauthorized request from %s", r.RemoteAddr)
+			writeJSONError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *AdminServer) serveAPI(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, AdminAPIPrefix), "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "sessions" && r.Method == http.MethodGet:
+		a.listSessions(w, r)
+	case len(parts) == 2 && parts[0] == "sessions":
+		id, err := strconv.ParseUint(parts[1], 10, 64)
+		if nil != err {
+			writeJSONError(w, http.StatusBadRequest, "invalid session id")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			a.getSession(w, id)
+		case http.MethodDelete:
+			a.killSession(w, id)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	case len(parts) == 3 && parts[0] == "sessions" && parts[2] == "capture":
+		id, err := strconv.ParseUint(parts[1], 10, 64)
+		if nil != err {
+			writeJSONError(w, http.StatusBadRequest, "invalid session id")
+			return
+		}
+		switch r.Method {
+		case http.MethodPost:
+			a.startCapture(w, id)
+		case http.MethodDelete:
+			a.stopCapture(w, id)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	case len(parts) == 1 && parts[0] == "capture":
+		a.captureFilters(w, r)
+	case len(parts) == 3 && parts[0] == "users" && parts[2] == "sessions" && r.Method == http.MethodDelete:
+		a.killUserSessions(w, parts[1])
+	case len(parts) == 1 && parts[0] == "reload" && r.Method == http.MethodPost:
+		a.reload(w)
+	case len(parts) == 1 && parts[0] == "stats" && r.Method == http.MethodGet:
+		a.stats(w)
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (a *AdminServer) listSessions(w http.ResponseWriter, r *http.Request) {
+	sessions := a.server.Sessions()
+	if user := r.URL.Query().Get("user"); user != "" {
+		filtered := sessions[:0]
+		for _, session := range sessions {
+			if session.Username == user {
+				filtered = append(filtered, session)
+			}
+		}
+		sessions = filtered
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (a *AdminServer) getSession(w http.ResponseWriter, id uint64) {
+	session, ok := a.server.SessionInfo(id)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, session)
+}
+
+func (a *AdminServer) killSession(w http.ResponseWriter, id uint64) {
+	if !a.server.KillSession(id) {
+		writeJSONError(w, http.StatusNotFound, "session not found")
+		return
+	}
+	log.Printf("admin api: session %d killed", id)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"killed": 1})
+}
+
+func (a *AdminServer) killUserSessions(w http.ResponseWriter, username string) {
+	killed := a.server.KillUserSessions(username)
+	log.Printf("admin api: %d sessions of user %s killed", killed, username)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"killed": killed})
+}
+
+func (a *AdminServer) startCapture(w http.ResponseWriter, id uint64) {
+	path, err := a.server.StartCapture(id)
+	switch err {
+	case nil:
+		log.Printf("admin api: capture of session %d started", id)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"capture": path})
+	case ErrSessionNotFound, ErrCaptureDisabled:
+		writeJSONError(w, http.StatusNotFound, err.Error())
+	case ErrCaptureNotRelaying:
+		writeJSONError(w, http.StatusConflict, err.Error())
+	default:
+		log.Printf("admin api: start capture of session %d error: %v", id, err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func (a *AdminServer) stopCapture(w http.ResponseWriter, id uint64) {
+	if !a.server.StopCapture(id) {
+		writeJSONError(w, http.StatusNotFound, "session not capturing")
+		return
+	}
+	log.Printf("admin api: capture of session %d stopped", id)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"stopped": true})
+}
+
+func (a *AdminServer) captureFilters(w http.ResponseWriter, r *http.Request) {
+	if nil == a.server.Capture {
+		writeJSONError(w, http.StatusNotFound, ErrCaptureDisabled.Error())
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.server.Capture.Filters())
+	case http.MethodPut:
+		var filters CaptureFilters
+		if err := json.NewDecoder(r.Body).Decode(&filters); nil != err {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		a.server.Capture.SetFilters(filters)
+		log.Printf("admin api: capture filters replaced: %+v", filters)
+		writeJSON(w, http.StatusOK, filters)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *AdminServer) reload(w http.ResponseWriter) {
+	reload := a.Reload
+	if nil == reload {
+		reload = func() error {
+			if nil == a.server.Router {
+				return ErrNothingToReload
+			}
+			return a.server.Router.Reload()
+		}
+	}
+	if err := reload(); nil != err {
+		log.Printf("admin api: reload error: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("admin api: config reloaded")
+	writeJSON(w, http.StatusOK, map[string]interface{}{"reloaded": true})
+}
+
+func (a *AdminServer) stats(w http.ResponseWriter) {
+	stats := map[string]interface{}{
+		"metrics":  a.server.Metrics.Snapshot(),
+		"sessions": len(a.server.Sessions()),
+	}
+	if nil != a.server.Router && len(a.server.Router.Rules().Groups) > 0 {
+		groups := make(map[string][]UpstreamStatus)
+		for name, group := range a.server.Router.Rules().Groups {
+			groups[name] = group.Status()
+		}
+		stats["upstream_groups"] = groups
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// help func ===========================================================================================================
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
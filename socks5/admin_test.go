@@ -0,0 +1,83 @@
+package socks5
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getPAC(t *testing.T, a *AdminServer, host string) (int, string) {
+	r := httptest.NewRequest(http.MethodGet, "http://"+host+DefaultPACPath, nil)
+	w := httptest.NewRecorder()
+	a.mux.ServeHTTP(w, r)
+	body, _ := ioutil.ReadAll(w.Result().Body)
+	return w.Code, string(body)
+}
+
+func TestAdminPAC(t *testing.T) {
+	s := &Server{TCPAddr: &net.TCPAddr{IP: net.IPv4zero, Port: 1080}}
+	a := NewAdminServer(s, "")
+
+	// listening on all interfaces, clients reach proxy by the host they requested.
+	if code, pac := getPAC(t, a, "proxy.example.com:8091"); code != http.StatusOK ||
+		!strings.Contains(pac, "SOCKS5 proxy.example.com:1080") || strings.Contains(pac, "0.0.0.0") ||
+		strings.Contains(pac, "SOCKS ") {
+		t.Errorf("%d, PAC:\n%s", code, pac)
+	}
+	if _, pac := getPAC(t, a, "[2001:db8::1]:8091"); !strings.Contains(pac, "SOCKS5 [2001:db8::1]:1080") {
+		t.Errorf("ipv6 host, PAC:\n%s", pac)
+	}
+
+	a.PACProxy = "203.0.113.1:1080"
+	if _, pac := getPAC(t, a, "proxy.example.com:8091"); !strings.Contains(pac, "SOCKS5 203.0.113.1:1080") {
+		t.Errorf("explicit proxy address, PAC:\n%s", pac)
+	}
+	a.PACProxy = ""
+	s.TCPAddr = &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1080}
+	if _, pac := getPAC(t, a, "proxy.example.com:8091"); !strings.Contains(pac, "SOCKS5 192.0.2.1:1080") {
+		t.Errorf("specific listen address, PAC:\n%s", pac)
+	}
+
+	// disabled PAC and api are not found.
+	a.PACPath = ""
+	if code, _ := getPAC(t, a, "proxy.example.com:8091"); code != http.StatusNotFound {
+		t.Errorf("disabled PAC: %d", code)
+	}
+	w := httptest.NewRecorder()
+	a.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, AdminAPIPrefix+"sessions", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("api without token: %d", w.Code)
+	}
+}
+
+func TestAdminRunTwice(t *testing.T) {
+	a := NewAdminServer(&Server{TCPAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080}}, "127.0.0.1:0")
+	a.Token = "token"
+	var last *http.Server
+	for i := 0; i < 2; i++ {
+		done := make(chan error, 1)
+		go func() { done <- a.Run() }()
+		// stop after the listener of this run is created.
+		for started := false; !started; time.Sleep(time.Millisecond) {
+			a.mu.Lock()
+			started = nil != a.http && a.http != last
+			a.mu.Unlock()
+		}
+		a.mu.Lock()
+		last = a.http
+		a.mu.Unlock()
+		a.Stop()
+		select {
+		case err := <-done:
+			if err != http.ErrServerClosed {
+				t.Fatalf("run %d: %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("run %d not stopped", i)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package socks5
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+)
+
+var (
+	ErrInvalidAuthMethod = errors.New("invalid authentication method")
+)
+
+// ServerAuthenticator is server side of one authentication method, it runs the sub-negotiation after method selected.
+// the returned connection replaces the original one, methods with per-message protection wrap it, others return it
+// directly. username is the identity of client, it's used by limits, quota and session listing, it may carry the
+// attempted identity when authentication failed.
+type ServerAuthenticator interface {
+	Method() byte
+	Authenticate(conn net.Conn) (authConn net.Conn, username string, err error)
+}
+
+// ClientAuthenticator is client side of one authentication method.
+type ClientAuthenticator interface {
+	Method() byte
+	Authenticate(conn net.Conn) (authConn net.Conn, err error)
+}
+
+// RegisterAuthenticator add or replace server side method, private methods use 0x80 to 0xFE.
+// the method is offered only if it's also listed in AuthMethods.
+func (s *Server) RegisterAuthenticator(authenticator ServerAuthenticator) error {
+	if authenticator.Method() == MethodNoAcceptableMethods {
+		return ErrInvalidAuthMethod
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.authenticators[authenticator.Method()] = authenticator
+	return nil
+}
+
+// selectAuthenticator choose the first method in server preference order which client offered.
+func (s *Server) selectAuthenticator(offered []byte) ServerAuthenticator {
+	preference := s.AuthMethods
+	if len(preference) == 0 {
+		preference = []byte{s.AuthValidateMethod}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, method := range preference {
+		authenticator, ok := s.authenticators[method]
+		if !ok {
+			continue
+		}
+		for _, m := range offered {
+			if m == method {
+				return authenticator
+			}
+		}
+	}
+	return nil
+}
+
+// help func ===========================================================================================================
+
+// 1. no authentication required
+type noAuthAuthenticator struct{}
+
+func (noAuthAuthenticator) Method() byte {
+	return MethodNoAuthRequired
+}
+
+func (noAuthAuthenticator) Authenticate(conn net.Conn) (net.Conn, string, error) {
+	return conn, "", nil
+}
+
+// 2. username/password of RFC 1929, server side validates against Server.Username and Server.Password.
+type serverUsernamePasswordAuthenticator struct {
+	server *Server
+}
+
+func (a *serverUsernamePasswordAuthenticator) Method() byte {
+	return MethodUsernamePassword
+}
+
+func (a *serverUsernamePasswordAuthenticator) Authenticate(conn net.Conn) (net.Conn, string, error) {
+	s := a.server
+	request, err := ParseUnamePasswdNegotiationRequest(conn)
+	if nil != err {
+		return nil, "", err
+	}
+	ip, username := remoteIP(conn), string(request.Uname)
+
+	// banned or backing off client doesn't get a chance to try password.
+	if nil != s.lockout && s.lockout.banned(ip, username) {
+		log.Printf("auth lockout: reject %s, user: %s", ip, username)
+		NewUserPassNegotiationReply(UsernamePasswordStatusFail).WriteTo(conn)
+		return nil, username, ErrAuthBanned
+	}
+
+	// sample validate
+	if !strings.EqualFold(s.Username, username) || !strings.EqualFold(s.Password, string(request.Password)) {
+		if Debug {
+			log.Printf("server receive uname: '%s', passwd: '%s' \n", username, string(request.Password))
+			log.Printf("server set uname: '%s', passwd: '%s' \n", s.Username, s.Password)
+		}
+		if nil != s.lockout {
+			s.lockout.failure(ip, username, strings.EqualFold(s.Username, username))
+		}
+		// failure terminates the session, client must not continue to send request.
+		NewUserPassNegotiationReply(UsernamePasswordStatusFail).WriteTo(conn)
+		return nil, username, ErrUnameOrPasswdError
+	}
+	if nil != s.lockout {
+		s.lockout.success(username)
+	}
+	successReply := NewUserPassNegotiationReply(UsernamePasswordStatusSuccess)
+	if _, err := successReply.WriteTo(conn); nil != err {
+		return nil, "", err
+	}
+	return conn, username, nil
+}
+
+type clientNoAuthAuthenticator struct{}
+
+func (clientNoAuthAuthenticator) Method() byte {
+	return MethodNoAuthRequired
+}
+
+func (clientNoAuthAuthenticator) Authenticate(conn net.Conn) (net.Conn, error) {
+	return conn, nil
+}
+
+type clientUsernamePasswordAuthenticator struct {
+	username string
+	password string
+}
+
+func (a *clientUsernamePasswordAuthenticator) Method() byte {
+	return MethodUsernamePassword
+}
+
+func (a *clientUsernamePasswordAuthenticator) Authenticate(conn net.Conn) (net.Conn, error) {
+	negotiationAuthRequest, err := NewUsernamePasswordNegotiationRequest(a.username, a.password)
+	if nil != err {
+		return nil, err
+	}
+	if _, err := negotiationAuthRequest.WriteTo(conn); nil != err {
+		return nil, err
+	}
+	authReply, err := NewUsernamePasswordNegotiationReply(conn)
+	if nil != err {
+		return nil, err
+	}
+	if authReply.Status != UsernamePasswordStatusSuccess {
+		return nil, ErrUnameOrPasswdError
+	}
+	return conn, nil
+}
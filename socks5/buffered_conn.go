@@ -0,0 +1,24 @@
+package socks5
+
+import (
+	"bufio"
+	"net"
+)
+
+// handshakeBufferSize is larger than any handshake message, and smaller than relay buffer, so relay reads bypass it.
+const handshakeBufferSize = 1024
+
+// bufferedConn read through buffer, so handshake messages pipelined by client are consumed by one syscall.
+// after buffered bytes drained, reads not smaller than buffer go to connection directly.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func newBufferedConn(conn net.Conn) *bufferedConn {
+	return &bufferedConn{Conn: conn, reader: bufio.NewReaderSize(conn, handshakeBufferSize)}
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
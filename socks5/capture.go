@@ -0,0 +1,281 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"xproxy/pcapng"
+)
+
+var (
+	ErrCaptureDisabled    = errors.New("packet capture disabled")
+	ErrCaptureNotRelaying = errors.New("session is not relaying")
+	ErrSessionNotFound    = errors.New("session not found")
+)
+
+const DefaultCaptureMaxBytes = 64 * 1024 * 1024
+
+// Capture write relayed streams of matched sessions to pcapng files, one file per session. the client side and
+// destination side are written as two synthesized tcp connections. streams are captured after socks handshake,
+// udp is not captured. sessions are matched by username, destination or session id, or started by admin api.
+type Capture struct {
+	Dir          string   `json:"dir"`
+	Users        []string `json:"users,omitempty"`
+	Destinations []string `json:"destinations,omitempty"` // host, "host:port" or cidr, host also matches sniffed name
+	SessionIDs   []uint64 `json:"session_ids,omitempty"`
+	MaxBytes     int64    `json:"max_bytes,omitempty"` // size limit of one file, default is DefaultCaptureMaxBytes
+
+	mu sync.Mutex // filters can be replaced by admin api
+}
+
+// CaptureFilters is the matching part of capture config.
+type CaptureFilters struct {
+	Users        []string `json:"users"`
+	Destinations []string `json:"destinations"`
+	SessionIDs   []uint64 `json:"session_ids"`
+}
+
+// Filters return current filters.
+func (c *Capture) Filters() CaptureFilters {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CaptureFilters{Users: c.Users, Destinations: c.Destinations, SessionIDs: c.SessionIDs}
+}
+
+// SetFilters replace filters, they are matched by sessions starting relay later.
+func (c *Capture) SetFilters(filters CaptureFilters) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Users, c.Destinations, c.SessionIDs = filters.Users, filters.Destinations, filters.SessionIDs
+}
+
+// StartCapture start capturing relaying session by id, return the capture file path.
+func (s *Server) StartCapture(id uint64) (string, error) {
+	if nil == s.Capture {
+		return "", ErrCaptureDisabled
+	}
+	session := s.sessionByID(id)
+	if nil == session {
+		return "", ErrSessionNotFound
+	}
+
+	capture, err := s.startCapture(session)
+	if nil != err {
+		return "", err
+	}
+	return capture.path, nil
+}
+
+// StopCapture stop capturing session by id, return false if session not found or not capturing.
+func (s *Server) StopCapture(id uint64) bool {
+	session := s.sessionByID(id)
+	if nil == session {
+		return false
+	}
+	capture := session.loadCapture()
+	if nil == capture {
+		return false
+	}
+	capture.stop()
+	return true
+}
+
+// help func ===========================================================================================================
+
+// sessionCapture is the capture file of one session.
+type sessionCapture struct {
+	session *Session
+	path    string
+	file    *os.File
+	writer  *pcapng.Writer
+	client  *pcapng.Stream // client -> proxy
+	remote  *pcapng.Stream // proxy -> destination
+	max     int64
+
+	stopOnce sync.Once
+}
+
+// record write relayed bytes to both streams, fromClient is the direction of client -> destination.
+func (c *sessionCapture) record(fromClient bool, data []byte) {
+	now := time.Now()
+	c.client.Write(fromClient, data, now)
+	c.remote.Write(fromClient, data, now)
+	if c.writer.Size() >= c.max {
+		log.Printf("capture %s: size limit %d bytes reached", c.path, c.max)
+		c.stop()
+	}
+}
+
+func (c *sessionCapture) stop() {
+	c.stopOnce.Do(func() {
+		now := time.Now()
+		c.client.Close(now)
+		c.remote.Close(now)
+		if err := c.file.Close(); nil != err {
+			log.Printf("capture %s: %v", c.path, err)
+		}
+		c.session.capture.Store((*sessionCapture)(nil))
+	})
+}
+
+// captureConn record bytes read from client or destination connection.
+type captureConn struct {
+	net.Conn
+	session    *Session
+	fromClient bool
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		if capture := c.session.loadCapture(); nil != capture {
+			capture.record(c.fromClient, b[:n])
+		}
+	}
+	return n, err
+}
+
+// captureRelay wrap relay connections, so capture can be started at any time of relay.
+// session is captured at once if it matches filters.
+func (s *Server) captureRelay(session *Session, conn, remoteConn net.Conn) (net.Conn, net.Conn) {
+	s.mu.Lock()
+	session.remoteConn = remoteConn
+	s.mu.Unlock()
+
+	if s.Capture.match(session, s.sessionSniffedName(session)) {
+		if _, err := s.startCapture(session); nil != err {
+			log.Printf("session %d: start capture error: %v", session.ID, err)
+		}
+	}
+	return &captureConn{Conn: conn, session: session, fromClient: true},
+		&captureConn{Conn: remoteConn, session: session, fromClient: false}
+}
+
+// stopSessionCapture close capture file when session relay finished.
+func (s *Server) stopSessionCapture(session *Session) {
+	if capture := session.loadCapture(); nil != capture {
+		capture.stop()
+	}
+}
+
+func (s *Server) startCapture(session *Session) (*sessionCapture, error) {
+	s.mu.Lock()
+	remoteConn, username, request := session.remoteConn, session.Username, session.Request
+	sniffedName := session.SniffedName
+	s.mu.Unlock()
+	if nil == remoteConn {
+		return nil, ErrCaptureNotRelaying
+	}
+
+	// serialize starts, so a session never gets two files.
+	s.Capture.mu.Lock()
+	defer s.Capture.mu.Unlock()
+	if capture := session.loadCapture(); nil != capture {
+		return capture, nil
+	}
+
+	if err := os.MkdirAll(s.Capture.Dir, 0700); nil != err {
+		return nil, err
+	}
+	start := time.Now()
+	path := filepath.Join(s.Capture.Dir, fmt.Sprintf("session-%d-%s.pcapng", session.ID, start.Format("20060102-150405")))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if nil != err {
+		return nil, err
+	}
+
+	destination := ""
+	if nil != request {
+		destination = request.Address()
+	}
+	comment := fmt.Sprintf("session %d, user '%s', client %s, destination %s", session.ID, username, session.ClientAddr, destination)
+	if sniffedName != "" {
+		comment += ", sniffed " + sniffedName
+	}
+	capture := &sessionCapture{session: session, path: path, file: file, max: s.Capture.MaxBytes}
+	if capture.max <= 0 {
+		capture.max = DefaultCaptureMaxBytes
+	}
+	if capture.writer, err = pcapng.NewWriter(file, "xproxy", comment); nil == err {
+		capture.client, err = capture.writer.NewStream(tcpAddr(session.conn.RemoteAddr()), tcpAddr(session.conn.LocalAddr()), start)
+	}
+	if nil == err {
+		capture.remote, err = capture.writer.NewStream(tcpAddr(remoteConn.LocalAddr()), tcpAddr(remoteConn.RemoteAddr()), start)
+	}
+	if nil != err {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+
+	session.capture.Store(capture)
+	log.Printf("session %d: capture to %s", session.ID, path)
+	return capture, nil
+}
+
+func (s *Server) sessionSniffedName(session *Session) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return session.SniffedName
+}
+
+// match session with filters, sniffedName can be empty.
+func (c *Capture) match(session *Session, sniffedName string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, id := range c.SessionIDs {
+		if id == session.ID {
+			return true
+		}
+	}
+	if session.Username != "" {
+		for _, user := range c.Users {
+			if user == session.Username {
+				return true
+			}
+		}
+	}
+	if nil == session.Request || len(c.Destinations) == 0 {
+		return false
+	}
+
+	addr := session.Request.Address()
+	host, _, _ := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	for _, dst := range c.Destinations {
+		if strings.EqualFold(dst, addr) || strings.EqualFold(dst, host) || (sniffedName != "" && strings.EqualFold(dst, sniffedName)) {
+			return true
+		}
+		if _, ipNet, err := net.ParseCIDR(dst); nil == err && nil != ip && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// tcpAddr convert address of any transport, address without ip is synthesized as unspecified address.
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp
+	}
+	tcp := &net.TCPAddr{IP: net.IPv4zero}
+	if nil == addr {
+		return tcp
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if nil != err {
+		return tcp
+	}
+	if ip := net.ParseIP(host); nil != ip {
+		tcp.IP = ip
+	}
+	tcp.Port, _ = strconv.Atoi(port)
+	return tcp
+}
@@ -1,20 +1,25 @@
 package socks5
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
-	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
+	"xproxy/mux"
+	"xproxy/socks5/codec"
+	"xproxy/trace"
 )
 
 var (
 	ErrNonSupportCurrentMethod               = errors.New("nonsupport current method")
-	ErrNonSupportCurrentSocksProtocolVersion = errors.New("nonsupport current socks protocol version")
-	ErrUnameOrPasswdTooLength                = errors.New("username or password too length")
-	ErrNonSupportCurrentUnamePasswdVersion   = errors.New("nonsupport current username/password version")
+	ErrNonSupportCurrentSocksProtocolVersion = codec.ErrSocksVersion
+	ErrUnameOrPasswdTooLength                = codec.ErrUnamePasswdLength
+	ErrNonSupportCurrentUnamePasswdVersion   = codec.ErrUnamePasswdVersion
 	ErrUnameOrPasswdError                    = errors.New("invalid username or password")
-	ErrBadReply                              = errors.New("bad reply")
+	ErrBadReply                              = codec.ErrBadReply
 	ErrRequestFail                           = errors.New("socks client request fail")
 )
 
@@ -22,13 +27,21 @@ type Client struct {
 	Username string
 	Password string
 
-	DstTCPAddr  *net.TCPAddr
-	DstTCPConn  *net.TCPConn
-	TCPDeadline int
-	TCPTimeout  int
+	DstTCPAddr *net.TCPAddr
+	DstTCPConn net.Conn
+	Dial       func(network, addr string) (net.Conn, error) // connect to proxy server, default is net.Dial
+	Tunnel     *Tunnel                                      // encrypt connection and udp packets, nil means plain
+
+	// offered methods in preference order, default is username/password if set, otherwise no authentication.
+	Authenticators []ClientAuthenticator
+	TCPDeadline    int
+	TCPTimeout     int
 
 	DstUDPAddr  *net.UDPAddr
 	UDPDeadline int
+
+	ctx     context.Context // dialing and handshake are aborted when ctx done, nil means never
+	unwatch func()          // stop watching ctx, nil if not watching
 }
 
 func NewClient(username, password, addr string, tcpTimeout, tcpDeadline, udpDeadline int) (*Client, error) {
@@ -55,69 +68,280 @@ func NewClient(username, password, addr string, tcpTimeout, tcpDeadline, udpDead
 	return client, nil
 }
 
-func (c *Client) Negotiation() error {
-	// step 1: prepare stage.
-	conn, err := net.Dial("tcp", c.DstTCPAddr.String())
+// ClientConfig is the socks proxy settings shared by client side modes, such as port forwarding and http bridge.
+type ClientConfig struct {
+	Username  string `json:"username,omitempty"`
+	Password  string `json:"password,omitempty"`
+	ProxyAddr string `json:"proxy_addr"`
+
+	TCPTimeout  int `json:"tcp_timeout,omitempty"`
+	TCPDeadline int `json:"tcp_deadline,omitempty"`
+	UDPDeadline int `json:"udp_deadline,omitempty"`
+
+	// multiplex proxied connections over Mux long-lived tcp connections, 0 means disabled.
+	// proxy server must be xproxy, it's not part of socks protocol.
+	Mux int `json:"mux,omitempty"`
+
+	// transport to proxy server: tcp (default), ws or wss, websocket needs xproxy server.
+	Transport          string `json:"transport,omitempty"`
+	WebSocketPath      string `json:"websocket_path,omitempty"`
+	TLSServerName      string `json:"tls_server_name,omitempty"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify,omitempty"`
+
+	// pre-shared-key encrypted tunnel, proxy server must be xproxy with the same cipher and key.
+	TunnelCipher string `json:"tunnel_cipher,omitempty"`
+	TunnelKey    string `json:"tunnel_key,omitempty"`
+
+	Authenticators []ClientAuthenticator `json:"-"` // private or extra authentication methods
+
+	// send method selection, credentials and CONNECT request in one flight, replies are verified by first read.
+	// it needs username/password or no authentication, and saves round trips on high latency links.
+	Optimistic bool `json:"optimistic,omitempty"`
+
+	muxOnce    sync.Once
+	muxPool    *muxPool
+	tunnelOnce sync.Once
+	tunnel     *Tunnel
+	tunnelErr  error
+}
+
+// Dial create a negotiated socks client, one client per proxied connection.
+func (cfg *ClientConfig) Dial() (*Client, error) {
+	return cfg.dial(context.Background())
+}
+
+// dial is Dial aborted when ctx done, client is still watching ctx when it returns, see finishHandshake.
+func (cfg *ClientConfig) dial(ctx context.Context) (*Client, error) {
+	client, err := cfg.newClient(ctx)
 	if nil != err {
-		return err
+		return nil, err
 	}
-	c.DstTCPConn = conn.(*net.TCPConn)
+	if err := client.Negotiation(); nil != err {
+		if ctxErr := client.finishHandshake(); nil != ctxErr {
+			err = ctxErr
+		}
+		if nil != client.DstTCPConn {
+			client.DstTCPConn.Close()
+		}
+		return nil, err
+	}
+	return client, nil
+}
 
-	if c.TCPTimeout != 0 {
-		c.DstTCPConn.SetKeepAlivePeriod(time.Duration(c.TCPTimeout) * time.Second)
+// newClient create a client with transport, tunnel and authentication settings, it doesn't connect.
+func (cfg *ClientConfig) newClient(ctx context.Context) (*Client, error) {
+	client, err := NewClient(cfg.Username, cfg.Password, cfg.ProxyAddr, cfg.TCPTimeout, cfg.TCPDeadline, cfg.UDPDeadline)
+	if nil != err {
+		return nil, err
+	}
+	client.ctx = ctx
+	client.Authenticators = cfg.Authenticators
+	if cfg.TunnelCipher != "" {
+		cfg.tunnelOnce.Do(func() {
+			cfg.tunnel, cfg.tunnelErr = NewTunnel(cfg.TunnelCipher, cfg.TunnelKey)
+		})
+		if nil != cfg.tunnelErr {
+			return nil, cfg.tunnelErr
+		}
+		client.Tunnel = cfg.tunnel
+	}
+	if cfg.Mux > 0 {
+		cfg.muxOnce.Do(func() {
+			cfg.muxPool = newMuxPool(cfg.Mux, cfg.dialTransport, cfg.tunnel)
+		})
+		client.Dial = cfg.muxPool.Dial
+	} else if cfg.Transport != "" && cfg.Transport != TransportTCP {
+		client.Dial = cfg.dialTransport
 	}
+	return client, nil
+}
 
-	if c.TCPDeadline != 0 {
-		if err := c.DstTCPConn.SetDeadline(time.Now().Add(time.Duration(c.TCPDeadline) * time.Second)); nil != err {
-			return err
+// Connect create a proxied connection to "host:port" address, domain is resolved by proxy server.
+func (cfg *ClientConfig) Connect(addr string) (net.Conn, error) {
+	return cfg.connect(addr, nil)
+}
+
+// ConnectContext is Connect aborted when ctx done, ctx doesn't affect the returned connection.
+func (cfg *ClientConfig) ConnectContext(ctx context.Context, addr string) (net.Conn, error) {
+	return cfg.connectContext(ctx, addr, nil)
+}
+
+// connect trace the hop as child of span, span can be nil.
+func (cfg *ClientConfig) connect(addr string, span *trace.Span) (net.Conn, error) {
+	return cfg.connectContext(context.Background(), addr, span)
+}
+
+func (cfg *ClientConfig) connectContext(ctx context.Context, addr string, span *trace.Span) (net.Conn, error) {
+	dialSpan := span.Child("socks.dial")
+	dialSpan.SetKind(trace.KindClient)
+	dialSpan.SetAttribute("net.peer.name", cfg.ProxyAddr)
+	dialSpan.SetAttribute("socks.destination", addr)
+	defer dialSpan.End()
+
+	if cfg.Optimistic {
+		optimisticSpan := dialSpan.Child("upstream.optimistic")
+		conn, err := cfg.connectOptimistic(ctx, addr)
+		optimisticSpan.SetError(err)
+		optimisticSpan.End()
+		dialSpan.SetError(err)
+		return conn, err
+	}
+
+	handshakeSpan := dialSpan.Child("upstream.negotiation")
+	client, err := cfg.dial(ctx)
+	handshakeSpan.SetError(err)
+	handshakeSpan.End()
+	if nil != err {
+		dialSpan.SetError(err)
+		return nil, err
+	}
+
+	connectSpan := dialSpan.Child("upstream.connect")
+	conn, err := client.Connect(addr)
+	if ctxErr := client.finishHandshake(); nil != ctxErr {
+		err = ctxErr
+	}
+	connectSpan.SetError(err)
+	connectSpan.End()
+	if nil != err {
+		dialSpan.SetError(err)
+		client.DstTCPConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialTransport connect to proxy server by configured transport.
+func (cfg *ClientConfig) dialTransport(network, addr string) (net.Conn, error) {
+	switch cfg.Transport {
+	case "", TransportTCP:
+		conn, err := net.Dial(network, addr)
+		if nil != err {
+			return nil, err
 		}
+		if tcpConn, ok := conn.(*net.TCPConn); ok && cfg.TCPTimeout != 0 {
+			tcpConn.SetKeepAlivePeriod(time.Duration(cfg.TCPTimeout) * time.Second)
+		}
+		return conn, nil
+	case TransportWebSocket, TransportWSS:
+		tlsConfig := &tls.Config{ServerName: cfg.TLSServerName, InsecureSkipVerify: cfg.InsecureSkipVerify}
+		timeout := time.Duration(cfg.TCPDeadline) * time.Second
+		return dialWebSocket(addr, cfg.Transport == TransportWSS, cfg.WebSocketPath, tlsConfig, timeout)
+	}
+	return nil, ErrUnknownTransport
+}
+
+func (c *Client) Negotiation() error {
+	// step 1: prepare stage.
+	if err := c.dialProxy(); nil != err {
+		return err
 	}
 
 	// step 2: first negotiation.
-	// tell proxy server, current used socks protocol version and next action.
-	method := MethodNoAcceptableMethods
-	if c.Username != "" && c.Password != "" {
-		method = MethodUsernamePassword
+	// tell proxy server, current used socks protocol version and offered methods.
+	authenticators := c.Authenticators
+	if len(authenticators) == 0 {
+		if c.Username != "" && c.Password != "" {
+			authenticators = []ClientAuthenticator{&clientUsernamePasswordAuthenticator{c.Username, c.Password}}
+		} else {
+			authenticators = []ClientAuthenticator{clientNoAuthAuthenticator{}}
+		}
+	}
+	methods := make([]byte, 0, len(authenticators))
+	for _, authenticator := range authenticators {
+		methods = append(methods, authenticator.Method())
 	}
 
-	negotiationRequest := NewNegotiationRequest([]byte{method})
-	if err := negotiationRequest.WriteTo(c.DstTCPConn); nil != err {
+	negotiationRequest := NewNegotiationRequest(methods)
+	if _, err := negotiationRequest.WriteTo(c.DstTCPConn); nil != err {
 		return err
 	}
 
 	// step 3: read proxy server reply.
-	// proxy server return expect socks protocol version and next action.
+	// proxy server return expect socks protocol version and selected method.
 	negotiationReply, err := ParseNegotiationReply(c.DstTCPConn)
 	if nil != err {
 		return err
 	}
 
-	// step 4: authorization validate
-	if negotiationReply.Method != method {
-		return ErrNonSupportCurrentMethod
+	// step 4: authorization validate by selected method
+	for _, authenticator := range authenticators {
+		if authenticator.Method() == negotiationReply.Method {
+			authConn, err := authenticator.Authenticate(c.DstTCPConn)
+			if nil != err {
+				return err
+			}
+			c.DstTCPConn = authConn
+			return nil
+		}
 	}
+	return ErrNonSupportCurrentMethod
+}
 
-	if method == MethodUsernamePassword {
-		negotiationAuthRequest, err := NewUsernamePasswordNegotiationRequest(c.Username, c.Password)
-		if nil != err {
-			return err
+// dialProxy connect to proxy server, set DstTCPConn.
+func (c *Client) dialProxy() error {
+	dial := c.Dial
+	if nil == dial {
+		dial = func(network, addr string) (net.Conn, error) {
+			if nil == c.ctx {
+				return net.Dial(network, addr)
+			}
+			return (&net.Dialer{}).DialContext(c.ctx, network, addr)
 		}
-		if err := negotiationAuthRequest.WriteTo(c.DstTCPConn); nil != err {
-			return err
+	}
+	conn, err := dial("tcp", c.DstTCPAddr.String())
+	if nil != err {
+		if nil != c.ctx && nil != c.ctx.Err() {
+			return c.ctx.Err()
 		}
-		authReply, err := NewUsernamePasswordNegotiationReply(c.DstTCPConn)
-		if nil != err {
+		return err
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok && c.TCPTimeout != 0 {
+		tcpConn.SetKeepAlivePeriod(time.Duration(c.TCPTimeout) * time.Second)
+	}
+	// mux stream is carried by a session which is already encrypted.
+	if _, isStream := conn.(*mux.Stream); !isStream && nil != c.Tunnel {
+		conn = c.Tunnel.Wrap(conn)
+	}
+	c.DstTCPConn = conn
+	c.watch()
+
+	if c.TCPDeadline != 0 {
+		if err := c.DstTCPConn.SetDeadline(time.Now().Add(time.Duration(c.TCPDeadline) * time.Second)); nil != err {
 			return err
 		}
-		if authReply.Status != UsernamePasswordStatusSuccess {
-			return ErrUnameOrPasswdError
-		}
 	}
 	return nil
 }
 
+// watch close proxy connection when ctx done, so blocked handshake returns at once.
+func (c *Client) watch() {
+	if nil == c.ctx || nil == c.ctx.Done() {
+		return
+	}
+	conn, finished := c.DstTCPConn, make(chan struct{})
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			conn.Close()
+		case <-finished:
+		}
+	}()
+	c.unwatch = func() { close(finished) }
+}
+
+// finishHandshake stop watching ctx, return error of ctx if it's done, proxy connection may be closed then.
+func (c *Client) finishHandshake() error {
+	if nil == c.unwatch {
+		return nil
+	}
+	c.unwatch()
+	c.unwatch = nil
+	return c.ctx.Err()
+}
+
 func (c *Client) Request(request *SocksRequest) (*SocksReply, error) {
-	if err := request.WriteTo(c.DstTCPConn); nil != err {
+	if _, err := request.WriteTo(c.DstTCPConn); nil != err {
 		return nil, err
 	}
 
@@ -132,55 +356,131 @@ func (c *Client) Request(request *SocksRequest) (*SocksReply, error) {
 	return socksReply, nil
 }
 
-// help func ===========================================================================================================
-
-// 1. negotiation request
-func NewNegotiationRequest(methods []byte) *NegotiationRequest {
-	return &NegotiationRequest{
-		Ver:      SocksVer,
-		NMethods: byte(len(methods)), // methods length
-		Methods:  methods,
+// Connect send CONNECT request of "host:port" address after negotiation, domain is resolved by proxy server.
+// return the proxied connection, data can be relayed on it directly.
+func (c *Client) Connect(addr string) (net.Conn, error) {
+	request, err := NewSocksRequestFromAddress(CMDConnect, addr)
+	if nil != err {
+		return nil, err
 	}
+	if _, err := c.Request(request); nil != err {
+		return nil, err
+	}
+	return c.DstTCPConn, nil
 }
 
-func (request *NegotiationRequest) WriteTo(dstConn *net.TCPConn) error {
-	if _, err := dstConn.Write([]byte{request.Ver}); nil != err {
-		return err
+// UDPAssociate send UDP ASSOCIATE request after negotiation, return the udp connection to proxy relay.
+// the association lives until the udp connection closed.
+func (c *Client) UDPAssociate() (*ClientUDPConn, error) {
+	request, err := NewSocksRequestFromAddress(CMDUDPAssociate, "0.0.0.0:0")
+	if nil != err {
+		return nil, err
+	}
+	reply, err := c.Request(request)
+	if nil != err {
+		return nil, err
 	}
 
-	if _, err := dstConn.Write([]byte{request.NMethods}); nil != err {
-		return err
+	// relay address, use proxy server address if it's unspecified.
+	relayAddr, err := net.ResolveUDPAddr("udp", reply.Address())
+	if nil != err {
+		return nil, err
+	}
+	if relayAddr.IP.IsUnspecified() {
+		relayAddr.IP = c.DstTCPAddr.IP
 	}
 
-	if _, err := dstConn.Write(request.Methods); nil != err {
-		return err
+	udpConn, err := net.DialUDP("udp", nil, relayAddr)
+	if nil != err {
+		return nil, err
 	}
+	if err := c.DstTCPConn.SetDeadline(time.Time{}); nil != err {
+		udpConn.Close()
+		return nil, err
+	}
+	return &ClientUDPConn{udpConn: udpConn, tcpConn: c.DstTCPConn, tunnel: c.Tunnel, deadline: c.UDPDeadline}, nil
+}
 
-	if Debug {
-		log.Printf("Sent NegotiationRequest: socks protocol version: %#v, nmethods: %#v, methods: %#v \n", request.Ver, request.NMethods, request.Methods)
+// ClientUDPConn is the client side of udp associate, datagrams are encapsulated with socks udp header.
+type ClientUDPConn struct {
+	udpConn  *net.UDPConn // connected to proxy udp relay
+	tcpConn  net.Conn     // the association terminates when it closed
+	tunnel   *Tunnel
+	deadline int
+}
+
+// WriteTo send data to "host:port" address through proxy relay.
+func (c *ClientUDPConn) WriteTo(b []byte, addr string) (int, error) {
+	atyp, dstAddr, dstPort, err := ParseAddress(addr)
+	if nil != err {
+		return 0, err
 	}
-	return nil
+	packet := NewSocksUDPDatagram(atyp, dstAddr, dstPort, b).Bytes()
+	if nil != c.tunnel {
+		if packet, err = c.tunnel.SealPacket(packet); nil != err {
+			return 0, err
+		}
+	}
+	if _, err := c.udpConn.Write(packet); nil != err {
+		return 0, err
+	}
+	return len(b), nil
 }
 
-// 2. parse negotiation reply
-func ParseNegotiationReply(conn *net.TCPConn) (*NegotiationReply, error) {
-	reply := make([]byte, 2) // according to socks protocol, it's only two bytes.
-	if _, err := io.ReadFull(conn, reply); nil != err {
-		return nil, err
+// ReadFrom read data from proxy relay, return data length and "host:port" address which sent the data.
+func (c *ClientUDPConn) ReadFrom(b []byte) (int, string, error) {
+	var buff [64 * 1024]byte
+	for {
+		if c.deadline != 0 {
+			if err := c.udpConn.SetReadDeadline(time.Now().Add(time.Duration(c.deadline) * time.Second)); nil != err {
+				return 0, "", err
+			}
+		}
+		n, err := c.udpConn.Read(buff[:])
+		if nil != err {
+			return 0, "", err
+		}
+		packet := buff[:n]
+		if nil != c.tunnel {
+			if packet, err = c.tunnel.OpenPacket(packet); nil != err {
+				continue // drop packet not from proxy relay
+			}
+		}
+		datagram, err := ParseSocksUDPDatagram(packet)
+		if nil != err || datagram.FRAG != 0x00 {
+			continue // drop bad or fragmented datagram
+		}
+		return copy(b, datagram.Data), datagram.Address(), nil
+	}
+}
+
+func (c *ClientUDPConn) Close() error {
+	c.tcpConn.Close()
+	return c.udpConn.Close()
+}
+
+// help func ===========================================================================================================
+
+// 1. negotiation request
+func NewNegotiationRequest(methods []byte) *NegotiationRequest {
+	return &NegotiationRequest{
+		Ver:      SocksVer,
+		NMethods: byte(len(methods)), // methods length
+		Methods:  methods,
 	}
+}
 
-	if reply[0] != SocksVer {
-		return nil, ErrNonSupportCurrentSocksProtocolVersion
+// 2. parse negotiation reply
+func ParseNegotiationReply(conn net.Conn) (*NegotiationReply, error) {
+	reply := &NegotiationReply{}
+	if _, err := reply.ReadFrom(conn); nil != err {
+		return nil, err
 	}
 
 	if Debug {
-		log.Printf("Received NegotiationReply: expect socks protocol version: %#v, methods: %#v \n", reply[0], reply[1])
+		log.Printf("Received NegotiationReply: expect socks protocol version: %#v, methods: %#v \n", reply.Ver, reply.Method)
 	}
-
-	return &NegotiationReply{
-		Ver:    reply[0],
-		Method: reply[1],
-	}, nil
+	return reply, nil
 }
 
 // 3. username/password negotiation request
@@ -203,48 +503,17 @@ func NewUsernamePasswordNegotiationRequest(username, password string) (*Username
 	}, nil
 }
 
-func (u *UsernamePasswordNegotiationRequest) WriteTo(dstConn *net.TCPConn) error {
-	if _, err := dstConn.Write([]byte{u.Ver, u.ULen}); nil != err {
-		return err
-	}
-
-	if _, err := dstConn.Write(u.Uname); nil != err {
-		return err
-	}
-
-	if _, err := dstConn.Write([]byte{u.PLen}); nil != err {
-		return err
-	}
-
-	if _, err := dstConn.Write(u.Password); nil != err {
-		return err
-	}
-
-	if Debug {
-		log.Printf("Sent UsernamePasswdNegotiationRequest: username/passed version: %#v, ulen: %#v, username: %#v, plen: %#v, passwd: %#v \n", u.Ver, u.ULen, u.Uname, u.PLen, u.Password)
-	}
-	return nil
-}
-
 // 4. username/password negotiation reply
-func NewUsernamePasswordNegotiationReply(conn *net.TCPConn) (*UsernamePasswordNegotiationReply, error) {
-	reply := make([]byte, 2) // according to socks protocol, it's only two bytes.
-	if _, err := io.ReadFull(conn, reply); nil != err {
+func NewUsernamePasswordNegotiationReply(conn net.Conn) (*UsernamePasswordNegotiationReply, error) {
+	reply := &UsernamePasswordNegotiationReply{}
+	if _, err := reply.ReadFrom(conn); nil != err {
 		return nil, err
 	}
 
-	if reply[0] != UsernamePasswordVer {
-		return nil, ErrNonSupportCurrentUnamePasswdVersion
-	}
-
 	if Debug {
-		log.Printf("Received UsernamePasswdNegotiationReply: expect username/password version: %#v, status: %#v \n", reply[0], reply[1])
+		log.Printf("Received UsernamePasswdNegotiationReply: expect username/password version: %#v, status: %#v \n", reply.Ver, reply.Status)
 	}
-
-	return &UsernamePasswordNegotiationReply{
-		Ver:    reply[0],
-		Status: reply[1],
-	}, nil
+	return reply, nil
 }
 
 // 5. socks request
@@ -267,84 +536,31 @@ func NewSocksRequest(cmd, atyp byte, dstAddr, dstPort []byte) (*SocksRequest, er
 	}, nil
 }
 
-func (r *SocksRequest) WriteTo(conn *net.TCPConn) error {
-	if _, err := conn.Write([]byte{r.Ver, r.CMD, r.RSV, r.ATYP}); nil != err {
-		return err
-	}
-
-	if _, err := conn.Write(r.DstAddr); nil != err {
-		return err
-	}
-
-	if _, err := conn.Write(r.DstPort); nil != err {
-		return err
-	}
-
-	if Debug {
-		log.Printf("Client Sent Socks5Request: socks protocol version: %#v, cmd: %#v, atyp: %#v, dst_addr: %#v, dst_port: %#v \n", r.Ver, r.CMD, r.ATYP, r.DstAddr, r.DstPort)
+// NewSocksRequestFromAddress create socks request of "host:port" address, address type is detected from host.
+func NewSocksRequestFromAddress(cmd byte, addr string) (*SocksRequest, error) {
+	atyp, dstAddr, dstPort, err := ParseAddress(addr)
+	if nil != err {
+		return nil, err
 	}
-	return nil
+	return &SocksRequest{
+		Ver:     SocksVer,
+		CMD:     cmd,
+		RSV:     0x00,
+		ATYP:    atyp,
+		DstAddr: dstAddr, // domain address already contains length byte.
+		DstPort: dstPort,
+	}, nil
 }
 
 // 6. parse socks reply
-func ParseSocksReply(dstConn *net.TCPConn) (*SocksReply, error) {
-	reply := make([]byte, 4) // every field 1 byte. VER, REP, RSV(resevred field), ATYP
-	if _, err := io.ReadFull(dstConn, reply); nil != err {
-		return nil, err
-	}
-
-	// validate socks protocol version
-	if reply[0] != SocksVer {
-		return nil, ErrNonSupportCurrentSocksProtocolVersion
-	}
-
-	// parse response packet
-	var addr []byte
-	atyp := reply[3]
-	if atyp == ATYPIPv4 {
-		addr = make([]byte, 4) // ip v4 address
-		if _, err := io.ReadFull(dstConn, addr); nil != err {
-			return nil, err
-		}
-	} else if atyp == ATYPDomain {
-		addr = make([]byte, 16) // ip v6 address
-		if _, err := io.ReadFull(dstConn, addr); nil != err {
-			return nil, err
-		}
-	} else if atyp == ATYPIPv6 {
-		domainLen := make([]byte, 1)
-		if _, err := io.ReadFull(dstConn, domainLen); nil != err {
-			return nil, err
-		}
-
-		if domainLen[0] == 0 {
-			return nil, ErrBadReply
-		}
-
-		addr := make([]byte, int(domainLen[0]))
-		if _, err := io.ReadFull(dstConn, addr); nil != err {
-			return nil, err
-		}
-		addr = append(domainLen, addr...)
-	} else {
-		return nil, ErrBadReply
-	}
-
-	port := make([]byte, 2) // 0 ~ 65535, 2 bytes.
-	if _, err := io.ReadFull(dstConn, port); nil != err {
+func ParseSocksReply(dstConn net.Conn) (*SocksReply, error) {
+	reply := &SocksReply{}
+	if _, err := reply.ReadFrom(dstConn); nil != err {
 		return nil, err
 	}
 
 	if Debug {
-		log.Printf("Client Received SocksReply: socks protocol version: %#v, rep status: %#v, atyp: %#v, bind_address: %#v, bind_port: %#v \n", SocksVer, reply[1], atyp, addr, port)
+		log.Printf("Client Received SocksReply: socks protocol version: %#v, rep status: %#v, atyp: %#v, bind_address: %#v, bind_port: %#v \n", reply.Ver, reply.REP, reply.ATYP, reply.BndAddr, reply.BndPort)
 	}
-
-	return &SocksReply{
-		Ver:     SocksVer,
-		REP:     reply[1],
-		RSV:     reply[2],
-		ATYP:    atyp,
-		BndAddr: addr,
-		BndPort: port,
-	}, nil
+	return reply, nil
 }
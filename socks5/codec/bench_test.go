@@ -0,0 +1,109 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+// the request path reuses packets and buffers, so it must not allocate.
+
+func BenchmarkSocksRequestUnmarshalBinary(b *testing.B) {
+	request := &SocksRequest{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := request.UnmarshalBinary(connectDomain); nil != err {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSocksRequestReadFrom(b *testing.B) {
+	request := &SocksRequest{}
+	reader := bytes.NewReader(connectDomain)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		reader.Reset(connectDomain)
+		if _, err := request.ReadFrom(reader); nil != err {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSocksRequestAppendBinary(b *testing.B) {
+	request := &SocksRequest{}
+	if err := request.UnmarshalBinary(connectDomain); nil != err {
+		b.Fatal(err)
+	}
+	buf := make([]byte, 0, MaxSocksRequestSize)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := request.AppendBinary(buf[:0]); nil != err {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSocksReplyReadFrom(b *testing.B) {
+	reply := &SocksReply{}
+	reader := bytes.NewReader(replyIPv6)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		reader.Reset(replyIPv6)
+		if _, err := reply.ReadFrom(reader); nil != err {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkNegotiationRequestReadFrom(b *testing.B) {
+	request := &NegotiationRequest{}
+	reader := bytes.NewReader(negotiationRequestUserPass)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		reader.Reset(negotiationRequestUserPass)
+		if _, err := request.ReadFrom(reader); nil != err {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkUsernamePasswordNegotiationRequestReadFrom(b *testing.B) {
+	request := &UsernamePasswordNegotiationRequest{}
+	reader := bytes.NewReader(userPassRequest)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		reader.Reset(userPassRequest)
+		if _, err := request.ReadFrom(reader); nil != err {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkSocksUDPDatagramDecode(b *testing.B) {
+	datagram := &SocksUDPDatagram{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := datagram.Decode(udpIPv4); nil != err {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestRequestPathAllocs keep benchmarks above honest in normal test runs.
+func TestRequestPathAllocs(t *testing.T) {
+	request := &SocksRequest{}
+	reader := bytes.NewReader(connectDomain)
+	buf := make([]byte, 0, MaxSocksRequestSize)
+	allocs := testing.AllocsPerRun(100, func() {
+		reader.Reset(connectDomain)
+		if _, err := request.ReadFrom(reader); nil != err {
+			t.Fatal(err)
+		}
+		if _, err := request.AppendBinary(buf[:0]); nil != err {
+			t.Fatal(err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("request path allocates %v times", allocs)
+	}
+}
@@ -0,0 +1,105 @@
+// Package codec implement wire format of socks5 packets.
+// See: socks5 protocol RFC.
+// https://www.ietf.org/rfc/rfc1928.txt
+// https://www.ietf.org/rfc/rfc1929.txt
+//
+// every packet implements encoding.BinaryMarshaler and encoding.BinaryUnmarshaler, stream packets also implement
+// io.ReaderFrom and io.WriterTo. decoded address fields point into a buffer owned by the packet, so decoding into
+// a reused packet doesn't allocate, and the fields are overwritten by next decoding.
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+)
+
+var (
+	ErrSocksVersion       = errors.New("nonsupport current socks protocol version")
+	ErrUnamePasswdVersion = errors.New("invalid uname/passwd version")
+	ErrUnamePasswdLength  = errors.New("username or password too length")
+	ErrBadRequest         = errors.New("bad request")
+	ErrBadReply           = errors.New("bad reply")
+)
+
+const (
+	// socks protocol version.
+	SocksVer          byte = 0x05
+	SocksReplySuccess byte = 0x00
+
+	MethodNoAuthRequired   byte = 0x00
+	MethodGSSAPI           byte = 0x01
+	MethodUsernamePassword byte = 0x02
+	// 0x03 to 0x7F IANA assigned.
+	// 0x80 to 0xFE reserved for private methods.
+	MethodNoAcceptableMethods byte = 0xFF
+
+	// use in user negotiation stage.
+	UsernamePasswordVer           byte = 0x01
+	UsernamePasswordStatusSuccess byte = 0x00
+	UsernamePasswordStatusFail    byte = 0x01
+
+	CMDConnect      byte = 0x01
+	CMDBind         byte = 0x02
+	CMDUDPAssociate byte = 0x03
+
+	ATYPIPv4   byte = 0x01
+	ATYPDomain byte = 0x03
+	ATYPIPv6   byte = 0x04
+
+	// reply
+	ReplySuccess            byte = 0x00
+	ReplyGeneralFailure     byte = 0x01
+	ReplyRemoteAddrConnFail byte = 0x01
+	ReplyConnNotAllowed     byte = 0x02 // connection not allowed by ruleset
+	ReplyNetworkUnreachable byte = 0x03
+	ReplyHostUnreachable    byte = 0x04
+	ReplyConnRefused        byte = 0x05
+	ReplyTTLExpired         byte = 0x06
+	ReplyCommandNonSupport  byte = 0x07
+	ReplyAddrTypeNonSupport byte = 0x08
+
+	// max packet sizes.
+	MaxNegotiationRequestSize      = 2 + 255
+	MaxUsernamePasswordRequestSize = 3 + 255 + 255
+	MaxAddressSize                 = 1 + 255 // domain with length byte
+	MaxSocksRequestSize            = 4 + MaxAddressSize + 2
+)
+
+// JoinAddress return "host:port" address, domain address must contain the length byte.
+func JoinAddress(atyp byte, addr, port []byte) string {
+	var host string
+	if ATYPDomain == atyp {
+		host = string(addr[1:])
+	} else {
+		host = net.IP(addr).String()
+	}
+	// notes: CPU big-endian type.
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+}
+
+// help func ===========================================================================================================
+
+// addressSize return the size of address field by address type, first is the first byte of address field,
+// it's the length of domain. ok is false if address type is unknown or domain is empty.
+func addressSize(atyp, first byte) (size int, ok bool) {
+	switch atyp {
+	case ATYPIPv4:
+		return 4, true
+	case ATYPIPv6:
+		return 16, true
+	case ATYPDomain:
+		return 1 + int(first), first != 0
+	}
+	return 0, false
+}
+
+// validAddress check address field and port before encoding.
+func validAddress(atyp byte, addr, port []byte) bool {
+	if len(addr) == 0 || len(port) != 2 {
+		return false
+	}
+	size, ok := addressSize(atyp, addr[0])
+	return ok && size == len(addr)
+}
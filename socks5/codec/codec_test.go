@@ -0,0 +1,203 @@
+package codec
+
+import (
+	"bytes"
+	"encoding"
+	"io"
+	"testing"
+)
+
+// golden vectors of RFC 1928 and RFC 1929.
+var (
+	negotiationRequestNoAuth   = []byte{0x05, 0x01, 0x00}
+	negotiationRequestUserPass = []byte{0x05, 0x02, 0x00, 0x02}
+	negotiationReplyUserPass   = []byte{0x05, 0x02}
+	negotiationReplyNoAccept   = []byte{0x05, 0xFF}
+
+	userPassRequest = append(append(append([]byte{0x01, 0x05}, "alice"...), 0x06), "secret"...)
+	userPassSuccess = []byte{0x01, 0x00}
+	userPassFail    = []byte{0x01, 0x01}
+
+	connectIPv4   = []byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0x00, 0x50}
+	connectDomain = append(append([]byte{0x05, 0x01, 0x00, 0x03, 0x0B}, "example.com"...), 0x01, 0xBB)
+	connectIPv6   = []byte{0x05, 0x01, 0x00, 0x04, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x1F, 0x90}
+
+	replyIPv4   = []byte{0x05, 0x00, 0x00, 0x01, 10, 0, 0, 1, 0x04, 0x38}
+	replyDomain = append(append([]byte{0x05, 0x00, 0x00, 0x03, 0x09}, "proxy.lan"...), 0x04, 0x38)
+	replyIPv6   = []byte{0x05, 0x05, 0x00, 0x04, 0xFE, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x04, 0x38}
+
+	udpIPv4   = append([]byte{0x00, 0x00, 0x00, 0x01, 8, 8, 8, 8, 0x00, 0x35}, "query"...)
+	udpDomain = append(append([]byte{0x00, 0x00, 0x00, 0x03, 0x0B}, "example.com"...), 0x00, 0x35)
+)
+
+type packet interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+	io.ReaderFrom
+	io.WriterTo
+}
+
+// writeCounter count writes.
+type writeCounter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *writeCounter) Write(b []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(b)
+}
+
+func TestGoldenVectors(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet func() packet
+		wire   []byte
+		want   string // Address of request and reply
+	}{
+		{"negotiation request no auth", func() packet { return &NegotiationRequest{} }, negotiationRequestNoAuth, ""},
+		{"negotiation request userpass", func() packet { return &NegotiationRequest{} }, negotiationRequestUserPass, ""},
+		{"negotiation reply userpass", func() packet { return &NegotiationReply{} }, negotiationReplyUserPass, ""},
+		{"negotiation reply no acceptable", func() packet { return &NegotiationReply{} }, negotiationReplyNoAccept, ""},
+		{"userpass request", func() packet { return &UsernamePasswordNegotiationRequest{} }, userPassRequest, ""},
+		{"userpass success", func() packet { return &UsernamePasswordNegotiationReply{} }, userPassSuccess, ""},
+		{"userpass fail", func() packet { return &UsernamePasswordNegotiationReply{} }, userPassFail, ""},
+		{"connect ipv4", func() packet { return &SocksRequest{} }, connectIPv4, "127.0.0.1:80"},
+		{"connect domain", func() packet { return &SocksRequest{} }, connectDomain, "example.com:443"},
+		{"connect ipv6", func() packet { return &SocksRequest{} }, connectIPv6, "[::1]:8080"},
+		{"reply ipv4", func() packet { return &SocksReply{} }, replyIPv4, "10.0.0.1:1080"},
+		{"reply domain", func() packet { return &SocksReply{} }, replyDomain, "proxy.lan:1080"},
+		{"reply ipv6", func() packet { return &SocksReply{} }, replyIPv6, "[fe80::1]:1080"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// unmarshal, then marshal back to the same bytes.
+			p := test.packet()
+			if err := p.UnmarshalBinary(test.wire); nil != err {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			b, err := p.MarshalBinary()
+			if nil != err {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+			if !bytes.Equal(b, test.wire) {
+				t.Fatalf("MarshalBinary = % x, want % x", b, test.wire)
+			}
+
+			// read from stream, trailing data must not be consumed.
+			p = test.packet()
+			r := bytes.NewReader(append(append([]byte{}, test.wire...), 0xAA))
+			n, err := p.ReadFrom(r)
+			if nil != err || n != int64(len(test.wire)) || r.Len() != 1 {
+				t.Fatalf("ReadFrom = %d, %v, remain %d", n, err, r.Len())
+			}
+			// the whole packet is written by one write, so it's never split into tiny segments.
+			w := &writeCounter{}
+			if _, err := p.WriteTo(w); nil != err || !bytes.Equal(w.Bytes(), test.wire) || w.writes != 1 {
+				t.Fatalf("WriteTo = % x by %d writes, %v, want % x", w.Bytes(), w.writes, err, test.wire)
+			}
+
+			if addresser, ok := p.(interface{ Address() string }); ok && addresser.Address() != test.want {
+				t.Fatalf("Address = %s, want %s", addresser.Address(), test.want)
+			}
+		})
+	}
+}
+
+func TestUnmarshalCopiesData(t *testing.T) {
+	wire := append([]byte{}, connectDomain...)
+	request := &SocksRequest{}
+	if err := request.UnmarshalBinary(wire); nil != err {
+		t.Fatal(err)
+	}
+	for i := range wire {
+		wire[i] = 0
+	}
+	if request.Address() != "example.com:443" {
+		t.Fatalf("Address = %s after input changed", request.Address())
+	}
+}
+
+func TestMalformedPackets(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet packet
+		wire   []byte
+		err    error
+	}{
+		{"negotiation request version", &NegotiationRequest{}, []byte{0x04, 0x01, 0x00}, ErrSocksVersion},
+		{"negotiation request no method", &NegotiationRequest{}, []byte{0x05, 0x00}, ErrBadRequest},
+		{"negotiation request short", &NegotiationRequest{}, []byte{0x05, 0x02, 0x00}, ErrBadRequest},
+		{"negotiation reply version", &NegotiationReply{}, []byte{0x04, 0x00}, ErrSocksVersion},
+		{"userpass request version", &UsernamePasswordNegotiationRequest{}, []byte{0x05, 0x01, 'a', 0x01, 'b'}, ErrUnamePasswdVersion},
+		{"userpass request empty user", &UsernamePasswordNegotiationRequest{}, []byte{0x01, 0x00, 0x01, 'b'}, ErrBadRequest},
+		{"userpass request empty password", &UsernamePasswordNegotiationRequest{}, []byte{0x01, 0x01, 'a', 0x00}, ErrBadRequest},
+		{"userpass reply version", &UsernamePasswordNegotiationReply{}, []byte{0x05, 0x00}, ErrUnamePasswdVersion},
+		{"request version", &SocksRequest{}, []byte{0x04, 0x01, 0x00, 0x01, 1, 2, 3, 4, 0, 80}, ErrSocksVersion},
+		{"request address type", &SocksRequest{}, []byte{0x05, 0x01, 0x00, 0x02, 1, 2, 3, 4, 0, 80}, ErrBadRequest},
+		{"request empty domain", &SocksRequest{}, []byte{0x05, 0x01, 0x00, 0x03, 0x00, 0, 80}, ErrBadRequest},
+		{"reply version", &SocksReply{}, []byte{0x04, 0x00, 0x00, 0x01, 1, 2, 3, 4, 0, 80}, ErrSocksVersion},
+		{"reply address type", &SocksReply{}, []byte{0x05, 0x00, 0x00, 0x05, 1, 2, 3, 4, 0, 80}, ErrBadReply},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.packet.UnmarshalBinary(test.wire); err != test.err {
+				t.Fatalf("UnmarshalBinary = %v, want %v", err, test.err)
+			}
+			if _, err := test.packet.ReadFrom(bytes.NewReader(test.wire)); err != test.err && err != io.ErrUnexpectedEOF {
+				t.Fatalf("ReadFrom = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestMarshalValidates(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet encoding.BinaryMarshaler
+		err    error
+	}{
+		{"nmethods mismatch", &NegotiationRequest{Ver: SocksVer, NMethods: 2, Methods: []byte{0x00}}, ErrBadRequest},
+		{"username too long", &UsernamePasswordNegotiationRequest{Ver: UsernamePasswordVer, Uname: make([]byte, 256)}, ErrUnamePasswdLength},
+		{"ipv4 address length", &SocksRequest{Ver: SocksVer, ATYP: ATYPIPv4, DstAddr: []byte{1, 2, 3}, DstPort: []byte{0, 80}}, ErrBadRequest},
+		{"domain without length byte", &SocksRequest{Ver: SocksVer, ATYP: ATYPDomain, DstAddr: []byte("example.com"), DstPort: []byte{0, 80}}, ErrBadRequest},
+		{"reply port length", &SocksReply{Ver: SocksVer, ATYP: ATYPIPv4, BndAddr: []byte{1, 2, 3, 4}, BndPort: []byte{80}}, ErrBadReply},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := test.packet.MarshalBinary(); err != test.err {
+				t.Fatalf("MarshalBinary = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestUDPDatagram(t *testing.T) {
+	for _, wire := range [][]byte{udpIPv4, udpDomain} {
+		datagram := &SocksUDPDatagram{}
+		if err := datagram.UnmarshalBinary(wire); nil != err {
+			t.Fatalf("UnmarshalBinary(% x): %v", wire, err)
+		}
+		b, err := datagram.MarshalBinary()
+		if nil != err || !bytes.Equal(b, wire) {
+			t.Fatalf("MarshalBinary = % x, %v, want % x", b, err, wire)
+		}
+	}
+
+	datagram := &SocksUDPDatagram{}
+	if err := datagram.UnmarshalBinary(udpIPv4); nil != err {
+		t.Fatal(err)
+	}
+	if datagram.Address() != "8.8.8.8:53" || string(datagram.Data) != "query" {
+		t.Fatalf("got %s %q", datagram.Address(), datagram.Data)
+	}
+
+	for _, wire := range [][]byte{udpIPv4[:9], {0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x35}, {0x00, 0x00, 0x00, 0x07, 1}} {
+		if err := datagram.UnmarshalBinary(wire); err != ErrBadRequest {
+			t.Fatalf("UnmarshalBinary(% x) = %v, want %v", wire, err, ErrBadRequest)
+		}
+	}
+}
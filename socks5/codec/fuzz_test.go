@@ -0,0 +1,115 @@
+package codec
+
+import (
+	"bytes"
+	"testing"
+)
+
+// checkRoundTrip check that accepted input is canonical, and stream decoding agrees with UnmarshalBinary.
+func checkRoundTrip(t *testing.T, data []byte, newPacket func() packet) {
+	p := newPacket()
+	err := p.UnmarshalBinary(data)
+
+	streamed := newPacket()
+	n, streamErr := streamed.ReadFrom(bytes.NewReader(data))
+	if nil != err {
+		// stream decoding may stop before trailing data, so it can accept prefix of rejected input.
+		if nil == streamErr && n == int64(len(data)) {
+			t.Fatalf("ReadFrom accepted % x rejected by UnmarshalBinary: %v", data, err)
+		}
+		return
+	}
+	if nil != streamErr || n != int64(len(data)) {
+		t.Fatalf("ReadFrom = %d, %v, UnmarshalBinary accepted % x", n, streamErr, data)
+	}
+
+	for _, packet := range []packet{p, streamed} {
+		b, err := packet.MarshalBinary()
+		if nil != err {
+			t.Fatalf("MarshalBinary of accepted % x: %v", data, err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Fatalf("MarshalBinary = % x, input % x", b, data)
+		}
+	}
+}
+
+func FuzzNegotiationRequest(f *testing.F) {
+	f.Add(negotiationRequestNoAuth)
+	f.Add(negotiationRequestUserPass)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkRoundTrip(t, data, func() packet { return &NegotiationRequest{} })
+	})
+}
+
+func FuzzNegotiationReply(f *testing.F) {
+	f.Add(negotiationReplyUserPass)
+	f.Add(negotiationReplyNoAccept)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkRoundTrip(t, data, func() packet { return &NegotiationReply{} })
+	})
+}
+
+func FuzzUsernamePasswordNegotiationRequest(f *testing.F) {
+	f.Add(userPassRequest)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkRoundTrip(t, data, func() packet { return &UsernamePasswordNegotiationRequest{} })
+	})
+}
+
+func FuzzUsernamePasswordNegotiationReply(f *testing.F) {
+	f.Add(userPassSuccess)
+	f.Add(userPassFail)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkRoundTrip(t, data, func() packet { return &UsernamePasswordNegotiationReply{} })
+	})
+}
+
+func FuzzSocksRequest(f *testing.F) {
+	f.Add(connectIPv4)
+	f.Add(connectDomain)
+	f.Add(connectIPv6)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkRoundTrip(t, data, func() packet { return &SocksRequest{} })
+
+		request := &SocksRequest{}
+		if nil == request.UnmarshalBinary(data) {
+			request.Address()
+		}
+	})
+}
+
+func FuzzSocksReply(f *testing.F) {
+	f.Add(replyIPv4)
+	f.Add(replyDomain)
+	f.Add(replyIPv6)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		checkRoundTrip(t, data, func() packet { return &SocksReply{} })
+
+		reply := &SocksReply{}
+		if nil == reply.UnmarshalBinary(data) {
+			reply.Address()
+		}
+	})
+}
+
+func FuzzSocksUDPDatagram(f *testing.F) {
+	f.Add(udpIPv4)
+	f.Add(udpDomain)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		datagram := &SocksUDPDatagram{}
+		if nil != datagram.UnmarshalBinary(data) {
+			return
+		}
+		datagram.Address()
+
+		// RSV is always encoded as zero, other fields must survive round trip.
+		b, err := datagram.MarshalBinary()
+		if nil != err {
+			t.Fatalf("MarshalBinary of accepted % x: %v", data, err)
+		}
+		if !bytes.Equal(b[2:], data[2:]) {
+			t.Fatalf("MarshalBinary = % x, input % x", b, data)
+		}
+	})
+}
@@ -0,0 +1,269 @@
+package codec
+
+import (
+	"io"
+)
+
+// NegotiationRequest is the negotiation request packet.
+//
+//	+----+----------+----------+
+//	|VER | NMETHODS | METHODS  |
+//	+----+----------+----------+
+//	| 1  |    1     | 1 to 255 |
+//	+----+----------+----------+
+type NegotiationRequest struct {
+	Ver      byte
+	NMethods byte
+	Methods  []byte // 1 to 255 bytes
+
+	raw [MaxNegotiationRequestSize]byte
+}
+
+func (r *NegotiationRequest) AppendBinary(b []byte) ([]byte, error) {
+	if len(r.Methods) == 0 || len(r.Methods) > 255 || int(r.NMethods) != len(r.Methods) {
+		return b, ErrBadRequest
+	}
+	b = append(b, r.Ver, r.NMethods)
+	return append(b, r.Methods...), nil
+}
+
+func (r *NegotiationRequest) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(make([]byte, 0, 2+len(r.Methods)))
+}
+
+func (r *NegotiationRequest) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return ErrBadRequest
+	}
+	if data[0] != SocksVer {
+		return ErrSocksVersion
+	}
+	if len(data) != 2+int(data[1]) {
+		return ErrBadRequest
+	}
+	return r.decode(r.raw[:copy(r.raw[:], data)])
+}
+
+func (r *NegotiationRequest) ReadFrom(reader io.Reader) (int64, error) {
+	n, err := io.ReadFull(reader, r.raw[:2])
+	if nil != err {
+		return int64(n), err
+	}
+	if r.raw[0] != SocksVer {
+		return int64(n), ErrSocksVersion
+	}
+	m, err := io.ReadFull(reader, r.raw[2:2+int(r.raw[1])])
+	if nil != err {
+		return int64(n + m), err
+	}
+	return int64(n + m), r.decode(r.raw[:n+m])
+}
+
+func (r *NegotiationRequest) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, r, 2+len(r.Methods))
+}
+
+func (r *NegotiationRequest) decode(b []byte) error {
+	if b[1] == 0 {
+		return ErrBadRequest
+	}
+	r.Ver = b[0]
+	r.NMethods = b[1]
+	r.Methods = b[2:len(b):len(b)]
+	return nil
+}
+
+// NegotiationReply is the negotiation reply packet.
+//
+//	+----+--------+
+//	|VER | METHOD |
+//	+----+--------+
+//	| 1  |   1    |
+//	+----+--------+
+type NegotiationReply struct {
+	Ver    byte
+	Method byte
+}
+
+func (r *NegotiationReply) AppendBinary(b []byte) ([]byte, error) {
+	return append(b, r.Ver, r.Method), nil
+}
+
+func (r *NegotiationReply) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(make([]byte, 0, 2))
+}
+
+func (r *NegotiationReply) UnmarshalBinary(data []byte) error {
+	if len(data) != 2 {
+		return ErrBadReply
+	}
+	if data[0] != SocksVer {
+		return ErrSocksVersion
+	}
+	r.Ver, r.Method = data[0], data[1]
+	return nil
+}
+
+func (r *NegotiationReply) ReadFrom(reader io.Reader) (int64, error) {
+	var b [2]byte
+	n, err := io.ReadFull(reader, b[:])
+	if nil != err {
+		return int64(n), err
+	}
+	return int64(n), r.UnmarshalBinary(b[:])
+}
+
+func (r *NegotiationReply) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, r, 2)
+}
+
+// UsernamePasswordNegotiationRequest is the negotiation username/password request packet.
+//
+//	+----+------+----------+------+----------+
+//	|VER | ULEN |  UNAME   | PLEN |  PASSWD  |
+//	+----+------+----------+------+----------+
+//	| 1  |  1   | 1 to 255 |  1   | 1 to 255 |
+//	+----+------+----------+------+----------+
+type UsernamePasswordNegotiationRequest struct {
+	Ver      byte   // the Ver field contains the current version of the subnegotiation, which is 0x01.
+	ULen     byte   // username length
+	Uname    []byte // 1 to 255 bytes
+	PLen     byte   // password length
+	Password []byte // 1 to 255 bytes
+
+	raw [MaxUsernamePasswordRequestSize]byte
+}
+
+func (r *UsernamePasswordNegotiationRequest) AppendBinary(b []byte) ([]byte, error) {
+	if len(r.Uname) > 255 || len(r.Password) > 255 {
+		return b, ErrUnamePasswdLength
+	}
+	if int(r.ULen) != len(r.Uname) || int(r.PLen) != len(r.Password) {
+		return b, ErrBadRequest
+	}
+	b = append(b, r.Ver, r.ULen)
+	b = append(b, r.Uname...)
+	b = append(b, r.PLen)
+	return append(b, r.Password...), nil
+}
+
+func (r *UsernamePasswordNegotiationRequest) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(make([]byte, 0, 3+len(r.Uname)+len(r.Password)))
+}
+
+func (r *UsernamePasswordNegotiationRequest) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return ErrBadRequest
+	}
+	if data[0] != UsernamePasswordVer {
+		return ErrUnamePasswdVersion
+	}
+	ulen := int(data[1])
+	if len(data) < 3+ulen || len(data) != 3+ulen+int(data[2+ulen]) {
+		return ErrBadRequest
+	}
+	return r.decode(r.raw[:copy(r.raw[:], data)])
+}
+
+func (r *UsernamePasswordNegotiationRequest) ReadFrom(reader io.Reader) (int64, error) {
+	// VER, ULEN
+	n, err := io.ReadFull(reader, r.raw[:2])
+	if nil != err {
+		return int64(n), err
+	}
+	if r.raw[0] != UsernamePasswordVer {
+		return int64(n), ErrUnamePasswdVersion
+	}
+	// UNAME, PLEN
+	ulen := int(r.raw[1])
+	m, err := io.ReadFull(reader, r.raw[2:3+ulen])
+	n += m
+	if nil != err {
+		return int64(n), err
+	}
+	// PASSWD
+	m, err = io.ReadFull(reader, r.raw[3+ulen:3+ulen+int(r.raw[2+ulen])])
+	n += m
+	if nil != err {
+		return int64(n), err
+	}
+	return int64(n), r.decode(r.raw[:n])
+}
+
+func (r *UsernamePasswordNegotiationRequest) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, r, 3+len(r.Uname)+len(r.Password))
+}
+
+func (r *UsernamePasswordNegotiationRequest) decode(b []byte) error {
+	ulen := int(b[1])
+	plen := int(b[2+ulen])
+	if ulen == 0 || plen == 0 {
+		return ErrBadRequest
+	}
+	r.Ver = b[0]
+	r.ULen = b[1]
+	r.Uname = b[2 : 2+ulen : 2+ulen]
+	r.PLen = b[2+ulen]
+	r.Password = b[3+ulen : len(b) : len(b)]
+	return nil
+}
+
+// UsernamePasswordNegotiationReply is the negotiation username/password reply packet.
+//
+//	+----+--------+
+//	|VER | STATUS |
+//	+----+--------+
+//	| 1  |   1    |
+//	+----+--------+
+type UsernamePasswordNegotiationReply struct {
+	Ver    byte
+	Status byte // 0x00 indicates negotiation success.
+}
+
+func (r *UsernamePasswordNegotiationReply) AppendBinary(b []byte) ([]byte, error) {
+	return append(b, r.Ver, r.Status), nil
+}
+
+func (r *UsernamePasswordNegotiationReply) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(make([]byte, 0, 2))
+}
+
+func (r *UsernamePasswordNegotiationReply) UnmarshalBinary(data []byte) error {
+	if len(data) != 2 {
+		return ErrBadReply
+	}
+	if data[0] != UsernamePasswordVer {
+		return ErrUnamePasswdVersion
+	}
+	r.Ver, r.Status = data[0], data[1]
+	return nil
+}
+
+func (r *UsernamePasswordNegotiationReply) ReadFrom(reader io.Reader) (int64, error) {
+	var b [2]byte
+	n, err := io.ReadFull(reader, b[:])
+	if nil != err {
+		return int64(n), err
+	}
+	return int64(n), r.UnmarshalBinary(b[:])
+}
+
+func (r *UsernamePasswordNegotiationReply) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, r, 2)
+}
+
+// help func ===========================================================================================================
+
+type appender interface {
+	AppendBinary(b []byte) ([]byte, error)
+}
+
+// writeTo write the whole packet by one write.
+func writeTo(w io.Writer, packet appender, size int) (int64, error) {
+	b, err := packet.AppendBinary(make([]byte, 0, size))
+	if nil != err {
+		return 0, err
+	}
+	n, err := w.Write(b)
+	return int64(n), err
+}
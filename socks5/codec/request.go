@@ -0,0 +1,163 @@
+package codec
+
+import (
+	"io"
+)
+
+// SocksRequest is the request packet.
+//
+//	+----+-----+-------+------+----------+----------+
+//	|VER | CMD |  RSV  | ATYP | DST.ADDR | DST.PORT |
+//	+----+-----+-------+------+----------+----------+
+//	| 1  |  1  | X'00' |  1   | Variable |    2     |
+//	+----+-----+-------+------+----------+----------+
+type SocksRequest struct {
+	Ver     byte   // socks protocol version: 0x05
+	CMD     byte   // connect : 0x01, bind : 0x02, udp associate : 0x03
+	RSV     byte   // reserved field, 0x00
+	ATYP    byte   // address type, IPv4 : 0x01, domain name : 0x03, IPv6 : 0x04
+	DstAddr []byte // desired destination address, domain address contains the length byte
+	DstPort []byte // desired destination port in network octet order, it's 2 bytes.
+
+	raw [MaxSocksRequestSize]byte
+}
+
+// Address return the "host:port" destination address of request.
+func (r *SocksRequest) Address() string {
+	return JoinAddress(r.ATYP, r.DstAddr, r.DstPort)
+}
+
+func (r *SocksRequest) AppendBinary(b []byte) ([]byte, error) {
+	if !validAddress(r.ATYP, r.DstAddr, r.DstPort) {
+		return b, ErrBadRequest
+	}
+	return appendAddressPacket(b, r.Ver, r.CMD, r.RSV, r.ATYP, r.DstAddr, r.DstPort), nil
+}
+
+func (r *SocksRequest) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(make([]byte, 0, 6+len(r.DstAddr)))
+}
+
+func (r *SocksRequest) UnmarshalBinary(data []byte) error {
+	n, err := unmarshalAddressPacket(r.raw[:], data, ErrBadRequest)
+	if nil != err {
+		return err
+	}
+	r.Ver, r.CMD, r.RSV, r.ATYP, r.DstAddr, r.DstPort = splitAddressPacket(r.raw[:n])
+	return nil
+}
+
+func (r *SocksRequest) ReadFrom(reader io.Reader) (int64, error) {
+	n, err := readAddressPacket(reader, r.raw[:], ErrBadRequest)
+	if nil != err {
+		return int64(n), err
+	}
+	r.Ver, r.CMD, r.RSV, r.ATYP, r.DstAddr, r.DstPort = splitAddressPacket(r.raw[:n])
+	return int64(n), nil
+}
+
+func (r *SocksRequest) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, r, 6+len(r.DstAddr))
+}
+
+// SocksReply is the reply packet.
+//
+//	+----+-----+-------+------+----------+----------+
+//	|VER | REP |  RSV  | ATYP | BND.ADDR | BND.PORT |
+//	+----+-----+-------+------+----------+----------+
+//	| 1  |  1  | X'00' |  1   | Variable |    2     |
+//	+----+-----+-------+------+----------+----------+
+type SocksReply struct {
+	Ver     byte
+	REP     byte
+	RSV     byte   // 0x00
+	ATYP    byte   // address type, IPv4 : 0x01, domain name : 0x03, IPv6 : 0x04
+	BndAddr []byte // server bound address, domain address contains the length byte
+	BndPort []byte // server bound port in network octet order, it's 2 bytes.
+
+	raw [MaxSocksRequestSize]byte
+}
+
+// Address return the "host:port" bound address of reply.
+func (r *SocksReply) Address() string {
+	return JoinAddress(r.ATYP, r.BndAddr, r.BndPort)
+}
+
+func (r *SocksReply) AppendBinary(b []byte) ([]byte, error) {
+	if !validAddress(r.ATYP, r.BndAddr, r.BndPort) {
+		return b, ErrBadReply
+	}
+	return appendAddressPacket(b, r.Ver, r.REP, r.RSV, r.ATYP, r.BndAddr, r.BndPort), nil
+}
+
+func (r *SocksReply) MarshalBinary() ([]byte, error) {
+	return r.AppendBinary(make([]byte, 0, 6+len(r.BndAddr)))
+}
+
+func (r *SocksReply) UnmarshalBinary(data []byte) error {
+	n, err := unmarshalAddressPacket(r.raw[:], data, ErrBadReply)
+	if nil != err {
+		return err
+	}
+	r.Ver, r.REP, r.RSV, r.ATYP, r.BndAddr, r.BndPort = splitAddressPacket(r.raw[:n])
+	return nil
+}
+
+func (r *SocksReply) ReadFrom(reader io.Reader) (int64, error) {
+	n, err := readAddressPacket(reader, r.raw[:], ErrBadReply)
+	if nil != err {
+		return int64(n), err
+	}
+	r.Ver, r.REP, r.RSV, r.ATYP, r.BndAddr, r.BndPort = splitAddressPacket(r.raw[:n])
+	return int64(n), nil
+}
+
+func (r *SocksReply) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, r, 6+len(r.BndAddr))
+}
+
+// help func ===========================================================================================================
+
+// request and reply share the layout: VER, CMD or REP, RSV, ATYP, ADDR, PORT.
+
+func appendAddressPacket(b []byte, ver, code, rsv, atyp byte, addr, port []byte) []byte {
+	b = append(b, ver, code, rsv, atyp)
+	b = append(b, addr...)
+	return append(b, port...)
+}
+
+func unmarshalAddressPacket(raw, data []byte, errBad error) (int, error) {
+	if len(data) < 5 {
+		return 0, errBad
+	}
+	if data[0] != SocksVer {
+		return 0, ErrSocksVersion
+	}
+	size, ok := addressSize(data[3], data[4])
+	if !ok || len(data) != 4+size+2 {
+		return 0, errBad
+	}
+	return copy(raw, data), nil
+}
+
+func readAddressPacket(reader io.Reader, raw []byte, errBad error) (int, error) {
+	// VER, CMD or REP, RSV, ATYP, first byte of address.
+	n, err := io.ReadFull(reader, raw[:5])
+	if nil != err {
+		return n, err
+	}
+	if raw[0] != SocksVer {
+		return n, ErrSocksVersion
+	}
+	size, ok := addressSize(raw[3], raw[4])
+	if !ok {
+		return n, errBad
+	}
+	m, err := io.ReadFull(reader, raw[5:4+size+2])
+	return n + m, err
+}
+
+func splitAddressPacket(b []byte) (ver, code, rsv, atyp byte, addr, port []byte) {
+	end := len(b) - 2
+	return b[0], b[1], b[2], b[3], b[4:end:end], b[end:len(b):len(b)]
+}
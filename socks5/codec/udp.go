@@ -0,0 +1,90 @@
+package codec
+
+import (
+	"io"
+)
+
+// SocksUDPDatagram is the UDP packet.
+//
+//	+----+------+------+----------+----------+----------+
+//	|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+//	+----+------+------+----------+----------+----------+
+//	| 2  |  1   |  1   | Variable |    2     | Variable |
+//	+----+------+------+----------+----------+----------+
+type SocksUDPDatagram struct {
+	Ver     byte   // first byte of RSV
+	FRAG    byte   // current fragment number
+	ATYP    byte   // address type, IP V4 : 0x01, domain name : 0x03, IP V6 : 0x04
+	DstAddr []byte // desired destination address, domain address contains the length byte
+	DstPort []byte // desired destination port in network octet order, it's 2 bytes.
+	Data    []byte // user data
+
+	raw []byte // copy of unmarshalled packet, reused by next UnmarshalBinary
+}
+
+// Address return the "host:port" destination address of udp datagram.
+func (d *SocksUDPDatagram) Address() string {
+	return JoinAddress(d.ATYP, d.DstAddr, d.DstPort)
+}
+
+func (d *SocksUDPDatagram) AppendBinary(b []byte) ([]byte, error) {
+	if !validAddress(d.ATYP, d.DstAddr, d.DstPort) {
+		return b, ErrBadRequest
+	}
+	return d.appendPacket(b), nil
+}
+
+func (d *SocksUDPDatagram) MarshalBinary() ([]byte, error) {
+	return d.AppendBinary(make([]byte, 0, d.size()))
+}
+
+// Bytes return the packet without validating address, it's used to relay datagram already validated.
+func (d *SocksUDPDatagram) Bytes() []byte {
+	return d.appendPacket(make([]byte, 0, d.size()))
+}
+
+// UnmarshalBinary decode a copy of packet, use Decode to avoid copying data.
+func (d *SocksUDPDatagram) UnmarshalBinary(data []byte) error {
+	d.raw = append(d.raw[:0], data...)
+	return d.Decode(d.raw)
+}
+
+// Decode is same as UnmarshalBinary, but the fields point into packet directly.
+func (d *SocksUDPDatagram) Decode(packet []byte) error {
+	// RSV(2 bytes), FRAG, ATYP, first byte of address
+	if len(packet) < 5 {
+		return ErrBadRequest
+	}
+	addrLen, ok := addressSize(packet[3], packet[4])
+	if !ok {
+		return ErrBadRequest
+	}
+	body := packet[4:]
+	if len(body) < addrLen+2 {
+		return ErrBadRequest
+	}
+	d.Ver = packet[0]
+	d.FRAG = packet[2]
+	d.ATYP = packet[3]
+	d.DstAddr = body[:addrLen:addrLen]
+	d.DstPort = body[addrLen : addrLen+2 : addrLen+2]
+	d.Data = body[addrLen+2:]
+	return nil
+}
+
+func (d *SocksUDPDatagram) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, d, d.size())
+}
+
+// help func ===========================================================================================================
+
+func (d *SocksUDPDatagram) size() int {
+	return 4 + len(d.DstAddr) + 2 + len(d.Data)
+}
+
+func (d *SocksUDPDatagram) appendPacket(b []byte) []byte {
+	b = append(b, 0x00, 0x00, d.FRAG, d.ATYP)
+	b = append(b, d.DstAddr...)
+	b = append(b, d.DstPort...)
+	return append(b, d.Data...)
+}
@@ -0,0 +1,183 @@
+package socks5
+
+import (
+	"errors"
+	"hash/crc32"
+	"net"
+	"sync/atomic"
+	"xproxy/proxyproto"
+)
+
+var (
+	ErrEgressNonSupport = errors.New("egress interface and mark only supported on linux")
+	ErrEgressAddress    = errors.New("invalid egress source address")
+	ErrEgressFamily     = errors.New("no egress source address of destination address family")
+	ErrEgressPool       = errors.New("invalid egress pool policy")
+)
+
+const (
+	// egress source address pool policy.
+	EgressPoolRoundRobin = "round_robin" // default
+	EgressPoolSticky     = "sticky"      // same user always uses the same address, client ip if no username
+)
+
+// Egress select the source of outbound connections to destinations, it's configured globally, per user and
+// per rule, the most specific one wins: rule, user, then global. connections to upstream proxies are not affected.
+// udp relay only uses source address, interface and mark.
+type Egress struct {
+	next uint64 // round robin counter, atomic, first field for 64-bit alignment on 32-bit platforms
+
+	SourceIPs []string `json:"source_ips,omitempty"` // local ips, several ips are a pool, ipv4 and ipv6 can be mixed
+	Pool      string   `json:"pool,omitempty"`       // round_robin or sticky, default is round_robin
+	Interface string   `json:"interface,omitempty"`  // bind to device by SO_BINDTODEVICE, linux only
+	Mark      int      `json:"mark,omitempty"`       // SO_MARK fwmark for policy routing, linux only
+	// send PROXY protocol header of this version (1 or 2) to destination, so it sees the original client address.
+	ProxyProtocol int `json:"proxy_protocol,omitempty"`
+
+	ips []net.IP // parsed source ips, ipv4 in 4-byte form
+}
+
+// compile parse source addresses and check options, it must be called before dialing.
+func (e *Egress) compile() error {
+	switch e.Pool {
+	case "":
+		e.Pool = EgressPoolRoundRobin
+	case EgressPoolRoundRobin, EgressPoolSticky:
+	default:
+		return ErrEgressPool
+	}
+	switch e.ProxyProtocol {
+	case 0, proxyproto.Version1, proxyproto.Version2:
+	default:
+		return proxyproto.ErrVersion
+	}
+
+	e.ips = e.ips[:0]
+	for _, s := range e.SourceIPs {
+		ip := net.ParseIP(s)
+		if nil == ip {
+			return ErrEgressAddress
+		}
+		if ipv4 := ip.To4(); nil != ipv4 {
+			ip = ipv4
+		}
+		e.ips = append(e.ips, ip)
+	}
+
+	if e.Interface != "" || e.Mark != 0 {
+		if err := checkEgressSupport(); nil != err {
+			return err
+		}
+	}
+	if e.Interface != "" {
+		if _, err := net.InterfaceByName(e.Interface); nil != err {
+			return err
+		}
+	}
+	return nil
+}
+
+// dial connect "ip:port" address from selected source, key is used by sticky pool.
+// nil egress dials from the default source.
+func (e *Egress) dial(network, addr, key string) (net.Conn, error) {
+	if nil == e {
+		return net.Dial(network, addr)
+	}
+	dialer := &net.Dialer{Control: e.control}
+
+	if len(e.ips) > 0 {
+		host, _, err := net.SplitHostPort(addr)
+		if nil != err {
+			return nil, err
+		}
+		ip := e.selectIP(net.ParseIP(host), key)
+		if nil == ip {
+			return nil, ErrEgressFamily
+		}
+		switch network {
+		case "udp", "udp4", "udp6":
+			dialer.LocalAddr = &net.UDPAddr{IP: ip}
+		default:
+			dialer.LocalAddr = &net.TCPAddr{IP: ip}
+		}
+	}
+	return dialer.Dial(network, addr)
+}
+
+// help func ===========================================================================================================
+
+// bindsSource return true if source address is selected, then destination must be resolved before dialing.
+func (e *Egress) bindsSource() bool {
+	return nil != e && len(e.ips) > 0
+}
+
+// accepts return true if there is a source address of ip family.
+func (e *Egress) accepts(ip net.IP) bool {
+	if !e.bindsSource() {
+		return true
+	}
+	ipv4 := nil != ip.To4()
+	for _, source := range e.ips {
+		if (len(source) == net.IPv4len) == ipv4 {
+			return true
+		}
+	}
+	return false
+}
+
+// selectIP select source address of dst family from pool, nil if no address of the family.
+func (e *Egress) selectIP(dst net.IP, key string) net.IP {
+	ipv4 := nil != dst.To4()
+	candidates := make([]net.IP, 0, len(e.ips))
+	for _, ip := range e.ips {
+		if (len(ip) == net.IPv4len) == ipv4 {
+			candidates = append(candidates, ip)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if e.Pool == EgressPoolSticky {
+		return candidates[crc32.ChecksumIEEE([]byte(key))%uint32(len(candidates))]
+	}
+	return candidates[(atomic.AddUint64(&e.next, 1)-1)%uint64(len(candidates))]
+}
+
+// egress return egress of session, rule egress wins over user egress, user egress wins over global egress.
+func (s *Server) egress(route *Route, username string) *Egress {
+	if nil != route && nil != route.Rule && nil != route.Rule.Egress {
+		return route.Rule.Egress
+	}
+	if username != "" {
+		if egress := s.UserEgress[username]; nil != egress {
+			return egress
+		}
+	}
+	return s.Egress
+}
+
+// egressKey return the sticky pool key of session.
+func egressKey(session *Session) string {
+	if nil == session {
+		return ""
+	}
+	if session.Username != "" {
+		return session.Username
+	}
+	host, _, _ := net.SplitHostPort(session.ClientAddr.String())
+	return host
+}
+
+func (s *Server) compileEgress() error {
+	if nil != s.Egress {
+		if err := s.Egress.compile(); nil != err {
+			return err
+		}
+	}
+	for _, egress := range s.UserEgress {
+		if err := egress.compile(); nil != err {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package socks5
+
+import (
+	"syscall"
+)
+
+func checkEgressSupport() error {
+	return nil
+}
+
+// control set SO_BINDTODEVICE and SO_MARK before connecting, both need privileges (CAP_NET_RAW, CAP_NET_ADMIN).
+func (e *Egress) control(network, address string, c syscall.RawConn) error {
+	if e.Interface == "" && e.Mark == 0 {
+		return nil
+	}
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		if e.Interface != "" {
+			if serr = syscall.BindToDevice(int(fd), e.Interface); nil != serr {
+				return
+			}
+		}
+		if e.Mark != 0 {
+			serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, e.Mark)
+		}
+	})
+	if nil != err {
+		return err
+	}
+	return serr
+}
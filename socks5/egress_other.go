@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import (
+	"syscall"
+)
+
+func checkEgressSupport() error {
+	return ErrEgressNonSupport
+}
+
+func (e *Egress) control(network, address string, c syscall.RawConn) error {
+	if e.Interface != "" || e.Mark != 0 {
+		return ErrEgressNonSupport
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package socks5
+
+import (
+	"net"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func newTestEgress(t *testing.T, pool string, ips ...string) *Egress {
+	e := &Egress{SourceIPs: ips, Pool: pool}
+	if err := e.compile(); nil != err {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEgressPool(t *testing.T) {
+	dst4, dst6 := net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")
+
+	e := newTestEgress(t, "", "10.0.0.1", "2001:db8::a", "10.0.0.2")
+	got := []string{e.selectIP(dst4, "").String(), e.selectIP(dst4, "").String(), e.selectIP(dst4, "").String()}
+	if got[0] == got[1] || got[0] != got[2] {
+		t.Fatalf("round robin picks %v", got)
+	}
+	if ip := e.selectIP(dst6, ""); !ip.Equal(net.ParseIP("2001:db8::a")) {
+		t.Fatalf("ipv6 destination from %v", ip)
+	}
+
+	e = newTestEgress(t, EgressPoolSticky, "10.0.0.1", "10.0.0.2", "10.0.0.3")
+	for _, user := range []string{"alice", "bob", "carol"} {
+		first := e.selectIP(dst4, user)
+		for i := 0; i < 5; i++ {
+			if ip := e.selectIP(dst4, user); !ip.Equal(first) {
+				t.Fatalf("%s moved from %v to %v", user, first, ip)
+			}
+		}
+	}
+
+	// no source of destination family, the kernel default must not be used.
+	e = newTestEgress(t, "", "10.0.0.1")
+	if e.accepts(dst6) || nil != e.selectIP(dst6, "") {
+		t.Fatal("ipv6 destination accepted by ipv4 pool")
+	}
+	if _, err := e.dial("tcp", "[2001:db8::1]:80", ""); err != ErrEgressFamily {
+		t.Fatalf("got %v, want %v", err, ErrEgressFamily)
+	}
+	if !(*Egress)(nil).accepts(dst6) || !newTestEgress(t, "").accepts(dst6) {
+		t.Fatal("egress without source ips must accept any destination")
+	}
+}
+
+func TestEgressCompile(t *testing.T) {
+	tests := []struct {
+		egress *Egress
+		err    error
+	}{
+		{&Egress{Pool: "random"}, ErrEgressPool},
+		{&Egress{SourceIPs: []string{"10.0.0"}}, ErrEgressAddress},
+	}
+	for i, test := range tests {
+		if err := test.egress.compile(); err != test.err {
+			t.Errorf("%d: got %v, want %v", i, err, test.err)
+		}
+	}
+	if err := (&Egress{Mark: 1}).compile(); runtime.GOOS != "linux" && err != ErrEgressNonSupport {
+		t.Errorf("got %v, want %v", err, ErrEgressNonSupport)
+	}
+	if err := (&Egress{Interface: "no-such-interface0"}).compile(); nil == err {
+		t.Error("unknown interface accepted")
+	}
+
+	rules := &RuleSet{Rules: []*Rule{{Action: RuleActionAllow, Egress: &Egress{Pool: "random"}}}}
+	if err := rules.compile(); err != ErrEgressPool {
+		t.Fatalf("got %v, want %v", err, ErrEgressPool)
+	}
+}
+
+func TestEgressDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if nil != err {
+				return
+			}
+			accepted <- conn.RemoteAddr()
+			conn.Close()
+		}
+	}()
+
+	e := newTestEgress(t, "", "127.0.0.2")
+	conn, err := e.dial("tcp", ln.Addr().String(), "")
+	if nil != err {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if src := (<-accepted).(*net.TCPAddr); !src.IP.Equal(net.ParseIP("127.0.0.2")) {
+		t.Fatalf("connection from %v", src)
+	}
+
+	// interface and mark need privileges.
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("interface and mark need root on linux")
+	}
+	e = &Egress{Interface: "lo", Mark: 0x20}
+	if err := e.compile(); nil != err {
+		t.Skip(err)
+	}
+	conn, err = e.dial("tcp", ln.Addr().String(), "")
+	if nil != err {
+		t.Skip(err) // sandbox without CAP_NET_ADMIN
+	}
+	conn.Close()
+	<-accepted
+}
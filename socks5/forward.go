@@ -0,0 +1,284 @@
+package socks5
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrForwardNetwork = errors.New("invalid forward network, only tcp and udp supported")
+)
+
+// Forward is a local port forwarding mapping, like "ssh -L".
+type Forward struct {
+	Network string // "tcp" or "udp"
+	Local   string // local listen address, e.g. "127.0.0.1:5432"
+	Remote  string // destination address, e.g. "db.internal:5432", domain is resolved by proxy server
+}
+
+// Forwarder listen every forward local address, and forward accepted connections through socks proxy server.
+type Forwarder struct {
+	ClientConfig
+	Forwards []Forward
+
+	mu        sync.Mutex
+	listeners []interface{ Close() error }
+	stopped   bool
+}
+
+func NewForwarder(username, password, proxyAddr string, forwards []Forward) *Forwarder {
+	return &Forwarder{
+		ClientConfig: ClientConfig{
+			Username:  username,
+			Password:  password,
+			ProxyAddr: proxyAddr,
+		},
+		Forwards: forwards,
+	}
+}
+
+// Run start all forwards, it blocks until one of them fails, then the others are stopped too.
+func (f *Forwarder) Run() error {
+	for _, forward := range f.Forwards {
+		if forward.Network != "tcp" && forward.Network != "udp" {
+			return ErrForwardNetwork
+		}
+	}
+
+	f.mu.Lock()
+	f.stopped = false
+	f.mu.Unlock()
+
+	errch := make(chan error, len(f.Forwards))
+	for _, forward := range f.Forwards {
+		forward := forward
+		go func() {
+			if forward.Network == "tcp" {
+				errch <- f.runTCP(forward)
+			} else {
+				errch <- f.runUDP(forward)
+			}
+		}()
+	}
+	err := <-errch
+	f.Stop()
+	return err
+}
+
+// Stop close all listeners, listeners opened after Stop are closed at once.
+func (f *Forwarder) Stop() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stopped = true
+	for _, ln := range f.listeners {
+		ln.Close()
+	}
+	f.listeners = nil
+}
+
+// track keep listener to be closed by Stop, it's closed at once if already stopped, so its serving loop returns.
+func (f *Forwarder) track(ln interface{ Close() error }) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stopped {
+		ln.Close()
+		return
+	}
+	f.listeners = append(f.listeners, ln)
+}
+
+// tcp forward =========================================================================================================
+
+func (f *Forwarder) runTCP(forward Forward) error {
+	ln, err := net.Listen("tcp", forward.Local)
+	if nil != err {
+		return err
+	}
+	f.track(ln)
+	defer ln.Close()
+
+	log.Printf("forward tcp %s -> %s via %s", ln.Addr(), forward.Remote, f.ProxyAddr)
+	for {
+		conn, err := ln.Accept()
+		if nil != err {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go f.forwardTCP(conn, forward)
+	}
+}
+
+func (f *Forwarder) forwardTCP(conn net.Conn, forward Forward) {
+	defer conn.Close()
+
+	remoteConn, err := f.Connect(forward.Remote)
+	if nil != err {
+		log.Printf("forward %s: %v", forward.Remote, err)
+		return
+	}
+
+	bridge(conn, remoteConn, f.TCPDeadline, nil, nil)
+}
+
+// udp forward =========================================================================================================
+
+// udpForward is a running udp forward, one udp associate per local client address.
+type udpForward struct {
+	Forward
+	conn *net.UDPConn
+
+	mu       sync.Mutex
+	mappings map[string]*udpForwardMapping
+	closed   bool
+}
+
+// udpForwardMapping is the udp associate of a local client, datagrams are queued while it's being created.
+type udpForwardMapping struct {
+	lastSend  int64          // unix nano of last datagram from client, atomic, first field for 64-bit alignment
+	proxyConn *ClientUDPConn // nil while associating
+	queue     [][]byte
+}
+
+func (f *Forwarder) runUDP(forward Forward) error {
+	addr, err := net.ResolveUDPAddr("udp", forward.Local)
+	if nil != err {
+		return err
+	}
+	udpConn, err := net.ListenUDP("udp", addr)
+	if nil != err {
+		return err
+	}
+	f.track(udpConn)
+	defer udpConn.Close()
+
+	u := &udpForward{Forward: forward, conn: udpConn, mappings: make(map[string]*udpForwardMapping)}
+	defer u.close()
+
+	log.Printf("forward udp %s -> %s via %s", udpConn.LocalAddr(), forward.Remote, f.ProxyAddr)
+	var buff [64 * 1024]byte
+	for {
+		n, client, err := udpConn.ReadFromUDP(buff[:])
+		if nil != err {
+			return err
+		}
+
+		// the first datagram of client only starts the udp associate in another goroutine, so a slow proxy
+		// doesn't block other clients, datagrams are queued until it's ready.
+		key := client.String()
+		u.mu.Lock()
+		m, ok := u.mappings[key]
+		if !ok || nil == m.proxyConn {
+			if !ok {
+				m = &udpForwardMapping{}
+				u.mappings[key] = m
+				go f.serveUDPMapping(u, client, m)
+			}
+			if len(m.queue) < maxUDPSetupQueue {
+				m.queue = append(m.queue, append([]byte(nil), buff[:n]...))
+			}
+			u.mu.Unlock()
+			continue
+		}
+		u.mu.Unlock()
+
+		atomic.StoreInt64(&m.lastSend, time.Now().UnixNano())
+		if _, err := m.proxyConn.WriteTo(buff[:n], forward.Remote); nil != err {
+			log.Printf("forward %s: %v", forward.Remote, err)
+		}
+	}
+}
+
+// serveUDPMapping create udp associate of client, send queued datagrams, then write remote responses back to
+// client until neither side sent anything in udp deadline.
+func (f *Forwarder) serveUDPMapping(u *udpForward, client *net.UDPAddr, m *udpForwardMapping) {
+	key := client.String()
+	proxyConn, err := f.associate()
+
+	u.mu.Lock()
+	if nil != err || u.closed {
+		delete(u.mappings, key)
+		u.mu.Unlock()
+		if nil != err {
+			log.Printf("forward %s: %v", u.Remote, err)
+		} else {
+			proxyConn.Close()
+		}
+		return
+	}
+	// queued datagrams are sent before the mapping is ready, so they are not reordered by later ones.
+	for _, data := range m.queue {
+		if _, err := proxyConn.WriteTo(data, u.Remote); nil != err {
+			delete(u.mappings, key)
+			u.mu.Unlock()
+			proxyConn.Close()
+			log.Printf("forward %s: %v", u.Remote, err)
+			return
+		}
+	}
+	atomic.StoreInt64(&m.lastSend, time.Now().UnixNano())
+	m.proxyConn = proxyConn
+	m.queue = nil
+	u.mu.Unlock()
+
+	defer func() {
+		u.mu.Lock()
+		if u.mappings[key] == m {
+			delete(u.mappings, key)
+		}
+		u.mu.Unlock()
+		proxyConn.Close()
+	}()
+	idle := time.Duration(proxyConn.deadline) * time.Second
+	var buff [64 * 1024]byte
+	for {
+		n, _, err := proxyConn.ReadFrom(buff[:])
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// no reply in deadline, but the mapping is alive as long as client keeps sending.
+			if time.Since(time.Unix(0, atomic.LoadInt64(&m.lastSend))) < idle {
+				continue
+			}
+			return
+		}
+		if nil != err {
+			return
+		}
+		if _, err := u.conn.WriteToUDP(buff[:n], client); nil != err {
+			return
+		}
+	}
+}
+
+// close the udp associates, associates still being created are closed when they are ready.
+func (u *udpForward) close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.closed = true
+	for _, m := range u.mappings {
+		if nil != m.proxyConn {
+			m.proxyConn.Close()
+		}
+	}
+}
+
+func (f *Forwarder) associate() (*ClientUDPConn, error) {
+	client, err := f.Dial()
+	if nil != err {
+		return nil, err
+	}
+	proxyConn, err := client.UDPAssociate()
+	if nil != err {
+		client.DstTCPConn.Close()
+		return nil, err
+	}
+	if proxyConn.deadline == 0 {
+		proxyConn.deadline = defaultUDPTimeout
+	}
+	return proxyConn, nil
+}
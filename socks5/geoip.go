@@ -0,0 +1,104 @@
+package socks5
+
+import (
+	"github.com/oschwald/maxminddb-golang"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// GeoTags is the geo information of ip address.
+type GeoTags struct {
+	Country string // ISO 3166-1 alpha-2 country code, e.g. "US"
+	ASN     uint   // autonomous system number
+}
+
+// geoRecord works with both GeoLite2-Country and GeoLite2-ASN databases, missing fields are left empty.
+type geoRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// GeoIP is a local MaxMind database (MMDB format), it can be reloaded without restart.
+type GeoIP struct {
+	Path string
+
+	mu      sync.RWMutex
+	reader  *maxminddb.Reader
+	modTime time.Time
+}
+
+// OpenGeoIP open MMDB file, such as GeoLite2-Country.mmdb or GeoLite2-ASN.mmdb.
+func OpenGeoIP(path string) (*GeoIP, error) {
+	g := &GeoIP{Path: path}
+	if err := g.Reload(); nil != err {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Lookup return geo tags of ip address, tags are empty if not found.
+func (g *GeoIP) Lookup(ip net.IP) (GeoTags, error) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	// reader is closed when router swapped database after reloaded.
+	if nil == g.reader {
+		return GeoTags{}, nil
+	}
+
+	var record geoRecord
+	if err := g.reader.Lookup(ip, &record); nil != err {
+		return GeoTags{}, err
+	}
+	return GeoTags{Country: record.Country.ISOCode, ASN: record.ASN}, nil
+}
+
+// Reload open the database file again, the old one is closed after swapped.
+func (g *GeoIP) Reload() error {
+	info, err := os.Stat(g.Path)
+	if nil != err {
+		return err
+	}
+	reader, err := maxminddb.Open(g.Path)
+	if nil != err {
+		return err
+	}
+
+	g.mu.Lock()
+	old := g.reader
+	g.reader = reader
+	g.modTime = info.ModTime()
+	g.mu.Unlock()
+
+	if nil != old {
+		old.Close()
+	}
+	return nil
+}
+
+// Changed return true if database file modified since last load.
+func (g *GeoIP) Changed() bool {
+	info, err := os.Stat(g.Path)
+	if nil != err {
+		return false
+	}
+
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return !info.ModTime().Equal(g.modTime)
+}
+
+func (g *GeoIP) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if nil == g.reader {
+		return nil
+	}
+	err := g.reader.Close()
+	g.reader = nil
+	return err
+}
@@ -0,0 +1,145 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mmdb data section encoding, see https://maxmind.github.io/MaxMind-DB/
+type mmdbMap [][2]interface{} // ordered key value pairs
+
+func mmdbEncode(buff *bytes.Buffer, v interface{}) {
+	control := func(typ byte, size int) {
+		if typ > 7 {
+			buff.WriteByte(byte(size))
+			buff.WriteByte(typ - 7)
+			return
+		}
+		buff.WriteByte(typ<<5 | byte(size))
+	}
+	switch v := v.(type) {
+	case string:
+		control(2, len(v))
+		buff.WriteString(v)
+	case uint16:
+		control(5, 2)
+		binary.Write(buff, binary.BigEndian, v)
+	case uint32:
+		control(6, 4)
+		binary.Write(buff, binary.BigEndian, v)
+	case uint64:
+		control(9, 8)
+		binary.Write(buff, binary.BigEndian, v)
+	case []interface{}:
+		control(11, len(v))
+		for _, e := range v {
+			mmdbEncode(buff, e)
+		}
+	case mmdbMap:
+		control(7, len(v))
+		for _, kv := range v {
+			mmdbEncode(buff, kv[0])
+			mmdbEncode(buff, kv[1])
+		}
+	default:
+		panic("mmdb: unsupported type")
+	}
+}
+
+// writeTestMMDB write ipv4 database, addresses in network have the record, others are not found.
+func writeTestMMDB(t *testing.T, path, network string, record mmdbMap) {
+	_, ipNet, err := net.ParseCIDR(network)
+	if nil != err {
+		t.Fatal(err)
+	}
+	prefix, _ := ipNet.Mask.Size()
+	ip := ipNet.IP.To4()
+
+	// one node per prefix bit, 24-bit records. the other branch is empty, the last node points to data.
+	nodeCount := uint32(prefix)
+	var tree bytes.Buffer
+	for i := 0; i < prefix; i++ {
+		next := uint32(i + 1)
+		if i == prefix-1 {
+			next = nodeCount + 16 // data section offset 0
+		}
+		records := [2]uint32{nodeCount, nodeCount}
+		records[ip[i/8]>>(7-uint(i%8))&1] = next
+		for _, r := range records {
+			tree.Write([]byte{byte(r >> 16), byte(r >> 8), byte(r)})
+		}
+	}
+
+	var data bytes.Buffer
+	mmdbEncode(&data, record)
+
+	var metadata bytes.Buffer
+	metadata.WriteString("\xAB\xCD\xEFMaxMind.com")
+	mmdbEncode(&metadata, mmdbMap{
+		{"binary_format_major_version", uint16(2)},
+		{"binary_format_minor_version", uint16(0)},
+		{"build_epoch", uint64(time.Now().Unix())},
+		{"database_type", "xproxy-test"},
+		{"description", mmdbMap{{"en", "test"}}},
+		{"ip_version", uint16(4)},
+		{"languages", []interface{}{"en"}},
+		{"node_count", nodeCount},
+		{"record_size", uint16(24)},
+	})
+
+	file := append(tree.Bytes(), make([]byte, 16)...)
+	file = append(file, data.Bytes()...)
+	file = append(file, metadata.Bytes()...)
+	if err := ioutil.WriteFile(path, file, 0644); nil != err {
+		t.Fatal(err)
+	}
+}
+
+func geoRecordOf(country string, asn uint32) mmdbMap {
+	return mmdbMap{{"autonomous_system_number", asn}, {"country", mmdbMap{{"iso_code", country}}}}
+}
+
+func TestGeoIP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	writeTestMMDB(t, path, "10.0.0.0/8", geoRecordOf("US", 64500))
+	g, err := OpenGeoIP(path)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer g.Close()
+
+	if tags, err := g.Lookup(net.ParseIP("10.1.2.3")); nil != err || tags != (GeoTags{Country: "US", ASN: 64500}) {
+		t.Fatalf("got %+v, %v", tags, err)
+	}
+	if tags, err := g.Lookup(net.ParseIP("192.0.2.1")); nil != err || tags != (GeoTags{}) {
+		t.Fatalf("address out of database: %+v, %v", tags, err)
+	}
+
+	// database replaced on disk is reloaded.
+	if g.Changed() {
+		t.Fatal("changed before modified")
+	}
+	writeTestMMDB(t, path, "10.0.0.0/8", geoRecordOf("DE", 64501))
+	later := time.Now().Add(time.Second)
+	os.Chtimes(path, later, later)
+	if !g.Changed() {
+		t.Fatal("modification not detected")
+	}
+	if err := g.Reload(); nil != err {
+		t.Fatal(err)
+	}
+	if tags, _ := g.Lookup(net.ParseIP("10.1.2.3")); tags.Country != "DE" || tags.ASN != 64501 {
+		t.Fatalf("reloaded: %+v", tags)
+	}
+
+	g.Close()
+	if tags, err := g.Lookup(net.ParseIP("10.1.2.3")); nil != err || tags != (GeoTags{}) {
+		t.Fatalf("closed database: %+v, %v", tags, err)
+	}
+}
@@ -0,0 +1,314 @@
+package socks5
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// GSSAPI authentication method.
+// See: https://www.ietf.org/rfc/rfc1961.txt
+//
+// every message after method selected is framed as:
+//
+//	+------+------+------+.......................+
+//	| VER  | MTYP | LEN  |         TOKEN         |
+//	+------+------+------+.......................+
+//	| 0x01 |  1   |  2   | up to 2^16 - 1 octets |
+//	+------+------+------+.......................+
+//
+// context establishment uses MTYP 0x01, protection level negotiation uses MTYP 0x02, then all user data is
+// encapsulated by the established context with MTYP 0x03. MTYP 0xFF aborts the negotiation.
+
+var (
+	ErrGSSAPIVersion    = errors.New("gssapi: bad message version")
+	ErrGSSAPIMessage    = errors.New("gssapi: unexpected message type")
+	ErrGSSAPIAborted    = errors.New("gssapi: negotiation aborted by peer")
+	ErrGSSAPIProtection = errors.New("gssapi: protection level not acceptable")
+	ErrGSSAPIToken      = errors.New("gssapi: bad token")
+)
+
+const (
+	GSSAPIVer byte = 0x01
+
+	gssMessageAuth       byte = 0x01
+	gssMessageProtection byte = 0x02
+	gssMessageData       byte = 0x03
+	gssMessageAbort      byte = 0xFF
+
+	// per-message protection levels.
+	GSSProtectionIntegrity       byte = 0x01
+	GSSProtectionConfidentiality byte = 0x02
+	GSSProtectionSelective       byte = 0x03 // integrity or confidentiality selected per message
+
+	gssMaxPayload = 32 * 1024
+)
+
+// GSSContext is an established security context, it protects per-message data.
+type GSSContext interface {
+	Wrap(payload []byte, confidential bool) ([]byte, error)
+	Unwrap(token []byte) ([]byte, error)
+}
+
+// GSSAcceptor establish security context on server side, one acceptor per connection.
+// Accept consume a token from initiator, return the token for initiator, ctx is non-nil when context established,
+// principal is the authenticated identity of initiator.
+type GSSAcceptor interface {
+	Accept(token []byte) (reply []byte, ctx GSSContext, principal string, err error)
+}
+
+// GSSInitiator establish security context on client side, one initiator per connection.
+// Init is called with nil token first, then with every token from acceptor until ctx is non-nil.
+type GSSInitiator interface {
+	Init(token []byte) (out []byte, ctx GSSContext, err error)
+}
+
+// GSSAPIServerAuthenticator is server side of GSSAPI method, kerberos acceptor is created by
+// NewGSSAPIServerAuthenticator, other mechanisms can be plugged by NewAcceptor.
+type GSSAPIServerAuthenticator struct {
+	NewAcceptor   func(conn net.Conn) (GSSAcceptor, error)
+	MinProtection byte                                   // lowest accepted level, default is integrity
+	MapPrincipal  func(principal string) (string, error) // map principal to session username, default is principal
+}
+
+func (a *GSSAPIServerAuthenticator) Method() byte {
+	return MethodGSSAPI
+}
+
+func (a *GSSAPIServerAuthenticator) Authenticate(conn net.Conn) (net.Conn, string, error) {
+	acceptor, err := a.NewAcceptor(conn)
+	if nil != err {
+		writeGSSMessage(conn, gssMessageAbort, nil)
+		return nil, "", err
+	}
+
+	// step 1: establish security context.
+	var ctx GSSContext
+	var principal string
+	for nil == ctx {
+		token, err := readGSSMessage(conn, gssMessageAuth)
+		if nil != err {
+			return nil, "", err
+		}
+		var reply []byte
+		reply, ctx, principal, err = acceptor.Accept(token)
+		if nil != err {
+			writeGSSMessage(conn, gssMessageAbort, nil)
+			return nil, "", err
+		}
+		if err := writeGSSMessage(conn, gssMessageAuth, reply); nil != err {
+			return nil, "", err
+		}
+	}
+
+	username := principal
+	if nil != a.MapPrincipal {
+		if username, err = a.MapPrincipal(principal); nil != err {
+			writeGSSMessage(conn, gssMessageAbort, nil)
+			return nil, "", err
+		}
+	}
+
+	// step 2: select protection level, the client decides whether to accept it.
+	token, err := readGSSMessage(conn, gssMessageProtection)
+	if nil != err {
+		return nil, "", err
+	}
+	level, err := ctx.Unwrap(token)
+	if nil != err || len(level) != 1 {
+		writeGSSMessage(conn, gssMessageAbort, nil)
+		return nil, "", ErrGSSAPIToken
+	}
+	selected := level[0]
+	if min := a.MinProtection; selected < min {
+		selected = min
+	}
+	if selected < GSSProtectionIntegrity {
+		selected = GSSProtectionIntegrity
+	}
+	if selected > GSSProtectionSelective {
+		selected = GSSProtectionSelective
+	}
+	if token, err = ctx.Wrap([]byte{selected}, false); nil != err {
+		return nil, "", err
+	}
+	if err := writeGSSMessage(conn, gssMessageProtection, token); nil != err {
+		return nil, "", err
+	}
+	return newGSSConn(conn, ctx, selected), username, nil
+}
+
+// GSSAPIClientAuthenticator is client side of GSSAPI method, kerberos initiator is created by
+// NewGSSAPIClientAuthenticator.
+type GSSAPIClientAuthenticator struct {
+	NewInitiator func() (GSSInitiator, error)
+	Protection   byte // required level, default is integrity
+}
+
+func (a *GSSAPIClientAuthenticator) Method() byte {
+	return MethodGSSAPI
+}
+
+func (a *GSSAPIClientAuthenticator) Authenticate(conn net.Conn) (net.Conn, error) {
+	initiator, err := a.NewInitiator()
+	if nil != err {
+		writeGSSMessage(conn, gssMessageAbort, nil)
+		return nil, err
+	}
+
+	// step 1: establish security context.
+	out, ctx, err := initiator.Init(nil)
+	if nil != err {
+		writeGSSMessage(conn, gssMessageAbort, nil)
+		return nil, err
+	}
+	for {
+		if err := writeGSSMessage(conn, gssMessageAuth, out); nil != err {
+			return nil, err
+		}
+		reply, err := readGSSMessage(conn, gssMessageAuth)
+		if nil != err {
+			return nil, err
+		}
+		if nil != ctx {
+			break
+		}
+		if out, ctx, err = initiator.Init(reply); nil != err {
+			writeGSSMessage(conn, gssMessageAbort, nil)
+			return nil, err
+		}
+		if nil != ctx && len(out) == 0 {
+			break
+		}
+	}
+
+	// step 2: request protection level.
+	required := a.Protection
+	if required == 0 {
+		required = GSSProtectionIntegrity
+	}
+	token, err := ctx.Wrap([]byte{required}, false)
+	if nil != err {
+		return nil, err
+	}
+	if err := writeGSSMessage(conn, gssMessageProtection, token); nil != err {
+		return nil, err
+	}
+	if token, err = readGSSMessage(conn, gssMessageProtection); nil != err {
+		return nil, err
+	}
+	level, err := ctx.Unwrap(token)
+	if nil != err || len(level) != 1 {
+		return nil, ErrGSSAPIToken
+	}
+	if level[0] < required {
+		writeGSSMessage(conn, gssMessageAbort, nil)
+		return nil, ErrGSSAPIProtection
+	}
+	return newGSSConn(conn, ctx, level[0]), nil
+}
+
+// help func ===========================================================================================================
+
+func writeGSSMessage(conn net.Conn, mtyp byte, token []byte) error {
+	if mtyp == gssMessageAbort {
+		_, err := conn.Write([]byte{GSSAPIVer, gssMessageAbort})
+		return err
+	}
+	if len(token) > 0xFFFF {
+		return ErrGSSAPIToken
+	}
+	message := make([]byte, 4+len(token))
+	message[0] = GSSAPIVer
+	message[1] = mtyp
+	message[2] = byte(len(token) >> 8)
+	message[3] = byte(len(token))
+	copy(message[4:], token)
+	_, err := conn.Write(message)
+	return err
+}
+
+// readGSSMessage read message of expected type, abort message from peer is returned as ErrGSSAPIAborted.
+func readGSSMessage(conn net.Conn, mtyp byte) ([]byte, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); nil != err {
+		return nil, err
+	}
+	if header[0] != GSSAPIVer {
+		return nil, ErrGSSAPIVersion
+	}
+	// abort message has no length and token.
+	if header[1] == gssMessageAbort {
+		return nil, ErrGSSAPIAborted
+	}
+	if header[1] != mtyp {
+		return nil, ErrGSSAPIMessage
+	}
+
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); nil != err {
+		return nil, err
+	}
+	token := make([]byte, int(length[0])<<8|int(length[1]))
+	if _, err := io.ReadFull(conn, token); nil != err {
+		return nil, err
+	}
+	return token, nil
+}
+
+// gssConn encapsulate user data with established context after authentication.
+type gssConn struct {
+	net.Conn
+	ctx          GSSContext
+	confidential bool
+
+	readMu sync.Mutex
+	plain  []byte
+
+	writeMu sync.Mutex
+}
+
+func newGSSConn(conn net.Conn, ctx GSSContext, level byte) *gssConn {
+	return &gssConn{Conn: conn, ctx: ctx, confidential: level >= GSSProtectionConfidentiality}
+}
+
+func (c *gssConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.plain) == 0 {
+		token, err := readGSSMessage(c.Conn, gssMessageData)
+		if nil != err {
+			return 0, err
+		}
+		if c.plain, err = c.ctx.Unwrap(token); nil != err {
+			return 0, err
+		}
+	}
+	n := copy(b, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+func (c *gssConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for written < len(b) {
+		n := len(b) - written
+		if n > gssMaxPayload {
+			n = gssMaxPayload
+		}
+		token, err := c.ctx.Wrap(b[written:written+n], c.confidential)
+		if nil != err {
+			return written, err
+		}
+		if err := writeGSSMessage(c.Conn, gssMessageData, token); nil != err {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
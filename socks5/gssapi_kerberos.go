@@ -0,0 +1,421 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"encoding/binary"
+	"errors"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/asn1tools"
+	"github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/crypto"
+	"github.com/jcmturner/gokrb5/v8/gssapi"
+	"github.com/jcmturner/gokrb5/v8/iana"
+	"github.com/jcmturner/gokrb5/v8/iana/asnAppTag"
+	"github.com/jcmturner/gokrb5/v8/iana/chksumtype"
+	krbflags "github.com/jcmturner/gokrb5/v8/iana/flags"
+	"github.com/jcmturner/gokrb5/v8/iana/keyusage"
+	"github.com/jcmturner/gokrb5/v8/iana/msgtype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/service"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"net"
+)
+
+// Kerberos V5 mechanism of GSSAPI.
+// See: https://www.ietf.org/rfc/rfc4121.txt
+//
+// the context is established by one AP-REQ, acceptor replies AP-REP if initiator requests mutual authentication.
+// acceptor never chooses its own subkey, the ticket session key (or authenticator subkey if present) protects
+// per-message tokens of both directions.
+
+var (
+	ErrKerberosToken    = errors.New("kerberos: bad context token")
+	ErrKerberosWrap     = errors.New("kerberos: bad wrap token")
+	ErrKerberosSequence = errors.New("kerberos: wrap token out of sequence")
+	ErrKerberosMutual   = errors.New("kerberos: mutual authentication failed")
+)
+
+const (
+	// RFC 4121 key usages of wrap token.
+	keyUsageAcceptorSeal  uint32 = 22
+	keyUsageAcceptorSign  uint32 = 23
+	keyUsageInitiatorSeal uint32 = 24
+	keyUsageInitiatorSign uint32 = 25
+
+	wrapFlagSentByAcceptor byte = 0x01
+	wrapFlagSealed         byte = 0x02
+
+	wrapHeaderSize = 16
+
+	// TOK_ID of initial context tokens.
+	tokenIDAPReq uint16 = 0x0100
+	tokenIDAPRep uint16 = 0x0200
+)
+
+// NewGSSAPIServerAuthenticator create kerberos acceptor from keytab, servicePrincipal selects the keytab entry,
+// such as "socks/proxy.example.com", empty means the service name in ticket.
+func NewGSSAPIServerAuthenticator(keytabPath, servicePrincipal string) (*GSSAPIServerAuthenticator, error) {
+	kt, err := keytab.Load(keytabPath)
+	if nil != err {
+		return nil, err
+	}
+	return &GSSAPIServerAuthenticator{
+		NewAcceptor: func(conn net.Conn) (GSSAcceptor, error) {
+			return NewKerberosAcceptor(kt, servicePrincipal, conn.RemoteAddr()), nil
+		},
+	}, nil
+}
+
+// NewGSSAPIClientAuthenticator create kerberos initiator from credential cache, such as the one created by kinit.
+// krb5Conf is used to find KDC when the service ticket is not cached, servicePrincipal is the proxy server service,
+// such as "socks/proxy.example.com". mutual requests AP-REP, so the proxy server is authenticated too.
+func NewGSSAPIClientAuthenticator(ccachePath, krb5Conf, servicePrincipal string, protection byte, mutual bool) (*GSSAPIClientAuthenticator, error) {
+	ccache, err := credentials.LoadCCache(ccachePath)
+	if nil != err {
+		return nil, err
+	}
+	conf, err := config.Load(krb5Conf)
+	if nil != err {
+		return nil, err
+	}
+	cl, err := client.NewFromCCache(ccache, conf, client.DisablePAFXFAST(true))
+	if nil != err {
+		return nil, err
+	}
+	return &GSSAPIClientAuthenticator{
+		NewInitiator: func() (GSSInitiator, error) {
+			return &KerberosInitiator{Credentials: cl.Credentials, Tickets: cl, ServicePrincipal: servicePrincipal, Mutual: mutual}, nil
+		},
+		Protection: protection,
+	}, nil
+}
+
+// KerberosAcceptor verify AP-REQ of initiator by service keytab.
+type KerberosAcceptor struct {
+	settings *service.Settings
+}
+
+func NewKerberosAcceptor(kt *keytab.Keytab, servicePrincipal string, remoteAddr net.Addr) *KerberosAcceptor {
+	options := []func(*service.Settings){service.DecodePAC(false)}
+	if servicePrincipal != "" {
+		options = append(options, service.KeytabPrincipal(servicePrincipal))
+	}
+	if nil != remoteAddr {
+		// tickets with addresses are only valid from these addresses.
+		if addr, err := types.GetHostAddress(remoteAddr.String()); nil == err {
+			options = append(options, service.ClientAddress(addr))
+		}
+	}
+	return &KerberosAcceptor{settings: service.NewSettings(kt, options...)}
+}
+
+func (a *KerberosAcceptor) Accept(token []byte) ([]byte, GSSContext, string, error) {
+	var krb5Token spnego.KRB5Token
+	if err := krb5Token.Unmarshal(token); nil != err {
+		return nil, nil, "", err
+	}
+	if !krb5Token.IsAPReq() {
+		return nil, nil, "", ErrKerberosToken
+	}
+
+	apReq := &krb5Token.APReq
+	ok, creds, err := service.VerifyAPREQ(apReq, a.settings)
+	if nil != err {
+		return nil, nil, "", err
+	}
+	if !ok {
+		return nil, nil, "", ErrKerberosToken
+	}
+
+	// acceptor uses the sequence number of initiator, it's sent back in AP-REP if mutual authentication requested.
+	var reply []byte
+	if flags := authenticatorFlags(apReq.Authenticator); flags&gssapi.ContextFlagMutual != 0 {
+		if reply, err = newAPRepToken(apReq); nil != err {
+			return nil, nil, "", err
+		}
+	}
+
+	key := apReq.Ticket.DecryptedEncPart.Key
+	if len(apReq.Authenticator.SubKey.KeyValue) > 0 {
+		key = apReq.Authenticator.SubKey
+	}
+	seq := uint64(apReq.Authenticator.SeqNumber)
+	ctx := &kerberosContext{key: key, acceptor: true, sendSeq: seq, recvSeq: seq}
+	principal := creds.CName().PrincipalNameString() + "@" + creds.Realm()
+	return reply, ctx, principal, nil
+}
+
+// KerberosTicketSource provide service ticket and its session key, client of gokrb5 implements it by TGS exchange,
+// a KDC stand-in can mint tickets from service keytab directly.
+type KerberosTicketSource interface {
+	GetServiceTicket(spn string) (messages.Ticket, types.EncryptionKey, error)
+}
+
+// KerberosInitiator create AP-REQ for proxy server service.
+type KerberosInitiator struct {
+	Credentials      *credentials.Credentials // client principal and realm
+	Tickets          KerberosTicketSource
+	ServicePrincipal string
+	Mutual           bool // request mutual authentication, server is verified by its AP-REP
+
+	sessionKey    types.EncryptionKey // waiting AP-REP of mutual authentication
+	authenticator types.Authenticator
+}
+
+func (i *KerberosInitiator) Init(token []byte) ([]byte, GSSContext, error) {
+	if nil != token {
+		// only AP-REP of mutual authentication is expected.
+		if !i.Mutual || 0 == len(i.sessionKey.KeyValue) {
+			return nil, nil, ErrKerberosToken
+		}
+		ctx, err := i.verifyAPRep(token)
+		return nil, ctx, err
+	}
+
+	ticket, sessionKey, err := i.Tickets.GetServiceTicket(i.ServicePrincipal)
+	if nil != err {
+		return nil, nil, err
+	}
+	authenticator, err := types.NewAuthenticator(i.Credentials.Domain(), i.Credentials.CName())
+	if nil != err {
+		return nil, nil, err
+	}
+	flags := gssapi.ContextFlagInteg | gssapi.ContextFlagConf | gssapi.ContextFlagSequence
+	if i.Mutual {
+		flags |= gssapi.ContextFlagMutual
+	}
+	authenticator.Cksum = types.Checksum{
+		CksumType: chksumtype.GSSAPI,
+		Checksum:  newAuthenticatorChecksum(flags),
+	}
+	apReq, err := messages.NewAPReq(ticket, sessionKey, authenticator)
+	if nil != err {
+		return nil, nil, err
+	}
+	if i.Mutual {
+		types.SetFlag(&apReq.APOptions, krbflags.APOptionMutualRequired)
+	}
+	apReqBytes, err := apReq.Marshal()
+	if nil != err {
+		return nil, nil, err
+	}
+	out, err := newContextToken(tokenIDAPReq, apReqBytes)
+	if nil != err {
+		return nil, nil, err
+	}
+
+	// context is established after AP-REP verified.
+	if i.Mutual {
+		i.sessionKey, i.authenticator = sessionKey, authenticator
+		return out, nil, nil
+	}
+	seq := uint64(authenticator.SeqNumber)
+	return out, &kerberosContext{key: sessionKey, acceptor: false, sendSeq: seq, recvSeq: seq}, nil
+}
+
+// verifyAPRep check AP-REP is encrypted by session key and echoes the time of authenticator.
+func (i *KerberosInitiator) verifyAPRep(token []byte) (GSSContext, error) {
+	var krb5Token spnego.KRB5Token
+	if err := krb5Token.Unmarshal(token); nil != err {
+		return nil, err
+	}
+	if !krb5Token.IsAPRep() {
+		return nil, ErrKerberosToken
+	}
+	plain, err := crypto.DecryptEncPart(krb5Token.APRep.EncPart, i.sessionKey, keyusage.AP_REP_ENCPART)
+	if nil != err {
+		return nil, ErrKerberosMutual
+	}
+	var part messages.EncAPRepPart
+	if err := part.Unmarshal(plain); nil != err {
+		return nil, ErrKerberosMutual
+	}
+	if part.CTime.Unix() != i.authenticator.CTime.Unix() || part.Cusec != i.authenticator.Cusec {
+		return nil, ErrKerberosMutual
+	}
+
+	key := i.sessionKey
+	if len(part.Subkey.KeyValue) > 0 {
+		key = part.Subkey
+	}
+	return &kerberosContext{
+		key:      key,
+		acceptor: false,
+		sendSeq:  uint64(i.authenticator.SeqNumber),
+		recvSeq:  uint64(part.SequenceNumber),
+	}, nil
+}
+
+// kerberosContext wrap and unwrap per-message tokens of RFC 4121, EC is zero and RRC is ignored on sending.
+type kerberosContext struct {
+	key      types.EncryptionKey
+	acceptor bool
+	sendSeq  uint64 // Wrap and Unwrap are called by writer and reader separately, sequences are not shared.
+	recvSeq  uint64
+}
+
+func (c *kerberosContext) Wrap(payload []byte, confidential bool) ([]byte, error) {
+	etype, err := crypto.GetEtype(c.key.KeyType)
+	if nil != err {
+		return nil, err
+	}
+
+	var flags byte
+	sealUsage, signUsage := keyUsageInitiatorSeal, keyUsageInitiatorSign
+	if c.acceptor {
+		flags |= wrapFlagSentByAcceptor
+		sealUsage, signUsage = keyUsageAcceptorSeal, keyUsageAcceptorSign
+	}
+
+	var token []byte
+	if confidential {
+		flags |= wrapFlagSealed
+		header := wrapHeader(flags, 0, 0, c.sendSeq)
+		// encrypt { payload | header }, EC is zero so there is no filler.
+		_, encrypted, err := etype.EncryptMessage(c.key.KeyValue, append(append([]byte(nil), payload...), header...), sealUsage)
+		if nil != err {
+			return nil, err
+		}
+		token = append(header, encrypted...)
+	} else {
+		// checksum { payload | header with zero EC and RRC }
+		checksum, err := etype.GetChecksumHash(c.key.KeyValue, append(append([]byte(nil), payload...), wrapHeader(flags, 0, 0, c.sendSeq)...), signUsage)
+		if nil != err {
+			return nil, err
+		}
+		token = wrapHeader(flags, uint16(len(checksum)), 0, c.sendSeq)
+		token = append(token, payload...)
+		token = append(token, checksum...)
+	}
+	c.sendSeq++
+	return token, nil
+}
+
+func (c *kerberosContext) Unwrap(token []byte) ([]byte, error) {
+	if len(token) < wrapHeaderSize || token[0] != 0x05 || token[1] != 0x04 || token[3] != 0xFF {
+		return nil, ErrKerberosWrap
+	}
+	flags := token[2]
+	// tokens from peer must be sent by the other side.
+	if (flags&wrapFlagSentByAcceptor != 0) == c.acceptor {
+		return nil, ErrKerberosWrap
+	}
+	ec := int(binary.BigEndian.Uint16(token[4:6]))
+	rrc := int(binary.BigEndian.Uint16(token[6:8]))
+	seq := binary.BigEndian.Uint64(token[8:16])
+	if seq != c.recvSeq {
+		return nil, ErrKerberosSequence
+	}
+
+	etype, err := crypto.GetEtype(c.key.KeyType)
+	if nil != err {
+		return nil, err
+	}
+	sealUsage, signUsage := keyUsageAcceptorSeal, keyUsageAcceptorSign
+	if c.acceptor {
+		sealUsage, signUsage = keyUsageInitiatorSeal, keyUsageInitiatorSign
+	}
+
+	// undo right rotation of data after header.
+	data := token[wrapHeaderSize:]
+	if len(data) > 0 && rrc > 0 {
+		rrc %= len(data)
+		data = append(append([]byte(nil), data[rrc:]...), data[:rrc]...)
+	}
+
+	var payload []byte
+	if flags&wrapFlagSealed != 0 {
+		plain, err := etype.DecryptMessage(c.key.KeyValue, data, sealUsage)
+		if nil != err {
+			return nil, ErrKerberosWrap
+		}
+		// plain is { payload | filler(EC) | header }, header copy has zero RRC.
+		if len(plain) < ec+wrapHeaderSize {
+			return nil, ErrKerberosWrap
+		}
+		header := plain[len(plain)-wrapHeaderSize:]
+		if !bytes.Equal(header, wrapHeader(flags, uint16(ec), 0, seq)) {
+			return nil, ErrKerberosWrap
+		}
+		payload = plain[:len(plain)-wrapHeaderSize-ec]
+	} else {
+		if len(data) < ec {
+			return nil, ErrKerberosWrap
+		}
+		payload = data[:len(data)-ec]
+		expected, err := etype.GetChecksumHash(c.key.KeyValue, append(append([]byte(nil), payload...), wrapHeader(flags, 0, 0, seq)...), signUsage)
+		if nil != err {
+			return nil, err
+		}
+		if !hmac.Equal(expected, data[len(data)-ec:]) {
+			return nil, ErrKerberosWrap
+		}
+	}
+	c.recvSeq++
+	return payload, nil
+}
+
+// help func ===========================================================================================================
+
+// newContextToken create initial context token: [APPLICATION 0] { mech oid, TOK_ID, AP-REQ or AP-REP }
+func newContextToken(tokenID uint16, message []byte) ([]byte, error) {
+	oid, err := asn1.Marshal(gssapi.OIDKRB5.OID())
+	if nil != err {
+		return nil, err
+	}
+	inner := append(oid, byte(tokenID>>8), byte(tokenID))
+	inner = append(inner, message...)
+	return asn1tools.AddASNAppTag(inner, 0), nil
+}
+
+// newAPRepToken create AP-REP of verified AP-REQ, it's encrypted by ticket session key.
+// See: https://www.ietf.org/rfc/rfc4120.txt 5.5.2
+func newAPRepToken(apReq *messages.APReq) ([]byte, error) {
+	part, err := asn1.Marshal(messages.EncAPRepPart{
+		CTime:          apReq.Authenticator.CTime,
+		Cusec:          apReq.Authenticator.Cusec,
+		SequenceNumber: apReq.Authenticator.SeqNumber,
+	})
+	if nil != err {
+		return nil, err
+	}
+	encPart, err := crypto.GetEncryptedData(asn1tools.AddASNAppTag(part, asnAppTag.EncAPRepPart),
+		apReq.Ticket.DecryptedEncPart.Key, keyusage.AP_REP_ENCPART, 0)
+	if nil != err {
+		return nil, err
+	}
+	apRep, err := asn1.Marshal(messages.APRep{PVNO: iana.PVNO, MsgType: msgtype.KRB_AP_REP, EncPart: encPart})
+	if nil != err {
+		return nil, err
+	}
+	return newContextToken(tokenIDAPRep, asn1tools.AddASNAppTag(apRep, asnAppTag.APREP))
+}
+
+func wrapHeader(flags byte, ec, rrc uint16, seq uint64) []byte {
+	header := make([]byte, wrapHeaderSize)
+	header[0], header[1], header[2], header[3] = 0x05, 0x04, flags, 0xFF
+	binary.BigEndian.PutUint16(header[4:6], ec)
+	binary.BigEndian.PutUint16(header[6:8], rrc)
+	binary.BigEndian.PutUint64(header[8:16], seq)
+	return header
+}
+
+// newAuthenticatorChecksum create GSSAPI checksum of authenticator, channel binding is not used.
+func newAuthenticatorChecksum(flags int) []byte {
+	checksum := make([]byte, 24)
+	binary.LittleEndian.PutUint32(checksum[:4], 16)
+	binary.LittleEndian.PutUint32(checksum[20:24], uint32(flags))
+	return checksum
+}
+
+func authenticatorFlags(authenticator types.Authenticator) int {
+	if authenticator.Cksum.CksumType != chksumtype.GSSAPI || len(authenticator.Cksum.Checksum) < 24 {
+		return 0
+	}
+	return int(binary.LittleEndian.Uint32(authenticator.Cksum.Checksum[20:24]))
+}
@@ -0,0 +1,287 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/iana/etypeID"
+	"github.com/jcmturner/gokrb5/v8/iana/nametype"
+	"github.com/jcmturner/gokrb5/v8/keytab"
+	"github.com/jcmturner/gokrb5/v8/messages"
+	"github.com/jcmturner/gokrb5/v8/types"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	testRealm   = "EXAMPLE.COM"
+	testService = "socks/proxy.example.com"
+)
+
+// testKDC is a KDC stand-in, it mints service tickets for client from service keytab.
+type testKDC struct {
+	client string
+	kt     *keytab.Keytab
+}
+
+func (k *testKDC) GetServiceTicket(spn string) (messages.Ticket, types.EncryptionKey, error) {
+	now := time.Now().UTC()
+	return messages.NewTicket(types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, k.client), testRealm,
+		types.NewPrincipalName(nametype.KRB_NT_SRV_INST, spn), testRealm, asn1.BitString{Bytes: make([]byte, 4), BitLength: 32},
+		k.kt, etypeID.AES256_CTS_HMAC_SHA1_96, 1, now, now, now.Add(time.Hour), now.Add(time.Hour))
+}
+
+func newTestKeytab(t *testing.T, password string) *keytab.Keytab {
+	kt := keytab.New()
+	if err := kt.AddEntry(testService, testRealm, password, time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); nil != err {
+		t.Fatal(err)
+	}
+	return kt
+}
+
+func newTestInitiator(kt *keytab.Keytab, mutual bool) *KerberosInitiator {
+	return &KerberosInitiator{
+		Credentials:      credentials.New("alice", testRealm),
+		Tickets:          &testKDC{client: "alice", kt: kt},
+		ServicePrincipal: testService,
+		Mutual:           mutual,
+	}
+}
+
+// writeTestCCache write credential cache of alice with TGT and service ticket, so client needs no KDC.
+// See: https://web.mit.edu/kerberos/krb5-latest/doc/formats/ccache_file_format.html
+func writeTestCCache(t *testing.T, kt *keytab.Keytab) string {
+	var b bytes.Buffer
+	writeData := func(data []byte) {
+		binary.Write(&b, binary.BigEndian, uint32(len(data)))
+		b.Write(data)
+	}
+	writePrincipal := func(name types.PrincipalName) {
+		binary.Write(&b, binary.BigEndian, name.NameType)
+		binary.Write(&b, binary.BigEndian, uint32(len(name.NameString)))
+		writeData([]byte(testRealm))
+		for _, component := range name.NameString {
+			writeData([]byte(component))
+		}
+	}
+
+	client := types.NewPrincipalName(nametype.KRB_NT_PRINCIPAL, "alice")
+	b.Write([]byte{0x05, 0x04, 0x00, 0x00}) // version 4 without header fields
+	writePrincipal(client)
+	// TGT is never used, only its entry is required.
+	tgtKeytab := keytab.New()
+	if err := tgtKeytab.AddEntry("krbtgt/"+testRealm, testRealm, "tgt", time.Now(), 1, etypeID.AES256_CTS_HMAC_SHA1_96); nil != err {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for spn, kt := range map[string]*keytab.Keytab{"krbtgt/" + testRealm: tgtKeytab, testService: kt} {
+		ticket, key, err := (&testKDC{client: "alice", kt: kt}).GetServiceTicket(spn)
+		if nil != err {
+			t.Fatal(err)
+		}
+		ticketBytes, err := ticket.Marshal()
+		if nil != err {
+			t.Fatal(err)
+		}
+		writePrincipal(client)
+		writePrincipal(types.NewPrincipalName(nametype.KRB_NT_SRV_INST, spn))
+		binary.Write(&b, binary.BigEndian, uint16(key.KeyType))
+		writeData(key.KeyValue)
+		for _, ts := range []time.Time{now, now.Add(-time.Minute), now.Add(time.Hour), now.Add(time.Hour)} {
+			binary.Write(&b, binary.BigEndian, uint32(ts.Unix()))
+		}
+		b.Write([]byte{0x00, 0x00, 0x00, 0x00, 0x00})                   // is_skey, ticket flags
+		b.Write([]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}) // no addresses and authdata
+		writeData(ticketBytes)
+		writeData(nil)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ccache")
+	if err := ioutil.WriteFile(path, b.Bytes(), 0600); nil != err {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// establish run context establishment between initiator and acceptor.
+func establish(t *testing.T, initiator *KerberosInitiator, acceptor *KerberosAcceptor) (client, server GSSContext) {
+	out, client, err := initiator.Init(nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	reply, server, principal, err := acceptor.Accept(out)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if principal != "alice@"+testRealm {
+		t.Fatalf("principal %q", principal)
+	}
+	if initiator.Mutual {
+		if nil != client || len(reply) == 0 {
+			t.Fatalf("mutual authentication: context %v before AP-REP, reply of %d bytes", client, len(reply))
+		}
+		if out, client, err = initiator.Init(reply); nil != err || len(out) != 0 {
+			t.Fatalf("AP-REP: %d bytes out, %v", len(out), err)
+		}
+	} else if nil != reply {
+		t.Fatalf("reply without mutual authentication: %x", reply)
+	}
+	return client, server
+}
+
+func TestKerberos(t *testing.T) {
+	kt := newTestKeytab(t, "secret")
+	for _, mutual := range []bool{false, true} {
+		client, server := establish(t, newTestInitiator(kt, mutual), NewKerberosAcceptor(kt, testService, nil))
+
+		for _, confidential := range []bool{false, true} {
+			for i, payload := range [][]byte{[]byte("request"), {}, bytes.Repeat([]byte("x"), 4096)} {
+				token, err := client.Wrap(payload, confidential)
+				if nil != err {
+					t.Fatal(err)
+				}
+				if got, err := server.Unwrap(token); nil != err || !bytes.Equal(got, payload) {
+					t.Fatalf("mutual %v, confidential %v, payload %d: %v", mutual, confidential, i, err)
+				}
+				if token, err = server.Wrap(payload, confidential); nil != err {
+					t.Fatal(err)
+				}
+				if got, err := client.Unwrap(token); nil != err || !bytes.Equal(got, payload) {
+					t.Fatalf("mutual %v, confidential %v, reply %d: %v", mutual, confidential, i, err)
+				}
+			}
+		}
+	}
+}
+
+func TestGSSAPIClientAuthenticator(t *testing.T) {
+	kt := newTestKeytab(t, "secret")
+	ccache := writeTestCCache(t, kt)
+	conf := filepath.Join(t.TempDir(), "krb5.conf")
+	if err := ioutil.WriteFile(conf, []byte("[libdefaults]\n default_realm = "+testRealm+"\n"), 0600); nil != err {
+		t.Fatal(err)
+	}
+
+	for _, mutual := range []bool{false, true} {
+		authenticator, err := NewGSSAPIClientAuthenticator(ccache, conf, testService, GSSProtectionIntegrity, mutual)
+		if nil != err {
+			t.Fatal(err)
+		}
+		initiator, err := authenticator.NewInitiator()
+		if nil != err {
+			t.Fatal(err)
+		}
+		kerberos := initiator.(*KerberosInitiator)
+		if kerberos.Mutual != mutual {
+			t.Fatalf("mutual %v, want %v", kerberos.Mutual, mutual)
+		}
+		// establish verifies AP-REP is replied and checked when mutual authentication requested.
+		client, server := establish(t, kerberos, NewKerberosAcceptor(kt, testService, nil))
+		token, _ := client.Wrap([]byte("request"), false)
+		if got, err := server.Unwrap(token); nil != err || string(got) != "request" {
+			t.Fatalf("mutual %v: %q, %v", mutual, got, err)
+		}
+	}
+}
+
+func TestKerberosRejected(t *testing.T) {
+	kt := newTestKeytab(t, "secret")
+
+	// ticket of another service key.
+	out, _, _ := newTestInitiator(newTestKeytab(t, "other"), false).Init(nil)
+	if _, _, _, err := NewKerberosAcceptor(kt, testService, nil).Accept(out); nil == err {
+		t.Error("ticket of wrong key accepted")
+	}
+
+	// AP-REQ replayed.
+	out, _, _ = newTestInitiator(kt, false).Init(nil)
+	if _, _, _, err := NewKerberosAcceptor(kt, testService, nil).Accept(out); nil != err {
+		t.Fatal(err)
+	}
+	if _, _, _, err := NewKerberosAcceptor(kt, testService, nil).Accept(out); nil == err {
+		t.Error("replayed AP-REQ accepted")
+	}
+
+	// AP-REP of another context doesn't authenticate server.
+	initiator, other := newTestInitiator(kt, true), newTestInitiator(kt, true)
+	initiator.Init(nil)
+	out, _, _ = other.Init(nil)
+	reply, _, _, err := NewKerberosAcceptor(kt, testService, nil).Accept(out)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if _, _, err := initiator.Init(reply); err != ErrKerberosMutual {
+		t.Errorf("AP-REP of another context: got %v, want %v", err, ErrKerberosMutual)
+	}
+	if _, _, err := newTestInitiator(kt, false).Init(reply); err != ErrKerberosToken {
+		t.Errorf("AP-REP without mutual authentication: got %v, want %v", err, ErrKerberosToken)
+	}
+
+	client, server := establish(t, newTestInitiator(kt, false), NewKerberosAcceptor(kt, testService, nil))
+	token, _ := client.Wrap([]byte("request"), true)
+	tampered := append([]byte(nil), token...)
+	tampered[len(tampered)-1] ^= 0x01
+	if _, err := server.Unwrap(tampered); err != ErrKerberosWrap {
+		t.Errorf("tampered token: got %v, want %v", err, ErrKerberosWrap)
+	}
+	// token is reflected back to its sender.
+	if _, err := client.Unwrap(token); err != ErrKerberosWrap {
+		t.Errorf("reflected token: got %v, want %v", err, ErrKerberosWrap)
+	}
+	next, _ := client.Wrap([]byte("next"), true)
+	if _, err := server.Unwrap(next); err != ErrKerberosSequence {
+		t.Errorf("token out of sequence: got %v, want %v", err, ErrKerberosSequence)
+	}
+}
+
+func TestGSSAPIKerberos(t *testing.T) {
+	kt := newTestKeytab(t, "secret")
+	server := &GSSAPIServerAuthenticator{
+		NewAcceptor: func(conn net.Conn) (GSSAcceptor, error) {
+			return NewKerberosAcceptor(kt, testService, nil), nil
+		},
+		MapPrincipal: func(principal string) (string, error) {
+			return principal[:len(principal)-len("@"+testRealm)], nil
+		},
+	}
+	client := &GSSAPIClientAuthenticator{
+		NewInitiator: func() (GSSInitiator, error) {
+			return newTestInitiator(kt, true), nil
+		},
+		Protection: GSSProtectionConfidentiality,
+	}
+
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	type result struct {
+		conn     net.Conn
+		username string
+		err      error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, username, err := server.Authenticate(s)
+		accepted <- result{conn, username, err}
+	}()
+
+	conn, err := client.Authenticate(c)
+	if nil != err {
+		t.Fatal(err)
+	}
+	r := <-accepted
+	if nil != r.err || r.username != "alice" {
+		t.Fatalf("server: %q, %v", r.username, r.err)
+	}
+
+	go conn.Write([]byte("hello"))
+	b := make([]byte, 5)
+	if _, err := r.conn.Read(b); nil != err || string(b) != "hello" {
+		t.Fatalf("got %q, %v", b, err)
+	}
+}
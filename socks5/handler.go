@@ -1,31 +1,48 @@
 package socks5
 
 import (
-	"bytes"
-	"encoding/binary"
-	"github.com/patrickmn/go-cache"
+	"context"
+	"io"
+	"io/ioutil"
 	"log"
 	"net"
-	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+	"xproxy/trace"
 )
 
 type Handler interface {
-	TCPHandler(s *Server, conn *net.TCPConn, request *SocksRequest) error
+	TCPHandler(s *Server, conn net.Conn, request *SocksRequest) error
 	UDPHandler(s *Server, conn *net.UDPAddr, request *SocksUDPDatagram) error
 }
 
 type DefaultHandler struct {
 }
 
-func (h *DefaultHandler) TCPHandler(s *Server, conn *net.TCPConn, request *SocksRequest) error {
+func (h *DefaultHandler) TCPHandler(s *Server, conn net.Conn, request *SocksRequest) error {
 	reqCmd := request.CMD
 	if CMDConnect == reqCmd {
-		remoteTCPConn, err := h.establishTCPRemoteConn(request)
+		span := s.sessionSpan(conn)
+		if s.Sniff {
+			return h.connectSniffed(s, conn, request, span)
+		}
+
+		route, err := h.route(s, request.Address(), "", span)
+		if nil != err {
+			h.writeReply(s, conn, newFailReply(ReplyGeneralFailure))
+			return err
+		}
+		if route.Action == RuleActionDeny {
+			h.writeReply(s, conn, newFailReply(ReplyConnNotAllowed))
+			return ErrRuleDenied
+		}
+
+		session := s.Session(conn)
+		remoteTCPConn, err := h.establishTCPRemoteConn(s, request, route, session, span)
 		if nil != err {
 			// connection remote addr fail.
-			reply := NewSocksReply(ReplyRemoteAddrConnFail, request.ATYP, []byte{0x00, 0x00, 0x00}, []byte{0x00, 0x00})
-			reply.WriteTo(conn)
+			h.writeReply(s, conn, newFailReply(ReplyRemoteAddrConnFail))
 			return err
 		}
 		defer remoteTCPConn.Close()
@@ -35,126 +52,260 @@ func (h *DefaultHandler) TCPHandler(s *Server, conn *net.TCPConn, request *Socks
 		atyp, lhost, lport, err := ParseAddress(localAddr)
 		if nil != err {
 			// connection remote addr fail.
-			reply := NewSocksReply(ReplyRemoteAddrConnFail, request.ATYP, []byte{0x00, 0x00, 0x00}, []byte{0x00, 0x00})
-			reply.WriteTo(conn)
+			h.writeReply(s, conn, newFailReply(ReplyRemoteAddrConnFail))
 			return err
 		} else {
 			reply := NewSocksReply(ReplySuccess, atyp, lhost, lport)
-			reply.WriteTo(conn)
-		}
-
-		// connection bridge
-		// 1. read client request content, write to remote connection.
-		go func() {
-			var buff [1024 * 2]byte
-			for {
-				if s.TCPDeadline != 0 {
-					if err := conn.SetDeadline(time.Now().Add(time.Duration(s.TCPDeadline) * time.Second)); nil != err {
-						return
-					}
-				}
-				offset, err := conn.Read(buff[:])
-				if nil != err {
-					return
-				}
-
-				if _, err := remoteTCPConn.Write(buff[0:offset]); nil != err {
-					return
-				}
-			}
-		}()
-
-		// 2. read remote connection return content, write to client.
-		go func() {
-			var buff [1024 * 2]byte
-			for {
-				if s.TCPDeadline != 0 {
-					if err := remoteTCPConn.SetDeadline(time.Now().Add(time.Duration(s.TCPDeadline) * time.Second)); nil != err {
-						return
-					}
-				}
-				offset, err := remoteTCPConn.Read(buff[:])
-				if nil != err {
-					return
-				}
-
-				if _, err := conn.Write(buff[0:offset]); nil != err {
-					return
-				}
-			}
-		}()
+			h.writeReply(s, conn, reply)
+		}
+
+		// connection bridge, blocks until the session finished.
+		h.relay(s, session, conn, remoteTCPConn, span)
+		return nil
 	}
 
 	if CMDUDPAssociate == reqCmd {
 		remoteUDPAddr, err := h.parseUDPRemoteAddr(request)
 		if nil != err {
-			reply := NewSocksReply(ReplyRemoteAddrConnFail, request.ATYP, []byte{0x00, 0x00, 0x00}, []byte{0x00, 0x00})
-			reply.WriteTo(conn)
+			h.writeReply(s, conn, newFailReply(ReplyRemoteAddrConnFail))
 			return err
 		}
 
 		// connection remote addr success, parse local connection address, tell to client.
-		localAddr := s.UDPAddr.String()
+		_, udpAddr := s.Addrs()
+		localAddr := udpAddr.String()
 		atyp, lhost, lport, err := ParseAddress(localAddr)
 		if nil != err {
 			// connection remote addr fail.
-			reply := NewSocksReply(ReplyRemoteAddrConnFail, request.ATYP, []byte{0x00, 0x00, 0x00}, []byte{0x00, 0x00})
-			reply.WriteTo(conn)
+			h.writeReply(s, conn, newFailReply(ReplyRemoteAddrConnFail))
 			return err
 		} else {
 			reply := NewSocksReply(ReplySuccess, atyp, lhost, lport)
-			reply.WriteTo(conn)
+			h.writeReply(s, conn, reply)
 		}
-		ch := make(chan byte)
-		s.TCPUDPAssociate.Set(remoteUDPAddr.String(), ch, cache.DefaultExpiration)
-		<-ch
+
+		// the association terminates when the tcp connection closed, the udp relay has its own timeout.
+		association := s.addUDPAssociation(conn, remoteUDPAddr.Port)
+		defer s.removeUDPAssociation(association)
+		conn.SetDeadline(time.Time{})
+		io.Copy(ioutil.Discard, conn)
 		return nil
 	}
 	return ErrNonSupportCommand
 }
 
 func (h *DefaultHandler) UDPHandler(s *Server, conn *net.UDPAddr, request *SocksUDPDatagram) error {
-	return ErrNonSupportCommand
+	return s.relayUDP(conn, request)
 }
 
 // help func ===========================================================================================================
-func (h *DefaultHandler) establishTCPRemoteConn(request *SocksRequest) (*net.TCPConn, error) {
-	// gen connection address by request address type.
-	var host string
-	atyp := request.ATYP
-	if ATYPDomain == atyp {
-		host = bytes.NewBuffer(request.DstAddr[1:]).String()
-	} else {
-		host = net.IP(request.DstAddr).String()
-	}
-	// notes: CPU big-endian type.
-	port := strconv.Itoa(int(binary.BigEndian.Uint16(request.DstPort)))
-	addr := net.JoinHostPort(host, port)
-
-	conn, err := net.Dial("tcp", addr)
+// newFailReply create reply with zero bound address, it's meaningless when request failed.
+func newFailReply(rep byte) *SocksReply {
+	return NewSocksReply(rep, ATYPIPv4, []byte{0x00, 0x00, 0x00, 0x00}, []byte{0x00, 0x00})
+}
+
+// connectSniffed reply success before dialing, so client sends its first bytes, then route by the sniffed name.
+// the reply can't tell failures anymore, denied or failed session is just closed.
+func (h *DefaultHandler) connectSniffed(s *Server, conn net.Conn, request *SocksRequest, span *trace.Span) error {
+	// bound address of client connection, destination is not dialed yet.
+	reply := NewSocksReply(ReplySuccess, ATYPIPv4, []byte{0x00, 0x00, 0x00, 0x00}, []byte{0x00, 0x00})
+	if atyp, lhost, lport, err := ParseAddress(conn.LocalAddr().String()); nil == err {
+		reply = NewSocksReply(ReplySuccess, atyp, lhost, lport)
+	}
+	if err := h.writeReply(s, conn, reply); nil != err {
+		return err
+	}
+
+	session := s.Session(conn)
+	sniffSpan := span.Child("socks.sniff")
+	sniffedConn, protocol, name := s.sniff(conn)
+	if name != "" {
+		sniffSpan.SetAttribute("sniff.protocol", protocol)
+		sniffSpan.SetAttribute("sniff.name", name)
+		if nil != session {
+			s.setSessionSniffed(session, protocol, name)
+		}
+		if Debug {
+			log.Printf("TCP Handler. sniffed %s server name %s, addr: %s", protocol, name, request.Address())
+		}
+	}
+	sniffSpan.End()
+
+	route, err := h.route(s, request.Address(), name, span)
+	if nil != err {
+		return err
+	}
+	if route.Action == RuleActionDeny {
+		return ErrRuleDenied
+	}
+
+	remoteTCPConn, err := h.establishTCPRemoteConn(s, request, route, session, span)
+	if nil != err {
+		return err
+	}
+	defer remoteTCPConn.Close()
+
+	h.relay(s, session, sniffedConn, remoteTCPConn, span)
+	return nil
+}
+
+// route match destination and sniffed name, it's traced as child of span.
+func (h *DefaultHandler) route(s *Server, addr, name string, span *trace.Span) (*Route, error) {
+	routeSpan := span.Child("socks.route")
+	defer routeSpan.End()
+	route, err := s.route(addr, name)
+	routeSpan.SetError(err)
+	if nil != route {
+		routeSpan.SetAttribute("route.action", route.Action)
+		routeSpan.SetAttribute("route.addr", route.Addr)
+	}
+	return route, err
+}
+
+// relay bridge client and remote connections until the session finished, session can be nil.
+func (h *DefaultHandler) relay(s *Server, session *Session, conn, remoteConn net.Conn, span *trace.Span) {
+	relaySpan := span.Child("socks.relay")
+	if nil != s.Capture && nil != session {
+		conn, remoteConn = s.captureRelay(session, conn, remoteConn)
+		defer s.stopSessionCapture(session)
+	}
+	s.relay(session, conn, remoteConn)
+	if nil != session {
+		relaySpan.SetAttribute("socks.bytes_up", atomic.LoadInt64(&session.BytesUp))
+		relaySpan.SetAttribute("socks.bytes_down", atomic.LoadInt64(&session.BytesDown))
+	}
+	relaySpan.End()
+}
+
+func (h *DefaultHandler) writeReply(s *Server, conn net.Conn, reply *SocksReply) error {
+	session := s.Session(conn)
+	if nil != session {
+		session.span.SetAttribute("socks.reply", int(reply.REP))
+	}
+	if nil != session && session.Transparent {
+		return nil
+	}
+	_, err := reply.WriteTo(conn)
+	return err
+}
+
+// establishTCPRemoteConn dial destination directly or through upstream, resolution and dial are traced as child of span.
+// session username is used by upstream group balanced by user and by egress, session can be nil.
+func (h *DefaultHandler) establishTCPRemoteConn(s *Server, request *SocksRequest, route *Route, session *Session, span *trace.Span) (net.Conn, error) {
+	username := sessionUsername(session)
+	if nil != route.Group {
+		if Debug {
+			log.Printf("TCP Handler. tcp remote conn through upstream group %s. addr: %s", route.Group.name, request.Address())
+		}
+		return route.Group.connect(request.Address(), username, span)
+	}
+
+	// upstream resolves domain itself.
+	if nil != route.Upstream {
+		if Debug {
+			log.Printf("TCP Handler. tcp remote conn through upstream %s. addr: %s", route.Upstream.ProxyAddr, request.Address())
+		}
+		return route.Upstream.connect(request.Address(), span)
+	}
+
+	addrs := []string{route.Addr}
+	egress := s.egress(route, username)
+	if nil != span || egress.bindsSource() {
+		// resolve explicitly, so resolution is traced apart from dial, and destination family matches source address.
+		addr := route.Addr
+		if host, _, err := net.SplitHostPort(addr); nil == err {
+			if ip := net.ParseIP(host); nil != ip && !egress.accepts(ip) {
+				addr = request.Address() // router resolved to the other family
+			}
+		}
+		resolved, err := resolveAddresses(addr, egress.accepts, span)
+		if nil != err {
+			return nil, err
+		}
+		addrs = resolved
+	}
+
+	conn, err := dialAddresses(egress, addrs, egressKey(session), span)
 	if nil != err {
 		return nil, err
 	}
+	if nil != egress && egress.ProxyProtocol != 0 {
+		if err := writeProxyHeader(conn, egress.ProxyProtocol, session); nil != err {
+			conn.Close()
+			return nil, err
+		}
+	}
 
 	if Debug {
-		log.Printf("TCP Handler. tcp remote conn established. addr: %s", addr)
+		log.Printf("TCP Handler. tcp remote conn established. addr: %s", conn.RemoteAddr())
 	}
-	return conn.(*net.TCPConn), nil
+	return conn, nil
 }
 
-func (h *DefaultHandler) parseUDPRemoteAddr(request *SocksRequest) (*net.UDPAddr, error) {
-	// gen connection address by request address type.
-	var host string
-	atyp := request.ATYP
-	if ATYPDomain == atyp {
-		host = bytes.NewBuffer(request.DstAddr[1:]).String()
-	} else {
-		host = net.IP(request.DstAddr).String()
-	}
-	// notes: CPU big-endian type.
-	port := strconv.Itoa(int(binary.BigEndian.Uint16(request.DstPort)))
-	addr := net.JoinHostPort(host, port)
+// dialAddresses dial resolved addresses in order until one is connected, like net.Dial does for a domain.
+// every attempt is traced as child of span.
+func dialAddresses(egress *Egress, addrs []string, key string, span *trace.Span) (conn net.Conn, err error) {
+	for _, addr := range addrs {
+		dialSpan := span.Child("socks.dial")
+		dialSpan.SetKind(trace.KindClient)
+		dialSpan.SetAttribute("net.peer.name", addr)
+		conn, err = egress.dial("tcp", addr, key)
+		dialSpan.SetError(err)
+		if nil == err && nil != egress {
+			dialSpan.SetAttribute("net.sock.host.addr", conn.LocalAddr().String())
+		}
+		dialSpan.End()
+		if nil == err {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// resolveAddresses replace domain of "host:port" address with its accepted ips in resolver order, nil accept means
+// any ip. ip address is returned as it is.
+func resolveAddresses(addr string, accept func(net.IP) bool, span *trace.Span) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if nil != err {
+		return nil, err
+	}
+	if nil != net.ParseIP(host) {
+		return []string{addr}, nil
+	}
+
+	resolveSpan := span.Child("socks.resolve")
+	resolveSpan.SetAttribute("net.host.name", host)
+	defer resolveSpan.End()
+	ips, err := net.DefaultResolver.LookupIPAddr(context.Background(), host)
+	if nil != err {
+		resolveSpan.SetError(err)
+		return nil, err
+	}
+	var addrs, accepted []string
+	for _, ip := range ips {
+		if nil == accept || accept(ip.IP) {
+			accepted = append(accepted, ip.String())
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	if len(addrs) == 0 {
+		resolveSpan.SetError(ErrEgressFamily)
+		return nil, ErrEgressFamily
+	}
+	resolveSpan.SetAttribute("net.host.ip", strings.Join(accepted, ","))
+	return addrs, nil
+}
 
+// sessionUsername return username of session, session can be nil.
+func sessionUsername(session *Session) string {
+	if nil == session {
+		return ""
+	}
+	return session.Username
+}
+
+func (h *DefaultHandler) parseUDPRemoteAddr(request *SocksRequest) (*net.UDPAddr, error) {
+	addr := request.Address()
 	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if nil != err {
 		return nil, err
@@ -0,0 +1,113 @@
+package socks5
+
+import (
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"xproxy/trace"
+)
+
+// spanRecorder collect exported spans.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.Span
+}
+
+func (r *spanRecorder) ExportSpans(service string, spans []*trace.Span) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, spans...)
+	return nil
+}
+
+func TestResolveAddresses(t *testing.T) {
+	if addrs, err := resolveAddresses("192.0.2.1:80", nil, nil); nil != err || !reflect.DeepEqual(addrs, []string{"192.0.2.1:80"}) {
+		t.Errorf("ip address: %v, %v", addrs, err)
+	}
+	ipv4 := func(ip net.IP) bool { return nil != ip.To4() }
+	if addrs, err := resolveAddresses("localhost:80", ipv4, nil); nil != err || !reflect.DeepEqual(addrs, []string{"127.0.0.1:80"}) {
+		t.Errorf("localhost: %v, %v", addrs, err)
+	}
+	none := func(ip net.IP) bool { return false }
+	if _, err := resolveAddresses("localhost:80", none, nil); err != ErrEgressFamily {
+		t.Errorf("no accepted address: got %v, want %v", err, ErrEgressFamily)
+	}
+}
+
+func TestDialAddresses(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	closed.Close()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	recorder := &spanRecorder{}
+	tracer := trace.NewTracer("xproxy-test", recorder)
+	span := tracer.Start("socks.session")
+
+	// the first address refuses, the next one is dialed.
+	conn, err := dialAddresses(nil, []string{closed.Addr().String(), listener.Addr().String()}, "", span)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if conn.RemoteAddr().String() != listener.Addr().String() {
+		t.Errorf("connected to %s", conn.RemoteAddr())
+	}
+	conn.Close()
+
+	if _, err := dialAddresses(nil, []string{closed.Addr().String()}, "", span); nil == err {
+		t.Error("refused address connected")
+	}
+	tracer.Close()
+
+	if len(recorder.spans) != 3 {
+		t.Fatalf("%d dial spans", len(recorder.spans))
+	}
+	for i, failed := range []bool{true, false, true} {
+		if (recorder.spans[i].Status == trace.StatusError) != failed {
+			t.Errorf("dial span %d: status %d, %s", i, recorder.spans[i].Status, recorder.spans[i].Message)
+		}
+	}
+}
+
+func TestUDPRelayTransparentFlow(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", "127.0.0.1", "", "", 0, 0, 0, 0)
+	if nil != err {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted, err := listener.Accept()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+
+	// transparent flow from the ip of a pending udp associate doesn't bind it.
+	association := s.addUDPAssociation(accepted, 0)
+	defer s.removeUDPAssociation(association)
+	datagram := &SocksUDPDatagram{ATYP: ATYPIPv4, DstAddr: []byte{127, 0, 0, 1}, DstPort: []byte{0, 9}, Data: []byte("x")}
+	if err := s.relayUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}, datagram); nil != err {
+		t.Fatal(err)
+	}
+	if association.key != "" {
+		t.Fatalf("udp associate bound to transparent flow %s", association.key)
+	}
+	if got, ok := s.udpAssociateConn(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40001}); !ok || got != accepted {
+		t.Fatal("udp associate not bound by its socks client")
+	}
+}
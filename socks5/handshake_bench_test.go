@@ -0,0 +1,236 @@
+package socks5
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// countingConn count reads of underlying connection, every read is a syscall over loopback.
+type countingConn struct {
+	net.Conn
+	reads *int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	atomic.AddInt64(c.reads, 1)
+	return c.Conn.Read(b)
+}
+
+// BenchmarkHandshakeLoopback measure username/password handshake and CONNECT over loopback, reads/op is the
+// number of server reads of client connection.
+func BenchmarkHandshakeLoopback(b *testing.B) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		b.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if nil != err {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	s, err := NewServer("127.0.0.1:0", "", "user", "password", 10, 10, 10, 10)
+	if nil != err {
+		b.Fatal(err)
+	}
+	s.Handler = &DefaultHandler{}
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		b.Fatal(err)
+	}
+	defer proxy.Close()
+	var reads int64
+	go func() {
+		for {
+			conn, err := proxy.Accept()
+			if nil != err {
+				return
+			}
+			go s.serveConn(&countingConn{Conn: conn, reads: &reads})
+		}
+	}()
+
+	// all handshake messages of client in one flight.
+	var pipelined []byte
+	for _, packet := range []interface {
+		AppendBinary(b []byte) ([]byte, error)
+	}{
+		NewNegotiationRequest([]byte{MethodUsernamePassword}),
+		&UsernamePasswordNegotiationRequest{Ver: UsernamePasswordVer, ULen: 4, Uname: []byte("user"), PLen: 8, Password: []byte("password")},
+		mustRequest(b, target.Addr().String()),
+	} {
+		if pipelined, err = packet.AppendBinary(pipelined); nil != err {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("sequential", func(b *testing.B) {
+		atomic.StoreInt64(&reads, 0)
+		for i := 0; i < b.N; i++ {
+			client, err := NewClient("user", "password", proxy.Addr().String(), 0, 10, 10)
+			if nil != err {
+				b.Fatal(err)
+			}
+			if err := client.Negotiation(); nil != err {
+				b.Fatal(err)
+			}
+			conn, err := client.Connect(target.Addr().String())
+			if nil != err {
+				b.Fatal(err)
+			}
+			conn.Close()
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&reads))/float64(b.N), "reads/op")
+	})
+
+	b.Run("optimistic", func(b *testing.B) {
+		atomic.StoreInt64(&reads, 0)
+		for i := 0; i < b.N; i++ {
+			client, err := NewClient("user", "password", proxy.Addr().String(), 0, 10, 10)
+			if nil != err {
+				b.Fatal(err)
+			}
+			conn, err := client.ConnectOptimistic(target.Addr().String())
+			if nil != err {
+				b.Fatal(err)
+			}
+			// target closes at once, so first read returns EOF after replies verified.
+			if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+				b.Fatal(err)
+			}
+			conn.Close()
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&reads))/float64(b.N), "reads/op")
+	})
+
+	b.Run("pipelined", func(b *testing.B) {
+		atomic.StoreInt64(&reads, 0)
+		replies := make([]byte, 2+2+10)
+		for i := 0; i < b.N; i++ {
+			conn, err := net.Dial("tcp", proxy.Addr().String())
+			if nil != err {
+				b.Fatal(err)
+			}
+			if _, err := conn.Write(pipelined); nil != err {
+				b.Fatal(err)
+			}
+			if _, err := io.ReadFull(conn, replies); nil != err {
+				b.Fatal(err)
+			}
+			conn.Close()
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&reads))/float64(b.N), "reads/op")
+	})
+}
+
+func mustRequest(b *testing.B, addr string) *SocksRequest {
+	request, err := NewSocksRequestFromAddress(CMDConnect, addr)
+	if nil != err {
+		b.Fatal(err)
+	}
+	return request
+}
+
+// recordingConn record every write of connection.
+type recordingConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.writes = append(c.writes, append([]byte(nil), b...))
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func (c *recordingConn) sizes() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sizes := make([]int, 0, len(c.writes))
+	for _, b := range c.writes {
+		sizes = append(sizes, len(b))
+	}
+	return sizes
+}
+
+// TestHandshakeWrites check every handshake message is written by one write on both sides, the codec has
+// coalesced them since it was split out of this package.
+func TestHandshakeWrites(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if nil == err {
+			defer conn.Close()
+			io.Copy(ioutil.Discard, conn)
+		}
+	}()
+
+	s, err := NewServer("127.0.0.1:0", "", "user", "password", 10, 10, 10, 10)
+	if nil != err {
+		t.Fatal(err)
+	}
+	s.Handler = &DefaultHandler{}
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	accepted := make(chan *recordingConn, 1)
+	go func() {
+		conn, err := proxy.Accept()
+		if nil != err {
+			return
+		}
+		recording := &recordingConn{Conn: conn}
+		accepted <- recording
+		s.serveConn(recording)
+	}()
+
+	var clientConn *recordingConn
+	client, err := NewClient("user", "password", proxy.Addr().String(), 0, 10, 10)
+	if nil != err {
+		t.Fatal(err)
+	}
+	client.Dial = func(network, addr string) (net.Conn, error) {
+		conn, err := net.Dial(network, addr)
+		if nil != err {
+			return nil, err
+		}
+		clientConn = &recordingConn{Conn: conn}
+		return clientConn, nil
+	}
+	if err := client.Negotiation(); nil != err {
+		t.Fatal(err)
+	}
+	conn, err := client.Connect(target.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	serverConn := <-accepted
+
+	// method selection, username/password and CONNECT request of ipv4 address.
+	if sizes := clientConn.sizes(); !reflect.DeepEqual(sizes, []int{3, 3 + len("user") + len("password"), 10}) {
+		t.Errorf("client writes of %v bytes", sizes)
+	}
+	// method, username/password status and CONNECT reply of ipv4 address.
+	if sizes := serverConn.sizes(); !reflect.DeepEqual(sizes, []int{2, 2, 10}) {
+		t.Errorf("server writes of %v bytes", sizes)
+	}
+}
@@ -0,0 +1,178 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// hop-by-hop headers, they are meaningful only for a single connection, must not be forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// HTTPBridge is a local http proxy, every request is forwarded through socks proxy server.
+// it supports CONNECT and absolute-URI requests, destination domain is resolved by proxy server.
+type HTTPBridge struct {
+	ClientConfig
+	ListenAddr string
+
+	transport *http.Transport
+	server    *http.Server
+}
+
+func NewHTTPBridge(listenAddr, username, password, proxyAddr string) *HTTPBridge {
+	b := &HTTPBridge{
+		ClientConfig: ClientConfig{
+			Username:  username,
+			Password:  password,
+			ProxyAddr: proxyAddr,
+		},
+		ListenAddr: listenAddr,
+	}
+	b.transport = &http.Transport{
+		Proxy: nil, // never use environment proxy, requests go through socks proxy server.
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return b.ConnectContext(ctx, addr)
+		},
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return b
+}
+
+// Run start the http proxy listener, it blocks until listener closed.
+func (b *HTTPBridge) Run() error {
+	b.server = &http.Server{Addr: b.ListenAddr, Handler: b}
+	log.Printf("http bridge %s via %s", b.ListenAddr, b.ProxyAddr)
+	return b.server.ListenAndServe()
+}
+
+func (b *HTTPBridge) Stop() error {
+	b.transport.CloseIdleConnections()
+	if nil == b.server {
+		return nil
+	}
+	return b.server.Close()
+}
+
+func (b *HTTPBridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		b.serveConnect(w, r)
+		return
+	}
+
+	if !r.URL.IsAbs() {
+		http.Error(w, "this is a proxy server, absolute-URI required", http.StatusBadRequest)
+		return
+	}
+	b.serveForward(w, r)
+}
+
+// serveConnect establish tunnel through socks proxy server, then relay raw bytes.
+func (b *HTTPBridge) serveConnect(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	// handshake is aborted if client goes away.
+	remoteConn, err := b.ConnectContext(r.Context(), hostPort(r.Host, "443"))
+	if nil != err {
+		log.Printf("http bridge CONNECT %s: %v", r.Host, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if nil != err {
+		remoteConn.Close()
+		return
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); nil != err {
+		remoteConn.Close()
+		return
+	}
+
+	// client may send data before it reads the response, flush the buffered bytes first.
+	if n := rw.Reader.Buffered(); n > 0 {
+		buffered, _ := rw.Reader.Peek(n)
+		if _, err := remoteConn.Write(buffered); nil != err {
+			remoteConn.Close()
+			return
+		}
+	}
+	bridge(conn, remoteConn, b.TCPDeadline, nil, nil)
+}
+
+// serveForward send absolute-URI request through socks proxy server, then copy response.
+func (b *HTTPBridge) serveForward(w http.ResponseWriter, r *http.Request) {
+	outReq := r.WithContext(r.Context())
+	outReq.RequestURI = ""
+	outReq.Header = cloneHeader(r.Header)
+	removeHopHeaders(outReq.Header)
+
+	resp, err := b.transport.RoundTrip(outReq)
+	if nil != err {
+		log.Printf("http bridge %s %s: %v", r.Method, r.URL, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	removeHopHeaders(resp.Header)
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// help func ===========================================================================================================
+
+func hostPort(host, defaultPort string) string {
+	if _, _, err := net.SplitHostPort(host); nil == err {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), defaultPort)
+}
+
+func cloneHeader(h http.Header) http.Header {
+	h2 := make(http.Header, len(h))
+	for key, values := range h {
+		h2[key] = append([]string(nil), values...)
+	}
+	return h2
+}
+
+func removeHopHeaders(h http.Header) {
+	// headers listed in "Connection" are hop-by-hop too.
+	for _, field := range h["Connection"] {
+		for _, key := range strings.Split(field, ",") {
+			if key = strings.TrimSpace(key); key != "" {
+				h.Del(key)
+			}
+		}
+	}
+	for _, key := range hopHeaders {
+		h.Del(key)
+	}
+}
@@ -0,0 +1,110 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newBlackHole accept proxy connections and never reply, closed connections are sent to channel.
+// at most 8 connections are accepted by one test.
+func newBlackHole(t *testing.T) (string, <-chan struct{}) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	closed := make(chan struct{}, 8)
+	accepted := make(chan net.Conn, 8)
+	t.Cleanup(func() {
+		listener.Close()
+		close(accepted)
+		for conn := range accepted {
+			conn.Close()
+		}
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+			accepted <- conn
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+				closed <- struct{}{}
+			}()
+		}
+	}()
+	return listener.Addr().String(), closed
+}
+
+func waitBlackHoleClosed(t *testing.T, closed <-chan struct{}) {
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy connection not closed")
+	}
+}
+
+// dialBridge dial by transport of bridge, fail if it's not returned in time.
+func dialBridge(t *testing.T, b *HTTPBridge, ctx context.Context) error {
+	dialed := make(chan error, 1)
+	go func() {
+		conn, err := b.transport.DialContext(ctx, "tcp", "example.com:80")
+		if nil == err {
+			conn.Close()
+		}
+		dialed <- err
+	}()
+	select {
+	case err := <-dialed:
+		return err
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial not returned after context done")
+		return nil
+	}
+}
+
+func TestHTTPBridgeDialContext(t *testing.T) {
+	proxyAddr, closed := newBlackHole(t)
+	b := NewHTTPBridge("", "", "", proxyAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := dialBridge(t, b, ctx); err != context.DeadlineExceeded {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+	waitBlackHoleClosed(t, closed)
+
+	// optimistic handshake is not sent after context done.
+	b.Optimistic = true
+	if err := dialBridge(t, b, ctx); err != context.DeadlineExceeded {
+		t.Fatalf("optimistic: got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestHTTPBridgeConnectCanceled(t *testing.T) {
+	b := NewHTTPBridge("", "", "", "")
+	bridge := httptest.NewServer(b)
+	t.Cleanup(bridge.Close)
+	// registered later, so black hole is closed first, then handler returns even if it's not canceled.
+	proxyAddr, closed := newBlackHole(t)
+	b.ProxyAddr = proxyAddr
+
+	conn, err := net.Dial("tcp", bridge.Listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"))
+
+	// client goes away while proxy handshake is pending.
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+	waitBlackHoleClosed(t, closed)
+}
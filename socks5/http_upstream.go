@@ -0,0 +1,76 @@
+package socks5
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+var (
+	ErrHTTPConnect = errors.New("http proxy refused CONNECT")
+)
+
+// dialHTTPConnect create tunnel to "host:port" address through http proxy by CONNECT method.
+// only proxy address, username, password and tcp deadline of client config are used.
+func dialHTTPConnect(ctx context.Context, cfg *ClientConfig, addr string) (net.Conn, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", cfg.ProxyAddr)
+	if nil != err {
+		return nil, err
+	}
+	// deadline of ctx bounds the handshake too.
+	deadline, _ := ctx.Deadline()
+	if cfg.TCPDeadline != 0 {
+		if d := time.Now().Add(time.Duration(cfg.TCPDeadline) * time.Second); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	if !deadline.IsZero() {
+		if err := conn.SetDeadline(deadline); nil != err {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if cfg.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(cfg.Username + ":" + cfg.Password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); nil != err {
+		conn.Close()
+		return nil, err
+	}
+
+	// proxy may send tunnel bytes right after response, they are kept in buffer.
+	reader := bufio.NewReaderSize(conn, handshakeBufferSize)
+	response, err := http.ReadResponse(reader, request)
+	if nil != err {
+		conn.Close()
+		return nil, err
+	}
+	// response body of CONNECT is the tunnel, it must not be read or closed.
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		if Debug {
+			log.Printf("http upstream %s: CONNECT %s: %s", cfg.ProxyAddr, addr, response.Status)
+		}
+		return nil, ErrHTTPConnect
+	}
+
+	if err := conn.SetDeadline(time.Time{}); nil != err {
+		conn.Close()
+		return nil, err
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
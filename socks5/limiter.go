@@ -0,0 +1,237 @@
+package socks5
+
+import (
+	"errors"
+	"github.com/patrickmn/go-cache"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTooManySessions        = errors.New("too many sessions")
+	ErrTooManySessionsPerIP   = errors.New("too many sessions from client ip")
+	ErrTooManySessionsPerUser = errors.New("too many sessions of user")
+	ErrConnRateLimited        = errors.New("new connection rate limited")
+)
+
+const (
+	// what to do when max sessions is reached.
+	LimitActionReject byte = 0x00 // reply 0x01 (general failure) to the request and close, authentication is skipped if possible.
+	// stop accepting tcp, transparent and websocket connections until a running session finished. a mux connection
+	// holds one accept slot, its streams over limit are rejected instead of paused.
+	LimitActionPause byte = 0x01
+)
+
+// Limits is the connection limits config, zero value means unlimited.
+type Limits struct {
+	MaxSessions        int // total running sessions
+	MaxSessionsPerIP   int // running sessions per client ip
+	MaxSessionsPerUser int // running sessions per username, only works when username/password enabled
+
+	ConnRatePerIP  float64 // new connections per second per client ip
+	ConnBurstPerIP int     // max burst of new connections per client ip, default is 1
+
+	Action byte // LimitActionReject or LimitActionPause, only used for MaxSessions
+}
+
+type limiter struct {
+	limits  Limits
+	metrics *Metrics
+
+	mu      sync.Mutex
+	total   int
+	perIP   map[string]int
+	perUser map[string]int
+
+	// session slots of accepted connections, only used by LimitActionPause.
+	slotMu    sync.Mutex
+	slotsUsed int
+	slotFreed chan struct{} // closed and replaced when a slot released
+
+	buckets *cache.Cache // client ip -> *tokenBucket
+}
+
+func newLimiter(limits Limits, metrics *Metrics) *limiter {
+	l := &limiter{
+		limits:    limits,
+		metrics:   metrics,
+		perIP:     make(map[string]int),
+		perUser:   make(map[string]int),
+		buckets:   cache.New(time.Minute, 5*time.Minute),
+		slotFreed: make(chan struct{}),
+	}
+	return l
+}
+
+// waitSlot block accept loop until a session slot is free, the slot is not taken, so idle listeners hold nothing.
+// only works with LimitActionPause, return false if done channel closed.
+func (l *limiter) waitSlot(done <-chan struct{}) bool {
+	return l.slot(done, false)
+}
+
+// acquireSlot take a session slot for accepted connection, it waits if another listener took the last one.
+// if success, caller must call releaseSlot when connection closed.
+func (l *limiter) acquireSlot(done <-chan struct{}) bool {
+	return l.slot(done, true)
+}
+
+func (l *limiter) releaseSlot() {
+	if !l.pause() {
+		return
+	}
+	l.slotMu.Lock()
+	defer l.slotMu.Unlock()
+	l.slotsUsed--
+	close(l.slotFreed)
+	l.slotFreed = make(chan struct{})
+}
+
+func (l *limiter) pause() bool {
+	return l.limits.Action == LimitActionPause && l.limits.MaxSessions > 0
+}
+
+// slot wait until a slot is free, then take it if take is true.
+func (l *limiter) slot(done <-chan struct{}, take bool) bool {
+	if !l.pause() {
+		return true
+	}
+	paused := false
+	for {
+		l.slotMu.Lock()
+		if l.slotsUsed < l.limits.MaxSessions {
+			if take {
+				l.slotsUsed++
+			}
+			l.slotMu.Unlock()
+			return true
+		}
+		freed := l.slotFreed
+		l.slotMu.Unlock()
+
+		if !take && !paused {
+			l.metrics.Add(&l.metrics.AcceptPaused, 1)
+			paused = true
+		}
+		select {
+		case <-freed:
+		case <-done:
+			return false
+		}
+	}
+}
+
+// acquireConn check rate, total and per ip limits of new connection.
+// if success, caller must call releaseConn when connection closed.
+func (l *limiter) acquireConn(ip string) error {
+	if l.limits.ConnRatePerIP > 0 && !l.allow(ip) {
+		l.metrics.Add(&l.metrics.RejectedRate, 1)
+		return ErrConnRateLimited
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// with LimitActionPause, accept loop keeps tcp sessions under the limit, but one connection can carry
+	// many sessions by mux, so the total is checked in both modes.
+	if l.limits.MaxSessions > 0 && l.total >= l.limits.MaxSessions {
+		l.metrics.Add(&l.metrics.RejectedTotal, 1)
+		return ErrTooManySessions
+	}
+	if l.limits.MaxSessionsPerIP > 0 && l.perIP[ip] >= l.limits.MaxSessionsPerIP {
+		l.metrics.Add(&l.metrics.RejectedPerIP, 1)
+		return ErrTooManySessionsPerIP
+	}
+	l.total++
+	l.perIP[ip]++
+	return nil
+}
+
+func (l *limiter) releaseConn(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.total--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// acquireUser check per user limits after negotiation.
+// if success, caller must call releaseUser when connection closed.
+func (l *limiter) acquireUser(username string) error {
+	if username == "" {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limits.MaxSessionsPerUser > 0 && l.perUser[username] >= l.limits.MaxSessionsPerUser {
+		l.metrics.Add(&l.metrics.RejectedPerUser, 1)
+		return ErrTooManySessionsPerUser
+	}
+	l.perUser[username]++
+	return nil
+}
+
+func (l *limiter) releaseUser(username string) {
+	if username == "" {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.perUser[username]--; l.perUser[username] <= 0 {
+		delete(l.perUser, username)
+	}
+}
+
+func (l *limiter) allow(ip string) bool {
+	burst := l.limits.ConnBurstPerIP
+	if burst <= 0 {
+		burst = 1
+	}
+
+	bucket := &tokenBucket{rate: l.limits.ConnRatePerIP, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+	if err := l.buckets.Add(ip, bucket, cache.DefaultExpiration); nil != err {
+		if v, ok := l.buckets.Get(ip); ok {
+			bucket = v.(*tokenBucket)
+		}
+	}
+	l.buckets.SetDefault(ip, bucket) // refresh expiration
+	return bucket.take(time.Now())
+}
+
+// help func ===========================================================================================================
+
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if nil != err {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
@@ -0,0 +1,134 @@
+package socks5
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterSessions(t *testing.T) {
+	for _, action := range []byte{LimitActionReject, LimitActionPause} {
+		metrics := NewMetrics()
+		l := newLimiter(Limits{MaxSessions: 3, MaxSessionsPerIP: 2, MaxSessionsPerUser: 1, Action: action}, metrics)
+
+		if err := l.acquireConn("10.0.0.1"); nil != err {
+			t.Fatal(err)
+		}
+		if err := l.acquireConn("10.0.0.1"); nil != err {
+			t.Fatal(err)
+		}
+		if err := l.acquireConn("10.0.0.1"); err != ErrTooManySessionsPerIP {
+			t.Errorf("action %d, per ip: got %v, want %v", action, err, ErrTooManySessionsPerIP)
+		}
+		if err := l.acquireConn("10.0.0.2"); nil != err {
+			t.Fatal(err)
+		}
+		// total is enforced in pause mode too, sessions over mux don't pass accept loop.
+		if err := l.acquireConn("10.0.0.3"); err != ErrTooManySessions {
+			t.Errorf("action %d, total: got %v, want %v", action, err, ErrTooManySessions)
+		}
+		l.releaseConn("10.0.0.1")
+		if err := l.acquireConn("10.0.0.3"); nil != err {
+			t.Errorf("action %d, session released: %v", action, err)
+		}
+
+		if err := l.acquireUser("alice"); nil != err {
+			t.Fatal(err)
+		}
+		if err := l.acquireUser("alice"); err != ErrTooManySessionsPerUser {
+			t.Errorf("action %d, per user: got %v, want %v", action, err, ErrTooManySessionsPerUser)
+		}
+		if err := l.acquireUser(""); nil != err {
+			t.Errorf("action %d, anonymous: %v", action, err)
+		}
+		l.releaseUser("alice")
+		if err := l.acquireUser("alice"); nil != err {
+			t.Errorf("action %d, user session released: %v", action, err)
+		}
+
+		snapshot := metrics.Snapshot()
+		if snapshot["rejected_per_ip"] != 1 || snapshot["rejected_total"] != 1 || snapshot["rejected_per_user"] != 1 {
+			t.Errorf("action %d, metrics %v", action, snapshot)
+		}
+	}
+}
+
+func TestLimiterRate(t *testing.T) {
+	metrics := NewMetrics()
+	l := newLimiter(Limits{ConnRatePerIP: 0.001, ConnBurstPerIP: 2}, metrics)
+	for i := 0; i < 2; i++ {
+		if err := l.acquireConn("10.0.0.1"); nil != err {
+			t.Fatalf("burst %d: %v", i, err)
+		}
+	}
+	if err := l.acquireConn("10.0.0.1"); err != ErrConnRateLimited {
+		t.Errorf("got %v, want %v", err, ErrConnRateLimited)
+	}
+	if err := l.acquireConn("10.0.0.2"); nil != err {
+		t.Errorf("other ip: %v", err)
+	}
+	if n := metrics.Snapshot()["rejected_rate"]; n != 1 {
+		t.Errorf("%d rejected by rate", n)
+	}
+
+	// tokens are refilled by elapsed time, up to burst.
+	now := time.Now()
+	bucket := &tokenBucket{rate: 10, burst: 2, tokens: 0, last: now}
+	if bucket.take(now) {
+		t.Error("empty bucket")
+	}
+	if !bucket.take(now.Add(100 * time.Millisecond)) {
+		t.Error("token not refilled")
+	}
+	later := now.Add(time.Hour)
+	if !bucket.take(later) || !bucket.take(later) || bucket.take(later) {
+		t.Error("tokens over burst")
+	}
+}
+
+func TestLimiterPause(t *testing.T) {
+	metrics := NewMetrics()
+	l := newLimiter(Limits{MaxSessions: 1, Action: LimitActionPause}, metrics)
+	done := make(chan struct{})
+	// waiting accept loop doesn't take the free slot.
+	if !l.waitSlot(done) || !l.waitSlot(done) {
+		t.Fatal("free slot")
+	}
+	if !l.acquireSlot(done) {
+		t.Fatal("free slot not acquired")
+	}
+
+	waited := make(chan bool, 1)
+	go func() {
+		waited <- l.waitSlot(done)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("accept not paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+	l.releaseSlot()
+	if ok := <-waited; !ok {
+		t.Fatal("slot released but accept still paused")
+	}
+
+	l.acquireSlot(done)
+	go func() {
+		waited <- l.waitSlot(done)
+	}()
+	close(done)
+	if ok := <-waited; ok {
+		t.Error("paused accept got slot after server closed")
+	}
+	if ok := l.acquireSlot(done); ok {
+		t.Error("slot acquired after server closed")
+	}
+	if n := metrics.Snapshot()["accept_paused"]; n != 2 {
+		t.Errorf("accept paused %d times", n)
+	}
+
+	// reject mode never pauses.
+	l = newLimiter(Limits{MaxSessions: 1}, metrics)
+	if !l.acquireSlot(done) || !l.acquireSlot(done) || !l.waitSlot(done) {
+		t.Error("reject mode paused")
+	}
+}
@@ -0,0 +1,172 @@
+package socks5
+
+import (
+	"errors"
+	"github.com/patrickmn/go-cache"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrAuthBanned = errors.New("authentication temporarily banned")
+)
+
+const (
+	DefaultFailureWindow = 15 * time.Minute
+	DefaultBanDuration   = 15 * time.Minute
+	DefaultMaxAuthDelay  = 5 * time.Second
+)
+
+// AuthLockout is the brute-force protection config of username/password authentication.
+// zero threshold disables the ban of that key, client still backs off after failures if BaseDelay is set.
+type AuthLockout struct {
+	MaxFailuresPerIP int // failures from one client ip before it's banned
+
+	// failures of one existing username before it's banned from every ip. it's opt-in, because anyone who knows
+	// the username can lock the account out. failures of unknown usernames are only counted by client ip.
+	MaxFailuresPerUser int
+
+	FailureWindow time.Duration // failures are forgotten after no more failure in the window
+	BanDuration   time.Duration
+
+	// client ip is rejected at once for this long after first failure, doubled by every next failure. failure reply
+	// is never delayed, so clients guessing passwords don't hold connection slots.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+type lockout struct {
+	config  AuthLockout
+	metrics *Metrics
+
+	ips   *cache.Cache // client ip -> *failureRecord
+	users *cache.Cache // lower case existing username -> *failureRecord
+}
+
+type failureRecord struct {
+	mu          sync.Mutex
+	failures    int
+	bannedUntil time.Time
+	retryAfter  time.Time // backoff of last failure
+}
+
+func newLockout(config AuthLockout, metrics *Metrics) *lockout {
+	if config.FailureWindow <= 0 {
+		config.FailureWindow = DefaultFailureWindow
+	}
+	if config.BanDuration <= 0 {
+		config.BanDuration = DefaultBanDuration
+	}
+	if config.MaxDelay <= 0 {
+		config.MaxDelay = DefaultMaxAuthDelay
+	}
+	return &lockout{
+		config:  config,
+		metrics: metrics,
+		ips:     cache.New(config.FailureWindow, time.Minute),
+		users:   cache.New(config.FailureWindow, time.Minute),
+	}
+}
+
+// banned check whether client ip or username is banned or backing off now.
+func (l *lockout) banned(ip, username string) bool {
+	now := time.Now()
+	for _, key := range []struct {
+		records *cache.Cache
+		name    string
+	}{{l.ips, ip}, {l.users, strings.ToLower(username)}} {
+		if key.name == "" {
+			continue
+		}
+		if v, ok := key.records.Get(key.name); ok {
+			record := v.(*failureRecord)
+			record.mu.Lock()
+			banned := now.Before(record.bannedUntil) || now.Before(record.retryAfter)
+			record.mu.Unlock()
+			if banned {
+				l.metrics.Add(&l.metrics.RejectedBanned, 1)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// failure record a failed attempt, return how long client must back off, attempts in it are rejected by banned.
+// exists is false if there is no such username, so random usernames never grow the records.
+func (l *lockout) failure(ip, username string, exists bool) time.Duration {
+	l.metrics.Add(&l.metrics.AuthFailures, 1)
+
+	var records []*failureRecord
+	record, failures := l.record(l.ips, "ip", ip, l.config.MaxFailuresPerIP)
+	if nil != record {
+		records = append(records, record)
+	}
+	if exists && l.config.MaxFailuresPerUser > 0 {
+		record, n := l.record(l.users, "user", strings.ToLower(username), l.config.MaxFailuresPerUser)
+		if nil != record {
+			records = append(records, record)
+		}
+		if n > failures {
+			failures = n
+		}
+	}
+
+	if l.config.BaseDelay <= 0 {
+		return 0
+	}
+	delay := l.config.BaseDelay
+	for i := 1; i < failures && delay < l.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > l.config.MaxDelay {
+		delay = l.config.MaxDelay
+	}
+	retryAfter := time.Now().Add(delay)
+	for _, record := range records {
+		record.mu.Lock()
+		if retryAfter.After(record.retryAfter) {
+			record.retryAfter = retryAfter
+		}
+		record.mu.Unlock()
+	}
+	return delay
+}
+
+// success forget failures of username, failures of client ip are kept until window passed, otherwise one valid
+// account resets the counter for guessing the others.
+func (l *lockout) success(username string) {
+	l.users.Delete(strings.ToLower(username))
+}
+
+func (l *lockout) record(records *cache.Cache, kind, key string, maxFailures int) (*failureRecord, int) {
+	if key == "" {
+		return nil, 0
+	}
+
+	record := &failureRecord{}
+	if err := records.Add(key, record, cache.DefaultExpiration); nil != err {
+		if v, ok := records.Get(key); ok {
+			record = v.(*failureRecord)
+		}
+	}
+
+	record.mu.Lock()
+	defer record.mu.Unlock()
+	record.failures++
+	failures := record.failures
+	if maxFailures > 0 && failures >= maxFailures {
+		record.bannedUntil = time.Now().Add(l.config.BanDuration)
+		record.failures = 0
+		l.metrics.Add(&l.metrics.AuthBans, 1)
+		log.Printf("auth lockout: %s %s banned for %v after %d failures", kind, key, l.config.BanDuration, failures)
+	}
+	expiration := l.config.FailureWindow
+	if until := time.Until(record.bannedUntil); until > expiration {
+		expiration = until
+	}
+	records.Set(key, record, expiration) // refresh expiration
+	return record, failures
+}
@@ -0,0 +1,94 @@
+package socks5
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLockoutIP(t *testing.T) {
+	metrics := NewMetrics()
+	l := newLockout(AuthLockout{MaxFailuresPerIP: 3}, metrics)
+
+	// random usernames are only counted by client ip.
+	for i := 0; i < 3; i++ {
+		if l.banned("10.0.0.1", "") {
+			t.Fatalf("banned after %d failures", i)
+		}
+		l.failure("10.0.0.1", fmt.Sprintf("random%d", i), false)
+	}
+	if n := l.users.ItemCount(); n != 0 {
+		t.Errorf("%d records of unknown usernames", n)
+	}
+	if !l.banned("10.0.0.1", "alice") {
+		t.Error("ip not banned")
+	}
+	if l.banned("10.0.0.2", "alice") {
+		t.Error("other ip banned")
+	}
+
+	// success of one account doesn't reset failures of ip.
+	l.failure("10.0.0.2", "alice", true)
+	l.failure("10.0.0.2", "alice", true)
+	l.success("alice")
+	l.failure("10.0.0.2", "alice", true)
+	if !l.banned("10.0.0.2", "") {
+		t.Error("ip failures reset by success")
+	}
+
+	snapshot := metrics.Snapshot()
+	if snapshot["auth_failures"] != 6 || snapshot["auth_bans"] != 2 || snapshot["rejected_banned"] != 2 {
+		t.Errorf("metrics %v", snapshot)
+	}
+}
+
+func TestLockoutUser(t *testing.T) {
+	// per user ban is opt-in, failures from many ips can't lock the account out by default.
+	l := newLockout(AuthLockout{MaxFailuresPerIP: 3}, NewMetrics())
+	for i := 0; i < 10; i++ {
+		l.failure(fmt.Sprintf("10.0.0.%d", i), "alice", true)
+	}
+	if l.banned("10.0.1.1", "alice") || l.users.ItemCount() != 0 {
+		t.Error("account banned without per user threshold")
+	}
+
+	l = newLockout(AuthLockout{MaxFailuresPerUser: 3}, NewMetrics())
+	l.failure("10.0.0.1", "alice", true)
+	l.failure("10.0.0.2", "Alice", true)
+	l.success("ALICE")
+	for i := 0; i < 3; i++ {
+		if l.banned("10.0.1.1", "alice") {
+			t.Fatalf("banned after %d failures since success", i)
+		}
+		l.failure(fmt.Sprintf("10.0.0.%d", i), "alice", true)
+	}
+	if !l.banned("10.0.1.1", "ALICE") {
+		t.Error("account not banned")
+	}
+	if l.banned("10.0.1.1", "bob") {
+		t.Error("other account banned")
+	}
+}
+
+func TestLockoutDelay(t *testing.T) {
+	l := newLockout(AuthLockout{BaseDelay: time.Second, MaxDelay: 3 * time.Second}, NewMetrics())
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		if delay := l.failure("10.0.0.1", "alice", true); delay != want {
+			t.Errorf("failure %d: delay %v, want %v", i+1, delay, want)
+		}
+	}
+	// failed client backs off without threshold, other clients don't.
+	if !l.banned("10.0.0.1", "") {
+		t.Error("ip not backing off")
+	}
+	if l.banned("10.0.0.2", "alice") {
+		t.Error("account backing off without per user threshold")
+	}
+
+	l = newLockout(AuthLockout{BaseDelay: 20 * time.Millisecond}, NewMetrics())
+	l.failure("10.0.0.1", "alice", true)
+	time.Sleep(30 * time.Millisecond)
+	if l.banned("10.0.0.1", "alice") {
+		t.Error("still backing off after delay")
+	}
+}
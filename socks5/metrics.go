@@ -0,0 +1,51 @@
+package socks5
+
+import (
+	"sync/atomic"
+)
+
+// Metrics hold server runtime counters, every field must be accessed by atomic operations.
+type Metrics struct {
+	SessionsActive int64 // current running sessions
+	SessionsTotal  int64 // accepted sessions since server start
+
+	// connection limits
+	RejectedTotal   int64 // rejected because of max sessions
+	RejectedPerIP   int64 // rejected because of max sessions per client ip
+	RejectedPerUser int64 // rejected because of max sessions per user
+	RejectedRate    int64 // rejected because of new connection rate per client ip
+	AcceptPaused    int64 // times of accept loop paused because of max sessions
+
+	// traffic quota
+	RejectedQuota int64 // rejected because of user traffic quota exceeded
+
+	// authentication lockout
+	AuthFailures   int64 // failed username/password attempts
+	AuthBans       int64 // times of client ip or username banned
+	RejectedBanned int64 // attempts rejected because of ban
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+func (m *Metrics) Add(counter *int64, delta int64) {
+	atomic.AddInt64(counter, delta)
+}
+
+// Snapshot return a copy of all counters, key is the counter name. it is served by "/api/stats" of admin api.
+func (m *Metrics) Snapshot() map[string]int64 {
+	return map[string]int64{
+		"sessions_active":   atomic.LoadInt64(&m.SessionsActive),
+		"sessions_total":    atomic.LoadInt64(&m.SessionsTotal),
+		"rejected_total":    atomic.LoadInt64(&m.RejectedTotal),
+		"rejected_per_ip":   atomic.LoadInt64(&m.RejectedPerIP),
+		"rejected_per_user": atomic.LoadInt64(&m.RejectedPerUser),
+		"rejected_rate":     atomic.LoadInt64(&m.RejectedRate),
+		"accept_paused":     atomic.LoadInt64(&m.AcceptPaused),
+		"rejected_quota":    atomic.LoadInt64(&m.RejectedQuota),
+		"auth_failures":     atomic.LoadInt64(&m.AuthFailures),
+		"auth_bans":         atomic.LoadInt64(&m.AuthBans),
+		"rejected_banned":   atomic.LoadInt64(&m.RejectedBanned),
+	}
+}
@@ -0,0 +1,152 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+	"xproxy/mux"
+)
+
+var (
+	ErrBadMuxPreface = errors.New("bad mux preface")
+)
+
+// MuxPreface is sent by client before mux frames, it never conflicts with socks version byte 0x05.
+var MuxPreface = []byte("XMUX")
+
+// serveMux accept streams multiplexed over conn, every stream is a socks session.
+func (s *Server) serveMux(conn net.Conn) {
+	session := mux.Server(conn, nil)
+	defer session.Close()
+
+	if Debug {
+		log.Printf("mux session established. client: %s", conn.RemoteAddr())
+	}
+	for {
+		stream, err := session.AcceptStream()
+		if nil != err {
+			if Debug {
+				log.Printf("mux session closed. client: %s, reason: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		go s.processTCPConn(stream)
+	}
+}
+
+// muxPool keep up to size long-lived mux sessions to proxy server, streams are opened on the least busy one.
+type muxPool struct {
+	size   int
+	dial   func(network, addr string) (net.Conn, error) // dial underlying transport
+	tunnel *Tunnel                                      // encrypt underlying transport, nil means plain
+
+	mu       sync.Mutex
+	sessions []*mux.Session
+	dialing  int           // sessions being dialed outside the lock
+	dialed   chan struct{} // closed and replaced when a dial finished
+}
+
+func newMuxPool(size int, dial func(network, addr string) (net.Conn, error), tunnel *Tunnel) *muxPool {
+	return &muxPool{size: size, dial: dial, tunnel: tunnel, dialed: make(chan struct{})}
+}
+
+// Dial open a stream to proxy server, it has the same signature as net.Dial, so it can be used as Client.Dial.
+// the pool is filled up to size first, a slow dial never blocks streams on established sessions.
+func (p *muxPool) Dial(network, addr string) (net.Conn, error) {
+	for {
+		p.mu.Lock()
+		live := p.sessions[:0]
+		for _, session := range p.sessions {
+			if !session.IsClosed() {
+				live = append(live, session)
+			}
+		}
+		p.sessions = live
+
+		if len(p.sessions)+p.dialing < p.size {
+			p.dialing++
+			p.mu.Unlock()
+
+			session, err := p.dialSession(network, addr)
+			p.mu.Lock()
+			p.dialing--
+			if nil == err {
+				p.sessions = append(p.sessions, session)
+			}
+			close(p.dialed)
+			p.dialed = make(chan struct{})
+			p.mu.Unlock()
+			if nil != err {
+				return nil, err
+			}
+			return session.OpenStream()
+		}
+
+		var best *mux.Session
+		for _, session := range p.sessions {
+			if nil == best || session.NumStreams() < best.NumStreams() {
+				best = session
+			}
+		}
+		dialed := p.dialed
+		p.mu.Unlock()
+		if nil != best {
+			return best.OpenStream()
+		}
+		// every session of pool is being dialed.
+		<-dialed
+	}
+}
+
+func (p *muxPool) dialSession(network, addr string) (*mux.Session, error) {
+	conn, err := p.dial(network, addr)
+	if nil != err {
+		return nil, err
+	}
+	if nil != p.tunnel {
+		conn = p.tunnel.Wrap(conn)
+	}
+	if _, err := conn.Write(MuxPreface); nil != err {
+		conn.Close()
+		return nil, err
+	}
+	return mux.Client(conn, nil), nil
+}
+
+// help func ===========================================================================================================
+
+// sniffMux peek the first bytes of connection, the returned connection keeps the buffer, so handshake reads are
+// buffered too.
+func sniffMux(conn net.Conn, deadline int) (net.Conn, bool, error) {
+	if deadline != 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(time.Duration(deadline) * time.Second)); nil != err {
+			return nil, false, err
+		}
+	}
+
+	buffered := newBufferedConn(conn)
+	first, err := buffered.reader.Peek(1)
+	if nil != err {
+		return nil, false, err
+	}
+	if first[0] != MuxPreface[0] {
+		return buffered, false, nil
+	}
+
+	preface, err := buffered.reader.Peek(len(MuxPreface))
+	if nil != err {
+		return nil, false, err
+	}
+	if !bytes.Equal(preface, MuxPreface) {
+		return nil, false, ErrBadMuxPreface
+	}
+	buffered.reader.Discard(len(MuxPreface))
+	// mux session has its own keepalive, clear handshake deadline.
+	if err := conn.SetReadDeadline(time.Time{}); nil != err {
+		return nil, false, err
+	}
+	return buffered, true, nil
+}
@@ -0,0 +1,72 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+	"xproxy/mux"
+)
+
+func TestMuxPoolDial(t *testing.T) {
+	dialed := make(chan struct{}, 2)
+	release := make(chan struct{})
+	dial := func(network, addr string) (net.Conn, error) {
+		// the second session is slow to connect.
+		dialed <- struct{}{}
+		if len(dialed) == 2 {
+			<-release
+		}
+		c, s := net.Pipe()
+		go func() {
+			preface := make([]byte, len(MuxPreface))
+			io.ReadFull(s, preface)
+			mux.Server(s, nil) // closed when client session closed
+		}()
+		return c, nil
+	}
+	pool := newMuxPool(2, dial, nil)
+	defer func() {
+		for _, session := range pool.sessions {
+			session.Close()
+		}
+	}()
+
+	if _, err := pool.Dial("tcp", "proxy"); nil != err {
+		t.Fatal(err)
+	}
+	slow := make(chan error, 1)
+	go func() {
+		_, err := pool.Dial("tcp", "proxy")
+		slow <- err
+	}()
+	for len(dialed) != 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// pool is full while the second session is being dialed, stream is opened on the first one.
+	opened := make(chan error, 1)
+	go func() {
+		_, err := pool.Dial("tcp", "proxy")
+		opened <- err
+	}()
+	select {
+	case err := <-opened:
+		if nil != err {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial blocked by slow session dial")
+	}
+	if n := pool.sessions[0].NumStreams(); n != 2 {
+		t.Errorf("%d streams on the first session", n)
+	}
+
+	close(release)
+	if err := <-slow; nil != err {
+		t.Fatal(err)
+	}
+	if len(pool.sessions) != 2 {
+		t.Errorf("%d sessions in pool", len(pool.sessions))
+	}
+}
@@ -12,21 +12,32 @@ func ParseAddress(address string) (addrType byte, addr, port []byte, err error)
 		return
 	}
 
-	// get address type.
+	// get address type, empty host is unspecified address, such as listen address ":1080".
 	ip := net.ParseIP(hostStr)
+	if hostStr == "" {
+		ip = net.IPv4zero
+	}
 	if ipv4 := ip.To4(); nil != ipv4 {
 		addrType = ATYPIPv4
 		addr = []byte(ipv4)
 	} else if ipv6 := ip.To16(); nil != ipv6 {
 		addrType = ATYPIPv6
-		addr = []byte(ipv4)
+		addr = []byte(ipv6)
 	} else {
+		// domain length must fit the length byte.
+		if len(hostStr) > 255 {
+			err = ErrBadRequest
+			return
+		}
 		addrType = ATYPDomain
 		addr = []byte{byte(len(hostStr))}
 		addr = append(addr, []byte(hostStr)...)
 	}
 
-	portInt, _ := strconv.Atoi(portStr)
+	portInt, err := strconv.ParseUint(portStr, 10, 16)
+	if nil != err {
+		return
+	}
 	port = make([]byte, 2)
 	binary.BigEndian.PutUint16(port, uint16(portInt))
 	return
@@ -0,0 +1,122 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+var (
+	ErrOptimisticMethod = errors.New("optimistic handshake needs username/password or no authentication")
+)
+
+// ConnectOptimistic is the pipelined form of Negotiation and Connect, method selection, credentials and CONNECT
+// request are sent by one write without waiting for replies. the returned connection can be written at once,
+// replies are read and verified by first read, which returns the handshake error if proxy server refused.
+// only username/password and no authentication are supported, because their messages are known in advance.
+func (c *Client) ConnectOptimistic(addr string) (net.Conn, error) {
+	if len(c.Authenticators) > 0 {
+		return nil, ErrOptimisticMethod
+	}
+	request, err := NewSocksRequestFromAddress(CMDConnect, addr)
+	if nil != err {
+		return nil, err
+	}
+
+	method := MethodNoAuthRequired
+	if c.Username != "" && c.Password != "" {
+		method = MethodUsernamePassword
+	}
+	flight, err := NewNegotiationRequest([]byte{method}).AppendBinary(nil)
+	if nil != err {
+		return nil, err
+	}
+	if method == MethodUsernamePassword {
+		authRequest, err := NewUsernamePasswordNegotiationRequest(c.Username, c.Password)
+		if nil != err {
+			return nil, err
+		}
+		if flight, err = authRequest.AppendBinary(flight); nil != err {
+			return nil, err
+		}
+	}
+	if flight, err = request.AppendBinary(flight); nil != err {
+		return nil, err
+	}
+
+	if err := c.dialProxy(); nil != err {
+		return nil, err
+	}
+	if _, err := c.DstTCPConn.Write(flight); nil != err {
+		c.DstTCPConn.Close()
+		return nil, err
+	}
+	return &optimisticConn{Conn: c.DstTCPConn, method: method}, nil
+}
+
+// connectOptimistic create a proxied connection by pipelined handshake.
+func (cfg *ClientConfig) connectOptimistic(ctx context.Context, addr string) (net.Conn, error) {
+	client, err := cfg.newClient(ctx)
+	if nil != err {
+		return nil, err
+	}
+	conn, err := client.ConnectOptimistic(addr)
+	if ctxErr := client.finishHandshake(); nil != ctxErr {
+		if nil == err {
+			conn.Close()
+		}
+		return nil, ctxErr
+	}
+	return conn, err
+}
+
+// help func ===========================================================================================================
+
+// optimisticConn verify handshake replies before the first read of proxied data, writes are not delayed.
+type optimisticConn struct {
+	net.Conn
+	method byte
+
+	once sync.Once
+	err  error
+}
+
+func (c *optimisticConn) Read(b []byte) (int, error) {
+	c.once.Do(func() {
+		c.err = c.readReplies()
+	})
+	if nil != c.err {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *optimisticConn) readReplies() error {
+	negotiationReply, err := ParseNegotiationReply(c.Conn)
+	if nil != err {
+		return err
+	}
+	if negotiationReply.Method != c.method {
+		return ErrNonSupportCurrentMethod
+	}
+
+	if c.method == MethodUsernamePassword {
+		authReply, err := NewUsernamePasswordNegotiationReply(c.Conn)
+		if nil != err {
+			return err
+		}
+		if authReply.Status != UsernamePasswordStatusSuccess {
+			return ErrUnameOrPasswdError
+		}
+	}
+
+	reply, err := ParseSocksReply(c.Conn)
+	if nil != err {
+		return err
+	}
+	if reply.REP != SocksReplySuccess {
+		return ErrRequestFail
+	}
+	return nil
+}
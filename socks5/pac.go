@@ -0,0 +1,82 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// GeneratePAC generate proxy auto-config script from rule set, destinations matching direct rules bypass proxy,
+// others go through proxy, so deny and upstream rules are still enforced by server.
+// notes: country and asn conditions can't be evaluated by browser, they are ignored. rules only having them are
+// skipped, so keep direct rules before geo rules if the order matters.
+func GeneratePAC(rules *RuleSet, proxyAddr string) string {
+	// no plain SOCKS fallback, browsers take it as socks4 which has no udp and resolves domains locally.
+	proxy := "SOCKS5 " + proxyAddr
+
+	var body bytes.Buffer
+	needIP := false
+	if nil != rules {
+		for _, rule := range rules.Rules {
+			if len(rule.Domains) == 0 && len(rule.CIDRs) == 0 {
+				continue
+			}
+			result := proxy
+			if rule.Action == RuleActionDirect {
+				result = "DIRECT"
+			}
+
+			var conds []string
+			for _, domain := range rule.Domains {
+				conds = append(conds, fmt.Sprintf("host == %s || dnsDomainIs(host, %s)", jsString(domain), jsString("."+domain)))
+			}
+			for _, cidr := range rule.CIDRs {
+				ip, ipNet, err := net.ParseCIDR(cidr)
+				if nil != err {
+					continue
+				}
+				needIP = true
+				if nil != ip.To4() {
+					conds = append(conds, fmt.Sprintf("(ip && isInNet(ip, %s, %s))", jsString(ipNet.IP.String()), jsString(net.IP(ipNet.Mask).String())))
+				} else {
+					conds = append(conds, fmt.Sprintf("(ip && typeof isInNetEx == \"function\" && isInNetEx(ip, %s))", jsString(ipNet.String())))
+				}
+			}
+			if len(conds) == 0 {
+				continue
+			}
+
+			body.WriteString("    if (")
+			for i, cond := range conds {
+				if i > 0 {
+					body.WriteString(" ||\n        ")
+				}
+				body.WriteString(cond)
+			}
+			fmt.Fprintf(&body, ") {\n        return %s;\n    }\n", jsString(result))
+		}
+	}
+
+	defaultResult := proxy
+	if nil != rules && rules.DefaultAction == RuleActionDirect {
+		defaultResult = "DIRECT"
+	}
+
+	var pac bytes.Buffer
+	pac.WriteString("// generated by xproxy, do not edit.\n")
+	pac.WriteString("function FindProxyForURL(url, host) {\n")
+	pac.WriteString("    host = host.toLowerCase();\n")
+	if needIP {
+		pac.WriteString("    var ip = dnsResolve(host);\n")
+	}
+	pac.Write(body.Bytes())
+	fmt.Fprintf(&pac, "    return %s;\n}\n", jsString(defaultResult))
+	return pac.String()
+}
+
+// jsString quote string as javascript string literal.
+func jsString(s string) string {
+	data, _ := json.Marshal(s)
+	return string(data)
+}
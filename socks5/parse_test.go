@@ -0,0 +1,63 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+)
+
+// pipeConn return the reading end of a connection which has data written.
+func pipeConn(data []byte) net.Conn {
+	client, server := net.Pipe()
+	go func() {
+		client.Write(data)
+		client.Close()
+	}()
+	return server
+}
+
+func TestParseSocksReplyAddressTypes(t *testing.T) {
+	tests := []struct {
+		wire []byte
+		want string
+	}{
+		{append(append([]byte{0x05, 0x00, 0x00, ATYPDomain, 0x09}, "proxy.lan"...), 0x04, 0x38), "proxy.lan:1080"},
+		{[]byte{0x05, 0x00, 0x00, ATYPIPv6, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0x04, 0x38}, "[::1]:1080"},
+	}
+	for _, test := range tests {
+		reply, err := ParseSocksReply(pipeConn(test.wire))
+		if nil != err {
+			t.Fatalf("ParseSocksReply(% x): %v", test.wire, err)
+		}
+		if reply.Address() != test.want {
+			t.Fatalf("Address = %s, want %s", reply.Address(), test.want)
+		}
+	}
+}
+
+func TestParseSocksRequestVersion(t *testing.T) {
+	_, err := ParseSocksRequest(pipeConn([]byte{0x04, CMDConnect, 0x00, ATYPIPv4, 127, 0, 0, 1, 0x00, 0x50}))
+	if err != ErrNonSupportCurrentSocksProtocolVersion {
+		t.Fatalf("ParseSocksRequest = %v, want %v", err, ErrNonSupportCurrentSocksProtocolVersion)
+	}
+}
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		atyp byte
+		ok   bool
+	}{
+		{"127.0.0.1:80", ATYPIPv4, true},
+		{"[::1]:80", ATYPIPv6, true},
+		{"example.com:443", ATYPDomain, true},
+		{":1080", ATYPIPv4, true},
+		{"example.com:65536", 0, false},
+		{"example.com:http", 0, false},
+	}
+	for _, test := range tests {
+		atyp, _, _, err := ParseAddress(test.addr)
+		if (nil == err) != test.ok || (test.ok && atyp != test.atyp) {
+			t.Fatalf("ParseAddress(%s) = %#x, %v", test.addr, atyp, err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package socks5
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+	"xproxy/proxyproto"
+)
+
+var (
+	ErrNoTrustedSource     = errors.New("proxy protocol needs trusted sources")
+	ErrProxyHeaderRequired = errors.New("proxy protocol header required from trusted source")
+)
+
+// DefaultProxyHeaderTimeout bound waiting for PROXY header after connection accepted.
+const DefaultProxyHeaderTimeout = 5 * time.Second
+
+// ProxyProtocol accept HAProxy PROXY protocol v1 and v2 headers on tcp listener, so the original client address
+// behind load balancer drives limits, lockout, rules, sessions and logs.
+// trusted sources must send the header, connections from other sources are served as they are.
+type ProxyProtocol struct {
+	TrustedSources []string      // ip or cidr of load balancers, e.g. "10.0.0.0/8"
+	Timeout        time.Duration // wait for header, default is DefaultProxyHeaderTimeout
+
+	nets []*net.IPNet
+}
+
+// compile parse trusted sources, it must be called before accepting connections.
+func (p *ProxyProtocol) compile() error {
+	if len(p.TrustedSources) == 0 {
+		return ErrNoTrustedSource
+	}
+	p.nets = p.nets[:0]
+	for _, source := range p.TrustedSources {
+		if !strings.Contains(source, "/") {
+			if ip := net.ParseIP(source); nil != ip && nil != ip.To4() {
+				source += "/32"
+			} else {
+				source += "/128"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(source)
+		if nil != err {
+			return err
+		}
+		p.nets = append(p.nets, ipNet)
+	}
+	return nil
+}
+
+// accept read PROXY header of connection from trusted source, the returned connection reports the original
+// client address as remote address and the address client connected to as local address.
+func (p *ProxyProtocol) accept(conn net.Conn) (net.Conn, error) {
+	if !p.trusted(conn.RemoteAddr()) {
+		return conn, nil
+	}
+
+	timeout := p.Timeout
+	if 0 == timeout {
+		timeout = DefaultProxyHeaderTimeout
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); nil != err {
+		return nil, err
+	}
+	buffered := newBufferedConn(conn)
+	header, err := proxyproto.Read(buffered.reader)
+	if err == proxyproto.ErrNoHeader {
+		return nil, ErrProxyHeaderRequired
+	}
+	if nil != err {
+		return nil, err
+	}
+	if err := conn.SetReadDeadline(time.Time{}); nil != err {
+		return nil, err
+	}
+
+	// health check of load balancer, addresses are not sent.
+	if header.Local {
+		return buffered, nil
+	}
+	if Debug {
+		log.Printf("proxy protocol v%d. balancer: %s, client: %s", header.Version, conn.RemoteAddr(), header.Source)
+	}
+	return &proxiedConn{bufferedConn: buffered, remote: header.Source, local: header.Destination}, nil
+}
+
+func (p *ProxyProtocol) trusted(addr net.Addr) bool {
+	ip := tcpAddr(addr).IP
+	for _, ipNet := range p.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxiedConn report addresses of PROXY header.
+type proxiedConn struct {
+	*bufferedConn
+	remote, local net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *proxiedConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// writeProxyHeader send PROXY header of session client to destination, header of nil session is LOCAL.
+func writeProxyHeader(conn net.Conn, version int, session *Session) error {
+	header := &proxyproto.Header{Version: version}
+	if nil != session {
+		header.Source, header.Destination = tcpAddr(session.ClientAddr), tcpAddr(conn.RemoteAddr())
+	} else {
+		header.Local = true
+	}
+	_, err := header.WriteTo(conn)
+	return err
+}
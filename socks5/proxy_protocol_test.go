@@ -0,0 +1,41 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+)
+
+func TestProxyProtocolTrusted(t *testing.T) {
+	if err := (&ProxyProtocol{}).compile(); err != ErrNoTrustedSource {
+		t.Fatalf("got %v, want %v", err, ErrNoTrustedSource)
+	}
+	if err := (&ProxyProtocol{TrustedSources: []string{"10.0.0"}}).compile(); nil == err {
+		t.Fatal("invalid source accepted")
+	}
+
+	p := &ProxyProtocol{TrustedSources: []string{"192.0.2.1", "10.0.0.0/8", "2001:db8::1"}}
+	if err := p.compile(); nil != err {
+		t.Fatal(err)
+	}
+	tests := map[string]bool{
+		"192.0.2.1:1080":     true,
+		"192.0.2.2:1080":     false,
+		"10.1.2.3:1080":      true,
+		"[2001:db8::1]:1080": true,
+		"[2001:db8::2]:1080": false,
+	}
+	for addr, trusted := range tests {
+		tcp, _ := net.ResolveTCPAddr("tcp", addr)
+		if p.trusted(tcp) != trusted {
+			t.Errorf("%s: trusted %v, want %v", addr, !trusted, trusted)
+		}
+	}
+
+	// untrusted connection is served as it is.
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if conn, err := p.accept(server); nil != err || conn != server {
+		t.Fatalf("untrusted conn: %v, %v", conn, err)
+	}
+}
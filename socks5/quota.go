@@ -0,0 +1,257 @@
+package socks5
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQuotaExceeded = errors.New("traffic quota exceeded")
+)
+
+const (
+	DefaultMaxDestinations = 1000
+	OtherDestinations      = "other" // counter of destinations over MaxDestinations
+
+	// relay adds bytes to accounting once per batch, a batch never exceeds bytes left of quota.
+	accountBatchBytes = 64 * 1024
+)
+
+// QuotaLimit is the traffic limit of user, zero value means unlimited.
+type QuotaLimit struct {
+	DailyBytes   int64 `json:"daily_bytes"`
+	MonthlyBytes int64 `json:"monthly_bytes"`
+}
+
+// Quota is the traffic accounting config.
+type Quota struct {
+	Default QuotaLimit            // limit of users without their own limit
+	Users   map[string]QuotaLimit // username -> limit
+
+	PerDestination  bool // also count bytes per destination address, destination counters are reset every month
+	MaxDestinations int  // destinations counted per user, the rest are counted as OtherDestinations, default is DefaultMaxDestinations
+	CutLive         bool // close running sessions of user when exceeded
+
+	StateFile    string        // persist counters to local file, empty means no persistence
+	SaveInterval time.Duration // default is 1 minute
+}
+
+// TrafficUsage is the traffic counters of user.
+type TrafficUsage struct {
+	TotalBytes   int64            `json:"total_bytes"`
+	Day          string           `json:"day"` // 2006-01-02
+	DailyBytes   int64            `json:"daily_bytes"`
+	Month        string           `json:"month"` // 2006-01
+	MonthlyBytes int64            `json:"monthly_bytes"`
+	Destinations map[string]int64 `json:"destinations,omitempty"`
+}
+
+// Accounting accumulate traffic of users, and check quota limits.
+type Accounting struct {
+	quota Quota
+
+	mu    sync.Mutex
+	users map[string]*TrafficUsage
+	dirty bool
+	done  chan struct{}
+}
+
+// NewAccounting create accounting by quota config, load counters from state file if exists.
+func NewAccounting(quota Quota) (*Accounting, error) {
+	if quota.SaveInterval == 0 {
+		quota.SaveInterval = time.Minute
+	}
+	if quota.MaxDestinations == 0 {
+		quota.MaxDestinations = DefaultMaxDestinations
+	}
+
+	a := &Accounting{
+		quota: quota,
+		users: make(map[string]*TrafficUsage),
+		done:  make(chan struct{}),
+	}
+	if err := a.load(); nil != err {
+		return nil, err
+	}
+	if quota.StateFile != "" {
+		go a.saveLoop()
+	}
+	return a, nil
+}
+
+// Add count traffic bytes of user, return false if user quota exceeded after counted.
+func (a *Accounting) Add(username, dst string, n int64) bool {
+	return a.add(username, dst, n, time.Now()) > 0
+}
+
+// Exceeded return true if user daily or monthly quota used up.
+func (a *Accounting) Exceeded(username string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.remainingLocked(username, a.usageLocked(username, time.Now())) <= 0
+}
+
+// CutLive return true if running sessions of user should be closed when quota exceeded.
+func (a *Accounting) CutLive() bool {
+	return a.quota.CutLive
+}
+
+// Usage return a copy of user traffic counters.
+func (a *Accounting) Usage(username string) TrafficUsage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	usage := *a.usageLocked(username, time.Now())
+	if nil != usage.Destinations {
+		destinations := make(map[string]int64, len(usage.Destinations))
+		for dst, n := range usage.Destinations {
+			destinations[dst] = n
+		}
+		usage.Destinations = destinations
+	}
+	return usage
+}
+
+// Close stop background saving, and save counters at last.
+func (a *Accounting) Close() error {
+	select {
+	case <-a.done:
+		return nil
+	default:
+		close(a.done)
+	}
+	return a.Save()
+}
+
+// Save write counters to state file, write to temp file then rename, avoid broken file.
+func (a *Accounting) Save() error {
+	if a.quota.StateFile == "" {
+		return nil
+	}
+
+	a.mu.Lock()
+	data, err := json.MarshalIndent(a.users, "", "  ")
+	a.dirty = false
+	a.mu.Unlock()
+	if nil != err {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(a.quota.StateFile), filepath.Base(a.quota.StateFile)+".tmp")
+	if nil != err {
+		return err
+	}
+	if _, err := tmp.Write(data); nil != err {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); nil != err {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), a.quota.StateFile)
+}
+
+// help func ===========================================================================================================
+
+// add count bytes, return bytes left before quota exceeded, it's not positive if exceeded.
+func (a *Accounting) add(username, dst string, n int64, now time.Time) int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	usage := a.usageLocked(username, now)
+	usage.TotalBytes += n
+	usage.DailyBytes += n
+	usage.MonthlyBytes += n
+	if a.quota.PerDestination && dst != "" {
+		if usage.Destinations == nil {
+			usage.Destinations = make(map[string]int64)
+		}
+		if _, ok := usage.Destinations[dst]; !ok && len(usage.Destinations) >= a.quota.MaxDestinations {
+			dst = OtherDestinations
+		}
+		usage.Destinations[dst] += n
+	}
+	a.dirty = true
+	return a.remainingLocked(username, usage)
+}
+
+func (a *Accounting) load() error {
+	if a.quota.StateFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(a.quota.StateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if nil != err {
+		return err
+	}
+	return json.Unmarshal(data, &a.users)
+}
+
+func (a *Accounting) saveLoop() {
+	ticker := time.NewTicker(a.quota.SaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.mu.Lock()
+			dirty := a.dirty
+			a.mu.Unlock()
+			if !dirty {
+				continue
+			}
+			if err := a.Save(); nil != err {
+				log.Printf("accounting: save state file error: %v", err)
+			}
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// usageLocked return counters of user, reset daily/monthly counters when day/month changed.
+func (a *Accounting) usageLocked(username string, now time.Time) *TrafficUsage {
+	usage, ok := a.users[username]
+	if !ok {
+		usage = &TrafficUsage{}
+		a.users[username] = usage
+	}
+
+	if day := now.Format("2006-01-02"); usage.Day != day {
+		usage.Day = day
+		usage.DailyBytes = 0
+	}
+	if month := now.Format("2006-01"); usage.Month != month {
+		usage.Month = month
+		usage.MonthlyBytes = 0
+		usage.Destinations = nil
+	}
+	return usage
+}
+
+// remainingLocked return bytes left before daily or monthly quota used up, math.MaxInt64 means unlimited.
+func (a *Accounting) remainingLocked(username string, usage *TrafficUsage) int64 {
+	limit, ok := a.quota.Users[username]
+	if !ok {
+		limit = a.quota.Default
+	}
+	remaining := int64(math.MaxInt64)
+	if limit.DailyBytes > 0 && limit.DailyBytes-usage.DailyBytes < remaining {
+		remaining = limit.DailyBytes - usage.DailyBytes
+	}
+	if limit.MonthlyBytes > 0 && limit.MonthlyBytes-usage.MonthlyBytes < remaining {
+		remaining = limit.MonthlyBytes - usage.MonthlyBytes
+	}
+	return remaining
+}
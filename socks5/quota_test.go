@@ -0,0 +1,172 @@
+package socks5
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAccountingRollover(t *testing.T) {
+	a, err := NewAccounting(Quota{
+		Default: QuotaLimit{DailyBytes: 100, MonthlyBytes: 250},
+		Users:   map[string]QuotaLimit{"vip": {}},
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	day := time.Date(2026, 1, 20, 12, 0, 0, 0, time.Local)
+	if a.add("alice", "", 99, day) <= 0 {
+		t.Fatal("exceeded under daily limit")
+	}
+	if a.add("alice", "", 1, day) > 0 {
+		t.Fatal("daily limit not exceeded")
+	}
+	if a.add("alice", "", 1, day.Add(time.Hour)) > 0 {
+		t.Fatal("daily limit reset in same day")
+	}
+	if a.add("vip", "", 1000, day) <= 0 {
+		t.Fatal("unlimited user exceeded")
+	}
+
+	// next day resets daily counter only.
+	if a.add("alice", "", 99, day.Add(24*time.Hour)) <= 0 {
+		t.Fatal("daily limit not reset in next day")
+	}
+	if a.add("alice", "", 50, day.Add(48*time.Hour)) > 0 {
+		t.Fatal("monthly limit not exceeded")
+	}
+
+	// next month resets both.
+	next := time.Date(2026, 2, 1, 0, 0, 0, 0, time.Local)
+	if a.add("alice", "", 10, next) <= 0 {
+		t.Fatal("limit not reset in next month")
+	}
+	a.mu.Lock()
+	usage := *a.users["alice"]
+	a.mu.Unlock()
+	if !reflect.DeepEqual(usage, TrafficUsage{TotalBytes: 260, Day: "2026-02-01", DailyBytes: 10, Month: "2026-02", MonthlyBytes: 10}) {
+		t.Errorf("usage %+v", usage)
+	}
+}
+
+func TestAccountingStateFile(t *testing.T) {
+	quota := Quota{
+		Default:        QuotaLimit{DailyBytes: 100},
+		PerDestination: true,
+		StateFile:      filepath.Join(t.TempDir(), "quota.json"),
+	}
+	a, err := NewAccounting(quota)
+	if nil != err {
+		t.Fatal(err)
+	}
+	a.Add("alice", "example.com:443", 60)
+	a.Add("alice", "example.org:80", 40)
+	if !a.Exceeded("alice") {
+		t.Fatal("limit not exceeded")
+	}
+	if err := a.Close(); nil != err {
+		t.Fatal(err)
+	}
+
+	// counters survive restart, quota is still used up.
+	b, err := NewAccounting(quota)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if !b.Exceeded("alice") || b.Exceeded("bob") {
+		t.Error("exceeded state not restored")
+	}
+	usage := b.Usage("alice")
+	if usage.TotalBytes != 100 || usage.DailyBytes != 100 || len(usage.Destinations) != 2 || usage.Destinations["example.com:443"] != 60 {
+		t.Errorf("restored usage %+v", usage)
+	}
+
+	// counters saved in a previous day are reset on load.
+	b.mu.Lock()
+	b.users["alice"].Day = "2000-01-01"
+	b.mu.Unlock()
+	if err := b.Save(); nil != err {
+		t.Fatal(err)
+	}
+	c, err := NewAccounting(quota)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if c.Exceeded("alice") || c.Usage("alice").TotalBytes != 100 {
+		t.Errorf("stale day not reset: %+v", c.Usage("alice"))
+	}
+}
+
+func TestAccountingDestinations(t *testing.T) {
+	a, err := NewAccounting(Quota{PerDestination: true, MaxDestinations: 2})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	day := time.Date(2026, 1, 20, 12, 0, 0, 0, time.Local)
+	for _, dst := range []string{"a:1", "b:1", "a:1", "c:1", "d:1"} {
+		a.add("alice", dst, 10, day)
+	}
+	a.mu.Lock()
+	destinations := a.users["alice"].Destinations
+	a.mu.Unlock()
+	if !reflect.DeepEqual(destinations, map[string]int64{"a:1": 20, "b:1": 10, OtherDestinations: 20}) {
+		t.Errorf("destinations over limit %+v", destinations)
+	}
+
+	// destination counters are monthly.
+	a.add("alice", "c:1", 10, time.Date(2026, 2, 1, 0, 0, 0, 0, time.Local))
+	a.mu.Lock()
+	destinations = a.users["alice"].Destinations
+	a.mu.Unlock()
+	if !reflect.DeepEqual(destinations, map[string]int64{"c:1": 10}) {
+		t.Errorf("destinations of next month %+v", destinations)
+	}
+}
+
+func TestTrafficCounterBatch(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", "", "", "", 0, 0, 0, 0)
+	if nil != err {
+		t.Fatal(err)
+	}
+	quota := Quota{Default: QuotaLimit{DailyBytes: 100 * 1024}, StateFile: filepath.Join(t.TempDir(), "quota.json")}
+	if s.Accounting, err = NewAccounting(quota); nil != err {
+		t.Fatal(err)
+	}
+	session := &Session{Username: "alice"}
+	counter := s.newTrafficCounter(session, true)
+
+	// the first write is flushed, the following ones are batched.
+	counter.add(2048)
+	counter.add(2048)
+	if used := s.Accounting.Usage("alice").DailyBytes; used != 2048 {
+		t.Fatalf("accounted %d bytes, want 2048 before batch is full", used)
+	}
+	// batch shrinks to bytes left of quota, so the write crossing quota is accounted at once.
+	for session.BytesUp < 100*1024 {
+		counter.add(1024)
+	}
+	if used := s.Accounting.Usage("alice").DailyBytes; used != 100*1024 || session.BytesUp != 100*1024 {
+		t.Fatalf("accounted %d bytes, session %d bytes, want %d", used, session.BytesUp, 100*1024)
+	}
+	if !s.Accounting.Exceeded("alice") {
+		t.Fatal("quota not exceeded")
+	}
+
+	// Close saves counters like Stop.
+	s.Close()
+	restored, err := NewAccounting(quota)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if !restored.Exceeded("alice") {
+		t.Error("counters not saved by Close")
+	}
+}
@@ -0,0 +1,133 @@
+package socks5
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// relay copy data between client and remote connection, it blocks until both directions finished.
+// session can be nil, then traffic will not be counted.
+func (s *Server) relay(session *Session, conn, remoteConn net.Conn) {
+	if nil == session {
+		bridge(conn, remoteConn, s.TCPDeadline, nil, nil)
+		return
+	}
+	up, down := s.newTrafficCounter(session, true), s.newTrafficCounter(session, false)
+	bridge(conn, remoteConn, s.TCPDeadline, up.add, down.add)
+	up.flush()
+	down.flush()
+}
+
+// bridge is the relay engine shared by server and client side, it blocks until both directions finished.
+// when one direction finished, both connections will be closed, so the other direction stops too.
+// up/down account are called with written bytes of client -> remote and remote -> client, can be nil.
+func bridge(conn, remoteConn net.Conn, deadline int, up, down func(n int) bool) {
+	var once sync.Once
+	closeAll := func() {
+		conn.Close()
+		remoteConn.Close()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	// 1. read client request content, write to remote connection.
+	go func() {
+		defer wg.Done()
+		defer once.Do(closeAll)
+		pipe(remoteConn, conn, deadline, up)
+	}()
+
+	// 2. read remote connection return content, write to client.
+	go func() {
+		defer wg.Done()
+		defer once.Do(closeAll)
+		pipe(conn, remoteConn, deadline, down)
+	}()
+	wg.Wait()
+}
+
+// trafficCounter count bytes of one relay direction, session counter is updated by every write, and bytes are added
+// to accounting in batches, so relay doesn't take accounting lock for every chunk.
+type trafficCounter struct {
+	s       *Server
+	session *Session
+	counter *int64
+	dst     string
+
+	pending   int64
+	threshold int64 // pending bytes to flush, it's no more than bytes left of quota
+}
+
+func (s *Server) newTrafficCounter(session *Session, up bool) *trafficCounter {
+	c := &trafficCounter{s: s, session: session, counter: &session.BytesDown, threshold: 1}
+	if up {
+		c.counter = &session.BytesUp
+	}
+	if nil != session.Request {
+		c.dst = session.Request.Address()
+	}
+	return c
+}
+
+// add is called after every write of relay direction, it returns false to stop relay.
+func (c *trafficCounter) add(n int) bool {
+	atomic.AddInt64(c.counter, int64(n))
+	if nil == c.s.Accounting || c.session.Username == "" {
+		return true
+	}
+	c.pending += int64(n)
+	if c.pending < c.threshold {
+		return true
+	}
+	return c.flush()
+}
+
+// flush add pending bytes to accounting, the first write is flushed at once to learn bytes left of quota.
+func (c *trafficCounter) flush() bool {
+	if c.pending == 0 {
+		return true
+	}
+	remaining := c.s.Accounting.add(c.session.Username, c.dst, c.pending, time.Now())
+	c.pending = 0
+	c.threshold = accountBatchBytes
+	if remaining > 0 && remaining < c.threshold {
+		c.threshold = remaining
+	}
+	if remaining <= 0 && c.s.Accounting.CutLive() {
+		// idle sessions of user never account again, close them all here.
+		killed := c.s.KillUserSessions(c.session.Username)
+		log.Printf("session %d: user '%s' %v, cut %d live sessions", c.session.ID, c.session.Username, ErrQuotaExceeded, killed)
+		return false
+	}
+	return true
+}
+
+// pipe read from src and write to dst until error occurs, return written bytes.
+// deadline is in seconds, 0 means no deadline. account is called after every write, return false to stop.
+func pipe(dst, src net.Conn, deadline int, account func(n int) bool) int64 {
+	var written int64
+	var buff [1024 * 2]byte
+	for {
+		if deadline != 0 {
+			if err := src.SetDeadline(time.Now().Add(time.Duration(deadline) * time.Second)); nil != err {
+				return written
+			}
+		}
+		offset, err := src.Read(buff[:])
+		if offset > 0 {
+			if _, err := dst.Write(buff[0:offset]); nil != err {
+				return written
+			}
+			written += int64(offset)
+			if nil != account && !account(offset) {
+				return written
+			}
+		}
+		if nil != err {
+			return written
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package socks5
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRuleDenied      = errors.New("connection not allowed by ruleset")
+	ErrInvalidRule     = errors.New("invalid rule")
+	ErrUnknownUpstream = errors.New("unknown upstream")
+	ErrUpstreamUDP     = errors.New("nonsupport udp through upstream")
+)
+
+const (
+	// rule action.
+	RuleActionAllow    = "allow"    // dial destination directly
+	RuleActionDeny     = "deny"     // reply connection not allowed by ruleset
+	RuleActionUpstream = "upstream" // dial destination through upstream socks proxy server
+	RuleActionDirect   = "direct"   // same as allow on server, but clients using PAC file bypass proxy
+)
+
+// Rule match destination by domain suffix, cidr, country or asn, it matches if any condition matches.
+// country and asn conditions need geoip databases, domain destination is resolved before matching them.
+type Rule struct {
+	Action    string   `json:"action"`
+	Upstream  string   `json:"upstream,omitempty"`  // upstream or upstream group name, only used by upstream action
+	Domains   []string `json:"domains,omitempty"`   // domain suffix, "example.com" matches "a.example.com"
+	CIDRs     []string `json:"cidrs,omitempty"`     // e.g. "10.0.0.0/8"
+	Countries []string `json:"countries,omitempty"` // ISO 3166-1 alpha-2 country code, e.g. "US"
+	ASNs      []uint   `json:"asns,omitempty"`
+	Egress    *Egress  `json:"egress,omitempty"` // source of direct connections, wins over user and global egress
+
+	nets []*net.IPNet
+}
+
+// RuleSet is the rule config file content, rules are matched in order, first matched rule wins.
+type RuleSet struct {
+	Rules         []*Rule                   `json:"rules"`
+	DefaultAction string                    `json:"default_action"` // default is allow
+	DefaultRoute  string                    `json:"default_upstream,omitempty"`
+	Upstreams     map[string]*ClientConfig  `json:"upstreams,omitempty"`
+	Groups        map[string]*UpstreamGroup `json:"upstream_groups,omitempty"`
+	GeoIP         []string                  `json:"geoip,omitempty"` // MMDB files, e.g. GeoLite2-Country.mmdb
+}
+
+// Route is the routing decision of destination.
+type Route struct {
+	Action   string
+	Upstream *ClientConfig  // only set with upstream action
+	Group    *UpstreamGroup // only set with upstream action to upstream group
+	Rule     *Rule          // nil if default action used
+	Addr     string         // destination address, domain is replaced by resolved ip if it has been resolved
+	Tags     GeoTags
+}
+
+// Router match destination with rule set, rules and geoip databases can be reloaded without restart.
+type Router struct {
+	Path string // rule set file, json format
+
+	mu    sync.RWMutex
+	rules *RuleSet
+	geoip []*GeoIP
+	done  chan struct{}
+}
+
+// NewRouter load rule set file and geoip databases.
+func NewRouter(path string) (*Router, error) {
+	r := &Router{Path: path, done: make(chan struct{})}
+	if err := r.Reload(); nil != err {
+		return nil, err
+	}
+	return r, nil
+}
+
+// NewRouterFromRuleSet create router from memory rule set, Reload does nothing but reload geoip databases.
+func NewRouterFromRuleSet(rules *RuleSet) (*Router, error) {
+	r := &Router{done: make(chan struct{})}
+	if err := r.swap(rules); nil != err {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload read rule set file and geoip databases again, old config is kept if any error occurs.
+func (r *Router) Reload() error {
+	if r.Path == "" {
+		return r.reloadGeoIP()
+	}
+
+	data, err := ioutil.ReadFile(r.Path)
+	if nil != err {
+		return err
+	}
+	rules := &RuleSet{}
+	if err := json.Unmarshal(data, rules); nil != err {
+		return err
+	}
+	return r.swap(rules)
+}
+
+// Watch check geoip database files every interval, reload the changed ones.
+func (r *Router) Watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.reloadGeoIP(); nil != err {
+				log.Printf("router: reload geoip error: %v", err)
+			}
+		case <-r.done:
+			return
+		}
+	}
+}
+
+// Close stop watching and health checks, close geoip databases. it can be called more than once.
+func (r *Router) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	select {
+	case <-r.done:
+		return
+	default:
+		close(r.done)
+	}
+	for _, g := range r.geoip {
+		g.Close()
+	}
+	r.geoip = nil
+	if nil != r.rules {
+		r.rules.stopHealthChecks()
+	}
+}
+
+// Rules return current rule set, it must not be modified.
+func (r *Router) Rules() *RuleSet {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.rules
+}
+
+// Route match "host:port" destination address.
+func (r *Router) Route(addr string) (*Route, error) {
+	return r.RouteSniffed(addr, "")
+}
+
+// RouteSniffed match destination with server name sniffed from client bytes, such as TLS SNI or HTTP Host.
+// the name is sent by client, so it only replaces destination host in domain rules if destination is an ip, and deny
+// rules matching the ip by cidr, country or asn are checked before it. if destination is a domain, the name can only
+// deny: deny domain rules match either of them.
+func (r *Router) RouteSniffed(addr, name string) (*Route, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if nil != err {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	rules, geoip := r.rules, r.geoip
+	r.mu.RUnlock()
+
+	route := &Route{Addr: addr}
+	ip := net.ParseIP(host)
+	domain := ""
+	if nil == ip {
+		domain = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+
+	resolved := false
+	resolve := func() net.IP {
+		if resolved || nil != ip {
+			return ip
+		}
+		resolved = true
+		ips, err := net.LookupIP(domain)
+		if nil != err || len(ips) == 0 {
+			if Debug {
+				log.Printf("router: resolve %s error: %v", domain, err)
+			}
+			return nil
+		}
+		ip = ips[0]
+		route.Addr = net.JoinHostPort(ip.String(), port)
+		return ip
+	}
+
+	tagged := false
+	tags := func() GeoTags {
+		if tagged {
+			return route.Tags
+		}
+		tagged = true
+		if ip := resolve(); nil != ip {
+			route.Tags = lookupGeoTags(geoip, ip)
+		}
+		return route.Tags
+	}
+
+	matchDomain := domain
+	if name != "" {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if domain == "" {
+			for _, rule := range rules.Rules {
+				if rule.Action == RuleActionDeny && rule.match("", resolve, tags) {
+					return r.decide(rules, route, rule.Action, rule.Upstream, rule)
+				}
+			}
+			matchDomain = name
+		} else if name != domain {
+			for _, rule := range rules.Rules {
+				if rule.Action == RuleActionDeny && rule.matchDomain(name) {
+					return r.decide(rules, route, rule.Action, rule.Upstream, rule)
+				}
+			}
+		}
+	}
+	for _, rule := range rules.Rules {
+		if rule.match(matchDomain, resolve, tags) {
+			return r.decide(rules, route, rule.Action, rule.Upstream, rule)
+		}
+	}
+	return r.decide(rules, route, rules.DefaultAction, rules.DefaultRoute, nil)
+}
+
+// route match destination with server router, all destinations are allowed if router not set.
+// name is the sniffed server name, empty if not sniffed.
+func (s *Server) route(addr, name string) (*Route, error) {
+	if nil == s.Router {
+		return &Route{Action: RuleActionAllow, Addr: addr}, nil
+	}
+	route, err := s.Router.RouteSniffed(addr, name)
+	if nil != err {
+		return nil, err
+	}
+	if Debug {
+		log.Printf("router: %s (%s) -> %s, action: %s, country: %s, asn: %d", addr, name, route.Addr, route.Action, route.Tags.Country, route.Tags.ASN)
+	}
+	return route, nil
+}
+
+// help func ===========================================================================================================
+
+func (r *Router) decide(rules *RuleSet, route *Route, action, upstream string, rule *Rule) (*Route, error) {
+	if action == "" {
+		action = RuleActionAllow
+	}
+	route.Action = action
+	route.Rule = rule
+	if action == RuleActionUpstream {
+		route.Upstream = rules.Upstreams[upstream]
+		route.Group = rules.Groups[upstream]
+		if nil == route.Upstream && nil == route.Group {
+			return nil, ErrUnknownUpstream
+		}
+	}
+	return route, nil
+}
+
+func (r *Router) swap(rules *RuleSet) error {
+	if err := rules.compile(); nil != err {
+		return err
+	}
+
+	var geoip []*GeoIP
+	for _, path := range rules.GeoIP {
+		g, err := OpenGeoIP(path)
+		if nil != err {
+			for _, g := range geoip {
+				g.Close()
+			}
+			return err
+		}
+		geoip = append(geoip, g)
+	}
+
+	r.mu.Lock()
+	oldRules, old := r.rules, r.geoip
+	r.rules, r.geoip = rules, geoip
+	r.mu.Unlock()
+
+	for _, g := range old {
+		g.Close()
+	}
+	if nil != oldRules {
+		oldRules.stopHealthChecks()
+	}
+	rules.startHealthChecks()
+	return nil
+}
+
+func (r *Router) reloadGeoIP() error {
+	r.mu.RLock()
+	geoip := r.geoip
+	r.mu.RUnlock()
+
+	for _, g := range geoip {
+		if !g.Changed() {
+			continue
+		}
+		if err := g.Reload(); nil != err {
+			return err
+		}
+		log.Printf("router: geoip database %s reloaded", g.Path)
+	}
+	return nil
+}
+
+func lookupGeoTags(geoip []*GeoIP, ip net.IP) GeoTags {
+	var tags GeoTags
+	for _, g := range geoip {
+		t, err := g.Lookup(ip)
+		if nil != err {
+			continue
+		}
+		if t.Country != "" {
+			tags.Country = t.Country
+		}
+		if t.ASN != 0 {
+			tags.ASN = t.ASN
+		}
+	}
+	return tags
+}
+
+func (rules *RuleSet) compile() error {
+	for name, group := range rules.Groups {
+		if nil != rules.Upstreams[name] {
+			return ErrDuplicateUpstream
+		}
+		if err := group.compile(name); nil != err {
+			return err
+		}
+	}
+
+	// unknown default action must not fail open, unknown default upstream must fail at load instead of every dial.
+	switch rules.DefaultAction {
+	case "", RuleActionAllow, RuleActionDeny, RuleActionDirect:
+	case RuleActionUpstream:
+		if rules.DefaultRoute == "" {
+			return ErrUnknownUpstream
+		}
+	default:
+		return ErrInvalidRule
+	}
+	if rules.DefaultRoute != "" && nil == rules.Upstreams[rules.DefaultRoute] && nil == rules.Groups[rules.DefaultRoute] {
+		return ErrUnknownUpstream
+	}
+
+	for _, rule := range rules.Rules {
+		switch rule.Action {
+		case RuleActionAllow, RuleActionDeny, RuleActionDirect:
+		case RuleActionUpstream:
+			if nil == rules.Upstreams[rule.Upstream] && nil == rules.Groups[rule.Upstream] {
+				return ErrUnknownUpstream
+			}
+		default:
+			return ErrInvalidRule
+		}
+
+		if nil != rule.Egress {
+			if err := rule.Egress.compile(); nil != err {
+				return err
+			}
+		}
+
+		rule.nets = rule.nets[:0]
+		for _, cidr := range rule.CIDRs {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if nil != err {
+				return err
+			}
+			rule.nets = append(rule.nets, ipNet)
+		}
+		for i, domain := range rule.Domains {
+			rule.Domains[i] = strings.ToLower(strings.Trim(domain, "."))
+		}
+	}
+	return nil
+}
+
+func (rules *RuleSet) startHealthChecks() {
+	for _, group := range rules.Groups {
+		group.start()
+	}
+}
+
+func (rules *RuleSet) stopHealthChecks() {
+	for _, group := range rules.Groups {
+		group.stop()
+	}
+}
+
+func (rule *Rule) match(domain string, resolve func() net.IP, tags func() GeoTags) bool {
+	if rule.matchDomain(domain) {
+		return true
+	}
+
+	if len(rule.nets) > 0 {
+		if ip := resolve(); nil != ip {
+			for _, ipNet := range rule.nets {
+				if ipNet.Contains(ip) {
+					return true
+				}
+			}
+		}
+	}
+
+	if len(rule.Countries) > 0 || len(rule.ASNs) > 0 {
+		t := tags()
+		for _, country := range rule.Countries {
+			if t.Country != "" && strings.EqualFold(country, t.Country) {
+				return true
+			}
+		}
+		for _, asn := range rule.ASNs {
+			if t.ASN != 0 && asn == t.ASN {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchDomain return true if domain matches domain suffix of rule.
+func (rule *Rule) matchDomain(domain string) bool {
+	if domain == "" {
+		return false
+	}
+	for _, suffix := range rule.Domains {
+		if domain == suffix || strings.HasSuffix(domain, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package socks5
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestRouteSniffed(t *testing.T) {
+	router, err := NewRouterFromRuleSet(&RuleSet{
+		Rules: []*Rule{
+			{Action: RuleActionDeny, Domains: []string{"blocked.example"}},
+			{Action: RuleActionAllow, Domains: []string{"allowed.example"}},
+			{Action: RuleActionDeny, CIDRs: []string{"192.0.2.0/24"}},
+		},
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer router.Close()
+
+	tests := []struct {
+		addr, name, action string
+	}{
+		{"blocked.example:443", "", RuleActionDeny},
+		// forged name doesn't allow denied destination, and denied name isn't allowed by destination.
+		{"blocked.example:443", "allowed.example", RuleActionDeny},
+		{"www.allowed.example:443", "blocked.example", RuleActionDeny},
+		{"www.allowed.example:443", "other.example", RuleActionAllow},
+		// ip destination matches domain rules by sniffed name.
+		{"198.51.100.1:443", "www.blocked.example", RuleActionDeny},
+		{"198.51.100.1:443", "allowed.example", RuleActionAllow},
+		{"192.0.2.1:443", "", RuleActionDeny},
+		// forged SNI of allowed domain doesn't bypass cidr deny rule after it.
+		{"192.0.2.1:443", "allowed.example", RuleActionDeny},
+	}
+	for _, test := range tests {
+		route, err := router.RouteSniffed(test.addr, test.name)
+		if nil != err {
+			t.Fatalf("%s (%s): %v", test.addr, test.name, err)
+		}
+		if route.Action != test.action {
+			t.Errorf("%s (%s): %s, want %s", test.addr, test.name, route.Action, test.action)
+		}
+	}
+}
+
+func TestRuleSetCompile(t *testing.T) {
+	upstreams := map[string]*ClientConfig{"up": {ProxyAddr: "192.0.2.1:1080"}}
+	tests := []struct {
+		rules *RuleSet
+		err   error
+	}{
+		{&RuleSet{DefaultAction: "block"}, ErrInvalidRule},
+		{&RuleSet{DefaultAction: "Deny"}, ErrInvalidRule},
+		{&RuleSet{DefaultAction: RuleActionUpstream}, ErrUnknownUpstream},
+		{&RuleSet{DefaultAction: RuleActionUpstream, DefaultRoute: "down", Upstreams: upstreams}, ErrUnknownUpstream},
+		{&RuleSet{DefaultAction: RuleActionUpstream, DefaultRoute: "up", Upstreams: upstreams}, nil},
+		{&RuleSet{Rules: []*Rule{{Action: "reject"}}}, ErrInvalidRule},
+		{&RuleSet{Rules: []*Rule{{Action: RuleActionUpstream, Upstream: "down"}}, Upstreams: upstreams}, ErrUnknownUpstream},
+		{&RuleSet{DefaultAction: RuleActionDeny}, nil},
+	}
+	for i, test := range tests {
+		if err := test.rules.compile(); err != test.err {
+			t.Errorf("%d: got %v, want %v", i, err, test.err)
+		}
+	}
+
+	invalid := &RuleSet{Rules: []*Rule{{Action: RuleActionDeny, CIDRs: []string{"10.0.0.0/33"}}}}
+	if err := invalid.compile(); nil == err {
+		t.Error("invalid cidr accepted")
+	}
+}
+
+func TestRouterGeoIP(t *testing.T) {
+	dir := t.TempDir()
+	country, asn := filepath.Join(dir, "country.mmdb"), filepath.Join(dir, "asn.mmdb")
+	writeTestMMDB(t, country, "10.0.0.0/8", mmdbMap{{"country", mmdbMap{{"iso_code", "US"}}}})
+	writeTestMMDB(t, asn, "10.1.0.0/16", mmdbMap{{"autonomous_system_number", uint32(64500)}})
+
+	router, err := NewRouterFromRuleSet(&RuleSet{
+		Rules: []*Rule{
+			{Action: RuleActionDeny, ASNs: []uint{64500}},
+			{Action: RuleActionDirect, Countries: []string{"us"}},
+		},
+		DefaultAction: RuleActionDeny,
+		GeoIP:         []string{country, asn},
+	})
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer router.Close()
+
+	tests := []struct {
+		addr    string
+		action  string
+		country string
+		asn     uint
+	}{
+		{"10.1.2.3:443", RuleActionDeny, "US", 64500},
+		{"10.2.0.1:443", RuleActionDirect, "US", 0},
+		{"192.0.2.1:443", RuleActionDeny, "", 0},
+	}
+	for _, test := range tests {
+		route, err := router.Route(test.addr)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if route.Action != test.action || route.Tags.Country != test.country || route.Tags.ASN != test.asn {
+			t.Errorf("%s: %s %+v, want %s %s %d", test.addr, route.Action, route.Tags, test.action, test.country, test.asn)
+		}
+	}
+}
+
+func TestRouterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	write := func(rules *RuleSet) {
+		data, _ := json.Marshal(rules)
+		if err := ioutil.WriteFile(path, data, 0644); nil != err {
+			t.Fatal(err)
+		}
+	}
+	write(&RuleSet{Rules: []*Rule{{Action: RuleActionDeny, Domains: []string{"example.com"}}}})
+	router, err := NewRouter(path)
+	if nil != err {
+		t.Fatal(err)
+	}
+	action := func() string {
+		route, err := router.Route("www.example.com:443")
+		if nil != err {
+			t.Fatal(err)
+		}
+		return route.Action
+	}
+	if action() != RuleActionDeny {
+		t.Fatal("rule not loaded")
+	}
+
+	// invalid rule set keeps the old one.
+	write(&RuleSet{DefaultAction: "block"})
+	if err := router.Reload(); err != ErrInvalidRule {
+		t.Fatalf("got %v, want %v", err, ErrInvalidRule)
+	}
+	if action() != RuleActionDeny {
+		t.Fatal("old rules lost after failed reload")
+	}
+
+	write(&RuleSet{})
+	if err := router.Reload(); nil != err {
+		t.Fatal(err)
+	}
+	if action() != RuleActionAllow {
+		t.Fatal("new rules not loaded")
+	}
+
+	router.Close()
+	router.Close()
+}
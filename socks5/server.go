@@ -3,14 +3,18 @@ package socks5
 import (
 	"errors"
 	"github.com/patrickmn/go-cache"
+	"log"
 	"net"
 	"sync"
+	"time"
+	"xproxy/socks5/codec"
+	"xproxy/trace"
 )
 
 var (
 	ErrServerClosed       = errors.New("socks server closed")
-	ErrUnamePasswdVersion = errors.New("invalid uname/passwd version")
-	ErrBadRequest         = errors.New("bad request")
+	ErrUnamePasswdVersion = codec.ErrUnamePasswdVersion
+	ErrBadRequest         = codec.ErrBadRequest
 	ErrNonSupportCommand  = errors.New("nonsupport command")
 )
 
@@ -20,6 +24,7 @@ type Server struct {
 	Password string
 
 	AuthValidateMethod byte   // username/password or anonymous
+	AuthMethods        []byte // methods in preference order, empty means AuthValidateMethod only
 	SupportCommands    []byte // support client command ranges
 
 	TCPAddr     *net.TCPAddr
@@ -30,13 +35,45 @@ type Server struct {
 	UDPDeadline int
 	UDPTimeout  int
 
+	Limits     *Limits      // connection limits, nil means unlimited
+	Lockout    *AuthLockout // username/password brute-force protection, nil means disabled
+	Accounting *Accounting  // traffic accounting and quota, nil means disabled
+	Router     *Router      // destination rules and upstream routing, nil means allow all
+	Metrics    *Metrics
+	Tunnel     *Tunnel       // encrypt connections and udp packets with pre-shared key, client must use the same key
+	Tracer     *trace.Tracer // export spans of every session, nil means disabled
+
+	// peek first client bytes of CONNECT sessions for TLS SNI or HTTP Host, rules match the sniffed name.
+	// success is replied before dialing destination, so dial failure just closes the connection.
+	Sniff        bool
+	SniffTimeout time.Duration // wait for first client bytes, default is DefaultSniffTimeout
+
+	Capture *Capture // write relayed streams of matched sessions to pcapng files, nil means disabled
+
+	// source address, interface and mark of direct connections to destinations, rule egress wins over them.
+	Egress     *Egress            // global egress, nil means kernel default
+	UserEgress map[string]*Egress // egress by username, wins over global egress
+
+	ProxyProtocol *ProxyProtocol // read PROXY header from load balancers on tcp listener, nil means disabled
+
 	mu sync.Mutex
 
 	// runtime info
 	TCPListen       *net.Listener
 	UDPConn         *net.UDPConn
 	Handler         Handler
-	TCPUDPAssociate *cache.Cache
+	TCPUDPAssociate *cache.Cache // client udp address -> udp associate tcp connection
+	udpAssociateMu  sync.Mutex
+	udpUnbound      map[string][]*udpAssociation // client ip -> associations of zero port, not bound yet
+	limiter         *limiter
+	lockout         *lockout
+	sessions        map[net.Conn]*Session
+	sessionSeq      uint64
+	udpResponders   *cache.Cache // client udp address -> UDPResponder
+	udpNATs         *cache.Cache // client udp address and destination -> remote *net.UDPConn
+	udpSetupMu      sync.Mutex
+	udpSetups       map[string][][]byte // nat key -> datagrams queued while setting up flow
+	authenticators  map[byte]ServerAuthenticator
 
 	doneChan chan struct{}
 }
@@ -62,7 +99,7 @@ func NewServer(addr, ip, username, password string, tcpDeadline, tcpTimeout, udp
 		validateMode = MethodUsernamePassword
 	}
 
-	return &Server{
+	s := &Server{
 		Username:           username,
 		Password:           password,
 		AuthValidateMethod: validateMode,
@@ -75,12 +112,38 @@ func NewServer(addr, ip, username, password string, tcpDeadline, tcpTimeout, udp
 		UDPAddr:     udpAddr,
 		UDPDeadline: udpDeadline,
 		UDPTimeout:  udpTimeout,
+		Metrics:     NewMetrics(),
 		mu:          sync.Mutex{},
-	}, nil
+
+		TCPUDPAssociate: cache.New(cache.NoExpiration, 10*time.Minute),
+	}
+	s.udpResponders = cache.New(s.udpTimeout(), s.udpTimeout())
+	s.udpNATs = newUDPNATCache(s.udpTimeout())
+	s.authenticators = map[byte]ServerAuthenticator{
+		MethodNoAuthRequired:   noAuthAuthenticator{},
+		MethodUsernamePassword: &serverUsernamePasswordAuthenticator{server: s},
+	}
+	return s, nil
 }
 
 func (s *Server) Run() error {
-	s.Handler = &DefaultHandler{}
+	if nil == s.Handler {
+		s.Handler = &DefaultHandler{}
+	}
+	if nil != s.Limits {
+		s.limiter = newLimiter(*s.Limits, s.Metrics)
+	}
+	if nil != s.Lockout {
+		s.lockout = newLockout(*s.Lockout, s.Metrics)
+	}
+	if err := s.compileEgress(); nil != err {
+		return err
+	}
+	if nil != s.ProxyProtocol {
+		if err := s.ProxyProtocol.compile(); nil != err {
+			return err
+		}
+	}
 
 	errch := make(chan error, 2)
 	go func() {
@@ -92,8 +155,37 @@ func (s *Server) Run() error {
 	return <-errch
 }
 
+// Stop is the same as Close.
 func (s *Server) Stop() {
+	s.Close()
+}
+
+// Close stop tcp, udp, websocket and transparent servers, running sessions are not interrupted.
+// accounting is closed too, so traffic counters are saved to state file.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	done := s.getDoneChanLocked()
+	select {
+	case <-done:
+	default:
+		close(done)
+	}
+	s.mu.Unlock()
 
+	if nil != s.Accounting {
+		if err := s.Accounting.Close(); nil != err {
+			log.Printf("accounting: save state file error: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// Addrs return tcp and udp server addresses, ephemeral port 0 is replaced by the bound port after server started.
+func (s *Server) Addrs() (*net.TCPAddr, *net.UDPAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.TCPAddr, s.UDPAddr
 }
 
 func (s *Server) getDoneChan() <-chan struct{} {
@@ -0,0 +1,229 @@
+package socks5
+
+import (
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+	"xproxy/trace"
+)
+
+// Session is a running client tcp connection, from negotiation success to connection closed.
+type Session struct {
+	// relay traffic, must be accessed by atomic operations, first fields for 64-bit alignment on 32-bit platforms.
+	BytesUp   int64 // client -> remote
+	BytesDown int64 // remote -> client
+
+	ID         uint64
+	Username   string // empty when no authentication required
+	ClientAddr net.Addr
+	Request    *SocksRequest // nil before request parsed
+	StartTime  time.Time
+
+	// transparent session is redirected by iptables, client doesn't speak socks protocol,
+	// so no socks reply should be written to client.
+	Transparent bool
+
+	// server name sniffed from first client bytes, empty if sniffing disabled or nothing sniffed.
+	SniffedProtocol string
+	SniffedName     string
+
+	conn       net.Conn
+	remoteConn net.Conn     // set when relay started, used by capture
+	capture    atomic.Value // *sessionCapture, nil if not capturing
+	span       *trace.Span  // root span, nil if tracing disabled
+}
+
+// Session return the running session of client connection, nil if not found.
+func (s *Server) Session(conn net.Conn) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sessions[conn]
+}
+
+// sessionSpan return root span of the running session, methods of nil span do nothing.
+func (s *Server) sessionSpan(conn net.Conn) *trace.Span {
+	if nil == s.Tracer {
+		return nil
+	}
+	if session := s.Session(conn); nil != session {
+		return session.span
+	}
+	return nil
+}
+
+// sessionByID return the running session, nil if not found.
+func (s *Server) sessionByID(id uint64) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, session := range s.sessions {
+		if session.ID == id {
+			return session
+		}
+	}
+	return nil
+}
+
+func (s *Server) addSession(conn net.Conn, username string) *Session {
+	session := &Session{
+		ID:         atomic.AddUint64(&s.sessionSeq, 1),
+		Username:   username,
+		ClientAddr: conn.RemoteAddr(),
+		StartTime:  time.Now(),
+		conn:       conn,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sessions == nil {
+		s.sessions = make(map[net.Conn]*Session)
+	}
+	s.sessions[conn] = session
+	return session
+}
+
+func (s *Server) removeSession(session *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, session.conn)
+}
+
+// setSessionRequest record parsed request, it's read by session listing concurrently.
+func (s *Server) setSessionRequest(session *Session, request *SocksRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session.Request = request
+}
+
+// setSessionSniffed record sniffed server name, it's read by session listing concurrently.
+func (s *Server) setSessionSniffed(session *Session, protocol, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session.SniffedProtocol = protocol
+	session.SniffedName = name
+}
+
+// Sessions return info of all running sessions, sorted by id.
+func (s *Server) Sessions() []SessionInfo {
+	s.mu.Lock()
+	infos := make([]SessionInfo, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		infos = append(infos, session.info())
+	}
+	s.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// SessionInfo return info of running session by id.
+func (s *Server) SessionInfo(id uint64) (SessionInfo, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, session := range s.sessions {
+		if session.ID == id {
+			return session.info(), true
+		}
+	}
+	return SessionInfo{}, false
+}
+
+// KillSession close running session by id, return false if not found.
+func (s *Server) KillSession(id uint64) bool {
+	s.mu.Lock()
+	var target *Session
+	for _, session := range s.sessions {
+		if session.ID == id {
+			target = session
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	if nil == target {
+		return false
+	}
+	target.Close()
+	return true
+}
+
+// KillUserSessions close all running sessions of username, return the count of closed sessions.
+func (s *Server) KillUserSessions(username string) int {
+	s.mu.Lock()
+	var targets []*Session
+	for _, session := range s.sessions {
+		if session.Username == username {
+			targets = append(targets, session)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, session := range targets {
+		session.Close()
+	}
+	return len(targets)
+}
+
+// loadCapture return the running capture of session, nil if not capturing.
+func (session *Session) loadCapture() *sessionCapture {
+	capture, _ := session.capture.Load().(*sessionCapture)
+	return capture
+}
+
+// Close close the client connection, it stops the session relay.
+func (session *Session) Close() error {
+	return session.conn.Close()
+}
+
+// SessionInfo is the snapshot of running session.
+type SessionInfo struct {
+	ID              uint64    `json:"id"`
+	Username        string    `json:"user"`
+	Client          string    `json:"client"`
+	Destination     string    `json:"destination"`
+	Command         string    `json:"command"`
+	Transparent     bool      `json:"transparent"`
+	SniffedProtocol string    `json:"sniffed_protocol,omitempty"`
+	SniffedName     string    `json:"sniffed_name,omitempty"`
+	Capture         string    `json:"capture,omitempty"` // capture file path, empty if not capturing
+	BytesUp         int64     `json:"bytes_up"`
+	BytesDown       int64     `json:"bytes_down"`
+	StartTime       time.Time `json:"start_time"`
+	Age             float64   `json:"age"` // seconds since session started
+}
+
+// info must be called with server lock held, because request is set after session added.
+func (session *Session) info() SessionInfo {
+	info := SessionInfo{
+		ID:              session.ID,
+		Username:        session.Username,
+		Client:          session.ClientAddr.String(),
+		Transparent:     session.Transparent,
+		SniffedProtocol: session.SniffedProtocol,
+		SniffedName:     session.SniffedName,
+		BytesUp:         atomic.LoadInt64(&session.BytesUp),
+		BytesDown:       atomic.LoadInt64(&session.BytesDown),
+		StartTime:       session.StartTime,
+		Age:             time.Since(session.StartTime).Seconds(),
+	}
+	if capture := session.loadCapture(); nil != capture {
+		info.Capture = capture.path
+	}
+	if nil != session.Request {
+		info.Destination = session.Request.Address()
+		info.Command = commandName(session.Request.CMD)
+	}
+	return info
+}
+
+func commandName(cmd byte) string {
+	switch cmd {
+	case CMDConnect:
+		return "connect"
+	case CMDBind:
+		return "bind"
+	case CMDUDPAssociate:
+		return "udp_associate"
+	}
+	return "unknown"
+}
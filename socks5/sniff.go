@@ -0,0 +1,254 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errSniffMore    = errors.New("sniff: need more bytes")
+	errSniffUnknown = errors.New("sniff: unknown protocol or no server name")
+)
+
+const (
+	// sniffed protocol.
+	SniffProtocolTLS  = "tls"
+	SniffProtocolHTTP = "http"
+
+	DefaultSniffTimeout = 300 * time.Millisecond
+
+	sniffBufferSize = 5 + 16*1024 // tls record header and max record
+)
+
+// httpMethods start HTTP/1 requests, the space is part of method.
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// sniffedConn replay sniffed bytes before reading connection.
+type sniffedConn struct {
+	net.Conn
+	prefix  []byte
+	readErr error // error of the last sniff read, returned after prefix
+
+	// done is closed when the sniff read returned, it's nil if sniff finished before timeout.
+	done chan struct{}
+}
+
+func (c *sniffedConn) Read(b []byte) (int, error) {
+	if nil != c.done {
+		// the sniff read is still in flight after timeout, its bytes come first.
+		<-c.done
+		c.done = nil
+	}
+	if len(c.prefix) > 0 {
+		n := copy(b, c.prefix)
+		c.prefix = c.prefix[n:]
+		return n, nil
+	}
+	if nil != c.readErr {
+		err := c.readErr
+		c.readErr = nil
+		return 0, err
+	}
+	return c.Conn.Read(b)
+}
+
+// sniff read first client bytes until TLS SNI or HTTP Host found, protocol is unknown or timeout expired.
+// protocols that server speaks first always wait for timeout, so it should be short.
+// no read deadline is set, a read timeout is fatal for websocket and may break tunnel chunks, so reads run in a
+// goroutine and the one in flight at timeout is handed over to the returned conn.
+// the returned conn replays read bytes, protocol and name are empty if nothing sniffed.
+func (s *Server) sniff(conn net.Conn) (net.Conn, string, string) {
+	timeout := s.SniffTimeout
+	if timeout == 0 {
+		timeout = DefaultSniffTimeout
+	}
+
+	sniffed := &sniffedConn{Conn: conn, done: make(chan struct{})}
+	var stopped int32
+	protocol, name, err := "", "", errSniffMore
+	go func() {
+		defer close(sniffed.done)
+		buff := make([]byte, 0, 1024)
+		for err == errSniffMore && len(buff) < sniffBufferSize && atomic.LoadInt32(&stopped) == 0 {
+			if len(buff) == cap(buff) {
+				size := 2 * cap(buff)
+				if size > sniffBufferSize {
+					size = sniffBufferSize
+				}
+				buff = append(make([]byte, 0, size), buff...)
+			}
+			n, readErr := conn.Read(buff[len(buff):cap(buff)])
+			buff = buff[:len(buff)+n]
+			protocol, name, err = sniffServerName(buff)
+			if nil != readErr {
+				sniffed.readErr = readErr
+				break
+			}
+		}
+		sniffed.prefix = buff
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-sniffed.done:
+		sniffed.done = nil
+		if nil != err {
+			return sniffed, "", ""
+		}
+		return sniffed, protocol, name
+	case <-timer.C:
+		atomic.StoreInt32(&stopped, 1)
+		return sniffed, "", ""
+	}
+}
+
+// help func ===========================================================================================================
+
+// sniffServerName return errSniffMore if data is a prefix of known protocol message.
+func sniffServerName(data []byte) (protocol, name string, err error) {
+	if len(data) == 0 {
+		return "", "", errSniffMore
+	}
+	if data[0] == 0x16 {
+		name, err = sniffTLSServerName(data)
+		protocol = SniffProtocolTLS
+	} else {
+		name, err = sniffHTTPHost(data)
+		protocol = SniffProtocolHTTP
+	}
+	if nil == err && (name == "" || nil != net.ParseIP(name)) {
+		// ip address tells nothing more than destination.
+		err = errSniffUnknown
+	}
+	return protocol, strings.ToLower(strings.TrimSuffix(name, ".")), err
+}
+
+// sniffTLSServerName parse server_name extension of ClientHello in the first tls record.
+// See: https://www.rfc-editor.org/rfc/rfc8446#section-4.1.2, https://www.rfc-editor.org/rfc/rfc6066#section-3
+func sniffTLSServerName(data []byte) (string, error) {
+	// record header: type, version, length.
+	if len(data) < 5 {
+		return "", errSniffMore
+	}
+	recordLen := int(data[3])<<8 | int(data[4])
+	if data[1] != 0x03 || recordLen > 16*1024 {
+		return "", errSniffUnknown
+	}
+	if len(data) < 5+recordLen {
+		return "", errSniffMore
+	}
+
+	// handshake header: type, length. ClientHello spans several records is not supported.
+	hello := data[5 : 5+recordLen]
+	if len(hello) < 4 || hello[0] != 0x01 {
+		return "", errSniffUnknown
+	}
+	helloLen := int(hello[1])<<16 | int(hello[2])<<8 | int(hello[3])
+	if 4+helloLen > len(hello) {
+		return "", errSniffUnknown
+	}
+	body := hello[4 : 4+helloLen]
+
+	// legacy_version, random.
+	if len(body) < 2+32 {
+		return "", errSniffUnknown
+	}
+	body = body[2+32:]
+	var ok bool
+	// legacy_session_id, cipher_suites, legacy_compression_methods.
+	for _, lenBytes := range []int{1, 2, 1} {
+		if _, body, ok = tlsVector(body, lenBytes); !ok {
+			return "", errSniffUnknown
+		}
+	}
+	extensions, _, ok := tlsVector(body, 2)
+	if !ok {
+		return "", errSniffUnknown
+	}
+
+	for len(extensions) >= 4 {
+		extType := int(extensions[0])<<8 | int(extensions[1])
+		var extData []byte
+		if extData, extensions, ok = tlsVector(extensions[2:], 2); !ok {
+			return "", errSniffUnknown
+		}
+		if extType != 0x0000 {
+			continue
+		}
+
+		// server_name extension: server_name_list of name_type and host_name.
+		list, _, ok := tlsVector(extData, 2)
+		if !ok {
+			return "", errSniffUnknown
+		}
+		for len(list) > 0 {
+			nameType := list[0]
+			var serverName []byte
+			if serverName, list, ok = tlsVector(list[1:], 2); !ok {
+				return "", errSniffUnknown
+			}
+			if nameType == 0x00 {
+				return string(serverName), nil
+			}
+		}
+	}
+	return "", errSniffUnknown
+}
+
+// tlsVector split variable-length vector with lenBytes length prefix from data.
+func tlsVector(data []byte, lenBytes int) (vector, rest []byte, ok bool) {
+	if len(data) < lenBytes {
+		return nil, nil, false
+	}
+	n := 0
+	for _, b := range data[:lenBytes] {
+		n = n<<8 | int(b)
+	}
+	if len(data) < lenBytes+n {
+		return nil, nil, false
+	}
+	return data[lenBytes : lenBytes+n], data[lenBytes+n:], true
+}
+
+// sniffHTTPHost parse Host header of HTTP/1 request, port is removed.
+func sniffHTTPHost(data []byte) (string, error) {
+	method := false
+	for _, m := range httpMethods {
+		if len(data) < len(m) && strings.HasPrefix(m, string(data)) {
+			return "", errSniffMore
+		}
+		if bytes.HasPrefix(data, []byte(m)) {
+			method = true
+			break
+		}
+	}
+	if !method {
+		return "", errSniffUnknown
+	}
+
+	// skip request line, then match complete header lines until empty line.
+	lines := bytes.Split(data, []byte("\r\n"))
+	if len(lines) < 2 {
+		return "", errSniffMore
+	}
+	for _, line := range lines[1 : len(lines)-1] {
+		if len(line) == 0 {
+			return "", errSniffUnknown
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon < 0 || !strings.EqualFold(string(line[:colon]), "host") {
+			continue
+		}
+		host := strings.TrimSpace(string(line[colon+1:]))
+		if h, _, err := net.SplitHostPort(host); nil == err {
+			host = h
+		}
+		return strings.Trim(host, "[]"), nil
+	}
+	return "", errSniffMore
+}
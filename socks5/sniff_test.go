@@ -0,0 +1,109 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello capture the first flight of a tls client.
+func clientHello(t *testing.T, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	buff := make([]byte, sniffBufferSize)
+	n, err := server.Read(buff)
+	if nil != err {
+		t.Fatal(err)
+	}
+	client.Close()
+	return buff[:n]
+}
+
+func TestSniffServerName(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		protocol string
+		name     string
+	}{
+		{clientHello(t, "Example.COM"), SniffProtocolTLS, "example.com"},
+		{[]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), SniffProtocolHTTP, "example.com"},
+		{[]byte("POST /a HTTP/1.1\r\nUser-Agent: x\r\nhost:Example.com.:8080\r\n"), SniffProtocolHTTP, "example.com"},
+		{[]byte("GET / HTTP/1.1\r\nHost: [::1]:80\r\n\r\n"), SniffProtocolHTTP, ""},
+		{[]byte("GET / HTTP/1.1\r\nAccept: */*\r\n\r\nHost: example.com\r\n"), SniffProtocolHTTP, ""},
+	}
+	for _, test := range tests {
+		protocol, name, err := sniffServerName(test.data)
+		if test.name == "" {
+			if err != errSniffUnknown {
+				t.Errorf("sniff %q: got %v, want %v", test.data, err, errSniffUnknown)
+			}
+			continue
+		}
+		if nil != err || protocol != test.protocol || name != test.name {
+			t.Errorf("sniff %q: got %s %q %v, want %s %q", test.data, protocol, name, err, test.protocol, test.name)
+		}
+	}
+}
+
+func TestSniffServerNameIncomplete(t *testing.T) {
+	for _, data := range [][]byte{
+		clientHello(t, "example.com"),
+		[]byte("OPTIONS * HTTP/1.1\r\nAccept: */*\r\nHost: example.com\r\n"),
+	} {
+		// every prefix needs more bytes.
+		for i := 0; i < len(data); i++ {
+			if _, _, err := sniffServerName(data[:i]); err != errSniffMore {
+				t.Fatalf("sniff %d of %d bytes: got %v, want %v", i, len(data), err, errSniffMore)
+			}
+		}
+	}
+
+	for _, data := range [][]byte{
+		[]byte("SSH-2.0-OpenSSH\r\n"),
+		{0x16, 0x02, 0x00, 0x00, 0x01, 0x01},
+		{0x16, 0x03, 0x01, 0x00, 0x01, 0x02},
+	} {
+		if _, _, err := sniffServerName(data); err != errSniffUnknown {
+			t.Fatalf("sniff % x: got %v, want %v", data, err, errSniffUnknown)
+		}
+	}
+}
+
+func TestSniffReplay(t *testing.T) {
+	data := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\nbody")
+	s := &Server{SniffTimeout: time.Second}
+	conn, protocol, name := s.sniff(pipeConn(data))
+	if protocol != SniffProtocolHTTP || name != "example.com" {
+		t.Fatalf("got %s %q", protocol, name)
+	}
+	got, err := ioutil.ReadAll(conn)
+	if nil != err || string(got) != string(data) {
+		t.Fatalf("replay %q, %v", got, err)
+	}
+
+	// server speaks first, wait for timeout.
+	client, server := net.Pipe()
+	defer client.Close()
+	s.SniffTimeout = 50 * time.Millisecond
+	start := time.Now()
+	conn, protocol, name = s.sniff(server)
+	if protocol != "" || name != "" {
+		t.Fatalf("got %s %q from silent client", protocol, name)
+	}
+	if elapsed := time.Since(start); elapsed < s.SniffTimeout {
+		t.Fatalf("returned after %v, before timeout", elapsed)
+	}
+
+	// bytes sent after timeout are taken by the sniff read in flight, they're replayed by conn.
+	go client.Write([]byte("SSH-2.0-client\r\n"))
+	got = make([]byte, 64)
+	n, err := conn.Read(got)
+	if nil != err || string(got[:n]) != "SSH-2.0-client\r\n" {
+		t.Fatalf("read after timeout %q, %v", got[:n], err)
+	}
+}
@@ -1,95 +1,71 @@
 package socks5
 
+import (
+	"xproxy/socks5/codec"
+)
+
 // Implement socks5 protocol.
 // See: socks5 protocol RFC.
 // https://www.ietf.org/rfc/rfc1928.txt
 // https://www.ietf.org/rfc/rfc1929.txt
+//
+// wire format of packets is implemented by codec package.
 
 const (
 	// socks protocol version.
-	SocksVer          byte = 0x05
-	SocksReplySuccess byte = 0x00
+	SocksVer          = codec.SocksVer
+	SocksReplySuccess = codec.SocksReplySuccess
 
-	MethodNoAuthRequired   byte = 0x00
-	MethodGSSAPI           byte = 0x01
-	MethodUsernamePassword byte = 0x02
+	MethodNoAuthRequired   = codec.MethodNoAuthRequired
+	MethodGSSAPI           = codec.MethodGSSAPI
+	MethodUsernamePassword = codec.MethodUsernamePassword
 	// 0x03 to 0x7F IANA assigned.
 	// 0x80 to 0xFE reserved for private methods.
-	MethodNoAcceptableMethods byte = 0xFF
+	MethodNoAcceptableMethods = codec.MethodNoAcceptableMethods
 
 	// use in user negotiation stage.
-	UsernamePasswordVer           byte = 0x01
-	UsernamePasswordStatusSuccess byte = 0x00
-	UsernamePasswordStatusFail    byte = 0x01
+	UsernamePasswordVer           = codec.UsernamePasswordVer
+	UsernamePasswordStatusSuccess = codec.UsernamePasswordStatusSuccess
+	UsernamePasswordStatusFail    = codec.UsernamePasswordStatusFail
 
-	CMDConnect      byte = 0x01
-	CMDBind         byte = 0x02
-	CMDUDPAssociate byte = 0x03
+	CMDConnect      = codec.CMDConnect
+	CMDBind         = codec.CMDBind
+	CMDUDPAssociate = codec.CMDUDPAssociate
 
-	ATYPIPv4   byte = 0x01
-	ATYPDomain byte = 0x03
-	ATYPIPv6   byte = 0x04
+	ATYPIPv4   = codec.ATYPIPv4
+	ATYPDomain = codec.ATYPDomain
+	ATYPIPv6   = codec.ATYPIPv6
 
 	// reply
-	ReplySuccess            byte = 0x00
-	ReplyRemoteAddrConnFail byte = 0x01
-	ReplyCommandNonSupport  byte = 0x02
+	ReplySuccess            = codec.ReplySuccess
+	ReplyGeneralFailure     = codec.ReplyGeneralFailure
+	ReplyRemoteAddrConnFail = codec.ReplyRemoteAddrConnFail
+	ReplyConnNotAllowed     = codec.ReplyConnNotAllowed // connection not allowed by ruleset
+	ReplyNetworkUnreachable = codec.ReplyNetworkUnreachable
+	ReplyHostUnreachable    = codec.ReplyHostUnreachable
+	ReplyConnRefused        = codec.ReplyConnRefused
+	ReplyTTLExpired         = codec.ReplyTTLExpired
+	ReplyCommandNonSupport  = codec.ReplyCommandNonSupport
+	ReplyAddrTypeNonSupport = codec.ReplyAddrTypeNonSupport
 )
 
 // NegotiationRequest is the negotiation request packet.
-type NegotiationRequest struct {
-	Ver      byte
-	NMethods byte
-	Methods  []byte // 1 to 255 bytes
-}
+type NegotiationRequest = codec.NegotiationRequest
 
 // NegotiationReply is the negotiation reply packet.
-type NegotiationReply struct {
-	Ver    byte
-	Method byte
-}
+type NegotiationReply = codec.NegotiationReply
 
 // UsernamePasswordNegotiationRequest is the negotiation username/password request packet.
-type UsernamePasswordNegotiationRequest struct {
-	Ver      byte   // the Ver field contains the current version of the subnegotiation, which is 0x01.
-	ULen     byte   // username length
-	Uname    []byte // 1 to 255 bytes
-	PLen     byte   // password length
-	Password []byte // 1 to 255 bytes
-}
+type UsernamePasswordNegotiationRequest = codec.UsernamePasswordNegotiationRequest
 
 // UsernamePasswordNegotiationReply is the negotiation username/password reply packet.
-type UsernamePasswordNegotiationReply struct {
-	Ver    byte
-	Status byte // 0x00 indicates negotiation success.
-}
+type UsernamePasswordNegotiationReply = codec.UsernamePasswordNegotiationReply
 
 // SocksRequest is the request packet.
-type SocksRequest struct {
-	Ver     byte   // socks protocol version: 0x05
-	CMD     byte   // connect : 0x01, bind : 0x02, udp associate : 0x03
-	RSV     byte   // reserved field, 0x00
-	ATYP    byte   // address type, IPv4 : 0x01, domain name : 0x03, IPv6 : 0x04
-	DstAddr []byte // desired destination address
-	DstPort []byte // desired destination port in network octet order, it's 2 bytes.
-}
+type SocksRequest = codec.SocksRequest
 
 // SocksReply is the reply packet.
-type SocksReply struct {
-	Ver     byte
-	REP     byte
-	RSV     byte   // 0x00
-	ATYP    byte   // address type, IPv4 : 0x01, domain name : 0x03, IPv6 : 0x04
-	BndAddr []byte // server bound address
-	BndPort []byte // server bound port in network octet order, it's 2 bytes.
-}
+type SocksReply = codec.SocksReply
 
-// SocksUDPDatagramRequest is the UDP packet.
-type SocksUDPDatagram struct {
-	Ver     byte
-	FRAG    byte   // current fragment number
-	ATYP    byte   // address type, IP V4 : 0x01, domain name : 0x03, IP V6 : 0x04
-	DstAddr []byte // desired destination address
-	DstPort []byte // desired destination port in network octet order, it's 2 bytes.
-	Data    []byte // user data
-}
+// SocksUDPDatagram is the UDP packet.
+type SocksUDPDatagram = codec.SocksUDPDatagram
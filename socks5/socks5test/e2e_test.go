@@ -0,0 +1,1701 @@
+package socks5test_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+	"xproxy/proxyproto"
+	"xproxy/socks5"
+	"xproxy/socks5/socks5test"
+)
+
+// dnsBlackhole hold a channel while dns queries should block until it's closed, see TestMain.
+var dnsBlackhole atomic.Value // chan struct{}
+
+func TestMain(m *testing.M) {
+	// resolver is replaced before tests run, swapping it in a test races with lookups of other tests' servers.
+	net.DefaultResolver.PreferGo = true
+	net.DefaultResolver.Dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if release, _ := dnsBlackhole.Load().(chan struct{}); nil != release {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-release:
+				return nil, errors.New("dns server unreachable")
+			}
+		}
+		return (&net.Dialer{}).DialContext(ctx, network, address)
+	}
+	os.Exit(m.Run())
+}
+
+func TestConnectNoAuth(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	server := socks5test.NewServer(t, "", "", nil)
+
+	client := server.Client(t, "", "")
+	reply, err := socks5test.Request(client, socks5.CMDConnect, echo)
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+	defer client.DstTCPConn.Close()
+	socks5test.AssertEcho(t, client.DstTCPConn, []byte("hello"))
+}
+
+func TestConnectPasswordAuth(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	server := socks5test.NewServer(t, "user", "password", nil)
+
+	client := server.Client(t, "user", "password")
+	reply, err := socks5test.Request(client, socks5.CMDConnect, echo)
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+
+	// larger than relay buffer, so it's relayed by several reads.
+	payload := bytes.Repeat([]byte("0123456789"), 10*1024)
+	socks5test.AssertEcho(t, client.DstTCPConn, payload)
+	defer client.DstTCPConn.Close()
+
+	// relayed bytes are accounted to the session, echo may be read before the counter updated.
+	for deadline := time.Now().Add(socks5test.DefaultTimeout); ; {
+		sessions := server.Sessions()
+		if len(sessions) != 1 {
+			t.Fatalf("%d sessions, want 1", len(sessions))
+		}
+		if sessions[0].Username == "user" && sessions[0].BytesUp == int64(len(payload)) && sessions[0].BytesDown == int64(len(payload)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session %+v, want %d bytes relayed in both directions", sessions[0], len(payload))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	server := socks5test.NewServer(t, "user", "password", nil)
+
+	client := server.Client(t, "user", "wrong")
+	if _, err := socks5test.Request(client, socks5.CMDConnect, echo); err != socks5.ErrUnameOrPasswdError {
+		t.Fatalf("request error %v, want %v", err, socks5.ErrUnameOrPasswdError)
+	}
+	// failed authentication terminates the session.
+	socks5test.AssertClosed(t, client.DstTCPConn, socks5test.DefaultTimeout)
+}
+
+func TestLockoutBackoff(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	server := socks5test.NewServer(t, "user", "password", func(s *socks5.Server) {
+		s.Limits = &socks5.Limits{MaxSessions: 1}
+		s.Lockout = &socks5.AuthLockout{BaseDelay: time.Minute}
+	})
+
+	// failure reply is not delayed, so the session doesn't hold its slot.
+	start := time.Now()
+	client := server.Client(t, "user", "wrong")
+	if _, err := socks5test.Request(client, socks5.CMDConnect, echo); err != socks5.ErrUnameOrPasswdError {
+		t.Fatalf("request error %v, want %v", err, socks5.ErrUnameOrPasswdError)
+	}
+	if elapsed := time.Since(start); elapsed > socks5test.DefaultTimeout/2 {
+		t.Fatalf("failure reply delayed %v", elapsed)
+	}
+	socks5test.AssertClosed(t, client.DstTCPConn, socks5test.DefaultTimeout)
+
+	// attempt in backoff is rejected at once, even with the right password.
+	client = server.Client(t, "user", "password")
+	if _, err := socks5test.Request(client, socks5.CMDConnect, echo); err != socks5.ErrUnameOrPasswdError {
+		t.Fatalf("request error %v, want %v", err, socks5.ErrUnameOrPasswdError)
+	}
+	if snapshot := server.Metrics.Snapshot(); snapshot["rejected_banned"] != 1 || snapshot["rejected_total"] != 0 {
+		t.Errorf("metrics %v", snapshot)
+	}
+}
+
+func TestNoAcceptableMethod(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	server := socks5test.NewServer(t, "user", "password", nil)
+
+	// client offers no authentication only.
+	client := server.Client(t, "", "")
+	if _, err := socks5test.Request(client, socks5.CMDConnect, echo); err != socks5.ErrNonSupportCurrentMethod {
+		t.Fatalf("request error %v, want %v", err, socks5.ErrNonSupportCurrentMethod)
+	}
+}
+
+func TestConnectRefused(t *testing.T) {
+	server := socks5test.NewServer(t, "", "", nil)
+
+	client := server.Client(t, "", "")
+	reply, err := socks5test.Request(client, socks5.CMDConnect, socks5test.RefusedAddr(t))
+	socks5test.AssertReply(t, reply, err, socks5.ReplyRemoteAddrConnFail)
+}
+
+func TestConnectIPv6(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp6")
+	server := socks5test.NewServer(t, "", "", nil)
+
+	client := server.Client(t, "", "")
+	reply, err := socks5test.Request(client, socks5.CMDConnect, echo)
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+	defer client.DstTCPConn.Close()
+	socks5test.AssertEcho(t, client.DstTCPConn, []byte("hello over ipv6"))
+}
+
+func TestConnectDomain(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	_, port, _ := net.SplitHostPort(echo)
+	server := socks5test.NewServer(t, "", "", nil)
+
+	client := server.Client(t, "", "")
+	reply, err := socks5test.Request(client, socks5.CMDConnect, net.JoinHostPort("localhost", port))
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+	defer client.DstTCPConn.Close()
+	socks5test.AssertEcho(t, client.DstTCPConn, []byte("hello localhost"))
+}
+
+func TestHTTPThroughProxy(t *testing.T) {
+	destination := socks5test.NewHTTPServer(t, "hello http")
+	server := socks5test.NewServer(t, "user", "password", nil)
+	cfg := server.ClientConfig("user", "password")
+
+	httpClient := &http.Client{
+		Timeout: socks5test.DefaultTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return cfg.Connect(addr)
+			},
+		},
+	}
+	response, err := httpClient.Get("http://" + destination + "/")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if nil != err || string(body) != "hello http" {
+		t.Fatalf("body %q, error %v", body, err)
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo := socks5test.NewUDPEchoServer(t)
+	server := socks5test.NewServer(t, "user", "password", nil)
+
+	client := server.Client(t, "user", "password")
+	if err := client.Negotiation(); nil != err {
+		t.Fatal(err)
+	}
+	udpConn, err := client.UDPAssociate()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	payload := []byte("hello udp")
+	if _, err := udpConn.WriteTo(payload, echo); nil != err {
+		t.Fatal(err)
+	}
+	buff := make([]byte, 1024)
+	n, from, err := udpConn.ReadFrom(buff)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if from != echo || !bytes.Equal(buff[:n], payload) {
+		t.Fatalf("datagram %q from %s, want %q from %s", buff[:n], from, payload, echo)
+	}
+}
+
+func TestUDPAssociateClientAddress(t *testing.T) {
+	echo := socks5test.NewUDPEchoServer(t)
+	server := socks5test.NewServer(t, "", "", nil)
+	associate := func() *socks5.ClientUDPConn {
+		client := server.Client(t, "", "")
+		if err := client.Negotiation(); nil != err {
+			t.Fatal(err)
+		}
+		udpConn, err := client.UDPAssociate()
+		if nil != err {
+			t.Fatal(err)
+		}
+		return udpConn
+	}
+	assertEcho := func(udpConn *socks5.ClientUDPConn) {
+		t.Helper()
+		if _, err := udpConn.WriteTo([]byte("hello"), echo); nil != err {
+			t.Fatal(err)
+		}
+		buff := make([]byte, 1024)
+		n, _, err := udpConn.ReadFrom(buff)
+		if nil != err || string(buff[:n]) != "hello" {
+			t.Fatalf("echo %q, %v", buff[:n], err)
+		}
+	}
+
+	// associations of zero port from the same ip are separated, ending one keeps the other.
+	first, second := associate(), associate()
+	defer second.Close()
+	assertEcho(first)
+	assertEcho(second)
+	first.Close()
+	time.Sleep(50 * time.Millisecond)
+	assertEcho(second)
+
+	// DST.ADDR of another host doesn't make relay accept its datagrams, only the tcp peer ip is trusted.
+	client := server.Client(t, "", "")
+	reply, err := socks5test.Request(client, socks5.CMDUDPAssociate, "127.0.0.2:0")
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+	defer client.DstTCPConn.Close()
+	other, err := net.ListenPacket("udp", "127.0.0.2:0")
+	if nil != err {
+		t.Skipf("127.0.0.2 not available: %v", err)
+	}
+	defer other.Close()
+	atyp, addr, port, _ := socks5.ParseAddress(echo)
+	relay, _ := net.ResolveUDPAddr("udp", server.UDPAddr)
+	other.WriteTo(socks5.NewSocksUDPDatagram(atyp, addr, port, []byte("spoofed")).Bytes(), relay)
+	other.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if n, _, err := other.ReadFrom(make([]byte, 1024)); nil == err {
+		t.Fatalf("relayed %d bytes for host which isn't the tcp peer", n)
+	}
+}
+
+func TestUDPNATRefresh(t *testing.T) {
+	// destination never replies, it records source of every datagram.
+	dst, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	server := socks5test.NewServer(t, "", "", func(s *socks5.Server) {
+		s.UDPTimeout = 1
+	})
+
+	client := server.Client(t, "", "")
+	if err := client.Negotiation(); nil != err {
+		t.Fatal(err)
+	}
+	udpConn, err := client.UDPAssociate()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	// client keeps sending longer than udp timeout, the same nat entry is used.
+	var source net.Addr
+	buff := make([]byte, 1024)
+	for i := 0; i < 10; i++ {
+		if _, err := udpConn.WriteTo([]byte("ping"), dst.LocalAddr().String()); nil != err {
+			t.Fatal(err)
+		}
+		dst.SetReadDeadline(time.Now().Add(socks5test.DefaultTimeout))
+		_, from, err := dst.ReadFrom(buff)
+		if nil != err {
+			t.Fatal(err)
+		}
+		if nil != source && from.String() != source.String() {
+			t.Fatalf("datagram %d from %s, nat entry of %s expired while client sending", i, from, source)
+		}
+		source = from
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	// reply after a long one-way flow still reaches client.
+	dst.WriteTo([]byte("pong"), source)
+	n, from, err := udpConn.ReadFrom(buff)
+	if nil != err || from != dst.LocalAddr().String() || string(buff[:n]) != "pong" {
+		t.Fatalf("reply %q from %s, %v", buff[:n], from, err)
+	}
+}
+
+func TestUDPSlowFlowSetup(t *testing.T) {
+	// dns server never answers, resolving destination of a flow blocks until test ends.
+	release := make(chan struct{})
+	dnsBlackhole.Store(release)
+	defer func() {
+		dnsBlackhole.Store((chan struct{})(nil))
+		close(release)
+	}()
+
+	echo := socks5test.NewUDPEchoServer(t)
+	server := socks5test.NewServer(t, "", "", nil)
+	client := server.Client(t, "", "")
+	if err := client.Negotiation(); nil != err {
+		t.Fatal(err)
+	}
+	udpConn, err := client.UDPAssociate()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	// setup of the blocked flow doesn't stop udp server reading datagrams of other flows.
+	if _, err := udpConn.WriteTo([]byte("blocked"), "unresolved.example:53"); nil != err {
+		t.Fatal(err)
+	}
+	payload := []byte("hello udp")
+	if _, err := udpConn.WriteTo(payload, echo); nil != err {
+		t.Fatal(err)
+	}
+	buff := make([]byte, 1024)
+	result := make(chan error, 1)
+	go func() {
+		n, from, err := udpConn.ReadFrom(buff)
+		if nil == err && (from != echo || !bytes.Equal(buff[:n], payload)) {
+			err = fmt.Errorf("datagram %q from %s, want %q from %s", buff[:n], from, payload, echo)
+		}
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		if nil != err {
+			t.Fatal(err)
+		}
+	case <-time.After(socks5test.DefaultTimeout):
+		t.Fatal("udp server blocked by flow setup")
+	}
+}
+
+func TestBindNotSupported(t *testing.T) {
+	server := socks5test.NewServer(t, "", "", nil)
+
+	client := server.Client(t, "", "")
+	reply, err := socks5test.Request(client, socks5.CMDBind, "127.0.0.1:0")
+	socks5test.AssertReply(t, reply, err, socks5.ReplyCommandNonSupport)
+
+	// reply of domain request is well-formed, nothing is left after it.
+	domain := server.Client(t, "", "")
+	reply, err = socks5test.Request(domain, socks5.CMDBind, "example.com:80")
+	socks5test.AssertReply(t, reply, err, socks5.ReplyCommandNonSupport)
+	if reply.ATYP != socks5.ATYPIPv4 {
+		t.Errorf("bound address type %#x", reply.ATYP)
+	}
+	socks5test.AssertClosed(t, domain.DstTCPConn, socks5test.DefaultTimeout)
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	server := socks5test.NewServer(t, "", "", func(s *socks5.Server) {
+		s.TCPDeadline = 1
+	})
+
+	// client connects but never sends negotiation request.
+	conn, err := net.Dial("tcp", server.Addr)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	socks5test.AssertClosed(t, conn, socks5test.DefaultTimeout)
+}
+
+func TestIdleRelayTimeout(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	server := socks5test.NewServer(t, "", "", func(s *socks5.Server) {
+		s.TCPDeadline = 1
+	})
+
+	client := server.Client(t, "", "")
+	reply, err := socks5test.Request(client, socks5.CMDConnect, echo)
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+	defer client.DstTCPConn.Close()
+	socks5test.AssertEcho(t, client.DstTCPConn, []byte("hello"))
+
+	// idle relay is closed after deadline.
+	start := time.Now()
+	socks5test.AssertClosed(t, client.DstTCPConn, socks5test.DefaultTimeout)
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Fatalf("closed after %v, before deadline", elapsed)
+	}
+}
+
+func TestRuleDenied(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	server := socks5test.NewServer(t, "", "", func(s *socks5.Server) {
+		router, err := socks5.NewRouterFromRuleSet(&socks5.RuleSet{
+			Rules: []*socks5.Rule{{Action: socks5.RuleActionDeny, CIDRs: []string{"127.0.0.0/8"}}},
+		})
+		if nil != err {
+			t.Fatal(err)
+		}
+		s.Router = router
+	})
+
+	client := server.Client(t, "", "")
+	reply, err := socks5test.Request(client, socks5.CMDConnect, echo)
+	socks5test.AssertReply(t, reply, err, socks5.ReplyConnNotAllowed)
+}
+
+func TestServerClose(t *testing.T) {
+	server := socks5test.NewServer(t, "", "", nil)
+	server.Close()
+
+	// listener is closed asynchronously.
+	for deadline := time.Now().Add(socks5test.DefaultTimeout); ; {
+		conn, err := net.Dial("tcp", server.Addr)
+		if nil != err {
+			return
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("server still accepts connections after close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSniffedNameRules(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	server := socks5test.NewServer(t, "", "", func(s *socks5.Server) {
+		router, err := socks5.NewRouterFromRuleSet(&socks5.RuleSet{
+			Rules: []*socks5.Rule{{Action: socks5.RuleActionDeny, Domains: []string{"blocked.example", "localhost"}}},
+		})
+		if nil != err {
+			t.Fatal(err)
+		}
+		s.Router = router
+		s.Sniff = true
+	})
+
+	// destination is a denied domain, forged Host of allowed domain doesn't bypass the rule.
+	_, port, _ := net.SplitHostPort(echo)
+	forged := server.Client(t, "", "")
+	reply, err := socks5test.Request(forged, socks5.CMDConnect, net.JoinHostPort("localhost", port))
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+	defer forged.DstTCPConn.Close()
+	forged.DstTCPConn.Write([]byte("GET / HTTP/1.1\r\nHost: allowed.example\r\n\r\n"))
+	socks5test.AssertClosed(t, forged.DstTCPConn, socks5test.DefaultTimeout)
+
+	// destination is a bare ip, the rule matches the sniffed Host.
+	blocked := server.Client(t, "", "")
+	reply, err = socks5test.Request(blocked, socks5.CMDConnect, echo)
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+	defer blocked.DstTCPConn.Close()
+	blocked.DstTCPConn.Write([]byte("GET / HTTP/1.1\r\nHost: www.blocked.example\r\n\r\n"))
+	socks5test.AssertClosed(t, blocked.DstTCPConn, socks5test.DefaultTimeout)
+
+	allowed := server.Client(t, "", "")
+	reply, err = socks5test.Request(allowed, socks5.CMDConnect, echo)
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+	defer allowed.DstTCPConn.Close()
+	socks5test.AssertEcho(t, allowed.DstTCPConn, []byte("GET / HTTP/1.1\r\nHost: allowed.example\r\n\r\n"))
+
+	sniffed := false
+	for _, session := range server.Sessions() {
+		sniffed = sniffed || session.SniffedProtocol == socks5.SniffProtocolHTTP && session.SniffedName == "allowed.example"
+	}
+	if !sniffed {
+		t.Fatalf("sniffed name not recorded: %+v", server.Sessions())
+	}
+
+	// nothing to sniff, client waits for server greeting.
+	silent := server.Client(t, "", "")
+	reply, err = socks5test.Request(silent, socks5.CMDConnect, echo)
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+	defer silent.DstTCPConn.Close()
+	time.Sleep(2 * socks5.DefaultSniffTimeout)
+	socks5test.AssertEcho(t, silent.DstTCPConn, []byte("SSH-2.0-client\r\n"))
+}
+
+func TestCapture(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	dir := t.TempDir()
+	server := socks5test.NewServer(t, "user", "password", func(s *socks5.Server) {
+		s.Capture = &socks5.Capture{Dir: dir, Users: []string{"user"}}
+	})
+
+	// matched by username from relay start.
+	client := server.Client(t, "user", "password")
+	reply, err := socks5test.Request(client, socks5.CMDConnect, echo)
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+	socks5test.AssertEcho(t, client.DstTCPConn, []byte("captured payload"))
+	sessions := server.Sessions()
+	if len(sessions) != 1 || sessions[0].Capture == "" {
+		t.Fatalf("capture not listed: %+v", sessions)
+	}
+	path := sessions[0].Capture
+	client.DstTCPConn.Close()
+
+	// file is closed when session finished, payload is in client and destination streams, both directions.
+	var data []byte
+	for deadline := time.Now().Add(socks5test.DefaultTimeout); ; time.Sleep(10 * time.Millisecond) {
+		data, err = ioutil.ReadFile(path)
+		if nil == err && bytes.Count(data, []byte("captured payload")) == 4 && len(server.Sessions()) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("capture file %s: %d bytes, %v", path, len(data), err)
+		}
+	}
+	if !bytes.HasPrefix(data, []byte{0x0A, 0x0D, 0x0D, 0x0A}) {
+		t.Fatalf("not pcapng: % x", data[:4])
+	}
+
+	// not matched, started and stopped by id while relaying.
+	server.Capture.SetFilters(socks5.CaptureFilters{})
+	client = server.Client(t, "user", "password")
+	reply, err = socks5test.Request(client, socks5.CMDConnect, echo)
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+	defer client.DstTCPConn.Close()
+	socks5test.AssertEcho(t, client.DstTCPConn, []byte("before"))
+	id := server.Sessions()[0].ID
+	if server.Sessions()[0].Capture != "" {
+		t.Fatal("session captured without matched filter")
+	}
+	path, err = server.StartCapture(id)
+	if nil != err {
+		t.Fatal(err)
+	}
+	socks5test.AssertEcho(t, client.DstTCPConn, []byte("during"))
+	if !server.StopCapture(id) || server.StopCapture(id) {
+		t.Fatal("stop capture twice")
+	}
+	socks5test.AssertEcho(t, client.DstTCPConn, []byte("after"))
+
+	data, err = ioutil.ReadFile(path)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("before")) || bytes.Count(data, []byte("during")) != 4 || bytes.Contains(data, []byte("after")) {
+		t.Fatalf("capture of %d bytes doesn't match capturing period", len(data))
+	}
+	if _, err := server.StartCapture(id + 100); err != socks5.ErrSessionNotFound {
+		t.Fatalf("got %v, want %v", err, socks5.ErrSessionNotFound)
+	}
+}
+
+func TestUpstreamGroup(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	socksUpstream := socks5test.NewServer(t, "up", "password", nil)
+	httpUpstream := socks5test.NewServer(t, "", "", nil)
+	bridge := httptest.NewServer(socks5.NewHTTPBridge("", "", "", httpUpstream.Addr))
+	defer bridge.Close()
+
+	dead := &socks5.UpstreamMember{ClientConfig: &socks5.ClientConfig{ProxyAddr: socks5test.RefusedAddr(t)}}
+	group := &socks5.UpstreamGroup{
+		Members: []*socks5.UpstreamMember{
+			{ClientConfig: socksUpstream.ClientConfig("up", "password")},
+			dead,
+			{ClientConfig: &socks5.ClientConfig{ProxyAddr: bridge.Listener.Addr().String()}, Protocol: socks5.UpstreamProtocolHTTP},
+		},
+		HealthCheck: &socks5.HealthCheck{Destination: echo, Interval: 60, Fall: 1, Rise: 1},
+	}
+	server := socks5test.NewServer(t, "", "", func(s *socks5.Server) {
+		router, err := socks5.NewRouterFromRuleSet(&socks5.RuleSet{
+			DefaultAction: socks5.RuleActionUpstream,
+			DefaultRoute:  "pool",
+			Groups:        map[string]*socks5.UpstreamGroup{"pool": group},
+		})
+		if nil != err {
+			t.Fatal(err)
+		}
+		s.Router = router
+		t.Cleanup(router.Close)
+	})
+
+	// first health check runs at once, dead member is ejected. next check is after the test.
+	for deadline := time.Now().Add(socks5test.DefaultTimeout); group.Status()[1].Healthy; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("dead member not ejected: %+v", group.Status())
+		}
+	}
+	for _, status := range []socks5.UpstreamStatus{group.Status()[0], group.Status()[2]} {
+		if !status.Healthy {
+			t.Fatalf("live member ejected: %+v", group.Status())
+		}
+	}
+
+	// health check probes of live members may still be running, they must not be counted below.
+	for deadline := time.Now().Add(socks5test.DefaultTimeout); ; time.Sleep(10 * time.Millisecond) {
+		socksMetrics, httpMetrics := socksUpstream.Metrics.Snapshot(), httpUpstream.Metrics.Snapshot()
+		if socksMetrics["sessions_total"] >= 1 && httpMetrics["sessions_total"] >= 1 &&
+			socksMetrics["sessions_active"] == 0 && httpMetrics["sessions_active"] == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("health check probes not finished: socks %v, http %v", socksMetrics, httpMetrics)
+		}
+	}
+
+	// round robin over live members, both socks and http upstreams relay.
+	socksSessions := socksUpstream.Metrics.Snapshot()["sessions_total"]
+	httpSessions := httpUpstream.Metrics.Snapshot()["sessions_total"]
+	for i := 0; i < 4; i++ {
+		client := server.Client(t, "", "")
+		reply, err := socks5test.Request(client, socks5.CMDConnect, echo)
+		socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+		socks5test.AssertEcho(t, client.DstTCPConn, []byte("through group"))
+		client.DstTCPConn.Close()
+	}
+	if socksUpstream.Metrics.Snapshot()["sessions_total"]-socksSessions != 2 || httpUpstream.Metrics.Snapshot()["sessions_total"]-httpSessions != 2 {
+		t.Fatalf("sessions not balanced: socks %v, http %v", socksUpstream.Metrics.Snapshot(), httpUpstream.Metrics.Snapshot())
+	}
+}
+
+func TestEgress(t *testing.T) {
+	// destinations reply the source address of connections.
+	source := func(addr string) string {
+		ln, err := net.Listen("tcp", addr)
+		if nil != err {
+			t.Skip(err)
+		}
+		t.Cleanup(func() { ln.Close() })
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if nil != err {
+					return
+				}
+				conn.Write([]byte(conn.RemoteAddr().(*net.TCPAddr).IP.String()))
+				conn.Close()
+			}
+		}()
+		return ln.Addr().String()
+	}
+	dst, ruleDst := source("127.0.0.1:0"), source("127.0.0.5:0")
+
+	configure := func(s *socks5.Server) {
+		router, err := socks5.NewRouterFromRuleSet(&socks5.RuleSet{
+			Rules: []*socks5.Rule{{
+				Action: socks5.RuleActionAllow,
+				CIDRs:  []string{"127.0.0.5/32"},
+				Egress: &socks5.Egress{SourceIPs: []string{"127.0.0.4"}},
+			}},
+		})
+		if nil != err {
+			t.Fatal(err)
+		}
+		s.Router = router
+		t.Cleanup(router.Close)
+		s.Egress = &socks5.Egress{SourceIPs: []string{"127.0.0.2"}}
+		s.UserEgress = map[string]*socks5.Egress{"user": {SourceIPs: []string{"127.0.0.3"}}}
+	}
+	anonymous := socks5test.NewServer(t, "", "", configure)
+	authenticated := socks5test.NewServer(t, "user", "password", configure)
+
+	tests := []struct {
+		server   *socks5test.Server
+		username string
+		dst      string
+		source   string
+	}{
+		{anonymous, "", dst, "127.0.0.2"},
+		{authenticated, "user", dst, "127.0.0.3"},
+		{authenticated, "user", ruleDst, "127.0.0.4"},
+	}
+	for _, test := range tests {
+		password := ""
+		if test.username != "" {
+			password = "password"
+		}
+		client := test.server.Client(t, test.username, password)
+		reply, err := socks5test.Request(client, socks5.CMDConnect, test.dst)
+		socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+		got, err := ioutil.ReadAll(client.DstTCPConn)
+		client.DstTCPConn.Close()
+		if nil != err {
+			t.Fatal(err)
+		}
+		if string(got) != test.source {
+			t.Errorf("user %q to %s: source %s, want %s", test.username, test.dst, got, test.source)
+		}
+	}
+}
+
+func TestProxyProtocol(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+
+	// destination behind our ingress reads PROXY header, and replies the client address in it.
+	dst, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	go func() {
+		for {
+			conn, err := dst.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				header, err := proxyproto.Read(r)
+				if nil != err {
+					return
+				}
+				conn.Write([]byte(header.Source.String()))
+				io.Copy(ioutil.Discard, r)
+			}()
+		}
+	}()
+
+	server := socks5test.NewServer(t, "", "", func(s *socks5.Server) {
+		s.ProxyProtocol = &socks5.ProxyProtocol{TrustedSources: []string{"127.0.0.1"}}
+		s.Egress = &socks5.Egress{ProxyProtocol: proxyproto.Version1}
+	})
+
+	// load balancer sends v2 header of client in front of the stream.
+	balancer, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer balancer.Close()
+	go func() {
+		for {
+			conn, err := balancer.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				backend, err := net.Dial("tcp", server.Addr)
+				if nil != err {
+					return
+				}
+				defer backend.Close()
+				header := &proxyproto.Header{Version: proxyproto.Version2, Source: client, Destination: conn.LocalAddr().(*net.TCPAddr)}
+				if _, err := header.WriteTo(backend); nil != err {
+					return
+				}
+				go io.Copy(backend, conn)
+				io.Copy(conn, backend)
+			}()
+		}
+	}()
+
+	c, err := socks5.NewClient("", "", balancer.Addr().String(), 0, 5, 5)
+	if nil != err {
+		t.Fatal(err)
+	}
+	reply, err := socks5test.Request(c, socks5.CMDConnect, dst.Addr().String())
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+	defer c.DstTCPConn.Close()
+
+	got := make([]byte, len(client.String()))
+	if _, err := io.ReadFull(c.DstTCPConn, got); nil != err {
+		t.Fatal(err)
+	}
+	if string(got) != client.String() {
+		t.Fatalf("destination sees client %q, want %s", got, client)
+	}
+	sessions := server.Sessions()
+	if len(sessions) != 1 || sessions[0].Client != client.String() {
+		t.Fatalf("sessions %+v, want client %s", sessions, client)
+	}
+
+	// trusted source without header is refused.
+	direct := server.Client(t, "", "")
+	if err := direct.Negotiation(); nil == err {
+		t.Fatal("negotiation without PROXY header from trusted source")
+	}
+}
+
+func TestTunnel(t *testing.T) {
+	echo, udpEcho := socks5test.NewEchoServer(t, "tcp"), socks5test.NewUDPEchoServer(t)
+	server := socks5test.NewServer(t, "user", "password", func(s *socks5.Server) {
+		tunnel, err := socks5.NewTunnel(socks5.CipherChaCha20Poly1305, "secret")
+		if nil != err {
+			t.Fatal(err)
+		}
+		s.Tunnel = tunnel
+	})
+	cfg := server.ClientConfig("user", "password")
+	cfg.TunnelCipher, cfg.TunnelKey = socks5.CipherChaCha20Poly1305, "secret"
+
+	conn, err := cfg.Connect(echo)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	socks5test.AssertEcho(t, conn, bytes.Repeat([]byte("tunnel"), 10000))
+
+	client, err := cfg.Dial()
+	if nil != err {
+		t.Fatal(err)
+	}
+	udpConn, err := client.UDPAssociate()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	if _, err := udpConn.WriteTo([]byte("hello udp"), udpEcho); nil != err {
+		t.Fatal(err)
+	}
+	buff := make([]byte, 1024)
+	if n, from, err := udpConn.ReadFrom(buff); nil != err || from != udpEcho || string(buff[:n]) != "hello udp" {
+		t.Fatalf("datagram %q from %s, %v", buff[:n], from, err)
+	}
+
+	// unauthenticated stream is dropped by tunnel server.
+	plain, err := net.Dial("tcp", server.Addr)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	plain.Write(bytes.Repeat([]byte{0x05, 0x01, 0x00}, 32))
+	socks5test.AssertClosed(t, plain, socks5test.DefaultTimeout)
+}
+
+func TestLimits(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	server := socks5test.NewServer(t, "", "", func(s *socks5.Server) {
+		s.Limits = &socks5.Limits{MaxSessions: 2, Action: socks5.LimitActionPause}
+	})
+
+	// one mux connection passes accept loop once, its streams are still limited.
+	cfg := server.ClientConfig("", "")
+	cfg.Mux = 1
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := cfg.Connect(echo)
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		socks5test.AssertEcho(t, conn, []byte("hello"))
+		conns = append(conns, conn)
+	}
+	if _, err := cfg.Connect(echo); nil == err {
+		t.Fatal("session over limit connected by mux")
+	}
+	if n := server.Metrics.Snapshot()["rejected_total"]; n != 1 {
+		t.Errorf("%d sessions rejected", n)
+	}
+
+	conns[0].Close()
+	for deadline := time.Now().Add(socks5test.DefaultTimeout); server.Metrics.Snapshot()["sessions_active"] != 1; {
+		if time.Now().After(deadline) {
+			t.Fatal("closed session still running")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	conn, err := cfg.Connect(echo)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	socks5test.AssertEcho(t, conn, []byte("hello"))
+}
+
+func TestLimitsReject(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	for _, c := range []struct {
+		name   string
+		limits socks5.Limits
+		metric string
+	}{
+		{"total", socks5.Limits{MaxSessions: 1}, "rejected_total"},
+		{"per ip", socks5.Limits{MaxSessionsPerIP: 1}, "rejected_per_ip"},
+		{"rate", socks5.Limits{ConnRatePerIP: 0.001, ConnBurstPerIP: 1}, "rejected_rate"},
+		{"per user", socks5.Limits{MaxSessionsPerUser: 1}, "rejected_per_user"},
+	} {
+		limits := c.limits
+		server := socks5test.NewServer(t, "user", "password", func(s *socks5.Server) {
+			s.Limits = &limits
+		})
+		client := server.Client(t, "user", "password")
+		reply, err := socks5test.Request(client, socks5.CMDConnect, echo)
+		socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+		defer client.DstTCPConn.Close()
+
+		// every limit replies general failure to the request, no authentication is selected if client offers it.
+		for _, exchange := range [][2][]byte{
+			{
+				[]byte{socks5.SocksVer, 2, socks5.MethodNoAuthRequired, socks5.MethodUsernamePassword},
+				[]byte{socks5.SocksVer, socks5.MethodNoAuthRequired},
+			},
+			{
+				append([]byte{socks5.SocksVer, 1, socks5.MethodUsernamePassword, 0x01, 4}, "user\x08password"...),
+				[]byte{socks5.SocksVer, socks5.MethodUsernamePassword, 0x01, 0x00},
+			},
+		} {
+			if c.name == "per user" && exchange[1][1] == socks5.MethodNoAuthRequired {
+				continue // server requires authentication, users are known after it
+			}
+			conn, err := net.Dial("tcp", server.Addr)
+			if nil != err {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(socks5test.DefaultTimeout))
+			conn.Write(exchange[0])
+			conn.Write([]byte{socks5.SocksVer, socks5.CMDConnect, 0x00, socks5.ATYPIPv4, 127, 0, 0, 1, 0, 80})
+			want := append(exchange[1], socks5.SocksVer, socks5.ReplyGeneralFailure, 0x00, socks5.ATYPIPv4, 0, 0, 0, 0, 0, 0)
+			got, err := ioutil.ReadAll(conn)
+			if nil != err || !bytes.Equal(got, want) {
+				t.Errorf("%s: got % x, %v, want % x", c.name, got, err, want)
+			}
+		}
+		if n := server.Metrics.Snapshot()[c.metric]; n == 0 {
+			t.Errorf("%s: %s not counted", c.name, c.metric)
+		}
+	}
+}
+
+func TestLimitsPauseWebSocket(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	server := socks5test.NewServer(t, "", "", func(s *socks5.Server) {
+		s.Limits = &socks5.Limits{MaxSessions: 1, Action: socks5.LimitActionPause}
+	})
+	wsAddr := freeAddr(t, "tcp")
+	go server.RunWebSocketServer(wsAddr, "", "", "")
+
+	cfg := server.ClientConfig("", "")
+	cfg.ProxyAddr, cfg.Transport, cfg.TCPDeadline = wsAddr, socks5.TransportWebSocket, 5
+	var first net.Conn
+	for deadline := time.Now().Add(socks5test.DefaultTimeout); ; time.Sleep(5 * time.Millisecond) {
+		var err error
+		if first, err = cfg.Connect(echo); nil == err {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connect over websocket: %v", err)
+		}
+	}
+	defer first.Close()
+
+	// upgrade of the second connection waits until the first session finished.
+	connected := make(chan net.Conn, 1)
+	go func() {
+		conn, err := cfg.Connect(echo)
+		if nil != err {
+			t.Error(err)
+		}
+		connected <- conn
+	}()
+	select {
+	case <-connected:
+		t.Fatal("websocket session over limit connected while paused")
+	case <-time.After(200 * time.Millisecond):
+	}
+	first.Close()
+	select {
+	case conn := <-connected:
+		if nil != conn {
+			defer conn.Close()
+			socks5test.AssertEcho(t, conn, []byte("hello"))
+		}
+	case <-time.After(socks5test.DefaultTimeout):
+		t.Fatal("paused websocket session not resumed")
+	}
+}
+
+func TestQuotaCutLive(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	server := socks5test.NewServer(t, "user", "password", func(s *socks5.Server) {
+		accounting, err := socks5.NewAccounting(socks5.Quota{Default: socks5.QuotaLimit{DailyBytes: 1024}, CutLive: true})
+		if nil != err {
+			t.Fatal(err)
+		}
+		s.Accounting = accounting
+	})
+
+	idle := server.Client(t, "user", "password")
+	reply, err := socks5test.Request(idle, socks5.CMDConnect, echo)
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+	defer idle.DstTCPConn.Close()
+
+	// busy session uses up quota, the idle one is closed too.
+	busy := server.Client(t, "user", "password")
+	reply, err = socks5test.Request(busy, socks5.CMDConnect, echo)
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+	defer busy.DstTCPConn.Close()
+	busy.DstTCPConn.Write(bytes.Repeat([]byte("x"), 2048))
+	busy.DstTCPConn.SetReadDeadline(time.Now().Add(socks5test.DefaultTimeout))
+	if _, err := io.Copy(ioutil.Discard, busy.DstTCPConn); nil != err {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			t.Fatal("session over quota still open")
+		}
+	}
+	socks5test.AssertClosed(t, idle.DstTCPConn, socks5test.DefaultTimeout)
+
+	// new sessions are rejected.
+	client := server.Client(t, "user", "password")
+	reply, err = socks5test.Request(client, socks5.CMDConnect, echo)
+	socks5test.AssertReply(t, reply, err, socks5.ReplyGeneralFailure)
+}
+
+func TestQuotaUDP(t *testing.T) {
+	// destination records datagrams and replies by hand.
+	dst, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	var accounting *socks5.Accounting
+	server := socks5test.NewServer(t, "user", "password", func(s *socks5.Server) {
+		if accounting, err = socks5.NewAccounting(socks5.Quota{Default: socks5.QuotaLimit{DailyBytes: 1024}}); nil != err {
+			t.Fatal(err)
+		}
+		s.Accounting = accounting
+	})
+
+	client := server.Client(t, "user", "password")
+	client.UDPDeadline = 1
+	if err := client.Negotiation(); nil != err {
+		t.Fatal(err)
+	}
+	udpConn, err := client.UDPAssociate()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	// both directions are counted, the reply which uses up quota is still delivered.
+	payload := bytes.Repeat([]byte("x"), 600)
+	if _, err := udpConn.WriteTo(payload, dst.LocalAddr().String()); nil != err {
+		t.Fatal(err)
+	}
+	buff := make([]byte, 1024)
+	dst.SetReadDeadline(time.Now().Add(socks5test.DefaultTimeout))
+	n, source, err := dst.ReadFrom(buff)
+	if nil != err || n != len(payload) {
+		t.Fatalf("destination read %d, %v", n, err)
+	}
+	dst.WriteTo(payload, source)
+	if n, _, err := udpConn.ReadFrom(buff); nil != err || n != len(payload) {
+		t.Fatalf("client read %d, %v", n, err)
+	}
+	if usage := accounting.Usage("user"); usage.DailyBytes != 2*int64(len(payload)) {
+		t.Fatalf("daily bytes %d, want %d", usage.DailyBytes, 2*len(payload))
+	}
+
+	// datagrams of both directions are dropped after quota exceeded.
+	udpConn.WriteTo([]byte("again"), dst.LocalAddr().String())
+	dst.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if n, _, err := dst.ReadFrom(buff); nil == err {
+		t.Errorf("destination received %q over quota", buff[:n])
+	}
+	dst.WriteTo([]byte("again"), source)
+	if n, _, err := udpConn.ReadFrom(buff); nil == err {
+		t.Errorf("client received %q over quota", buff[:n])
+	}
+	if usage := accounting.Usage("user"); usage.DailyBytes != 2*int64(len(payload)) {
+		t.Errorf("dropped datagrams counted, daily bytes %d", usage.DailyBytes)
+	}
+}
+
+func TestQuotaUDPCutLive(t *testing.T) {
+	echo := socks5test.NewUDPEchoServer(t)
+	server := socks5test.NewServer(t, "user", "password", func(s *socks5.Server) {
+		accounting, err := socks5.NewAccounting(socks5.Quota{Default: socks5.QuotaLimit{DailyBytes: 1024}, CutLive: true})
+		if nil != err {
+			t.Fatal(err)
+		}
+		s.Accounting = accounting
+	})
+
+	client := server.Client(t, "user", "password")
+	if err := client.Negotiation(); nil != err {
+		t.Fatal(err)
+	}
+	udpConn, err := client.UDPAssociate()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+
+	// udp associate session is closed when datagram uses up quota.
+	if _, err := udpConn.WriteTo(bytes.Repeat([]byte("x"), 2048), echo); nil != err {
+		t.Fatal(err)
+	}
+	socks5test.AssertClosed(t, client.DstTCPConn, socks5test.DefaultTimeout)
+}
+
+// freeAddr return a loopback address which is free now, for listeners whose bound address isn't exposed.
+func freeAddr(t *testing.T, network string) string {
+	var addr string
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if nil != err {
+			t.Fatal(err)
+		}
+		addr = conn.LocalAddr().String()
+		conn.Close()
+	} else {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if nil != err {
+			t.Fatal(err)
+		}
+		addr = listener.Addr().String()
+		listener.Close()
+	}
+	return addr
+}
+
+func TestForward(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	udpEcho := socks5test.NewUDPEchoServer(t)
+	server := socks5test.NewServer(t, "user", "password", nil)
+
+	tcpLocal, udpLocal := freeAddr(t, "tcp"), freeAddr(t, "udp")
+	forwarder := socks5.NewForwarder("user", "password", server.Addr, []socks5.Forward{
+		{Network: "tcp", Local: tcpLocal, Remote: echo},
+		{Network: "udp", Local: udpLocal, Remote: udpEcho},
+	})
+	done := make(chan error, 1)
+	go func() {
+		done <- forwarder.Run()
+	}()
+
+	// every accepted connection is proxied to remote.
+	var conn net.Conn
+	for deadline := time.Now().Add(socks5test.DefaultTimeout); ; time.Sleep(5 * time.Millisecond) {
+		var err error
+		if conn, err = net.Dial("tcp", tcpLocal); nil == err {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("forward not listening: %v", err)
+		}
+	}
+	defer conn.Close()
+	socks5test.AssertEcho(t, conn, []byte("hello"))
+	if sessions := server.Sessions(); len(sessions) != 1 || sessions[0].Username != "user" || sessions[0].Destination != echo {
+		t.Errorf("proxy sessions %+v", sessions)
+	}
+
+	// datagrams of local client are relayed by one udp associate, replies are sent back to it.
+	udpConn, err := net.Dial("udp", udpLocal)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	buff := make([]byte, 1024)
+	for i := 0; ; i++ {
+		udpConn.Write([]byte("ping"))
+		udpConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := udpConn.Read(buff)
+		if nil == err {
+			if string(buff[:n]) != "ping" {
+				t.Fatalf("udp reply %q", buff[:n])
+			}
+			break
+		}
+		if i == 50 {
+			t.Fatalf("no udp reply: %v", err)
+		}
+	}
+
+	forwarder.Stop()
+	select {
+	case <-done:
+	case <-time.After(socks5test.DefaultTimeout):
+		t.Fatal("forwarder not stopped")
+	}
+
+	// invalid entry is found before any forward started.
+	bad := socks5.NewForwarder("", "", server.Addr, []socks5.Forward{
+		{Network: "tcp", Local: tcpLocal, Remote: echo},
+		{Network: "sctp", Local: tcpLocal, Remote: echo},
+	})
+	if err := bad.Run(); err != socks5.ErrForwardNetwork {
+		t.Errorf("got %v, want %v", err, socks5.ErrForwardNetwork)
+	}
+	if conn, err := net.Dial("tcp", tcpLocal); nil == err {
+		conn.Close()
+		t.Error("forward of invalid config is listening")
+	}
+
+	// one forward fails, the others are stopped.
+	used, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer used.Close()
+	failed := socks5.NewForwarder("", "", server.Addr, []socks5.Forward{
+		{Network: "udp", Local: udpLocal, Remote: udpEcho},
+		{Network: "tcp", Local: used.Addr().String(), Remote: echo},
+	})
+	if err := failed.Run(); nil == err {
+		t.Fatal("forward of used address started")
+	}
+	for deadline := time.Now().Add(socks5test.DefaultTimeout); ; time.Sleep(5 * time.Millisecond) {
+		// udp forward may start after Run returned, it's closed at once.
+		conn, err := net.ListenPacket("udp", udpLocal)
+		if nil == err {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("forward still listening after Run failed: %v", err)
+		}
+	}
+}
+
+func TestForwardUDP(t *testing.T) {
+	udpEcho := socks5test.NewUDPEchoServer(t)
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0") // never replies
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	server := socks5test.NewServer(t, "", "", nil)
+
+	// front of proxy server counts connections, the first one is held until release is closed.
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer front.Close()
+	release := make(chan struct{})
+	defer close(release)
+	var accepted int32
+	go func() {
+		for {
+			conn, err := front.Accept()
+			if nil != err {
+				return
+			}
+			n := atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				if n == 1 {
+					<-release
+				}
+				remote, err := net.Dial("tcp", server.Addr)
+				if nil != err {
+					return
+				}
+				go func() {
+					io.Copy(remote, conn)
+					remote.Close()
+				}()
+				io.Copy(conn, remote)
+			}()
+		}
+	}()
+
+	echoLocal, sinkLocal := freeAddr(t, "udp"), freeAddr(t, "udp")
+	forwarder := socks5.NewForwarder("", "", front.Addr().String(), []socks5.Forward{
+		{Network: "udp", Local: echoLocal, Remote: udpEcho},
+		{Network: "udp", Local: sinkLocal, Remote: sink.LocalAddr().String()},
+	})
+	forwarder.UDPDeadline = 1
+	go forwarder.Run()
+	defer forwarder.Stop()
+
+	slow, err := net.Dial("udp", echoLocal)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	for deadline := time.Now().Add(socks5test.DefaultTimeout); atomic.LoadInt32(&accepted) == 0; time.Sleep(5 * time.Millisecond) {
+		slow.Write([]byte("slow"))
+		if time.Now().After(deadline) {
+			t.Fatal("forward not listening")
+		}
+	}
+
+	// udp associate of the first client is held, other clients are still served.
+	fast, err := net.Dial("udp", echoLocal)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer fast.Close()
+	buff := make([]byte, 1024)
+	for i := 0; ; i++ {
+		fast.Write([]byte("fast"))
+		fast.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, err := fast.Read(buff)
+		if nil == err {
+			if string(buff[:n]) != "fast" {
+				t.Fatalf("udp reply %q", buff[:n])
+			}
+			break
+		}
+		if i == 50 {
+			t.Fatalf("udp forward blocked by slow udp associate: %v", err)
+		}
+	}
+
+	// datagrams queued while associating are sent when it's ready.
+	release <- struct{}{}
+	slow.SetReadDeadline(time.Now().Add(socks5test.DefaultTimeout))
+	if n, err := slow.Read(buff); nil != err || string(buff[:n]) != "slow" {
+		t.Fatalf("queued datagram reply %q, %v", buff[:n], err)
+	}
+
+	// one-way client keeps sending longer than udp deadline, the same udp associate is used.
+	oneway, err := net.Dial("udp", sinkLocal)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer oneway.Close()
+	before := atomic.LoadInt32(&accepted)
+	for i := 0; i < 10; i++ {
+		oneway.Write([]byte("ping"))
+		sink.SetReadDeadline(time.Now().Add(socks5test.DefaultTimeout))
+		if _, _, err := sink.ReadFrom(buff); nil != err {
+			t.Fatal(err)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&accepted) - before; n != 1 {
+		t.Errorf("%d udp associates of one-way client, want 1", n)
+	}
+}
+
+func TestWebSocket(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	server := socks5test.NewServer(t, "user", "password", nil)
+	wsAddr := freeAddr(t, "tcp")
+	done := make(chan error, 1)
+	go func() {
+		done <- server.RunWebSocketServer(wsAddr, "/tunnel", "", "")
+	}()
+
+	cfg := server.ClientConfig("user", "password")
+	cfg.ProxyAddr, cfg.Transport, cfg.WebSocketPath, cfg.TCPDeadline = wsAddr, socks5.TransportWebSocket, "/tunnel", 5
+	var conn net.Conn
+	for deadline := time.Now().Add(socks5test.DefaultTimeout); ; time.Sleep(5 * time.Millisecond) {
+		var err error
+		if conn, err = cfg.Connect(echo); nil == err {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connect over websocket: %v", err)
+		}
+	}
+	defer conn.Close()
+	// larger than one websocket message read, it's reassembled as stream.
+	socks5test.AssertEcho(t, conn, bytes.Repeat([]byte("0123456789"), 10*1024))
+
+	// mux sessions are carried by websocket too.
+	muxCfg := server.ClientConfig("user", "password")
+	muxCfg.ProxyAddr, muxCfg.Transport, muxCfg.WebSocketPath, muxCfg.Mux = wsAddr, socks5.TransportWebSocket, "/tunnel", 1
+	for i := 0; i < 2; i++ {
+		conn, err := muxCfg.Connect(echo)
+		if nil != err {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		socks5test.AssertEcho(t, conn, []byte("hello"))
+	}
+
+	cfg.WebSocketPath = "/other"
+	if _, err := cfg.Connect(echo); nil == err {
+		t.Error("connected by wrong websocket path")
+	}
+
+	server.Close()
+	select {
+	case err := <-done:
+		if err != socks5.ErrServerClosed {
+			t.Errorf("websocket server: %v", err)
+		}
+	case <-time.After(socks5test.DefaultTimeout):
+		t.Fatal("websocket server not closed")
+	}
+}
+
+func TestWebSocketSniffServerFirst(t *testing.T) {
+	// destination greets first like ssh, then echoes.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte("SSH-2.0-server\r\n"))
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	server := socks5test.NewServer(t, "", "", func(s *socks5.Server) {
+		s.Sniff = true
+	})
+	wsAddr := freeAddr(t, "tcp")
+	go server.RunWebSocketServer(wsAddr, "", "", "")
+
+	cfg := server.ClientConfig("", "")
+	cfg.ProxyAddr, cfg.Transport, cfg.TCPDeadline = wsAddr, socks5.TransportWebSocket, 5
+	var conn net.Conn
+	for deadline := time.Now().Add(socks5test.DefaultTimeout); ; time.Sleep(5 * time.Millisecond) {
+		if conn, err = cfg.Connect(listener.Addr().String()); nil == err {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connect over websocket: %v", err)
+		}
+	}
+	defer conn.Close()
+
+	// client waits for greeting, so sniffing times out before client sends anything.
+	conn.SetReadDeadline(time.Now().Add(socks5test.DefaultTimeout))
+	greeting, err := bufio.NewReader(conn).ReadString('\n')
+	if nil != err || greeting != "SSH-2.0-server\r\n" {
+		t.Fatalf("greeting %q, %v", greeting, err)
+	}
+	time.Sleep(2 * socks5.DefaultSniffTimeout)
+	socks5test.AssertEcho(t, conn, []byte("SSH-2.0-client\r\n"))
+}
+
+// tokenAuthenticator is a private method: client sends length prefixed token, server replies one status byte.
+// authenticated connection is xor masked, as methods with per-message protection wrap it.
+type tokenAuthenticator struct {
+	token string
+}
+
+func (a *tokenAuthenticator) Method() byte {
+	return 0x80
+}
+
+func (a *tokenAuthenticator) Authenticate(conn net.Conn) (net.Conn, string, error) {
+	size := make([]byte, 1)
+	if _, err := io.ReadFull(conn, size); nil != err {
+		return nil, "", err
+	}
+	token := make([]byte, size[0])
+	if _, err := io.ReadFull(conn, token); nil != err {
+		return nil, "", err
+	}
+	if string(token) != a.token {
+		conn.Write([]byte{1})
+		return nil, "", socks5.ErrUnameOrPasswdError
+	}
+	if _, err := conn.Write([]byte{0}); nil != err {
+		return nil, "", err
+	}
+	return &xorConn{conn}, "token-user", nil
+}
+
+type tokenClientAuthenticator struct {
+	token string
+}
+
+func (a *tokenClientAuthenticator) Method() byte {
+	return 0x80
+}
+
+func (a *tokenClientAuthenticator) Authenticate(conn net.Conn) (net.Conn, error) {
+	if _, err := conn.Write(append([]byte{byte(len(a.token))}, a.token...)); nil != err {
+		return nil, err
+	}
+	status := make([]byte, 1)
+	if _, err := io.ReadFull(conn, status); nil != err {
+		return nil, err
+	}
+	if status[0] != 0 {
+		return nil, socks5.ErrUnameOrPasswdError
+	}
+	return &xorConn{conn}, nil
+}
+
+type xorConn struct {
+	net.Conn
+}
+
+func (c *xorConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	for i := range b[:n] {
+		b[i] ^= 0x5A
+	}
+	return n, err
+}
+
+func (c *xorConn) Write(b []byte) (int, error) {
+	masked := make([]byte, len(b))
+	for i := range b {
+		masked[i] = b[i] ^ 0x5A
+	}
+	return c.Conn.Write(masked)
+}
+
+func TestAuthRegistry(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	server := socks5test.NewServer(t, "user", "password", func(s *socks5.Server) {
+		if err := s.RegisterAuthenticator(&tokenAuthenticator{token: "old"}); nil != err {
+			t.Fatal(err)
+		}
+		s.AuthMethods = []byte{0x80, socks5.MethodUsernamePassword}
+	})
+	// registered again, the method is replaced.
+	if err := server.RegisterAuthenticator(&tokenAuthenticator{token: "secret"}); nil != err {
+		t.Fatal(err)
+	}
+
+	// private method is preferred, request and relay go through the connection it returned.
+	client := server.Client(t, "user", "password")
+	client.Authenticators = []socks5.ClientAuthenticator{&tokenClientAuthenticator{token: "secret"}}
+	reply, err := socks5test.Request(client, socks5.CMDConnect, echo)
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+	defer client.DstTCPConn.Close()
+	if _, ok := client.DstTCPConn.(*xorConn); !ok {
+		t.Fatalf("connection %T not replaced by authenticator", client.DstTCPConn)
+	}
+	socks5test.AssertEcho(t, client.DstTCPConn, []byte("hello"))
+	if sessions := server.Sessions(); len(sessions) != 1 || sessions[0].Username != "token-user" {
+		t.Errorf("sessions %+v", sessions)
+	}
+
+	// built-in method is still selected by client which doesn't offer private one.
+	client = server.Client(t, "user", "password")
+	reply, err = socks5test.Request(client, socks5.CMDConnect, echo)
+	socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+	client.DstTCPConn.Close()
+
+	client = server.Client(t, "", "")
+	client.Authenticators = []socks5.ClientAuthenticator{&tokenClientAuthenticator{token: "wrong"}}
+	if _, err := socks5test.Request(client, socks5.CMDConnect, echo); err != socks5.ErrUnameOrPasswdError {
+		t.Errorf("wrong token: got %v, want %v", err, socks5.ErrUnameOrPasswdError)
+	}
+
+	// registered method isn't offered unless it's in AuthMethods.
+	server.AuthMethods = []byte{socks5.MethodUsernamePassword}
+	client = server.Client(t, "", "")
+	client.Authenticators = []socks5.ClientAuthenticator{&tokenClientAuthenticator{token: "secret"}}
+	if _, err := socks5test.Request(client, socks5.CMDConnect, echo); err != socks5.ErrNonSupportCurrentMethod {
+		t.Errorf("method not listed: got %v, want %v", err, socks5.ErrNonSupportCurrentMethod)
+	}
+
+	if err := server.RegisterAuthenticator(invalidAuthenticator{}); err != socks5.ErrInvalidAuthMethod {
+		t.Errorf("register 0xFF: got %v, want %v", err, socks5.ErrInvalidAuthMethod)
+	}
+}
+
+type invalidAuthenticator struct{}
+
+func (invalidAuthenticator) Method() byte {
+	return socks5.MethodNoAcceptableMethods
+}
+
+func (invalidAuthenticator) Authenticate(conn net.Conn) (net.Conn, string, error) {
+	return conn, "", nil
+}
+
+// adminRequest send admin api request, decode json response into v if it's not nil.
+func adminRequest(t *testing.T, method, url, authorization string, v interface{}) int {
+	req, err := http.NewRequest(method, url, nil)
+	if nil != err {
+		t.Fatal(err)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if nil != v {
+		if err := json.NewDecoder(resp.Body).Decode(v); nil != err {
+			t.Fatalf("%s %s: %v", method, url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminAPI(t *testing.T) {
+	echo := socks5test.NewEchoServer(t, "tcp")
+	server := socks5test.NewServer(t, "user", "password", nil)
+	admin := socks5.NewAdminServer(server.Server, freeAddr(t, "tcp"))
+	admin.Token = "admin-token"
+	go admin.Run()
+	defer admin.Stop()
+	api := "http://" + admin.Addr + socks5.AdminAPIPrefix
+	bearer := "Bearer " + admin.Token
+
+	var clients []*socks5.Client
+	for i := 0; i < 3; i++ {
+		client := server.Client(t, "user", "password")
+		reply, err := socks5test.Request(client, socks5.CMDConnect, echo)
+		socks5test.AssertReply(t, reply, err, socks5.ReplySuccess)
+		defer client.DstTCPConn.Close()
+		clients = append(clients, client)
+	}
+
+	var sessions []socks5.SessionInfo
+	for deadline := time.Now().Add(socks5test.DefaultTimeout); ; time.Sleep(5 * time.Millisecond) {
+		resp, err := http.Get(api + "sessions")
+		if nil == err {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("admin server not listening: %v", err)
+		}
+	}
+
+	// bearer token is required, a wrong one or one without Bearer scheme is rejected.
+	for _, authorization := range []string{"", "Bearer wrong", admin.Token} {
+		if code := adminRequest(t, http.MethodGet, api+"sessions", authorization, nil); code != http.StatusUnauthorized {
+			t.Errorf("authorization %q: %d", authorization, code)
+		}
+		if code := adminRequest(t, http.MethodDelete, api+"users/user/sessions", authorization, nil); code != http.StatusUnauthorized {
+			t.Errorf("kill user with authorization %q: %d", authorization, code)
+		}
+	}
+	if len(server.Sessions()) != 3 {
+		t.Fatal("sessions killed by unauthorized request")
+	}
+
+	if code := adminRequest(t, http.MethodGet, api+"sessions?user=user", bearer, &sessions); code != http.StatusOK || len(sessions) != 3 {
+		t.Fatalf("list sessions: %d, %+v", code, sessions)
+	}
+	var other []socks5.SessionInfo
+	if adminRequest(t, http.MethodGet, api+"sessions?user=other", bearer, &other); len(other) != 0 {
+		t.Errorf("sessions of other user: %+v", other)
+	}
+	var session socks5.SessionInfo
+	id := strconv.FormatUint(sessions[0].ID, 10)
+	if code := adminRequest(t, http.MethodGet, api+"sessions/"+id, bearer, &session); code != http.StatusOK ||
+		session.ID != sessions[0].ID || session.Destination != echo {
+		t.Errorf("get session: %d, %+v", code, session)
+	}
+	if code := adminRequest(t, http.MethodGet, api+"sessions/x", bearer, nil); code != http.StatusBadRequest {
+		t.Errorf("invalid session id: %d", code)
+	}
+
+	// kill one session.
+	var killed map[string]int
+	if code := adminRequest(t, http.MethodDelete, api+"sessions/"+id, bearer, &killed); code != http.StatusOK || killed["killed"] != 1 {
+		t.Fatalf("kill session: %d, %v", code, killed)
+	}
+	var target net.Conn
+	for _, client := range clients {
+		if client.DstTCPConn.LocalAddr().String() == sessions[0].Client {
+			target = client.DstTCPConn
+		}
+	}
+	if nil == target {
+		t.Fatalf("no client of session %+v", sessions[0])
+	}
+	socks5test.AssertClosed(t, target, socks5test.DefaultTimeout)
+	for deadline := time.Now().Add(socks5test.DefaultTimeout); len(server.Sessions()) != 2; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("killed session still running")
+		}
+	}
+	if code := adminRequest(t, http.MethodDelete, api+"sessions/"+id, bearer, nil); code != http.StatusNotFound {
+		t.Errorf("kill session again: %d", code)
+	}
+
+	// kill all sessions of user.
+	if code := adminRequest(t, http.MethodDelete, api+"users/user/sessions", bearer, &killed); code != http.StatusOK || killed["killed"] != 2 {
+		t.Fatalf("kill user sessions: %d, %v", code, killed)
+	}
+	for _, client := range clients {
+		socks5test.AssertClosed(t, client.DstTCPConn, socks5test.DefaultTimeout)
+	}
+	if adminRequest(t, http.MethodDelete, api+"users/user/sessions", bearer, &killed); killed["killed"] != 0 {
+		t.Errorf("kill user sessions again: %v", killed)
+	}
+}
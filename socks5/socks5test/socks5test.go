@@ -0,0 +1,223 @@
+// Package socks5test provide in-process proxy server, destinations and client helpers for end-to-end tests.
+// every listener binds an ephemeral loopback port, so tests need no network access.
+package socks5test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"xproxy/socks5"
+)
+
+const (
+	// DefaultTimeout bounds every blocking step of helpers, a broken scenario fails instead of hanging.
+	DefaultTimeout = 5 * time.Second
+)
+
+// Server is a running proxy server.
+type Server struct {
+	*socks5.Server
+	Addr    string // tcp address
+	UDPAddr string // udp relay address
+}
+
+// NewServer start proxy server on ephemeral loopback port, empty username and password means no authentication.
+// configure is called before server started, it can be nil. the server is closed by test cleanup.
+func NewServer(t testing.TB, username, password string, configure func(s *socks5.Server)) *Server {
+	t.Helper()
+	s, err := socks5.NewServer("127.0.0.1:0", "", username, password, 10, 10, 10, 10)
+	if nil != err {
+		t.Fatalf("socks5test: create server: %v", err)
+	}
+	if nil != configure {
+		configure(s)
+	}
+
+	errch := make(chan error, 1)
+	go func() {
+		errch <- s.Run()
+	}()
+	t.Cleanup(func() {
+		s.Close()
+	})
+
+	// wait until both servers bound their ports.
+	for deadline := time.Now().Add(DefaultTimeout); ; {
+		tcpAddr, udpAddr := s.Addrs()
+		if tcpAddr.Port != 0 && udpAddr.Port != 0 {
+			return &Server{Server: s, Addr: tcpAddr.String(), UDPAddr: udpAddr.String()}
+		}
+		select {
+		case err := <-errch:
+			t.Fatalf("socks5test: run server: %v", err)
+		case <-time.After(5 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("socks5test: server not started in %v", DefaultTimeout)
+		}
+	}
+}
+
+// Client create a client of server, it's not negotiated yet.
+func (s *Server) Client(t testing.TB, username, password string) *socks5.Client {
+	t.Helper()
+	client, err := socks5.NewClient(username, password, s.Addr, 0, int(DefaultTimeout/time.Second), int(DefaultTimeout/time.Second))
+	if nil != err {
+		t.Fatalf("socks5test: create client: %v", err)
+	}
+	return client
+}
+
+// ClientConfig return client config of server, it's used by port forwarding, http bridge and upstream routing.
+func (s *Server) ClientConfig(username, password string) *socks5.ClientConfig {
+	return &socks5.ClientConfig{Username: username, Password: password, ProxyAddr: s.Addr}
+}
+
+// Request negotiate, then send request of cmd, the reply is returned whatever its code is.
+// Client.Request hides the reply code of failures, scenarios need it.
+func Request(client *socks5.Client, cmd byte, addr string) (*socks5.SocksReply, error) {
+	if err := client.Negotiation(); nil != err {
+		return nil, err
+	}
+	request, err := socks5.NewSocksRequestFromAddress(cmd, addr)
+	if nil != err {
+		return nil, err
+	}
+	if _, err := request.WriteTo(client.DstTCPConn); nil != err {
+		return nil, err
+	}
+	return socks5.ParseSocksReply(client.DstTCPConn)
+}
+
+// NewEchoServer start tcp server which writes back everything it reads, network is "tcp", "tcp4" or "tcp6".
+// it skips the test if network isn't available, such as ipv6 disabled.
+func NewEchoServer(t testing.TB, network string) string {
+	t.Helper()
+	host := "127.0.0.1"
+	if network == "tcp6" {
+		host = "::1"
+	}
+	listener, err := net.Listen(network, net.JoinHostPort(host, "0"))
+	if nil != err {
+		t.Skipf("socks5test: %s not available: %v", network, err)
+	}
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if nil != err {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// NewUDPEchoServer start udp server which sends every datagram back to its sender.
+func NewUDPEchoServer(t testing.TB) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("socks5test: listen udp: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+	})
+
+	go func() {
+		buff := make([]byte, 64*1024)
+		for {
+			n, addr, err := conn.ReadFrom(buff)
+			if nil != err {
+				return
+			}
+			conn.WriteTo(buff[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// NewHTTPServer start http server which responds body to every request.
+func NewHTTPServer(t testing.TB, body string) string {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return server.Listener.Addr().String()
+}
+
+// RefusedAddr return loopback address which refuses connections.
+func RefusedAddr(t testing.TB) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatalf("socks5test: listen tcp: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+// AssertReply fail the test if reply code isn't expected.
+func AssertReply(t testing.TB, reply *socks5.SocksReply, err error, rep byte) {
+	t.Helper()
+	if nil != err {
+		t.Fatalf("socks5test: request error: %v", err)
+	}
+	if reply.REP != rep {
+		t.Fatalf("socks5test: reply code %#x, want %#x", reply.REP, rep)
+	}
+}
+
+// AssertEcho write payload to connection of echo destination, and check the same bytes are relayed back.
+func AssertEcho(t testing.TB, conn net.Conn, payload []byte) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(DefaultTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := conn.Write(payload); nil != err {
+		t.Fatalf("socks5test: write: %v", err)
+	}
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); nil != err {
+		t.Fatalf("socks5test: read echo: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("socks5test: echo %s, want %s", summary(got), summary(payload))
+	}
+}
+
+// AssertClosed check that connection is closed by peer within timeout.
+func AssertClosed(t testing.TB, conn net.Conn, timeout time.Duration) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, err := conn.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatalf("socks5test: connection still open after %v", timeout)
+	}
+	if nil == err {
+		t.Fatalf("socks5test: read %d bytes, want connection closed", n)
+	}
+}
+
+// help func ===========================================================================================================
+
+func summary(b []byte) string {
+	if len(b) > 32 {
+		return fmt.Sprintf("%q... (%d bytes)", b[:32], len(b))
+	}
+	return fmt.Sprintf("%q", b)
+}
@@ -1,22 +1,38 @@
 package socks5
 
 import (
-	"io"
+	"bytes"
 	"log"
 	"net"
-	"strings"
 	"time"
+	"xproxy/trace"
 )
 
 func (s *Server) RunTCPServer() error {
-	tcpListener, err := net.ListenTCP("tcp", s.TCPAddr)
+	tcpAddr, _ := s.Addrs()
+	tcpListener, err := net.ListenTCP("tcp", tcpAddr)
 	if nil != err {
 		return err
 	}
 	defer tcpListener.Close()
+	go func() {
+		<-s.getDoneChan()
+		tcpListener.Close()
+	}()
+
+	if tcpAddr.Port == 0 {
+		s.mu.Lock()
+		s.TCPAddr = tcpListener.Addr().(*net.TCPAddr)
+		s.mu.Unlock()
+	}
 
 	var tempDelay time.Duration
 	for {
+		// backpressure: with LimitActionPause, stop accepting until a session slot is free.
+		if nil != s.limiter && !s.limiter.waitSlot(s.getDoneChan()) {
+			return ErrServerClosed
+		}
+
 		tcpConn, err := tcpListener.AcceptTCP()
 		if nil != err {
 			select {
@@ -39,20 +55,64 @@ func (s *Server) RunTCPServer() error {
 			}
 			return err
 		}
-		go s.processTCPConn(tcpConn)
+		go s.serveTCPConn(tcpConn)
 	}
-	return nil
 }
 
-func (s *Server) processTCPConn(conn *net.TCPConn) {
-	defer conn.Close()
+// serveTCPConn set tcp options of accepted connection, it holds a slot of limiter until finished.
+func (s *Server) serveTCPConn(tcpConn *net.TCPConn) {
+	if nil != s.limiter {
+		if !s.limiter.acquireSlot(s.getDoneChan()) {
+			tcpConn.Close()
+			return
+		}
+		defer s.limiter.releaseSlot()
+	}
 
 	if s.TCPTimeout != 0 {
-		if err := conn.SetKeepAlivePeriod(time.Duration(s.TCPTimeout) * time.Second); err != nil {
+		if err := tcpConn.SetKeepAlivePeriod(time.Duration(s.TCPTimeout) * time.Second); err != nil {
 			log.Println(err)
+			tcpConn.Close()
+			return
+		}
+	}
+
+	// load balancer sends client address before tunnel and mux layers.
+	var conn net.Conn = tcpConn
+	if nil != s.ProxyProtocol {
+		proxied, err := s.ProxyProtocol.accept(tcpConn)
+		if nil != err {
+			log.Printf("proxy protocol %s: %v", tcpConn.RemoteAddr(), err)
+			tcpConn.Close()
 			return
 		}
+		conn = proxied
 	}
+	s.serveConn(conn)
+}
+
+// serveConn serve connection of any transport, such as tcp or websocket.
+// tunnel encryption is removed first, then it detects whether client speaks socks protocol directly or multiplexes streams over the connection.
+func (s *Server) serveConn(rawConn net.Conn) {
+	if nil != s.Tunnel {
+		rawConn = s.Tunnel.Wrap(rawConn)
+	}
+	conn, isMux, err := sniffMux(rawConn, s.TCPDeadline)
+	if nil != err {
+		log.Println(err)
+		rawConn.Close()
+		return
+	}
+	if isMux {
+		s.serveMux(conn)
+		return
+	}
+	s.processTCPConn(conn)
+}
+
+// processTCPConn process one socks session, conn can be a tcp connection or a multiplexed stream.
+func (s *Server) processTCPConn(conn net.Conn) {
+	defer conn.Close()
 
 	if s.TCPDeadline != 0 {
 		if err := conn.SetDeadline(time.Now().Add(time.Duration(s.TCPDeadline) * time.Second)); err != nil {
@@ -61,82 +121,119 @@ func (s *Server) processTCPConn(conn *net.TCPConn) {
 		}
 	}
 
+	ip := remoteIP(conn)
+	span := s.Tracer.Start("socks.session")
+	span.SetAttribute("net.peer.ip", ip)
+	defer span.End()
+
+	// step 0: connection limits
+	if nil != s.limiter {
+		if err := s.limiter.acquireConn(ip); nil != err {
+			span.SetError(err)
+			s.refuse(conn, err)
+			return
+		}
+		defer s.limiter.releaseConn(ip)
+	}
+
 	// step 1: negotiation
-	if err := s.negotiation(conn); nil != err {
+	negotiationSpan := span.Child("socks.negotiation")
+	conn, username, err := s.negotiation(conn, negotiationSpan)
+	negotiationSpan.SetError(err)
+	negotiationSpan.End()
+	if nil != err {
+		span.SetError(err)
 		log.Println(err)
 		return
 	}
+	if username != "" {
+		span.SetAttribute("socks.user", username)
+	}
+
+	if nil != s.limiter {
+		if err := s.limiter.acquireUser(username); nil != err {
+			span.SetError(err)
+			s.refuseRequest(conn, err)
+			return
+		}
+		defer s.limiter.releaseUser(username)
+	}
+
+	if nil != s.Accounting && username != "" && s.Accounting.Exceeded(username) {
+		s.Metrics.Add(&s.Metrics.RejectedQuota, 1)
+		span.SetError(ErrQuotaExceeded)
+		s.refuseRequest(conn, ErrQuotaExceeded)
+		return
+	}
+
+	s.Metrics.Add(&s.Metrics.SessionsTotal, 1)
+	s.Metrics.Add(&s.Metrics.SessionsActive, 1)
+	defer s.Metrics.Add(&s.Metrics.SessionsActive, -1)
+
+	session := s.addSession(conn, username)
+	session.span = span
+	defer s.removeSession(session)
 
 	// step 2: get request
 	request, err := s.parseRequest(conn)
 	if nil != err {
+		span.SetError(err)
 		log.Println(err)
 		return
 	}
+	s.setSessionRequest(session, request)
+	span.SetAttribute("socks.command", commandName(request.CMD))
+	span.SetAttribute("socks.destination", request.Address())
 
 	// step 3: process
 	if err := s.Handler.TCPHandler(s, conn, request); nil != err {
+		span.SetError(err)
 		log.Println(err)
 		return
 	}
 }
 
-func (s *Server) negotiation(conn *net.TCPConn) error {
+// negotiation return the authenticated connection and username, username is empty when no authentication required.
+// sub-negotiation is traced as child of span, span can be nil.
+func (s *Server) negotiation(conn net.Conn, span *trace.Span) (net.Conn, string, error) {
 	negotiationRequest, err := ParseNegotiationRequest(conn)
 	if nil != err {
-		return err
-	}
-
-	isEqual := false
-	for _, method := range negotiationRequest.Methods {
-		if s.AuthValidateMethod == method {
-			isEqual = true
-			break
-		}
+		return nil, "", err
 	}
+	return s.authenticate(conn, negotiationRequest, span)
+}
 
-	// step 1: check client negotiation method.
-	if !isEqual {
+// authenticate select method of negotiation request and run its sub-negotiation.
+func (s *Server) authenticate(conn net.Conn, negotiationRequest *NegotiationRequest, span *trace.Span) (net.Conn, string, error) {
+	// step 1: select method by server preference order.
+	authenticator := s.selectAuthenticator(negotiationRequest.Methods)
+	if nil == authenticator {
 		reply := NewNegotiationReply(MethodNoAcceptableMethods)
-		if err := reply.WriteTo(conn); nil != err {
-			return err
+		if _, err := reply.WriteTo(conn); nil != err {
+			return nil, "", err
 		}
+		return nil, "", ErrNonSupportCurrentMethod
 	}
 
 	// step 2: agree client authentication
-	reply := NewNegotiationReply(s.AuthValidateMethod)
-	if err := reply.WriteTo(conn); nil != err {
-		return err
+	reply := NewNegotiationReply(authenticator.Method())
+	if _, err := reply.WriteTo(conn); nil != err {
+		return nil, "", err
 	}
 
-	// step 3: wait receive client username/password
-	if s.AuthValidateMethod == MethodUsernamePassword {
-		request, err := ParseUnamePasswdNegotiationRequest(conn)
-		if nil != err {
-			return err
-		}
-		// sample validate
-
-		if !strings.EqualFold(s.Username, string(request.Uname)) || !strings.EqualFold(s.Password, string(request.Password)) {
-			if Debug {
-				log.Printf("server receive uname: '%s', passwd: '%s' \n", string(request.Uname), string(request.Password))
-				log.Printf("server set uname: '%s', passwd: '%s' \n", s.Username, s.Password)
-			}
-			failReply := NewUserPassNegotiationReply(UsernamePasswordStatusFail)
-			if err := failReply.WriteTo(conn); nil != err {
-				return err
-			}
-			return nil
-		}
-		successReply := NewUserPassNegotiationReply(UsernamePasswordStatusSuccess)
-		if err := successReply.WriteTo(conn); nil != err {
-			return err
-		}
+	// step 3: method specific sub-negotiation
+	authSpan := span.Child("socks.auth")
+	authSpan.SetAttribute("socks.auth.method", int(authenticator.Method()))
+	authConn, username, err := authenticator.Authenticate(conn)
+	if username != "" {
+		authSpan.SetAttribute("socks.user", username)
 	}
-	return nil
+	authSpan.SetError(err)
+	authSpan.End()
+	return authConn, username, err
 }
 
-func (s *Server) parseRequest(conn *net.TCPConn) (*SocksRequest, error) {
+func (s *Server) parseRequest(conn net.Conn) (*SocksRequest, error) {
 	request, err := ParseSocksRequest(conn)
 	if nil != err {
 		return nil, err
@@ -151,8 +248,7 @@ func (s *Server) parseRequest(conn *net.TCPConn) (*SocksRequest, error) {
 	}
 
 	if !isSupport {
-		reply := NewSocksReply(ReplyCommandNonSupport, request.ATYP, request.DstAddr, request.DstPort)
-		if err := reply.WriteTo(conn); nil != err {
+		if _, err := newFailReply(ReplyCommandNonSupport).WriteTo(conn); nil != err {
 			return nil, err
 		}
 		return nil, ErrNonSupportCommand
@@ -160,34 +256,54 @@ func (s *Server) parseRequest(conn *net.TCPConn) (*SocksRequest, error) {
 	return request, nil
 }
 
-// help func ===========================================================================================================
-
-// 1. parse negotiation request
-func ParseNegotiationRequest(conn *net.TCPConn) (*NegotiationRequest, error) {
-	body := make([]byte, 2)
-	if _, err := io.ReadFull(conn, body); nil != err {
-		return nil, err
+// refuse reply general failure to the request, it used to reject sessions over connection limits, so clients see
+// the same failure as per-user and quota rejections. no authentication is selected if client offers it, so a flood
+// of refused connections costs nothing more than reading two messages, other clients are authenticated first.
+func (s *Server) refuse(conn net.Conn, reason error) {
+	log.Printf("refuse %s: %v", conn.RemoteAddr(), reason)
+	negotiationRequest, err := ParseNegotiationRequest(conn)
+	if nil != err {
+		return
 	}
+	if bytes.IndexByte(negotiationRequest.Methods, MethodNoAuthRequired) >= 0 {
+		if _, err := NewNegotiationReply(MethodNoAuthRequired).WriteTo(conn); nil != err {
+			return
+		}
+	} else {
+		authConn, _, err := s.authenticate(conn, negotiationRequest, nil)
+		if nil != err {
+			return
+		}
+		conn = authConn
+	}
+	if _, err := ParseSocksRequest(conn); nil != err {
+		return
+	}
+	newFailReply(ReplyGeneralFailure).WriteTo(conn)
+}
 
-	if SocksVer != body[0] {
-		return nil, ErrNonSupportCurrentSocksProtocolVersion
+// refuseRequest read the request after negotiation, then reply general failure.
+func (s *Server) refuseRequest(conn net.Conn, reason error) {
+	log.Printf("refuse %s: %v", conn.RemoteAddr(), reason)
+	if _, err := ParseSocksRequest(conn); nil != err {
+		return
 	}
+	newFailReply(ReplyGeneralFailure).WriteTo(conn)
+}
+
+// help func ===========================================================================================================
 
-	nmethos := uint(body[1])
-	methods := make([]byte, nmethos)
-	if _, err := io.ReadFull(conn, methods); nil != err {
+// 1. parse negotiation request
+func ParseNegotiationRequest(conn net.Conn) (*NegotiationRequest, error) {
+	request := &NegotiationRequest{}
+	if _, err := request.ReadFrom(conn); nil != err {
 		return nil, err
 	}
 
 	if Debug {
-		log.Printf("Received NegotiationReply: socks protocol version: %#v, nmethods: %#v, methods: %#v \n", body[0], body[1], methods)
+		log.Printf("Received NegotiationReply: socks protocol version: %#v, nmethods: %#v, methods: %#v \n", request.Ver, request.NMethods, request.Methods)
 	}
-
-	return &NegotiationRequest{
-		Ver:      body[0],
-		NMethods: body[1],
-		Methods:  methods,
-	}, nil
+	return request, nil
 }
 
 // 2. negotiation reply.
@@ -198,62 +314,17 @@ func NewNegotiationReply(method byte) *NegotiationReply {
 	}
 }
 
-func (r *NegotiationReply) WriteTo(w *net.TCPConn) error {
-	if _, err := w.Write([]byte{r.Ver, r.Method}); err != nil {
-		return err
-	}
-	if Debug {
-		log.Printf("Sent NegotiationReply: %#v %#v\n", r.Ver, r.Method)
-	}
-	return nil
-}
-
 // 3. parse username/password negotiation request
-func ParseUnamePasswdNegotiationRequest(conn *net.TCPConn) (*UsernamePasswordNegotiationRequest, error) {
-	body := make([]byte, 2)
-	if _, err := io.ReadFull(conn, body); nil != err {
-		return nil, err
-	}
-
-	// validate username/password version
-	if UsernamePasswordVer != body[0] {
-		return nil, ErrUnamePasswdVersion
-	}
-
-	ulen := uint8(body[1])
-	if ulen == 0 {
-		return nil, ErrBadRequest
-	}
-
-	uname := make([]byte, ulen)
-	if _, err := io.ReadFull(conn, uname); nil != err {
-		return nil, err
-	}
-
-	plenByte := make([]byte, 1)
-	if _, err := io.ReadFull(conn, plenByte); nil != err {
-		return nil, err
-	}
-	plen := uint8(plenByte[0])
-	if plen == 0 {
-		return nil, ErrBadRequest
-	}
-
-	passwd := make([]byte, plen)
-	if _, err := io.ReadFull(conn, passwd); nil != err {
+func ParseUnamePasswdNegotiationRequest(conn net.Conn) (*UsernamePasswordNegotiationRequest, error) {
+	request := &UsernamePasswordNegotiationRequest{}
+	if _, err := request.ReadFrom(conn); nil != err {
 		return nil, err
 	}
 
 	if Debug {
-		log.Printf("Parse UnamePasswdNegotiationRequest: uname/passwd version: %#v, ulen: %#v, uname: %#v, plen: %#v, passwd: %#v \n", body[0], ulen, uname, plen, passwd)
-	}
-	return &UsernamePasswordNegotiationRequest{
-		Ver:      body[0],
-		ULen:     ulen,
-		Uname:    uname,
-		PLen:     plen,
-		Password: passwd,
-	}, nil
+		log.Printf("Parse UnamePasswdNegotiationRequest: uname/passwd version: %#v, ulen: %#v, uname: %#v, plen: %#v, passwd: %#v \n", request.Ver, request.ULen, request.Uname, request.PLen, request.Password)
+	}
+	return request, nil
 }
 
 // 4. username/password negotiation reply
@@ -264,79 +335,17 @@ func NewUserPassNegotiationReply(status byte) *UsernamePasswordNegotiationReply
 	}
 }
 
-func (r *UsernamePasswordNegotiationReply) WriteTo(w *net.TCPConn) error {
-	if _, err := w.Write([]byte{r.Ver, r.Status}); err != nil {
-		return err
-	}
-	if Debug {
-		log.Printf("Sent UserPassNegotiationReply: %#v %#v \n", r.Ver, r.Status)
-	}
-	return nil
-}
-
 // 5. parse socks request
-func ParseSocksRequest(conn *net.TCPConn) (*SocksRequest, error) {
-	body := make([]byte, 4)
-	if _, err := io.ReadFull(conn, body); nil != err {
-		return nil, err
-	}
-
-	if SocksVer != body[0] {
-		return nil, ErrNonSupportCurrentUnamePasswdVersion
-	}
-
-	addrType := body[3]
-	var addr []byte
-	if addrType == ATYPIPv4 {
-		// the address is a version-4 IP address, with a length of 4 octets.
-		addr = make([]byte, 4)
-		if _, err := io.ReadFull(conn, addr); nil != err {
-			return nil, err
-		}
-	} else if addrType == ATYPDomain {
-		// the address field contains a fully-qualified domain name.  The first
-		// octet of the address field contains the number of octets of name that
-		// follow, there is no terminating NUL octet.
-		addrLen := make([]byte, 1)
-		if _, err := io.ReadFull(conn, addrLen); nil != err {
-			return nil, err
-		}
-		if addrLen[0] == 0 {
-			return nil, ErrBadRequest
-		}
-		// first byte is domain length.
-		addr = make([]byte, uint(addrLen[0]))
-		if _, err := io.ReadFull(conn, addr); nil != err {
-			return nil, err
-		}
-		addr = append(addrLen, addr...)
-	} else if addrType == ATYPIPv6 {
-		// the address is a version-6 IP address, with a length of 16 octets.
-		addr = make([]byte, 16)
-		if _, err := io.ReadFull(conn, addr); nil != err {
-			return nil, err
-		}
-	} else {
-		return nil, ErrBadRequest
-	}
-
-	port := make([]byte, 2)
-	if _, err := io.ReadFull(conn, port); nil != err {
+func ParseSocksRequest(conn net.Conn) (*SocksRequest, error) {
+	request := &SocksRequest{}
+	if _, err := request.ReadFrom(conn); nil != err {
 		return nil, err
 	}
 
 	if Debug {
-		log.Printf("Server receive socks request, socks protocol version: %#v, cmd: %#v, atyp: %#v, dstAddr: %#v, dstPort: %#v \n", body[0], body[1], addrType, addr, port)
+		log.Printf("Server receive socks request, socks protocol version: %#v, cmd: %#v, atyp: %#v, dstAddr: %#v, dstPort: %#v \n", request.Ver, request.CMD, request.ATYP, request.DstAddr, request.DstPort)
 	}
-
-	return &SocksRequest{
-		Ver:     body[0],
-		CMD:     body[1],
-		RSV:     body[2],
-		ATYP:    addrType,
-		DstAddr: addr,
-		DstPort: port,
-	}, nil
+	return request, nil
 }
 
 // 6. socks reply
@@ -353,19 +362,3 @@ func NewSocksReply(rep byte, atyp byte, bndaddr []byte, bndport []byte) *SocksRe
 		BndPort: bndport,
 	}
 }
-
-func (r *SocksReply) WriteTo(conn *net.TCPConn) error {
-	if _, err := conn.Write([]byte{r.Ver, r.REP, r.RSV, r.ATYP}); err != nil {
-		return err
-	}
-	if _, err := conn.Write(r.BndAddr); err != nil {
-		return err
-	}
-	if _, err := conn.Write(r.BndPort); err != nil {
-		return err
-	}
-	if Debug {
-		log.Printf("Sent Reply: %#v %#v %#v %#v %#v %#v\n", r.Ver, r.REP, r.RSV, r.ATYP, r.BndAddr, r.BndPort)
-	}
-	return nil
-}
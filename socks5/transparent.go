@@ -0,0 +1,286 @@
+package socks5
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTransparentNonSupport = errors.New("transparent proxy only supported on linux")
+	ErrTransparentMode       = errors.New("invalid transparent proxy mode")
+	ErrTransparentLoop       = errors.New("original destination is the transparent listener itself")
+)
+
+const (
+	// transparent proxy mode.
+	TransparentRedirect byte = 0x01 // iptables REDIRECT, original destination from SO_ORIGINAL_DST
+	TransparentTProxy   byte = 0x02 // iptables TPROXY, original destination is the local address, need IP_TRANSPARENT
+)
+
+// RunTransparentTCPServer accept connections redirected by iptables, the original destination is passed to
+// the handler as a synthesized CONNECT request, so it shares the same pipeline as socks sessions.
+func (s *Server) RunTransparentTCPServer(addr string, mode byte) error {
+	if mode != TransparentRedirect && mode != TransparentTProxy {
+		return ErrTransparentMode
+	}
+
+	tcpListener, err := listenTransparentTCP(addr, mode)
+	if nil != err {
+		return err
+	}
+	defer tcpListener.Close()
+	go func() {
+		<-s.getDoneChan()
+		tcpListener.Close()
+	}()
+
+	for {
+		// backpressure: with LimitActionPause, stop accepting until a session slot is free.
+		if nil != s.limiter && !s.limiter.waitSlot(s.getDoneChan()) {
+			return ErrServerClosed
+		}
+
+		tcpConn, err := tcpListener.AcceptTCP()
+		if nil != err {
+			select {
+			case <-s.getDoneChan():
+				return ErrServerClosed
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Printf("transparent tcp server: Accept error: %v", err)
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		go s.processTransparentConn(tcpConn, mode, tcpListener.Addr().(*net.TCPAddr))
+	}
+}
+
+// processTransparentConn process one redirected connection, it holds a slot of limiter until finished.
+func (s *Server) processTransparentConn(conn *net.TCPConn, mode byte, listenAddr *net.TCPAddr) {
+	defer conn.Close()
+	if nil != s.limiter {
+		if !s.limiter.acquireSlot(s.getDoneChan()) {
+			return
+		}
+		defer s.limiter.releaseSlot()
+	}
+
+	ip := remoteIP(conn)
+	span := s.Tracer.Start("socks.session")
+	span.SetAttribute("net.peer.ip", ip)
+	span.SetAttribute("socks.transparent", true)
+	defer span.End()
+
+	// step 1: get original destination, client connecting to listener directly would make server dial itself.
+	dst := conn.LocalAddr().(*net.TCPAddr)
+	if mode == TransparentRedirect {
+		origDst, err := originalDst(conn)
+		if nil != err {
+			span.SetError(err)
+			log.Println(err)
+			return
+		}
+		dst = origDst
+	}
+	if isListenAddr(dst, listenAddr) {
+		span.SetError(ErrTransparentLoop)
+		log.Printf("refuse %s: %v", conn.RemoteAddr(), ErrTransparentLoop)
+		return
+	}
+
+	request, err := newTransparentRequest(CMDConnect, dst.String())
+	if nil != err {
+		span.SetError(err)
+		log.Println(err)
+		return
+	}
+	span.SetAttribute("socks.command", commandName(request.CMD))
+	span.SetAttribute("socks.destination", request.Address())
+
+	// step 2: connection limits, there is no socks reply, just close connection.
+	if nil != s.limiter {
+		if err := s.limiter.acquireConn(ip); nil != err {
+			span.SetError(err)
+			log.Printf("refuse %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+		defer s.limiter.releaseConn(ip)
+	}
+
+	s.Metrics.Add(&s.Metrics.SessionsTotal, 1)
+	s.Metrics.Add(&s.Metrics.SessionsActive, 1)
+	defer s.Metrics.Add(&s.Metrics.SessionsActive, -1)
+
+	session := s.addSession(conn, "")
+	session.span = span
+	defer s.removeSession(session)
+	s.mu.Lock()
+	session.Transparent = true
+	session.Request = request
+	s.mu.Unlock()
+
+	if Debug {
+		log.Printf("Transparent session %d: client: %s, original destination: %s", session.ID, conn.RemoteAddr(), dst)
+	}
+
+	// step 3: process
+	if err := s.Handler.TCPHandler(s, conn, request); nil != err {
+		span.SetError(err)
+		log.Println(err)
+		return
+	}
+}
+
+// RunTransparentUDPServer receive udp datagrams redirected by iptables TPROXY, the original destination is passed
+// to the handler as a synthesized udp datagram. responses are sent back with the original destination as source.
+func (s *Server) RunTransparentUDPServer(addr string) error {
+	udpConn, err := listenTransparentUDP(addr)
+	if nil != err {
+		return err
+	}
+	defer udpConn.Close()
+	go func() {
+		<-s.getDoneChan()
+		udpConn.Close()
+	}()
+
+	replyConns := newUDPNATCache(s.udpTimeout())
+	defer func() {
+		for key := range replyConns.Items() {
+			replyConns.Delete(key) // close by evicted callback
+		}
+	}()
+
+	var buff [64 * 1024]byte
+	oob := make([]byte, 1024)
+	for {
+		n, oobn, _, client, err := udpConn.ReadMsgUDP(buff[:], oob)
+		if nil != err {
+			select {
+			case <-s.getDoneChan():
+				return ErrServerClosed
+			default:
+			}
+			return err
+		}
+
+		dst, err := originalDstFromOOB(oob[:oobn])
+		if nil != err {
+			log.Printf("transparent udp server: %v", err)
+			continue
+		}
+
+		atyp, dstAddr, dstPort, err := parseTransparentDst(dst.String())
+		if nil != err {
+			log.Printf("transparent udp server: %v", err)
+			continue
+		}
+		datagram := &SocksUDPDatagram{
+			Ver:     0x00,
+			FRAG:    0x00,
+			ATYP:    atyp,
+			DstAddr: dstAddr,
+			DstPort: dstPort,
+			Data:    append([]byte(nil), buff[:n]...),
+		}
+
+		clientAddr := client
+		s.SetUDPResponder(clientAddr, func(src *net.UDPAddr, data []byte) error {
+			// responses must come from the original destination, or client drops them.
+			key := src.String() + "-" + clientAddr.String()
+			if v, ok := replyConns.Get(key); ok {
+				replyConns.SetDefault(key, v)
+				_, err := v.(*net.UDPConn).WriteToUDP(data, clientAddr)
+				return err
+			}
+			replyConn, err := dialTransparentUDP(src)
+			if nil != err {
+				return err
+			}
+			replyConns.SetDefault(key, replyConn)
+			_, err = replyConn.WriteToUDP(data, clientAddr)
+			return err
+		})
+
+		if err := s.Handler.UDPHandler(s, clientAddr, datagram); nil != err {
+			log.Printf("transparent udp server: %v", err)
+		}
+	}
+}
+
+// help func ===========================================================================================================
+
+func newTransparentRequest(cmd byte, dst string) (*SocksRequest, error) {
+	atyp, addr, port, err := parseTransparentDst(dst)
+	if nil != err {
+		return nil, err
+	}
+	return &SocksRequest{
+		Ver:     SocksVer,
+		CMD:     cmd,
+		RSV:     0x00,
+		ATYP:    atyp,
+		DstAddr: addr,
+		DstPort: port,
+	}, nil
+}
+
+// isListenAddr return true if dst is the listen address, listener on unspecified ip accepts any local ip.
+func isListenAddr(dst, listenAddr *net.TCPAddr) bool {
+	if dst.Port != listenAddr.Port {
+		return false
+	}
+	if !listenAddr.IP.IsUnspecified() {
+		return dst.IP.Equal(listenAddr.IP)
+	}
+	if dst.IP.IsLoopback() || dst.IP.IsUnspecified() {
+		return true
+	}
+	return isLocalIP(dst.IP)
+}
+
+// local interface addresses, they're refreshed after localIPsTTL, so accepting connections needs no netlink query.
+var localIPs struct {
+	sync.Mutex
+	ips     []net.IP
+	updated time.Time
+}
+
+const localIPsTTL = 10 * time.Second
+
+func isLocalIP(ip net.IP) bool {
+	localIPs.Lock()
+	defer localIPs.Unlock()
+	if time.Since(localIPs.updated) > localIPsTTL {
+		localIPs.ips = localIPs.ips[:0]
+		if addrs, err := net.InterfaceAddrs(); nil == err {
+			for _, addr := range addrs {
+				if ipNet, ok := addr.(*net.IPNet); ok {
+					localIPs.ips = append(localIPs.ips, ipNet.IP)
+				}
+			}
+		}
+		localIPs.updated = time.Now()
+	}
+	for _, local := range localIPs.ips {
+		if local.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTransparentDst(dst string) (atyp byte, addr, port []byte, err error) {
+	atyp, addr, port, err = ParseAddress(dst)
+	if nil == err && atyp == ATYPDomain {
+		// original destination must be an ip address.
+		err = ErrBadRequest
+	}
+	return
+}
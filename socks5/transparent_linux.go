@@ -0,0 +1,181 @@
+//go:build linux
+// +build linux
+
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// linux socket options, not all of them are defined in syscall package.
+const (
+	soOriginalDst       = 80 // SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST
+	ipTransparent       = 19 // IP_TRANSPARENT
+	ipRecvOrigDstAddr   = 20 // IP_RECVORIGDSTADDR
+	ipv6Transparent     = 75 // IPV6_TRANSPARENT
+	ipv6RecvOrigDstAddr = 74 // IPV6_RECVORIGDSTADDR
+)
+
+func listenTransparentTCP(addr string, mode byte) (*net.TCPListener, error) {
+	lc := net.ListenConfig{}
+	if mode == TransparentTProxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			return setTransparent(c, network, false)
+		}
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if nil != err {
+		return nil, err
+	}
+	return ln.(*net.TCPListener), nil
+}
+
+func listenTransparentUDP(addr string) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			return setTransparent(c, network, true)
+		},
+	}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
+	if nil != err {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// dialTransparentUDP create udp socket bound to non-local address src, used to send response as the original
+// destination.
+func dialTransparentUDP(src *net.UDPAddr) (*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); nil != serr {
+					return
+				}
+				serr = setTransparentFd(int(fd), network, false)
+			})
+			if nil != err {
+				return err
+			}
+			return serr
+		},
+	}
+	network := "udp4"
+	if nil == src.IP.To4() {
+		network = "udp6"
+	}
+	conn, err := lc.ListenPacket(context.Background(), network, src.String())
+	if nil != err {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// originalDst read the destination before iptables REDIRECT.
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	rawConn, err := conn.SyscallConn()
+	if nil != err {
+		return nil, err
+	}
+
+	var addr *net.TCPAddr
+	var serr error
+	err = rawConn.Control(func(fd uintptr) {
+		level := unix.SOL_IP
+		if ip := conn.LocalAddr().(*net.TCPAddr).IP; nil == ip.To4() {
+			level = unix.SOL_IPV6
+		}
+		// ip6_mtuinfo starts with a sockaddr_in6, big enough for both sockaddr_in and sockaddr_in6, and the helper
+		// goes through socketcall on 386 where there is no getsockopt syscall.
+		info, err := unix.GetsockoptIPv6MTUInfo(int(fd), level, soOriginalDst)
+		if nil != err {
+			serr = err
+			return
+		}
+		raw := (*[unix.SizeofSockaddrInet6]byte)(unsafe.Pointer(&info.Addr))
+		addr, serr = parseRawSockaddr(raw[:])
+	})
+	if nil != err {
+		return nil, err
+	}
+	return addr, serr
+}
+
+// originalDstFromOOB parse the destination before iptables TPROXY from IP_RECVORIGDSTADDR control message.
+func originalDstFromOOB(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if nil != err {
+		return nil, err
+	}
+	for _, msg := range msgs {
+		if (msg.Header.Level == syscall.SOL_IP && msg.Header.Type == ipRecvOrigDstAddr) ||
+			(msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6RecvOrigDstAddr) {
+			addr, err := parseRawSockaddr(msg.Data)
+			if nil != err {
+				return nil, err
+			}
+			return &net.UDPAddr{IP: addr.IP, Port: addr.Port, Zone: addr.Zone}, nil
+		}
+	}
+	return nil, ErrBadRequest
+}
+
+// help func ===========================================================================================================
+
+func setTransparent(c syscall.RawConn, network string, recvOrigDst bool) error {
+	var serr error
+	err := c.Control(func(fd uintptr) {
+		serr = setTransparentFd(int(fd), network, recvOrigDst)
+	})
+	if nil != err {
+		return err
+	}
+	return serr
+}
+
+func setTransparentFd(fd int, network string, recvOrigDst bool) error {
+	// "tcp"/"udp" listener can be dual stack, so set both ipv4 and ipv6 options, ignore ipv6 errors on ipv4 socket.
+	if network != "tcp6" && network != "udp6" {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, ipTransparent, 1); nil != err {
+			return err
+		}
+		if recvOrigDst {
+			if err := syscall.SetsockoptInt(fd, syscall.SOL_IP, ipRecvOrigDstAddr, 1); nil != err {
+				return err
+			}
+		}
+	}
+	if network != "tcp4" && network != "udp4" {
+		err := syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6Transparent, 1)
+		if nil == err && recvOrigDst {
+			err = syscall.SetsockoptInt(fd, syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1)
+		}
+		if nil != err && (network == "tcp6" || network == "udp6") {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseRawSockaddr parse sockaddr_in or sockaddr_in6, family is native endian, port is big endian.
+func parseRawSockaddr(raw []byte) (*net.TCPAddr, error) {
+	if len(raw) < 4 {
+		return nil, ErrBadRequest
+	}
+	family := *(*uint16)(unsafe.Pointer(&raw[0]))
+	port := int(binary.BigEndian.Uint16(raw[2:4]))
+	switch {
+	case family == syscall.AF_INET && len(raw) >= syscall.SizeofSockaddrInet4:
+		return &net.TCPAddr{IP: net.IP(append([]byte(nil), raw[4:8]...)), Port: port}, nil
+	case family == syscall.AF_INET6 && len(raw) >= syscall.SizeofSockaddrInet6:
+		return &net.TCPAddr{IP: net.IP(append([]byte(nil), raw[8:24]...)), Port: port}, nil
+	}
+	return nil, ErrBadRequest
+}
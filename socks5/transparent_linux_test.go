@@ -0,0 +1,180 @@
+//go:build linux
+// +build linux
+
+package socks5
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+	"xproxy/trace"
+)
+
+func rawSockaddrInet4(ip net.IP, port int) []byte {
+	sa := syscall.RawSockaddrInet4{Family: syscall.AF_INET}
+	copy(sa.Addr[:], ip.To4())
+	p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	p[0], p[1] = byte(port>>8), byte(port)
+	return append([]byte(nil), (*[syscall.SizeofSockaddrInet4]byte)(unsafe.Pointer(&sa))[:]...)
+}
+
+func rawSockaddrInet6(ip net.IP, port int) []byte {
+	sa := syscall.RawSockaddrInet6{Family: syscall.AF_INET6}
+	copy(sa.Addr[:], ip.To16())
+	p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	p[0], p[1] = byte(port>>8), byte(port)
+	return append([]byte(nil), (*[syscall.SizeofSockaddrInet6]byte)(unsafe.Pointer(&sa))[:]...)
+}
+
+// controlMessage encode one socket control message, like kernel does for IP_RECVORIGDSTADDR.
+func controlMessage(level, typ int32, data []byte) []byte {
+	b := make([]byte, syscall.CmsgSpace(len(data)))
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level, h.Type = level, typ
+	h.SetLen(syscall.CmsgLen(len(data)))
+	copy(b[syscall.CmsgLen(0):], data)
+	return b
+}
+
+func TestParseRawSockaddr(t *testing.T) {
+	for _, want := range []*net.TCPAddr{
+		{IP: net.ParseIP("192.0.2.10").To4(), Port: 443},
+		{IP: net.ParseIP("2001:db8::10"), Port: 8443},
+	} {
+		raw := rawSockaddrInet4(want.IP, want.Port)
+		if nil == want.IP.To4() {
+			raw = rawSockaddrInet6(want.IP, want.Port)
+		}
+		if addr, err := parseRawSockaddr(raw); nil != err || addr.String() != want.String() {
+			t.Errorf("got %v, %v, want %s", addr, err, want)
+		}
+	}
+
+	short := rawSockaddrInet6(net.ParseIP("2001:db8::10"), 80)[:syscall.SizeofSockaddrInet4]
+	unknown := rawSockaddrInet4(net.ParseIP("192.0.2.10"), 80)
+	*(*uint16)(unsafe.Pointer(&unknown[0])) = syscall.AF_UNIX
+	for _, raw := range [][]byte{nil, {0x02, 0x00}, short, unknown} {
+		if _, err := parseRawSockaddr(raw); err != ErrBadRequest {
+			t.Errorf("raw % x: got %v, want %v", raw, err, ErrBadRequest)
+		}
+	}
+}
+
+func TestOriginalDstFromOOB(t *testing.T) {
+	v4 := controlMessage(syscall.SOL_IP, ipRecvOrigDstAddr, rawSockaddrInet4(net.ParseIP("192.0.2.10"), 53))
+	v6 := controlMessage(syscall.SOL_IPV6, ipv6RecvOrigDstAddr, rawSockaddrInet6(net.ParseIP("2001:db8::53"), 53))
+	other := controlMessage(syscall.SOL_SOCKET, syscall.SCM_TIMESTAMP, make([]byte, 16))
+
+	for _, c := range []struct {
+		oob  []byte
+		want string
+	}{
+		{v4, "192.0.2.10:53"},
+		{v6, "[2001:db8::53]:53"},
+		{append(append([]byte(nil), other...), v4...), "192.0.2.10:53"}, // other messages are skipped
+	} {
+		if addr, err := originalDstFromOOB(c.oob); nil != err || addr.String() != c.want {
+			t.Errorf("got %v, %v, want %s", addr, err, c.want)
+		}
+	}
+	if _, err := originalDstFromOOB(other); err != ErrBadRequest {
+		t.Errorf("no original destination: got %v, want %v", err, ErrBadRequest)
+	}
+}
+
+func TestTransparentRequest(t *testing.T) {
+	// TPROXY connection keeps the original destination as local address, it's turned into a CONNECT request.
+	// loopback connection needs no IP_TRANSPARENT, so the listener is a plain one.
+	listener, err := listenTransparentTCP("127.0.0.1:0", TransparentRedirect)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted, err := listener.AcceptTCP()
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+
+	request, err := newTransparentRequest(CMDConnect, accepted.LocalAddr().String())
+	if nil != err || request.Address() != listener.Addr().String() || request.ATYP != ATYPIPv4 {
+		t.Fatalf("request of %s: %+v, %v", accepted.LocalAddr(), request, err)
+	}
+	if _, err := newTransparentRequest(CMDConnect, "example.com:80"); err != ErrBadRequest {
+		t.Errorf("domain destination: got %v, want %v", err, ErrBadRequest)
+	}
+}
+
+// handlerFunc serve tcp sessions by function, udp datagrams are dropped.
+type handlerFunc func(s *Server, conn net.Conn, request *SocksRequest) error
+
+func (f handlerFunc) TCPHandler(s *Server, conn net.Conn, request *SocksRequest) error {
+	return f(s, conn, request)
+}
+
+func (f handlerFunc) UDPHandler(s *Server, client *net.UDPAddr, request *SocksUDPDatagram) error {
+	return nil
+}
+
+func TestTransparentLoop(t *testing.T) {
+	// client connects to listener directly, the original destination of TPROXY connection is the listener.
+	listener, err := listenTransparentTCP("127.0.0.1:0", TransparentRedirect)
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted, err := listener.AcceptTCP()
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	handled := false
+	recorder := &spanRecorder{}
+	s := &Server{Handler: handlerFunc(func(s *Server, conn net.Conn, request *SocksRequest) error {
+		handled = true
+		return nil
+	}), Tracer: trace.NewTracer("xproxy-test", recorder)}
+	s.processTransparentConn(accepted, TransparentTProxy, listener.Addr().(*net.TCPAddr))
+	if handled {
+		t.Error("connection to listener itself is handled")
+	}
+	// refused transparent session is traced like socks sessions.
+	s.Tracer.Close()
+	if len(recorder.spans) != 1 || recorder.spans[0].Name != "socks.session" || recorder.spans[0].Status != trace.StatusError ||
+		recorder.spans[0].Attributes["socks.transparent"] != true {
+		t.Errorf("transparent session spans %+v", recorder.spans)
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	for _, c := range []struct {
+		dst, listen string
+		want        bool
+	}{
+		{"127.0.0.1", "127.0.0.1", true},
+		{"127.0.0.1", "0.0.0.0", true},
+		{"127.0.0.1", "::", true},
+		{"192.0.2.1", "0.0.0.0", false},
+		{"192.0.2.1", "127.0.0.1", false},
+	} {
+		dst := &net.TCPAddr{IP: net.ParseIP(c.dst), Port: port}
+		listen := &net.TCPAddr{IP: net.ParseIP(c.listen), Port: port}
+		if got := isListenAddr(dst, listen); got != c.want {
+			t.Errorf("%s on %s: got %v, want %v", dst, listen, got, c.want)
+		}
+	}
+	other := &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: port + 1}
+	if isListenAddr(other, listener.Addr().(*net.TCPAddr)) {
+		t.Errorf("%s is not listen address %s", other, listener.Addr())
+	}
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+// +build !linux
+
+package socks5
+
+import (
+	"net"
+)
+
+func listenTransparentTCP(addr string, mode byte) (*net.TCPListener, error) {
+	return nil, ErrTransparentNonSupport
+}
+
+func listenTransparentUDP(addr string) (*net.UDPConn, error) {
+	return nil, ErrTransparentNonSupport
+}
+
+func dialTransparentUDP(src *net.UDPAddr) (*net.UDPConn, error) {
+	return nil, ErrTransparentNonSupport
+}
+
+func originalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, ErrTransparentNonSupport
+}
+
+func originalDstFromOOB(oob []byte) (*net.UDPAddr, error) {
+	return nil, ErrTransparentNonSupport
+}
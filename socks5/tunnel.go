@@ -0,0 +1,305 @@
+package socks5
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownCipher    = errors.New("unknown tunnel cipher")
+	ErrTunnelReplay     = errors.New("tunnel replay detected")
+	ErrTunnelBadMessage = errors.New("tunnel bad message")
+)
+
+const (
+	// tunnel ciphers, key is derived from pre-shared password.
+	CipherChaCha20Poly1305 = "chacha20-ietf-poly1305"
+	CipherAES256GCM        = "aes-256-gcm"
+	CipherAES128GCM        = "aes-128-gcm"
+
+	// salts are remembered for 2x window, older messages are rejected by timestamp.
+	TunnelReplayWindow = 2 * time.Minute
+
+	tunnelMaxPayload = 16*1024 - 1
+	timestampSize    = 8
+)
+
+// Tunnel is a pre-shared-key encrypted transport between xproxy client and server.
+//
+// Stream format, every direction starts with its own random salt, session subkey is derived from key and salt:
+//
+//	+------+---------------+-------------+---------------+----------+-----
+//	| SALT | LENGTH(2)+TAG | TIME(8)+TAG | LENGTH(2)+TAG | DATA+TAG | ...
+//	+------+---------------+-------------+---------------+----------+-----
+//
+// the nonce is a little-endian counter increased after every seal. Packet format is SALT | SEAL(TIME(8)+DATA), the nonce
+// is zero because every packet has its own subkey. Replayed salts and stale timestamps are rejected, salts written by
+// ourselves are remembered too, so a stream or packet of peer direction can't be reflected back to us.
+type Tunnel struct {
+	Method string
+
+	key     []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	salts   *cache.Cache // seen and written salts within replay window
+}
+
+func NewTunnel(method, password string) (*Tunnel, error) {
+	t := &Tunnel{Method: method, salts: cache.New(2*TunnelReplayWindow, TunnelReplayWindow)}
+
+	var keySize int
+	switch method {
+	case CipherChaCha20Poly1305:
+		keySize = chacha20poly1305.KeySize
+		t.newAEAD = chacha20poly1305.New
+	case CipherAES256GCM, CipherAES128GCM:
+		keySize = 32
+		if method == CipherAES128GCM {
+			keySize = 16
+		}
+		t.newAEAD = func(key []byte) (cipher.AEAD, error) {
+			block, err := aes.NewCipher(key)
+			if nil != err {
+				return nil, err
+			}
+			return cipher.NewGCM(block)
+		}
+	default:
+		return nil, ErrUnknownCipher
+	}
+
+	t.key = make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(password), nil, []byte("xproxy-tunnel-key")), t.key); nil != err {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Wrap encrypt connection, the protocol is symmetric, so it's used by both client and server.
+func (t *Tunnel) Wrap(conn net.Conn) net.Conn {
+	return &tunnelConn{Conn: conn, tunnel: t}
+}
+
+// SealPacket encrypt one udp packet.
+func (t *Tunnel) SealPacket(b []byte) ([]byte, error) {
+	salt := make([]byte, len(t.key))
+	if _, err := rand.Read(salt); nil != err {
+		return nil, err
+	}
+	aead, err := t.subAEAD(salt)
+	if nil != err {
+		return nil, err
+	}
+	t.salts.SetDefault(string(salt), nil)
+
+	plain := make([]byte, timestampSize+len(b))
+	binary.BigEndian.PutUint64(plain, uint64(time.Now().Unix()))
+	copy(plain[timestampSize:], b)
+	return aead.Seal(salt, make([]byte, aead.NonceSize()), plain, nil), nil
+}
+
+// OpenPacket decrypt one udp packet, the result never shares memory with b.
+func (t *Tunnel) OpenPacket(b []byte) ([]byte, error) {
+	if len(b) < len(t.key) {
+		return nil, ErrTunnelBadMessage
+	}
+	salt := b[:len(t.key)]
+	aead, err := t.subAEAD(salt)
+	if nil != err {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, make([]byte, aead.NonceSize()), b[len(salt):], nil)
+	if nil != err || len(plain) < timestampSize {
+		return nil, ErrTunnelBadMessage
+	}
+	if err := t.checkReplay(salt, plain[:timestampSize]); nil != err {
+		return nil, err
+	}
+	return plain[timestampSize:], nil
+}
+
+// help func ===========================================================================================================
+
+func (t *Tunnel) subAEAD(salt []byte) (cipher.AEAD, error) {
+	subkey := make([]byte, len(t.key))
+	if _, err := io.ReadFull(hkdf.New(sha256.New, t.key, salt, []byte("xproxy-tunnel-subkey")), subkey); nil != err {
+		return nil, err
+	}
+	return t.newAEAD(subkey)
+}
+
+// checkReplay must be called after message authenticated, otherwise forged salts fill the cache.
+func (t *Tunnel) checkReplay(salt, timestamp []byte) error {
+	sent := time.Unix(int64(binary.BigEndian.Uint64(timestamp)), 0)
+	if d := time.Since(sent); d > TunnelReplayWindow || d < -TunnelReplayWindow {
+		return ErrTunnelReplay
+	}
+	if err := t.salts.Add(string(salt), nil, cache.DefaultExpiration); nil != err {
+		return ErrTunnelReplay
+	}
+	return nil
+}
+
+// tunnelConn encrypt written data into chunks, and decrypt chunks read from underlying connection.
+type tunnelConn struct {
+	net.Conn
+	tunnel *Tunnel
+
+	readMu    sync.Mutex
+	reader    cipher.AEAD
+	readNonce []byte
+	readBuf   []byte // ciphertext buffer
+	plain     []byte // decrypted data not read yet
+
+	writeMu    sync.Mutex
+	writer     cipher.AEAD
+	writeNonce []byte
+	writeBuf   []byte
+}
+
+func (c *tunnelConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.plain) == 0 {
+		if nil == c.reader {
+			if err := c.readHeader(); nil != err {
+				return 0, err
+			}
+		}
+		plain, err := c.readChunk()
+		if nil != err {
+			return 0, err
+		}
+		c.plain = plain
+	}
+	n := copy(b, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+func (c *tunnelConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	// header and data are sent together, handshake doesn't cost extra packets.
+	buf := c.writeBuf[:0]
+	if nil == c.writer {
+		salt := make([]byte, len(c.tunnel.key))
+		if _, err := rand.Read(salt); nil != err {
+			return 0, err
+		}
+		aead, err := c.tunnel.subAEAD(salt)
+		if nil != err {
+			return 0, err
+		}
+		c.tunnel.salts.SetDefault(string(salt), nil)
+		c.writer = aead
+		c.writeNonce = make([]byte, aead.NonceSize())
+
+		timestamp := make([]byte, timestampSize)
+		binary.BigEndian.PutUint64(timestamp, uint64(time.Now().Unix()))
+		buf = append(buf, salt...)
+		buf = c.sealChunk(buf, timestamp)
+	}
+
+	for p := b; len(p) > 0; {
+		n := len(p)
+		if n > tunnelMaxPayload {
+			n = tunnelMaxPayload
+		}
+		buf = c.sealChunk(buf, p[:n])
+		p = p[n:]
+	}
+	c.writeBuf = buf
+
+	if _, err := c.Conn.Write(buf); nil != err {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// readHeader read salt and timestamp chunk of peer.
+func (c *tunnelConn) readHeader() error {
+	salt := make([]byte, len(c.tunnel.key))
+	if _, err := io.ReadFull(c.Conn, salt); nil != err {
+		return err
+	}
+	aead, err := c.tunnel.subAEAD(salt)
+	if nil != err {
+		return err
+	}
+	c.reader = aead
+	c.readNonce = make([]byte, aead.NonceSize())
+	c.readBuf = make([]byte, tunnelMaxPayload+aead.Overhead())
+
+	timestamp, err := c.readChunk()
+	if nil != err {
+		return err
+	}
+	if len(timestamp) != timestampSize {
+		return ErrTunnelBadMessage
+	}
+	return c.tunnel.checkReplay(salt, timestamp)
+}
+
+func (c *tunnelConn) readChunk() ([]byte, error) {
+	overhead := c.reader.Overhead()
+	lengthBuf := c.readBuf[:2+overhead]
+	if _, err := io.ReadFull(c.Conn, lengthBuf); nil != err {
+		return nil, err
+	}
+	length, err := c.open(lengthBuf)
+	if nil != err {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint16(length))
+	if size > tunnelMaxPayload {
+		return nil, ErrTunnelBadMessage
+	}
+
+	payloadBuf := c.readBuf[:size+overhead]
+	if _, err := io.ReadFull(c.Conn, payloadBuf); nil != err {
+		return nil, err
+	}
+	return c.open(payloadBuf)
+}
+
+func (c *tunnelConn) open(b []byte) ([]byte, error) {
+	plain, err := c.reader.Open(b[:0], c.readNonce, b, nil)
+	if nil != err {
+		return nil, ErrTunnelBadMessage
+	}
+	increase(c.readNonce)
+	return plain, nil
+}
+
+func (c *tunnelConn) sealChunk(dst, payload []byte) []byte {
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(payload)))
+	dst = c.writer.Seal(dst, c.writeNonce, length[:], nil)
+	increase(c.writeNonce)
+	dst = c.writer.Seal(dst, c.writeNonce, payload, nil)
+	increase(c.writeNonce)
+	return dst
+}
+
+// increase little-endian nonce counter.
+func increase(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
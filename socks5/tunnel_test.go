@@ -0,0 +1,157 @@
+package socks5
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// streamConn read from r and write to w, other methods of net.Conn are not used by tunnel.
+type streamConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *streamConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *streamConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func newTestTunnels(t *testing.T, method string) (client, server *Tunnel) {
+	client, err := NewTunnel(method, "secret")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if server, err = NewTunnel(method, "secret"); nil != err {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+// seal return stream written by tunnel connection for payloads.
+func seal(t *testing.T, tunnel *Tunnel, payloads ...[]byte) []byte {
+	var wire bytes.Buffer
+	conn := tunnel.Wrap(&streamConn{w: &wire})
+	for _, payload := range payloads {
+		if _, err := conn.Write(payload); nil != err {
+			t.Fatal(err)
+		}
+	}
+	return wire.Bytes()
+}
+
+// open read n bytes of stream by tunnel connection.
+func open(tunnel *Tunnel, wire []byte, n int) ([]byte, error) {
+	conn := tunnel.Wrap(&streamConn{r: bytes.NewReader(wire)})
+	b := make([]byte, n)
+	_, err := io.ReadFull(conn, b)
+	return b, err
+}
+
+func TestTunnelStream(t *testing.T) {
+	for _, method := range []string{CipherChaCha20Poly1305, CipherAES256GCM, CipherAES128GCM} {
+		client, server := newTestTunnels(t, method)
+		small, large := []byte("hello"), bytes.Repeat([]byte("0123456789"), 4000)
+		wire := seal(t, client, small, large)
+
+		// salt, timestamp chunk, then chunks not larger than max payload.
+		aead, _ := client.subAEAD(make([]byte, len(client.key)))
+		chunk := func(n int) int { return 2 + n + 2*aead.Overhead() }
+		want := len(client.key) + chunk(timestampSize) + chunk(len(small)) +
+			chunk(tunnelMaxPayload) + chunk(tunnelMaxPayload) + chunk(len(large)-2*tunnelMaxPayload)
+		if len(wire) != want {
+			t.Fatalf("%s: %d bytes on wire, want %d", method, len(wire), want)
+		}
+
+		got, err := open(server, wire, len(small)+len(large))
+		if nil != err {
+			t.Fatalf("%s: %v", method, err)
+		}
+		if !bytes.Equal(got, append(small, large...)) {
+			t.Fatalf("%s: payload mismatch", method)
+		}
+	}
+
+	if _, err := NewTunnel("rc4", "secret"); err != ErrUnknownCipher {
+		t.Fatalf("got %v, want %v", err, ErrUnknownCipher)
+	}
+}
+
+func TestTunnelStreamRejected(t *testing.T) {
+	client, server := newTestTunnels(t, CipherChaCha20Poly1305)
+	wire := seal(t, client, []byte("hello"))
+
+	// every byte after salt is authenticated.
+	for _, i := range []int{len(client.key), len(client.key) + 20, len(wire) - 1} {
+		tampered := seal(t, client, []byte("hello"))
+		tampered[i] ^= 0x01
+		if _, err := open(server, tampered, 5); err != ErrTunnelBadMessage {
+			t.Errorf("byte %d tampered: got %v, want %v", i, err, ErrTunnelBadMessage)
+		}
+	}
+
+	wrongKey, _ := NewTunnel(CipherChaCha20Poly1305, "other")
+	if _, err := open(wrongKey, wire, 5); err != ErrTunnelBadMessage {
+		t.Errorf("wrong key: got %v, want %v", err, ErrTunnelBadMessage)
+	}
+
+	if _, err := open(server, wire, 5); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := open(server, wire, 5); err != ErrTunnelReplay {
+		t.Errorf("replayed stream: got %v, want %v", err, ErrTunnelReplay)
+	}
+
+	// stream written by server is reflected back to it.
+	reflected := seal(t, server, []byte("reply"))
+	if _, err := open(server, reflected, 5); err != ErrTunnelReplay {
+		t.Errorf("reflected stream: got %v, want %v", err, ErrTunnelReplay)
+	}
+	if got, err := open(client, reflected, 5); nil != err || string(got) != "reply" {
+		t.Errorf("stream of peer: %q, %v", got, err)
+	}
+}
+
+func TestTunnelPacket(t *testing.T) {
+	client, server := newTestTunnels(t, CipherAES256GCM)
+	packet, err := client.SealPacket([]byte("datagram"))
+	if nil != err {
+		t.Fatal(err)
+	}
+	if got, err := server.OpenPacket(packet); nil != err || string(got) != "datagram" {
+		t.Fatalf("got %q, %v", got, err)
+	}
+	if _, err := server.OpenPacket(packet); err != ErrTunnelReplay {
+		t.Errorf("replayed packet: got %v, want %v", err, ErrTunnelReplay)
+	}
+
+	packet, _ = client.SealPacket([]byte("datagram"))
+	packet[len(packet)-1] ^= 0x01
+	if _, err := server.OpenPacket(packet); err != ErrTunnelBadMessage {
+		t.Errorf("tampered packet: got %v, want %v", err, ErrTunnelBadMessage)
+	}
+	if _, err := server.OpenPacket(packet[:4]); err != ErrTunnelBadMessage {
+		t.Errorf("short packet: got %v, want %v", err, ErrTunnelBadMessage)
+	}
+
+	reply, _ := server.SealPacket([]byte("reply"))
+	if _, err := server.OpenPacket(reply); err != ErrTunnelReplay {
+		t.Errorf("reflected packet: got %v, want %v", err, ErrTunnelReplay)
+	}
+	if got, err := client.OpenPacket(reply); nil != err || string(got) != "reply" {
+		t.Errorf("packet of peer: %q, %v", got, err)
+	}
+}
+
+func TestTunnelStaleTimestamp(t *testing.T) {
+	tunnel, _ := newTestTunnels(t, CipherChaCha20Poly1305)
+	timestamp := make([]byte, timestampSize)
+	for _, sent := range []time.Time{time.Now().Add(-2 * TunnelReplayWindow), time.Now().Add(2 * TunnelReplayWindow)} {
+		binary.BigEndian.PutUint64(timestamp, uint64(sent.Unix()))
+		if err := tunnel.checkReplay([]byte("salt"), timestamp); err != ErrTunnelReplay {
+			t.Errorf("sent at %v: got %v, want %v", sent, err, ErrTunnelReplay)
+		}
+	}
+}
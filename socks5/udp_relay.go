@@ -0,0 +1,307 @@
+package socks5
+
+import (
+	"errors"
+	"github.com/patrickmn/go-cache"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrNonSupportFragment = errors.New("nonsupport udp fragment")
+	ErrNoUDPResponder     = errors.New("no udp responder of client")
+)
+
+const (
+	// default udp nat entry idle timeout.
+	defaultUDPTimeout = 60
+	// datagrams of a flow queued while resolving and dialing its destination, the rest are dropped.
+	maxUDPSetupQueue = 16
+)
+
+// UDPResponder write remote response back to client, src is the remote address which sent the data.
+// every udp listener (socks udp associate, transparent proxy) registers its own responder by client address,
+// so the handler doesn't care how responses are encapsulated.
+type UDPResponder func(src *net.UDPAddr, data []byte) error
+
+// SetUDPResponder register responder of client address, it expires with udp timeout.
+func (s *Server) SetUDPResponder(client *net.UDPAddr, responder UDPResponder) {
+	s.udpResponders.Set(client.String(), responder, s.udpTimeout())
+}
+
+func (s *Server) udpResponder(client *net.UDPAddr) (UDPResponder, bool) {
+	v, ok := s.udpResponders.Get(client.String())
+	if !ok {
+		return nil, false
+	}
+	return v.(UDPResponder), true
+}
+
+func (s *Server) udpTimeout() time.Duration {
+	if s.UDPTimeout != 0 {
+		return time.Duration(s.UDPTimeout) * time.Second
+	}
+	return defaultUDPTimeout * time.Second
+}
+
+func newUDPNATCache(timeout time.Duration) *cache.Cache {
+	c := cache.New(timeout, timeout)
+	c.OnEvicted(func(key string, v interface{}) {
+		v.(*net.UDPConn).Close()
+	})
+	return c
+}
+
+// relayUDP send datagram to destination, one remote udp socket per client and destination address.
+// remote responses are written back by the client responder until the nat entry idle timeout, datagrams of both
+// directions keep the entry alive. it's called by udp read loop, so the first datagram of a flow only starts setup
+// of the flow in another goroutine, datagrams are queued until the setup finished.
+func (s *Server) relayUDP(client *net.UDPAddr, request *SocksUDPDatagram) error {
+	if request.FRAG != 0x00 {
+		return ErrNonSupportFragment
+	}
+
+	dst := request.Address()
+	// socks udp server bound the associate of client before, transparent clients have no session, only rule and
+	// global egress apply to them.
+	session := s.udpBoundSession(client)
+	key := client.String() + "-" + dst
+	s.udpSetupMu.Lock()
+	v, ok := s.udpNATs.Get(key)
+	if !ok {
+		if nil == s.udpSetups {
+			s.udpSetups = make(map[string][][]byte)
+		}
+		queue, setting := s.udpSetups[key]
+		if len(queue) < maxUDPSetupQueue {
+			s.udpSetups[key] = append(queue, request.Data)
+		}
+		s.udpSetupMu.Unlock()
+		if !setting {
+			go s.setupUDPFlow(client, session, dst, key)
+		}
+		return nil
+	}
+	s.udpSetupMu.Unlock()
+
+	s.udpNATs.SetDefault(key, v) // refresh expiration
+	if !s.accountUDP(session, dst, len(request.Data), true) {
+		return ErrQuotaExceeded
+	}
+	_, err := v.(*net.UDPConn).Write(request.Data)
+	return err
+}
+
+// setupUDPFlow route and dial destination of new flow, send queued datagrams, then relay remote responses.
+func (s *Server) setupUDPFlow(client *net.UDPAddr, session *Session, dst, key string) {
+	remoteConn, err := s.dialUDP(client, session, dst)
+
+	s.udpSetupMu.Lock()
+	queue := s.udpSetups[key]
+	delete(s.udpSetups, key)
+	if nil != err {
+		s.udpSetupMu.Unlock()
+		log.Printf("udp relay %s: %s: %v", client, dst, err)
+		return
+	}
+	// queued datagrams are sent before the nat entry is visible, so they are not reordered by later ones.
+	for _, data := range queue {
+		if !s.accountUDP(session, dst, len(data), true) {
+			continue
+		}
+		if _, err := remoteConn.Write(data); nil != err {
+			s.udpSetupMu.Unlock()
+			remoteConn.Close()
+			log.Printf("udp relay %s: %s: %v", client, dst, err)
+			return
+		}
+	}
+	s.udpNATs.SetDefault(key, remoteConn)
+	s.udpSetupMu.Unlock()
+
+	if Debug {
+		log.Printf("UDP Handler. udp remote conn established. client: %s, addr: %s", client, dst)
+	}
+
+	defer s.releaseUDPNAT(key, remoteConn)
+	var buff [64 * 1024]byte
+	for {
+		if err := remoteConn.SetReadDeadline(time.Now().Add(s.udpTimeout())); nil != err {
+			return
+		}
+		n, src, err := remoteConn.ReadFromUDP(buff[:])
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			// no reply in timeout, but the entry is alive as long as client keeps sending.
+			if v, ok := s.udpNATs.Get(key); ok && v == remoteConn {
+				continue
+			}
+			return
+		}
+		if nil != err {
+			return
+		}
+		s.udpNATs.SetDefault(key, remoteConn) // refresh expiration
+		if !s.accountUDP(session, dst, n, false) {
+			return
+		}
+		responder, ok := s.udpResponder(client)
+		if !ok {
+			log.Printf("udp relay %s: %v", client, ErrNoUDPResponder)
+			return
+		}
+		if err := responder(src, buff[:n]); nil != err {
+			log.Printf("udp relay %s: %v", client, err)
+			return
+		}
+	}
+}
+
+// dialUDP create remote udp socket of flow by rules and egress, domain destination is resolved.
+func (s *Server) dialUDP(client *net.UDPAddr, session *Session, dst string) (*net.UDPConn, error) {
+	route, err := s.route(dst, "")
+	if nil != err {
+		return nil, err
+	}
+	if route.Action == RuleActionDeny {
+		return nil, ErrRuleDenied
+	}
+	if nil != route.Upstream || nil != route.Group {
+		return nil, ErrUpstreamUDP
+	}
+
+	egress := s.egress(route, sessionUsername(session))
+	dstAddrs, err := resolveAddresses(route.Addr, egress.accepts, nil)
+	if nil != err {
+		return nil, err
+	}
+	egressKey := egressKey(session)
+	if nil == session {
+		egressKey = client.IP.String()
+	}
+	conn, err := egress.dial("udp", dstAddrs[0], egressKey)
+	if nil != err {
+		return nil, err
+	}
+	return conn.(*net.UDPConn), nil
+}
+
+// accountUDP count datagram bytes to user of udp associate session, return false to drop it if quota exceeded.
+// the datagram which used up quota is still relayed, as tcp relay stops after the write.
+func (s *Server) accountUDP(session *Session, dst string, n int, up bool) bool {
+	if nil == session {
+		return true
+	}
+	if nil != s.Accounting && session.Username != "" {
+		if s.Accounting.Exceeded(session.Username) {
+			return false
+		}
+		if !s.Accounting.Add(session.Username, dst, int64(n)) && s.Accounting.CutLive() {
+			// closing the udp associate tcp connection terminates the association too.
+			killed := s.KillUserSessions(session.Username)
+			log.Printf("session %d: user '%s' %v, cut %d live sessions", session.ID, session.Username, ErrQuotaExceeded, killed)
+		}
+	}
+
+	counter := &session.BytesDown
+	if up {
+		counter = &session.BytesUp
+	}
+	atomic.AddInt64(counter, int64(n))
+	return true
+}
+
+// releaseUDPNAT delete nat entry of key if it's still conn, an expired entry may be replaced by a new one.
+func (s *Server) releaseUDPNAT(key string, conn *net.UDPConn) {
+	if v, ok := s.udpNATs.Get(key); ok && v == conn {
+		s.udpNATs.Delete(key) // closed by evicted callback
+		return
+	}
+	conn.Close()
+}
+
+// udpAssociation is udp associate of one tcp connection, the client udp address is bound by the first datagram if
+// client sent zero port.
+type udpAssociation struct {
+	conn net.Conn
+	ip   string
+	key  string // bound client udp address, empty until bound
+}
+
+// addUDPAssociation accept datagrams of tcp connection peer ip, DST.ADDR of request is not trusted, only its port is.
+func (s *Server) addUDPAssociation(conn net.Conn, port int) *udpAssociation {
+	association := &udpAssociation{conn: conn, ip: remoteIP(conn)}
+	s.udpAssociateMu.Lock()
+	defer s.udpAssociateMu.Unlock()
+	if port != 0 {
+		association.key = net.JoinHostPort(association.ip, strconv.Itoa(port))
+		s.TCPUDPAssociate.Set(association.key, conn, cache.NoExpiration)
+		return association
+	}
+	if nil == s.udpUnbound {
+		s.udpUnbound = make(map[string][]*udpAssociation)
+	}
+	s.udpUnbound[association.ip] = append(s.udpUnbound[association.ip], association)
+	return association
+}
+
+// removeUDPAssociation is called when tcp connection closed, other associations of the same client are kept.
+func (s *Server) removeUDPAssociation(association *udpAssociation) {
+	s.udpAssociateMu.Lock()
+	defer s.udpAssociateMu.Unlock()
+	if association.key != "" {
+		if v, ok := s.TCPUDPAssociate.Get(association.key); ok && v == association.conn {
+			s.TCPUDPAssociate.Delete(association.key)
+		}
+		return
+	}
+	unbound := s.udpUnbound[association.ip]
+	for i, a := range unbound {
+		if a == association {
+			unbound = append(unbound[:i:i], unbound[i+1:]...)
+			break
+		}
+	}
+	if len(unbound) == 0 {
+		delete(s.udpUnbound, association.ip)
+	} else {
+		s.udpUnbound[association.ip] = unbound
+	}
+}
+
+// udpAssociateConn return tcp connection of udp associate of client, a datagram from unknown port binds the oldest
+// unbound association of client ip.
+func (s *Server) udpAssociateConn(client *net.UDPAddr) (net.Conn, bool) {
+	s.udpAssociateMu.Lock()
+	defer s.udpAssociateMu.Unlock()
+	key := client.String()
+	if v, ok := s.TCPUDPAssociate.Get(key); ok {
+		return v.(net.Conn), true
+	}
+	ip := client.IP.String()
+	unbound := s.udpUnbound[ip]
+	if len(unbound) == 0 {
+		return nil, false
+	}
+	association := unbound[0]
+	if len(unbound) == 1 {
+		delete(s.udpUnbound, ip)
+	} else {
+		s.udpUnbound[ip] = unbound[1:]
+	}
+	association.key = key
+	s.TCPUDPAssociate.Set(key, association.conn, cache.NoExpiration)
+	return association.conn, true
+}
+
+// udpBoundSession return session of udp associate already bound to client address, nil if not found. it never
+// binds, only the socks udp server does, so transparent flows from client ip can't take over a pending association.
+func (s *Server) udpBoundSession(client *net.UDPAddr) *Session {
+	v, ok := s.TCPUDPAssociate.Get(client.String())
+	if !ok {
+		return nil
+	}
+	return s.Session(v.(net.Conn))
+}
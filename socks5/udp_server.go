@@ -1,11 +1,113 @@
 package socks5
 
-import "time"
+import (
+	"log"
+	"net"
+)
 
 // udp server ==========================================================================================================
 func (s *Server) RunUDPServer() error {
+	_, udpAddr := s.Addrs()
+	udpConn, err := net.ListenUDP("udp", udpAddr)
+	if nil != err {
+		return err
+	}
+	defer udpConn.Close()
+	go func() {
+		<-s.getDoneChan()
+		udpConn.Close()
+	}()
+
+	s.mu.Lock()
+	s.UDPConn = udpConn
+	if udpAddr.Port == 0 {
+		s.UDPAddr = udpConn.LocalAddr().(*net.UDPAddr)
+	}
+	s.mu.Unlock()
+
+	var buff [64 * 1024]byte
 	for {
-		time.Sleep(5 * time.Second)
+		n, client, err := udpConn.ReadFromUDP(buff[:])
+		if nil != err {
+			select {
+			case <-s.getDoneChan():
+				return ErrServerClosed
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return err
+		}
+		s.processUDPDatagram(udpConn, client, buff[:n])
+	}
+}
+
+func (s *Server) processUDPDatagram(udpConn *net.UDPConn, client *net.UDPAddr, packet []byte) {
+	// step 1: only accept datagram from client which has an udp associate session.
+	if _, ok := s.udpAssociateConn(client); !ok {
+		if Debug {
+			log.Printf("UDP server drop datagram from %s, no udp associate", client)
+		}
+		return
+	}
+
+	// step 2: parse datagram, copy data because the buffer is reused, decrypted packet is already a copy.
+	if nil != s.Tunnel {
+		plain, err := s.Tunnel.OpenPacket(packet)
+		if nil != err {
+			log.Printf("udp server: %s: %v", client, err)
+			return
+		}
+		packet = plain
+	} else {
+		packet = append([]byte(nil), packet...)
+	}
+	datagram, err := ParseSocksUDPDatagram(packet)
+	if nil != err {
+		log.Printf("udp server: %s: %v", client, err)
+		return
+	}
+
+	// step 3: process, remote responses are encapsulated with socks udp header.
+	s.SetUDPResponder(client, func(src *net.UDPAddr, data []byte) error {
+		atyp, addr, port, err := ParseAddress(src.String())
+		if nil != err {
+			return err
+		}
+		packet := NewSocksUDPDatagram(atyp, addr, port, data).Bytes()
+		if nil != s.Tunnel {
+			if packet, err = s.Tunnel.SealPacket(packet); nil != err {
+				return err
+			}
+		}
+		_, err = udpConn.WriteToUDP(packet, client)
+		return err
+	})
+	if err := s.Handler.UDPHandler(s, client, datagram); nil != err {
+		log.Printf("udp server: %s: %v", client, err)
+	}
+}
+
+// help func ===========================================================================================================
+
+// 1. parse socks udp datagram, fields point into packet.
+func ParseSocksUDPDatagram(packet []byte) (*SocksUDPDatagram, error) {
+	datagram := &SocksUDPDatagram{}
+	if err := datagram.Decode(packet); nil != err {
+		return nil, err
+	}
+	return datagram, nil
+}
+
+// 2. socks udp datagram, the domain address must contain the length byte.
+func NewSocksUDPDatagram(atyp byte, dstAddr, dstPort, data []byte) *SocksUDPDatagram {
+	return &SocksUDPDatagram{
+		Ver:     0x00,
+		FRAG:    0x00,
+		ATYP:    atyp,
+		DstAddr: dstAddr,
+		DstPort: dstPort,
+		Data:    data,
 	}
-	return nil
 }
@@ -0,0 +1,386 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"hash/crc32"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"xproxy/trace"
+)
+
+var (
+	ErrNoHealthyUpstream   = errors.New("no healthy upstream in group")
+	ErrEmptyUpstreamGroup  = errors.New("upstream group has no member")
+	ErrBalanceStrategy     = errors.New("invalid upstream balance strategy")
+	ErrUpstreamProtocol    = errors.New("invalid upstream protocol")
+	ErrDuplicateUpstream   = errors.New("upstream and upstream group have the same name")
+	ErrHealthCheckTimeout  = errors.New("upstream health check timeout")
+	ErrHealthCheckNoTarget = errors.New("upstream health check needs destination")
+)
+
+const (
+	// upstream group balance strategy.
+	BalanceRoundRobin      = "round_robin" // default
+	BalanceLeastConn       = "least_conn"  // fewest running connections by weight
+	BalanceWeighted        = "weighted"    // smooth weighted round robin
+	BalanceHashUser        = "hash_user"   // consistent hash by username, destination if no username
+	BalanceHashDestination = "hash_destination"
+
+	// upstream protocol.
+	UpstreamProtocolSocks5 = "socks5" // default
+	UpstreamProtocolHTTP   = "http"   // CONNECT method
+
+	// health check defaults.
+	DefaultHealthCheckInterval = 10 // seconds
+	DefaultHealthCheckTimeout  = 5  // seconds
+	DefaultHealthCheckRise     = 2
+	DefaultHealthCheckFall     = 3
+
+	hashRingReplicas = 64 // virtual nodes of every weight unit
+)
+
+// UpstreamGroup balance proxied connections over member proxies, dial failure fails over to next healthy member.
+// members are always healthy without health check.
+type UpstreamGroup struct {
+	next uint64 // round robin counter, atomic, first field for 64-bit alignment on 32-bit platforms
+
+	Members     []*UpstreamMember `json:"members"`
+	Strategy    string            `json:"strategy,omitempty"`
+	HealthCheck *HealthCheck      `json:"health_check,omitempty"`
+
+	name string
+	mu   sync.Mutex // smooth weighted round robin state and health check lifecycle
+	ring []hashRingNode
+	done chan struct{}
+}
+
+// UpstreamMember is a proxy of group, http proxy only uses proxy_addr, username and password of client config.
+type UpstreamMember struct {
+	*ClientConfig
+	Protocol string `json:"protocol,omitempty"` // socks5 or http, default is socks5
+	Weight   int    `json:"weight,omitempty"`   // default is 1
+
+	active  int64 // running connections, atomic
+	ejected int32 // 1 if ejected by health check, atomic
+
+	// consecutive health check results, only accessed by health check.
+	successes int
+	failures  int
+
+	currentWeight int // smooth weighted round robin state, guarded by group lock
+}
+
+// HealthCheck dial destination through every member periodically, members are ejected after Fall consecutive
+// failures, and re-admitted after Rise consecutive successes.
+type HealthCheck struct {
+	Destination string `json:"destination"`        // probe "host:port", such as "1.1.1.1:443"
+	Interval    int    `json:"interval,omitempty"` // seconds
+	Timeout     int    `json:"timeout,omitempty"`  // seconds
+	Rise        int    `json:"rise,omitempty"`
+	Fall        int    `json:"fall,omitempty"`
+}
+
+// UpstreamStatus is the snapshot of group member.
+type UpstreamStatus struct {
+	Addr     string `json:"addr"`
+	Protocol string `json:"protocol"`
+	Weight   int    `json:"weight"`
+	Healthy  bool   `json:"healthy"`
+	Active   int64  `json:"active"`
+}
+
+// Status return snapshot of members in config order.
+func (g *UpstreamGroup) Status() []UpstreamStatus {
+	status := make([]UpstreamStatus, 0, len(g.Members))
+	for _, m := range g.Members {
+		status = append(status, UpstreamStatus{
+			Addr:     m.ProxyAddr,
+			Protocol: m.Protocol,
+			Weight:   m.Weight,
+			Healthy:  m.healthy(),
+			Active:   atomic.LoadInt64(&m.active),
+		})
+	}
+	return status
+}
+
+// help func ===========================================================================================================
+
+type hashRingNode struct {
+	hash   uint32
+	member *UpstreamMember
+}
+
+func (m *UpstreamMember) healthy() bool {
+	return atomic.LoadInt32(&m.ejected) == 0
+}
+
+// compile check config and fill defaults, name is used by logs.
+func (g *UpstreamGroup) compile(name string) error {
+	g.name = name
+	if len(g.Members) == 0 {
+		return ErrEmptyUpstreamGroup
+	}
+	switch g.Strategy {
+	case "":
+		g.Strategy = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceLeastConn, BalanceWeighted, BalanceHashUser, BalanceHashDestination:
+	default:
+		return ErrBalanceStrategy
+	}
+	for _, m := range g.Members {
+		if nil == m.ClientConfig {
+			return ErrEmptyUpstreamGroup
+		}
+		switch m.Protocol {
+		case "":
+			m.Protocol = UpstreamProtocolSocks5
+		case UpstreamProtocolSocks5, UpstreamProtocolHTTP:
+		default:
+			return ErrUpstreamProtocol
+		}
+		if m.Weight <= 0 {
+			m.Weight = 1
+		}
+	}
+	if check := g.HealthCheck; nil != check {
+		if check.Destination == "" {
+			return ErrHealthCheckNoTarget
+		}
+		if check.Interval <= 0 {
+			check.Interval = DefaultHealthCheckInterval
+		}
+		if check.Timeout <= 0 {
+			check.Timeout = DefaultHealthCheckTimeout
+		}
+		if check.Rise <= 0 {
+			check.Rise = DefaultHealthCheckRise
+		}
+		if check.Fall <= 0 {
+			check.Fall = DefaultHealthCheckFall
+		}
+	}
+
+	// every member has virtual nodes by weight, so adding or removing a member only moves its own keys.
+	g.ring = g.ring[:0]
+	for _, m := range g.Members {
+		for i := 0; i < m.Weight*hashRingReplicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(m.ProxyAddr + "#" + strconv.Itoa(i)))
+			g.ring = append(g.ring, hashRingNode{hash: hash, member: m})
+		}
+	}
+	sort.Slice(g.ring, func(i, j int) bool { return g.ring[i].hash < g.ring[j].hash })
+	return nil
+}
+
+// start health check, it runs until stop called.
+func (g *UpstreamGroup) start() {
+	if nil == g.HealthCheck {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if nil != g.done {
+		return
+	}
+	g.done = make(chan struct{})
+	go g.runHealthCheck(g.done)
+}
+
+func (g *UpstreamGroup) stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if nil != g.done {
+		close(g.done)
+		g.done = nil
+	}
+}
+
+// connect dial destination through selected member, other healthy members are tried if dial failed.
+func (g *UpstreamGroup) connect(addr, username string, span *trace.Span) (net.Conn, error) {
+	candidates := g.candidates(addr, username)
+	if len(candidates) == 0 {
+		return nil, ErrNoHealthyUpstream
+	}
+
+	var err error
+	for _, m := range candidates {
+		atomic.AddInt64(&m.active, 1)
+		var conn net.Conn
+		conn, err = m.dial(context.Background(), addr, span)
+		if nil == err {
+			return &upstreamConn{Conn: conn, member: m}, nil
+		}
+		atomic.AddInt64(&m.active, -1)
+		log.Printf("upstream group %s: connect %s through %s error: %v", g.name, addr, m.ProxyAddr, err)
+	}
+	return nil, err
+}
+
+// candidates return healthy members, the first one is selected by strategy, others are in config order.
+func (g *UpstreamGroup) candidates(addr, username string) []*UpstreamMember {
+	healthy := make([]*UpstreamMember, 0, len(g.Members))
+	for _, m := range g.Members {
+		if m.healthy() {
+			healthy = append(healthy, m)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	var selected *UpstreamMember
+	switch g.Strategy {
+	case BalanceLeastConn:
+		for _, m := range healthy {
+			// active/weight < selected.active/selected.weight
+			if nil == selected || atomic.LoadInt64(&m.active)*int64(selected.Weight) < atomic.LoadInt64(&selected.active)*int64(m.Weight) {
+				selected = m
+			}
+		}
+	case BalanceWeighted:
+		selected = g.selectWeighted(healthy)
+	case BalanceHashUser, BalanceHashDestination:
+		key := addr
+		if g.Strategy == BalanceHashUser && username != "" {
+			key = username
+		}
+		selected = g.selectHash(key, healthy)
+	default:
+		selected = healthy[(atomic.AddUint64(&g.next, 1)-1)%uint64(len(healthy))]
+	}
+
+	candidates := append(make([]*UpstreamMember, 0, len(healthy)), selected)
+	for _, m := range healthy {
+		if m != selected {
+			candidates = append(candidates, m)
+		}
+	}
+	return candidates
+}
+
+// selectWeighted is smooth weighted round robin, heavy member is not selected in bursts.
+func (g *UpstreamGroup) selectWeighted(healthy []*UpstreamMember) *UpstreamMember {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var selected *UpstreamMember
+	total := 0
+	for _, m := range healthy {
+		m.currentWeight += m.Weight
+		total += m.Weight
+		if nil == selected || m.currentWeight > selected.currentWeight {
+			selected = m
+		}
+	}
+	selected.currentWeight -= total
+	return selected
+}
+
+// selectHash walk hash ring clockwise from key to the first member of healthy, members ejected after healthy was
+// taken are still selected, so the choice agrees with the candidates.
+func (g *UpstreamGroup) selectHash(key string, healthy []*UpstreamMember) *UpstreamMember {
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(g.ring), func(i int) bool { return g.ring[i].hash >= hash })
+	for i := 0; i < len(g.ring); i++ {
+		node := g.ring[(start+i)%len(g.ring)]
+		for _, m := range healthy {
+			if m == node.member {
+				return m
+			}
+		}
+	}
+	return healthy[0]
+}
+
+func (g *UpstreamGroup) runHealthCheck(done chan struct{}) {
+	ticker := time.NewTicker(time.Duration(g.HealthCheck.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		g.checkHealth()
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
+
+// checkHealth probe all members concurrently, it returns after all probes finished or timeout.
+func (g *UpstreamGroup) checkHealth() {
+	check := g.HealthCheck
+	var wg sync.WaitGroup
+	wg.Add(len(g.Members))
+	for _, m := range g.Members {
+		go func(m *UpstreamMember) {
+			defer wg.Done()
+			err := m.probe(check.Destination, time.Duration(check.Timeout)*time.Second)
+			if nil == err {
+				m.successes, m.failures = m.successes+1, 0
+				if !m.healthy() && m.successes >= check.Rise {
+					atomic.StoreInt32(&m.ejected, 0)
+					log.Printf("upstream group %s: %s re-admitted after %d successful checks", g.name, m.ProxyAddr, m.successes)
+				}
+				return
+			}
+			m.successes, m.failures = 0, m.failures+1
+			if Debug {
+				log.Printf("upstream group %s: %s health check error: %v", g.name, m.ProxyAddr, err)
+			}
+			if m.healthy() && m.failures >= check.Fall {
+				atomic.StoreInt32(&m.ejected, 1)
+				log.Printf("upstream group %s: %s ejected after %d failed checks: %v", g.name, m.ProxyAddr, m.failures, err)
+			}
+		}(m)
+	}
+	wg.Wait()
+}
+
+// probe dial destination through member, the connection is closed at once. dialing is aborted on timeout.
+func (m *UpstreamMember) probe(addr string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := m.dial(ctx, addr, nil)
+	if nil != err {
+		// context.DeadlineExceeded is a timeout net.Error too.
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return ErrHealthCheckTimeout
+		}
+		return err
+	}
+	return conn.Close()
+}
+
+// dial destination through member by its protocol, it's traced as child of span. ctx only aborts dialing.
+func (m *UpstreamMember) dial(ctx context.Context, addr string, span *trace.Span) (net.Conn, error) {
+	if m.Protocol == UpstreamProtocolHTTP {
+		dialSpan := span.Child("socks.dial")
+		dialSpan.SetKind(trace.KindClient)
+		dialSpan.SetAttribute("net.peer.name", m.ProxyAddr)
+		dialSpan.SetAttribute("socks.destination", addr)
+		conn, err := dialHTTPConnect(ctx, m.ClientConfig, addr)
+		dialSpan.SetError(err)
+		dialSpan.End()
+		return conn, err
+	}
+	return m.ClientConfig.connectContext(ctx, addr, span)
+}
+
+// upstreamConn count running connections of member for least connections strategy.
+type upstreamConn struct {
+	net.Conn
+	member *UpstreamMember
+	once   sync.Once
+}
+
+func (c *upstreamConn) Close() error {
+	c.once.Do(func() {
+		atomic.AddInt64(&c.member.active, -1)
+	})
+	return c.Conn.Close()
+}
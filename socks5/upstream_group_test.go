@@ -0,0 +1,190 @@
+package socks5
+
+import (
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestGroup(t *testing.T, strategy string, weights ...int) *UpstreamGroup {
+	group := &UpstreamGroup{Strategy: strategy}
+	for i, weight := range weights {
+		group.Members = append(group.Members, &UpstreamMember{
+			ClientConfig: &ClientConfig{ProxyAddr: "192.0.2.1:" + strconv.Itoa(1080+i)},
+			Weight:       weight,
+		})
+	}
+	if err := group.compile("test"); nil != err {
+		t.Fatal(err)
+	}
+	return group
+}
+
+// pick return member index selected for key.
+func pick(g *UpstreamGroup, addr, username string) int {
+	selected := g.candidates(addr, username)[0]
+	for i, m := range g.Members {
+		if m == selected {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestBalanceRoundRobin(t *testing.T) {
+	g := newTestGroup(t, "", 1, 1, 1)
+	atomic.StoreInt32(&g.Members[1].ejected, 1)
+	got := []int{pick(g, "", ""), pick(g, "", ""), pick(g, "", ""), pick(g, "", "")}
+	if got[0] == got[1] || got[0] != got[2] || got[1] != got[3] || got[0] == 1 || got[1] == 1 {
+		t.Fatalf("round robin over members 0 and 2: %v", got)
+	}
+
+	// failover candidates are the other healthy members.
+	if candidates := g.candidates("", ""); len(candidates) != 2 {
+		t.Fatalf("%d candidates, want 2", len(candidates))
+	}
+	atomic.StoreInt32(&g.Members[0].ejected, 1)
+	atomic.StoreInt32(&g.Members[2].ejected, 1)
+	if candidates := g.candidates("", ""); nil != candidates {
+		t.Fatalf("candidates of ejected group: %v", candidates)
+	}
+}
+
+func TestBalanceWeighted(t *testing.T) {
+	g := newTestGroup(t, BalanceWeighted, 3, 1)
+	var got []int
+	for i := 0; i < 8; i++ {
+		got = append(got, pick(g, "", ""))
+	}
+	// smooth: the light member is picked in the middle of every round.
+	want := []int{0, 0, 1, 0, 0, 0, 1, 0}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("weighted picks %v, want %v", got, want)
+		}
+	}
+}
+
+func TestBalanceLeastConn(t *testing.T) {
+	g := newTestGroup(t, BalanceLeastConn, 1, 2)
+	atomic.StoreInt64(&g.Members[0].active, 2)
+	atomic.StoreInt64(&g.Members[1].active, 3)
+	if got := pick(g, "", ""); got != 1 {
+		t.Fatalf("picked %d, want member with fewer connections by weight", got)
+	}
+	atomic.StoreInt64(&g.Members[1].active, 5)
+	if got := pick(g, "", ""); got != 0 {
+		t.Fatalf("picked %d, want 0", got)
+	}
+}
+
+func TestBalanceConsistentHash(t *testing.T) {
+	g := newTestGroup(t, BalanceHashDestination, 1, 1, 1, 1)
+	before := make(map[string]int)
+	for i := 0; i < 200; i++ {
+		addr := "10.0.0." + strconv.Itoa(i) + ":443"
+		before[addr] = pick(g, addr, "user")
+		if pick(g, addr, "other") != before[addr] {
+			t.Fatalf("%s moved by username", addr)
+		}
+	}
+
+	// ejecting a member only moves its own keys, re-admitting moves them back.
+	atomic.StoreInt32(&g.Members[2].ejected, 1)
+	for addr, member := range before {
+		got := pick(g, addr, "")
+		if (member == 2) == (got == member) {
+			t.Fatalf("%s: member %d before ejection, %d after", addr, member, got)
+		}
+	}
+	atomic.StoreInt32(&g.Members[2].ejected, 0)
+	for addr, member := range before {
+		if got := pick(g, addr, ""); got != member {
+			t.Fatalf("%s: member %d before ejection, %d after re-admission", addr, member, got)
+		}
+	}
+
+	// members ejected by health check after candidates took the healthy ones are still selected.
+	healthy := append([]*UpstreamMember(nil), g.Members[1:]...)
+	for _, m := range g.Members {
+		atomic.StoreInt32(&m.ejected, 1)
+	}
+	for addr := range before {
+		if m := g.selectHash(addr, healthy); nil == m || m == g.Members[0] {
+			t.Fatalf("%s: selected %v, want one of healthy members", addr, m)
+		}
+	}
+
+	g = newTestGroup(t, BalanceHashUser, 1, 1, 1, 1)
+	if pick(g, "10.0.0.1:443", "alice") != pick(g, "10.0.0.2:443", "alice") {
+		t.Fatal("same user on different members")
+	}
+}
+
+func TestUpstreamGroupCompile(t *testing.T) {
+	member := func() *UpstreamMember { return &UpstreamMember{ClientConfig: &ClientConfig{ProxyAddr: "192.0.2.1:1080"}} }
+	tests := []struct {
+		group *UpstreamGroup
+		err   error
+	}{
+		{&UpstreamGroup{}, ErrEmptyUpstreamGroup},
+		{&UpstreamGroup{Members: []*UpstreamMember{{}}}, ErrEmptyUpstreamGroup},
+		{&UpstreamGroup{Members: []*UpstreamMember{member()}, Strategy: "random"}, ErrBalanceStrategy},
+		{&UpstreamGroup{Members: []*UpstreamMember{{ClientConfig: &ClientConfig{}, Protocol: "socks4"}}}, ErrUpstreamProtocol},
+		{&UpstreamGroup{Members: []*UpstreamMember{member()}, HealthCheck: &HealthCheck{}}, ErrHealthCheckNoTarget},
+	}
+	for i, test := range tests {
+		if err := test.group.compile("test"); err != test.err {
+			t.Errorf("%d: got %v, want %v", i, err, test.err)
+		}
+	}
+
+	rules := &RuleSet{
+		Upstreams: map[string]*ClientConfig{"a": {ProxyAddr: "192.0.2.1:1080"}},
+		Groups:    map[string]*UpstreamGroup{"a": {Members: []*UpstreamMember{member()}}},
+	}
+	if err := rules.compile(); err != ErrDuplicateUpstream {
+		t.Fatalf("got %v, want %v", err, ErrDuplicateUpstream)
+	}
+}
+
+func TestProbeTimeout(t *testing.T) {
+	// proxy accepts but never replies.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if nil != err {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	for _, protocol := range []string{UpstreamProtocolSocks5, UpstreamProtocolHTTP} {
+		m := &UpstreamMember{ClientConfig: &ClientConfig{ProxyAddr: ln.Addr().String()}, Protocol: protocol}
+		start := time.Now()
+		if err := m.probe("192.0.2.1:80", 200*time.Millisecond); err != ErrHealthCheckTimeout {
+			t.Errorf("%s: got %v, want %v", protocol, err, ErrHealthCheckTimeout)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: probe returned after %s", protocol, elapsed)
+		}
+
+		// probe connection isn't left behind after timeout.
+		conn := <-accepted
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := ioutil.ReadAll(conn); nil != err {
+			t.Errorf("%s: probe connection still open: %v", protocol, err)
+		}
+		conn.Close()
+	}
+}
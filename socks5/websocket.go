@@ -0,0 +1,197 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/gorilla/websocket"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrUnknownTransport = errors.New("unknown transport")
+)
+
+const (
+	// client transport to proxy server.
+	TransportTCP       = "tcp"
+	TransportWebSocket = "ws"  // websocket over plain http
+	TransportWSS       = "wss" // websocket over tls
+
+	DefaultWebSocketPath = "/ws"
+)
+
+// RunWebSocketServer accept socks sessions over websocket, it shares the same negotiation and handler pipeline as tcp
+// server, mux sessions are also supported. tls is enabled if certFile and keyFile are set.
+func (s *Server) RunWebSocketServer(addr, path, certFile, keyFile string) error {
+	if path == "" {
+		path = DefaultWebSocketPath
+	}
+
+	upgrader := &websocket.Upgrader{
+		ReadBufferSize:  32 * 1024,
+		WriteBufferSize: 32 * 1024,
+		// client is xproxy, not browser, origin is meaningless.
+		CheckOrigin: func(r *http.Request) bool { return true },
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		// backpressure: http server accepts connections itself, so the upgrade waits for a session slot.
+		if nil != s.limiter {
+			if !s.limiter.acquireSlot(s.getDoneChan()) {
+				return
+			}
+			defer s.limiter.releaseSlot()
+		}
+
+		wsConn, err := upgrader.Upgrade(w, r, nil)
+		if nil != err {
+			if Debug {
+				log.Printf("websocket server: upgrade %s error: %v", r.RemoteAddr, err)
+			}
+			return
+		}
+		// http server does nothing more with hijacked connection, serve it in current goroutine.
+		s.serveConn(newWebSocketConn(wsConn))
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		<-s.getDoneChan()
+		server.Close()
+	}()
+
+	var err error
+	if certFile != "" && keyFile != "" {
+		err = server.ListenAndServeTLS(certFile, keyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// dialWebSocket connect to proxy server by websocket upgrade, return the websocket as a stream connection.
+func dialWebSocket(addr string, secure bool, path string, tlsConfig *tls.Config, handshakeTimeout time.Duration) (net.Conn, error) {
+	if path == "" {
+		path = DefaultWebSocketPath
+	}
+	u := url.URL{Scheme: TransportWebSocket, Host: addr, Path: path}
+	if secure {
+		u.Scheme = TransportWSS
+	}
+
+	dialer := &websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment, // l7 gateway is usually configured by environment
+		HandshakeTimeout: handshakeTimeout,
+		TLSClientConfig:  tlsConfig,
+		ReadBufferSize:   32 * 1024,
+		WriteBufferSize:  32 * 1024,
+	}
+	wsConn, _, err := dialer.Dial(u.String(), nil)
+	if nil != err {
+		return nil, err
+	}
+	return newWebSocketConn(wsConn), nil
+}
+
+// webSocketConn adapts websocket messages to byte stream, every Write is sent as one binary message.
+type webSocketConn struct {
+	ws *websocket.Conn
+
+	readMu sync.Mutex
+	reader io.Reader
+
+	writeMu       sync.Mutex
+	writeDeadline atomic.Value // time.Time
+}
+
+func newWebSocketConn(ws *websocket.Conn) *webSocketConn {
+	return &webSocketConn{ws: ws}
+}
+
+func (c *webSocketConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for {
+		if nil == c.reader {
+			messageType, reader, err := c.ws.NextReader()
+			if nil != err {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if messageType != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = reader
+		}
+
+		n, err := c.reader.Read(b)
+		if err == io.EOF {
+			// current message finished, read next one.
+			c.reader = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *webSocketConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if deadline, ok := c.writeDeadline.Load().(time.Time); ok {
+		c.ws.SetWriteDeadline(deadline)
+	}
+	if err := c.ws.WriteMessage(websocket.BinaryMessage, b); nil != err {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close doesn't take writeMu, a write stalled by peer holds it. WriteControl is safe to call concurrently, and the
+// deadline of underlying conn stops the stalled write.
+func (c *webSocketConn) Close() error {
+	deadline := time.Now().Add(time.Second)
+	c.ws.UnderlyingConn().SetWriteDeadline(deadline)
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.ws.WriteControl(websocket.CloseMessage, msg, deadline)
+	return c.ws.Close()
+}
+
+func (c *webSocketConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+func (c *webSocketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+func (c *webSocketConn) SetDeadline(t time.Time) error {
+	if err := c.ws.SetReadDeadline(t); nil != err {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *webSocketConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+// SetWriteDeadline is called by relay of the other direction while writing, so it's applied by next write.
+func (c *webSocketConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.Store(t)
+	return nil
+}
@@ -0,0 +1,62 @@
+package socks5
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocketCloseStalledWrite(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	upgrader := &websocket.Upgrader{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if nil != err {
+			return
+		}
+		defer ws.Close()
+		// never read, client write stalls when socket buffers are full.
+		<-release
+	}))
+	defer server.Close()
+
+	conn, err := dialWebSocket(strings.TrimPrefix(server.URL, "http://"), false, "", nil, time.Second)
+	if nil != err {
+		t.Fatal(err)
+	}
+	written := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1024*1024)
+		for {
+			if _, err := conn.Write(b); nil != err {
+				written <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	select {
+	case err := <-written:
+		t.Fatalf("write not stalled: %v", err)
+	default:
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- conn.Close()
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close blocked by stalled write")
+	}
+	select {
+	case <-written:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stalled write not stopped by close")
+	}
+}
@@ -0,0 +1,235 @@
+// Package trace implement minimal tracing spans, finished spans are exported in batches by Exporter, such as OTLP
+// collector. it covers what the proxy needs without the full OpenTelemetry SDK.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// span kinds, same values as OTLP.
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+
+	// span status codes, same values as OTLP.
+	StatusUnset = 0
+	StatusOK    = 1
+	StatusError = 2
+
+	DefaultBatchSize     = 512
+	DefaultFlushInterval = 5 * time.Second
+	queueSize            = 4096
+)
+
+// Exporter send finished spans to tracing backend.
+type Exporter interface {
+	ExportSpans(service string, spans []*Span) error
+}
+
+// Tracer create spans, finished spans are queued and exported in background, they are dropped if queue is full,
+// so slow backend never blocks the proxy. dropped spans are counted and logged once per flush interval, spans
+// ended after tracer closed are dropped silently.
+type Tracer struct {
+	Service string
+
+	dropped  uint64 // spans dropped since last log, atomic
+	exporter Exporter
+	queue    chan *Span
+	done     chan struct{}
+	stopped  chan struct{}
+	once     sync.Once
+}
+
+func NewTracer(service string, exporter Exporter) *Tracer {
+	t := &Tracer{
+		Service:  service,
+		exporter: exporter,
+		queue:    make(chan *Span, queueSize),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go t.exportLoop()
+	return t
+}
+
+// Start create root span of a new trace, it returns nil if tracer is nil, methods of nil span do nothing.
+func (t *Tracer) Start(name string) *Span {
+	if nil == t {
+		return nil
+	}
+	span := newSpan(t, name, KindServer)
+	rand.Read(span.TraceID[:])
+	return span
+}
+
+// Close export queued spans and stop background exporting.
+func (t *Tracer) Close() error {
+	if nil == t {
+		return nil
+	}
+	t.once.Do(func() {
+		close(t.done)
+	})
+	<-t.stopped
+	return nil
+}
+
+// Span is one timed operation of a trace.
+type Span struct {
+	TraceID  [16]byte
+	SpanID   [8]byte
+	ParentID [8]byte // zero for root span
+	Name     string
+	Kind     int
+
+	mu         sync.Mutex
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes map[string]interface{} // string, bool, int, int64 or float64
+	Status     int
+	Message    string // status message
+
+	tracer *Tracer
+	ended  bool
+}
+
+// Child create span of same trace, its parent is current span.
+func (s *Span) Child(name string) *Span {
+	if nil == s {
+		return nil
+	}
+	child := newSpan(s.tracer, name, KindInternal)
+	child.TraceID = s.TraceID
+	child.ParentID = s.SpanID
+	return child
+}
+
+func (s *Span) SetKind(kind int) {
+	if nil == s {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Kind = kind
+}
+
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if nil == s {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// SetError mark span failed, nil error does nothing.
+func (s *Span) SetError(err error) {
+	if nil == s || nil == err {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Status = StatusError
+	s.Message = err.Error()
+}
+
+// End finish span and queue it for exporting, later calls do nothing.
+func (s *Span) End() {
+	if nil == s {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+
+	select {
+	case <-s.tracer.done:
+		return
+	default:
+	}
+	select {
+	case s.tracer.queue <- s:
+	default:
+		atomic.AddUint64(&s.tracer.dropped, 1)
+	}
+}
+
+// TraceIDString return hex trace id, it's empty for nil span.
+func (s *Span) TraceIDString() string {
+	if nil == s {
+		return ""
+	}
+	return hex.EncodeToString(s.TraceID[:])
+}
+
+// help func ===========================================================================================================
+
+func newSpan(t *Tracer, name string, kind int) *Span {
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		StartTime:  time.Now(),
+		Attributes: make(map[string]interface{}),
+		tracer:     t,
+	}
+	rand.Read(span.SpanID[:])
+	return span
+}
+
+func (t *Tracer) exportLoop() {
+	defer close(t.stopped)
+
+	ticker := time.NewTicker(DefaultFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, DefaultBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.ExportSpans(t.Service, batch); nil != err {
+			log.Printf("trace: export %d spans error: %v", len(batch), err)
+		}
+		batch = make([]*Span, 0, DefaultBatchSize)
+	}
+	logDropped := func() {
+		if dropped := atomic.SwapUint64(&t.dropped, 0); dropped > 0 {
+			log.Printf("trace: queue full, %d spans dropped", dropped)
+		}
+	}
+
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= DefaultBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+			logDropped()
+		case <-t.done:
+			for {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+				default:
+					flush()
+					logDropped()
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// otlpReceiver is a collector stand-in, it records requests of OTLP/HTTP JSON.
+type otlpReceiver struct {
+	mu       sync.Mutex
+	requests []otlpRequest
+	headers  []http.Header
+}
+
+func (r *otlpReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var request otlpRequest
+	if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	body, _ := ioutil.ReadAll(req.Body)
+	if err := json.Unmarshal(body, &request); nil != err {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests = append(r.requests, request)
+	r.headers = append(r.headers, req.Header)
+}
+
+func TestOTLPExporter(t *testing.T) {
+	receiver := &otlpReceiver{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	exporter := NewOTLPExporter(server.URL)
+	exporter.Headers = map[string]string{"Authorization": "Bearer token"}
+	tracer := NewTracer("xproxy-test", exporter)
+
+	root := tracer.Start("socks.session")
+	root.SetAttribute("socks.user", "alice")
+	root.SetAttribute("socks.reply", 0)
+	child := root.Child("socks.dial")
+	child.SetKind(KindClient)
+	child.SetError(errors.New("connection refused"))
+	child.End()
+	root.End()
+	root.End() // ended once
+	tracer.Close()
+
+	if len(receiver.requests) != 1 {
+		t.Fatalf("%d requests exported", len(receiver.requests))
+	}
+	if got := receiver.headers[0].Get("Authorization"); got != "Bearer token" {
+		t.Errorf("authorization header %q", got)
+	}
+	resourceSpans := receiver.requests[0].ResourceSpans
+	if len(resourceSpans) != 1 || len(resourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("resource spans: %+v", resourceSpans)
+	}
+	if attributes := resourceSpans[0].Resource.Attributes; len(attributes) != 1 ||
+		attributes[0].Key != "service.name" || attributes[0].Value["stringValue"] != "xproxy-test" {
+		t.Errorf("resource attributes: %+v", attributes)
+	}
+
+	spans := resourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("%d spans exported", len(spans))
+	}
+	dial, session := spans[0], spans[1]
+	if dial.Name != "socks.dial" || session.Name != "socks.session" {
+		t.Fatalf("spans %s, %s", dial.Name, session.Name)
+	}
+	if dial.TraceID != session.TraceID || dial.TraceID != root.TraceIDString() || dial.ParentSpanID != session.SpanID {
+		t.Errorf("child span is not in trace of root: %+v, %+v", dial, session)
+	}
+	if session.ParentSpanID != "" || session.Kind != KindServer || dial.Kind != KindClient {
+		t.Errorf("root span: %+v", session)
+	}
+	if dial.Status.Code != StatusError || dial.Status.Message != "connection refused" {
+		t.Errorf("dial status: %+v", dial.Status)
+	}
+	// attributes are sorted by key, integers are strings in OTLP JSON.
+	if len(session.Attributes) != 2 || session.Attributes[0].Value["intValue"] != "0" ||
+		session.Attributes[1].Value["stringValue"] != "alice" {
+		t.Errorf("root attributes: %+v", session.Attributes)
+	}
+}
+
+// blockingExporter block exporting until released.
+type blockingExporter struct {
+	release chan struct{}
+}
+
+func (e *blockingExporter) ExportSpans(service string, spans []*Span) error {
+	<-e.release
+	return nil
+}
+
+func TestTracerDrop(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	exporter := &blockingExporter{release: make(chan struct{})}
+	tracer := NewTracer("xproxy-test", exporter)
+
+	// exporter is blocked with one batch, queue is full then.
+	n := DefaultBatchSize + queueSize + 100
+	for i := 0; i < n; i++ {
+		tracer.Start("socks.session").End()
+	}
+	close(exporter.release)
+	tracer.Close()
+
+	if got := strings.Count(logs.String(), "spans dropped"); got != 1 {
+		t.Fatalf("dropped spans logged %d times: %s", got, logs.String())
+	}
+
+	// spans ended after close are dropped silently.
+	logs.Reset()
+	tracer.Start("socks.session").End()
+	if len(tracer.queue) != 0 || tracer.dropped != 0 || logs.Len() != 0 {
+		t.Errorf("span queued after close, %d dropped, log: %s", tracer.dropped, logs.String())
+	}
+}